@@ -0,0 +1,110 @@
+// Command migrate manages the database schema.
+//
+//	migrate up              apply all pending migrations
+//	migrate down [N]        roll back the last N migrations (default 1)
+//	migrate to VERSION      migrate up or down to VERSION (0 = empty schema)
+//	migrate status          list migrations and whether they are applied
+//
+// Commands run on the primary database and then on each of postgres.shards.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/logger"
+	"github.com/richardliu001/wallet-service/internal/migrate"
+	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func main() {
+	cfgPath := flag.String("config", config.DefaultPath(), "path to config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: migrate [-config path] up | down [N] | to VERSION | status\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		panic(fmt.Errorf("load config: %w", err))
+	}
+
+	log, err := logger.NewLogger()
+	if err != nil {
+		panic(fmt.Errorf("init logger: %w", err))
+	}
+	defer log.Sync()
+
+	// every shard has the same schema; shard 0 first
+	dsns := append([]string{cfg.Postgres.ConnString()}, cfg.Postgres.ShardConnStrings()...)
+	for shard, dsn := range dsns {
+		if len(dsns) > 1 {
+			fmt.Printf("shard %d:\n", shard)
+		}
+		if err := run(dsn, log); err != nil {
+			log.Fatalf("migrate %s on shard %d: %v", flag.Arg(0), shard, err)
+		}
+	}
+}
+
+// run applies the command line's migration command to one database.
+func run(dsn string, log *zap.SugaredLogger) error {
+	gdb, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return fmt.Errorf("open postgres: %w", err)
+	}
+	m, err := migrate.New(gdb, log)
+	if err != nil {
+		return fmt.Errorf("load migrations: %w", err)
+	}
+	ctx := context.Background()
+	switch cmd := flag.Arg(0); cmd {
+	case "up":
+		err = m.Up(ctx)
+	case "down":
+		steps := 1
+		if flag.NArg() > 1 {
+			if steps, err = strconv.Atoi(flag.Arg(1)); err != nil || steps < 1 {
+				return fmt.Errorf("invalid step count %q", flag.Arg(1))
+			}
+		}
+		err = m.Down(ctx, steps)
+	case "to":
+		if flag.NArg() < 2 {
+			return errors.New("to requires a VERSION")
+		}
+		v, perr := strconv.ParseInt(flag.Arg(1), 10, 64)
+		if perr != nil {
+			return fmt.Errorf("invalid version %q", flag.Arg(1))
+		}
+		err = m.To(ctx, v)
+	case "status":
+		sts, serr := m.Status(ctx)
+		if serr != nil {
+			return serr
+		}
+		for _, st := range sts {
+			applied := "pending"
+			if st.Applied {
+				applied = "applied " + st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-32s %s\n", st.Version, st.Name, applied)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	return err
+}
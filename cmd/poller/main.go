@@ -2,21 +2,28 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"time"
 
 	"github.com/richardliu001/wallet-service/internal/config"
 	"github.com/richardliu001/wallet-service/internal/logger"
+	"github.com/richardliu001/wallet-service/internal/model"
 	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/richardliu001/wallet-service/internal/service"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
 )
 
 func main() {
-	cfg, err := config.Load("internal/config/config.yaml")
+	cfgPath := flag.String("config", config.DefaultPath(), "path to config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*cfgPath)
 	if err != nil {
 		panic(fmt.Errorf("load config: %w", err))
 	}
@@ -27,7 +34,7 @@ func main() {
 	}
 	defer log.Sync()
 
-	gdb, err := gorm.Open(postgres.Open(cfg.Postgres.DSN), &gorm.Config{PrepareStmt: true})
+	gdb, err := gorm.Open(postgres.Open(cfg.Postgres.ConnString()), &gorm.Config{PrepareStmt: true})
 	if err != nil {
 		log.Fatalf("open postgres: %v", err)
 	}
@@ -44,28 +51,92 @@ func main() {
 		Balancer: &kafka.LeastBytes{},
 	}
 
-	repo := repo.NewRepository(gdb, rdb, kw, log)
+	repository := repo.NewRepository(gdb, rdb, kw, log)
+	if err := repository.OpenShards(cfg.Postgres.ShardConnStrings(), nil); err != nil {
+		log.Fatalf("shards: %v", err)
+	}
 
-	ticker := time.NewTicker(1 * time.Second)
+	var settings config.SettingsFunc
+	if cfg.Runtime.DBSettings {
+		settings = repository.RuntimeSettings
+	}
+	rt := config.NewRuntime(*cfgPath, cfg, settings, log)
+	if err := rt.Reload(context.Background()); err != nil {
+		log.Errorf("load runtime config: %v", err)
+	}
+	go rt.Watch(context.Background(), cfg.Runtime.ReloadInterval)
+	svc := service.NewWalletService(repository, log, service.WithRuntime(rt))
+	// slow subscribers must not hold up the outbox
+	go deliver(context.Background(), svc, rt, log)
+
+	interval := cfg.Poller.Interval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	log.Info("wallet-poller started")
 	for range ticker.C {
 		ctx := context.Background()
-		events, err := repo.PollOutbox(ctx, 100)
-		if err != nil {
-			log.Errorf("poll outbox: %v", err)
+		pc := rt.Current().Poller
+		if pc.Interval != interval {
+			interval = pc.Interval
+			ticker.Reset(interval)
+		}
+		// each shard has its own outbox
+		for _, shard := range repository.Shards() {
+			publish(repo.OnShard(ctx, shard), repository, svc, pc.BatchSize, log)
+		}
+	}
+}
+
+// publish sends a batch of the outbox of the shard ctx is marked with to
+// Kafka and queues its webhook deliveries. Events are marked processed only
+// once both are done; otherwise they are sent again on the next tick.
+func publish(ctx context.Context, r *repo.Repository, svc *service.WalletService, limit int, log *zap.SugaredLogger) {
+	shard := repo.ShardFrom(ctx)
+	events, err := r.PollOutbox(ctx, limit)
+	if err != nil {
+		log.Errorf("shard %d: poll outbox: %v", shard, err)
+		return
+	}
+	sent := events[:0]
+	for _, evt := range events {
+		if err := r.PublishEvent(ctx, evt); err != nil {
+			log.Errorf("publish id=%d: %v", evt.ID, err)
 			continue
 		}
-		for _, evt := range events {
-			if err := repo.PublishEvent(ctx, evt); err != nil {
-				log.Errorf("publish id=%d: %v", evt.ID, err)
-				continue
-			}
-			if err := repo.MarkOutboxProcessed(ctx, evt.ID); err != nil {
-				log.Errorf("mark processed id=%d: %v", evt.ID, err)
-			} else {
-				log.Infof("event %d sent", evt.ID)
+		sent = append(sent, evt)
+	}
+	if err := svc.EnqueueWebhooks(ctx, shard, sent); err != nil {
+		log.Errorf("shard %d: queue webhooks: %v", shard, err)
+		return
+	}
+	for _, evt := range sent {
+		if err := r.MarkOutboxProcessed(ctx, evt.ID); err != nil {
+			log.Errorf("mark processed id=%d: %v", evt.ID, err)
+		} else {
+			log.Infof("event %d sent", evt.ID)
+		}
+	}
+}
+
+// deliver sends due webhook deliveries every poller interval.
+func deliver(ctx context.Context, svc *service.WalletService, rt *config.Runtime, log *zap.SugaredLogger) {
+	interval := rt.Current().Poller.Interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pc := rt.Current().Poller
+		if pc.Interval != interval {
+			interval = pc.Interval
+			ticker.Reset(interval)
+		}
+		done, err := svc.DeliverWebhooks(ctx, time.Now(), pc.BatchSize)
+		if err != nil {
+			log.Errorf("deliver webhooks: %v", err)
+		}
+		for _, d := range done {
+			if d.Status != model.DeliveryDelivered {
+				log.Infof("webhook delivery %d to subscription %d: attempt %d: %s", d.ID, d.SubscriptionID, d.Attempts, d.LastError)
 			}
 		}
 	}
@@ -0,0 +1,118 @@
+// Command rebalance moves wallets between shards, e.g.
+//
+//	rebalance -wallets 17,42 -to 2
+//	rebalance -from 0 -limit 1000 -to 3
+//
+// Each wallet is unavailable while it moves. A failed move is resumed by
+// running the command again for the same wallet and shard.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/richardliu001/wallet-service/internal/cache"
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/logger"
+	"github.com/richardliu001/wallet-service/internal/migrate"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/richardliu001/wallet-service/internal/service"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func main() {
+	cfgPath := flag.String("config", config.DefaultPath(), "path to config file")
+	wallets := flag.String("wallets", "", "comma-separated wallet IDs to move")
+	from := flag.Int("from", -1, "move wallets off this shard instead, lowest IDs first")
+	limit := flag.Int("limit", 100, "with -from, how many wallets to move")
+	to := flag.Int("to", -1, "destination shard")
+	flag.Parse()
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		panic(fmt.Errorf("load config: %w", err))
+	}
+
+	log, err := logger.NewLogger()
+	if err != nil {
+		panic(fmt.Errorf("init logger: %w", err))
+	}
+	defer log.Sync()
+
+	gdb, err := gorm.Open(postgres.Open(cfg.Postgres.ConnString()), &gorm.Config{PrepareStmt: true})
+	if err != nil {
+		log.Fatalf("open postgres: %v", err)
+	}
+	checkSchema := func(db *gorm.DB) error {
+		m, err := migrate.New(db, log)
+		if err != nil {
+			return err
+		}
+		return m.CheckCurrent(context.Background())
+	}
+	if err := checkSchema(gdb); err != nil {
+		log.Fatalf("schema check: %v", err)
+	}
+
+	// redis only to drop cached balances should a move fail halfway
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+	rdb.AddHook(cache.NewBreaker(cfg.Redis.BreakerFailures, cfg.Redis.BreakerCooldown, log))
+
+	repository := repo.NewRepository(gdb, rdb, nil, log)
+	if err := repository.OpenShards(cfg.Postgres.ShardConnStrings(), checkSchema); err != nil {
+		log.Fatalf("shards: %v", err)
+	}
+	if *to < 0 || *to >= len(repository.Shards()) {
+		log.Fatalf("-to must name one of the %d shards", len(repository.Shards()))
+	}
+
+	ctx := context.Background()
+	var ids []uint64
+	switch {
+	case *wallets != "":
+		for _, s := range strings.Split(*wallets, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				log.Fatalf("invalid wallet id %q", s)
+			}
+			ids = append(ids, id)
+		}
+	case *from >= 0:
+		if *from >= len(repository.Shards()) || *from == *to {
+			log.Fatal("-from must name another shard")
+		}
+		if err := repository.DB(repo.OnShard(ctx, *from)).Model(&model.Wallet{}).
+			Where("status <> ?", model.WalletMoved).Order("id").Limit(*limit).Pluck("id", &ids).Error; err != nil {
+			log.Fatalf("list wallets on shard %d: %v", *from, err)
+		}
+	default:
+		log.Fatal("one of -wallets or -from is required")
+	}
+
+	svc := service.NewWalletService(repository, log)
+	failed := 0
+	for _, id := range ids {
+		if err := svc.MoveWallet(ctx, id, *to); err != nil {
+			log.Errorf("wallet %d: %v", id, err)
+			failed++
+			continue
+		}
+		log.Infof("wallet %d moved to shard %d", id, *to)
+	}
+	log.Infof("moved %d wallets, %d failed", len(ids)-failed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
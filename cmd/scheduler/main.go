@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/cache"
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/logger"
+	"github.com/richardliu001/wallet-service/internal/migrate"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/richardliu001/wallet-service/internal/service"
+	"github.com/richardliu001/wallet-service/internal/settlement"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// wallet-scheduler executes due scheduled transfers, expires escrows past
+// their deadline, resumes stalled cross-shard transfers, pays external
+// withdrawals out through the settlement provider and, once a day,
+// snapshots balances, accrues and posts interest and maintains ledger
+// partitions. Any number of replicas may run: each due schedule and
+// withdrawal is leased to exactly one of them, and the other jobs are
+// idempotent.
+func main() {
+	cfgPath := flag.String("config", config.DefaultPath(), "path to config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		panic(fmt.Errorf("load config: %w", err))
+	}
+
+	log, err := logger.NewLogger()
+	if err != nil {
+		panic(fmt.Errorf("init logger: %w", err))
+	}
+	defer log.Sync()
+
+	gdb, err := gorm.Open(postgres.Open(cfg.Postgres.ConnString()), &gorm.Config{PrepareStmt: true})
+	if err != nil {
+		log.Fatalf("open postgres: %v", err)
+	}
+	migrator, err := migrate.New(gdb, log)
+	if err != nil {
+		log.Fatalf("load migrations: %v", err)
+	}
+	if err := migrator.CheckCurrent(context.Background()); err != nil {
+		log.Fatalf("schema check: %v", err)
+	}
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+	rdb.AddHook(cache.NewBreaker(cfg.Redis.BreakerFailures, cfg.Redis.BreakerCooldown, log))
+
+	// events go through the outbox, so no kafka writer is needed here
+	repository := repo.NewRepository(gdb, rdb, nil, log)
+	if err := repository.OpenShards(cfg.Postgres.ShardConnStrings(), func(db *gorm.DB) error {
+		m, err := migrate.New(db, log)
+		if err != nil {
+			return err
+		}
+		return m.CheckCurrent(context.Background())
+	}); err != nil {
+		log.Fatalf("shards: %v", err)
+	}
+	var settings config.SettingsFunc
+	if cfg.Runtime.DBSettings {
+		settings = repository.RuntimeSettings
+	}
+	rt := config.NewRuntime(*cfgPath, cfg, settings, log)
+	if err := rt.Reload(context.Background()); err != nil {
+		log.Errorf("load runtime config: %v", err)
+	}
+	go rt.Watch(context.Background(), cfg.Runtime.ReloadInterval)
+	opts := []service.Option{service.WithRuntime(rt)}
+	if name := cfg.Settlement.Provider; name != "" {
+		provider, err := settlement.New(name)
+		if err != nil {
+			log.Fatalf("settlement: %v", err)
+		}
+		opts = append(opts, service.WithSettlement(provider))
+	}
+	svc := service.NewWalletService(repository, log, opts...)
+
+	interval := cfg.Scheduler.Interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var dailyDay time.Time
+	log.Info("wallet-scheduler started")
+	for range ticker.C {
+		ctx := context.Background()
+		sc := rt.Current().Scheduler
+		if sc.Interval != interval {
+			interval = sc.Interval
+			ticker.Reset(interval)
+		}
+		now := time.Now()
+		if day := now.UTC().Truncate(24 * time.Hour); !day.Equal(dailyDay) {
+			accrued, posted, ierr := svc.RunInterest(ctx, now)
+			if ierr != nil {
+				log.Errorf("interest: %v", ierr)
+			}
+			ok := ierr == nil
+			// every shard has its own ledger
+			for _, shard := range svc.Shards() {
+				sctx := repo.OnShard(ctx, shard)
+				snaps, serr := svc.RunSnapshots(sctx, now)
+				if serr != nil {
+					log.Errorf("shard %d: balance snapshots: %v", shard, serr)
+				}
+				created, archived, perr := svc.MaintainPartitions(sctx, now)
+				if perr != nil {
+					log.Errorf("shard %d: ledger partitions: %v", shard, perr)
+				}
+				ok = ok && serr == nil && perr == nil
+				log.Infof("daily jobs on shard %d: %d snapshots, %d partitions created, %d archived",
+					shard, snaps, len(created), len(archived))
+			}
+			if ok {
+				dailyDay = day
+			}
+			log.Infof("daily jobs: %d interest accruals, %d postings", accrued, posted)
+		}
+		expired, err := svc.ExpireDueEscrows(ctx, now, sc.BatchSize)
+		if err != nil {
+			log.Errorf("expire escrows: %v", err)
+		}
+		for _, e := range expired {
+			log.Infof("escrow %d expired, refunded %s to wallet %d", e.ID, e.Refunded, e.PayerWalletID)
+		}
+		resumed, err := svc.ResumeSagas(ctx, now, sc.SagaRetryAfter, sc.BatchSize)
+		if err != nil {
+			log.Errorf("resume transfer sagas: %v", err)
+		}
+		if resumed > 0 {
+			log.Infof("%d stalled cross-shard transfers finished", resumed)
+		}
+		settled, err := svc.RunWithdrawals(ctx, now, sc.BatchSize, sc.Lease)
+		if err != nil {
+			log.Errorf("withdrawals: %v", err)
+		}
+		for _, wd := range settled {
+			log.Infof("withdrawal %d of wallet %d %s", wd.ID, wd.WalletID, wd.Status)
+		}
+		// schedules are kept on the shard of the paying wallet
+		for _, shard := range svc.Shards() {
+			sctx := repo.OnShard(ctx, shard)
+			due, err := svc.ClaimDueSchedules(sctx, now, sc.BatchSize, sc.Lease)
+			if err != nil {
+				log.Errorf("shard %d: claim schedules: %v", shard, err)
+				continue
+			}
+			for _, s := range due {
+				run, err := svc.RunSchedule(sctx, s, time.Now(), sc.MaxRetries, sc.RetryDelay)
+				if errors.Is(err, service.ErrRunAlreadyRecorded) {
+					log.Infof("schedule %d occurrence %d: recorded by another worker", s.ID, s.Occurrence)
+					continue
+				}
+				if err != nil {
+					log.Errorf("schedule %d occurrence %d: record result: %v", s.ID, s.Occurrence, err)
+					continue
+				}
+				log.Infof("schedule %d occurrence %d attempt %d: %s %s", s.ID, s.Occurrence, run.Attempt, run.Status, run.Error)
+			}
+		}
+	}
+}
@@ -2,25 +2,33 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/richardliu001/wallet-service/internal/cache"
 	"github.com/richardliu001/wallet-service/internal/config"
 	"github.com/richardliu001/wallet-service/internal/logger"
-	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/migrate"
+	"github.com/richardliu001/wallet-service/internal/ratelimit"
 	"github.com/richardliu001/wallet-service/internal/repo"
 	"github.com/richardliu001/wallet-service/internal/service"
 	httptransport "github.com/richardliu001/wallet-service/internal/transport/http"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 func main() {
 	// 1. load config
-	cfg, err := config.Load("internal/config/config.yaml")
+	cfgPath := flag.String("config", config.DefaultPath(), "path to config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*cfgPath)
 	if err != nil {
 		panic(fmt.Errorf("load config: %w", err))
 	}
@@ -33,12 +41,17 @@ func main() {
 	defer log.Sync()
 
 	// 3. postgres
-	gdb, err := gorm.Open(postgres.Open(cfg.Postgres.DSN), &gorm.Config{PrepareStmt: true})
+	gdb, err := gorm.Open(postgres.Open(cfg.Postgres.ConnString()), &gorm.Config{PrepareStmt: true})
 	if err != nil {
 		log.Fatalf("open postgres: %v", err)
 	}
-	if err := gdb.AutoMigrate(&model.Wallet{}, &model.Transaction{}, &model.OutboxEvent{}); err != nil {
-		log.Fatalf("auto-migrate: %v", err)
+	// schema is owned by cmd/migrate; refuse to run against an older one
+	migrator, err := migrate.New(gdb, log)
+	if err != nil {
+		log.Fatalf("load migrations: %v", err)
+	}
+	if err := migrator.CheckCurrent(context.Background()); err != nil {
+		log.Fatalf("schema check: %v", err)
 	}
 
 	// 4. redis
@@ -47,8 +60,11 @@ func main() {
 		Password: cfg.Redis.Password,
 		DB:       cfg.Redis.DB,
 	})
+	// fail fast while redis is down: balances are read from postgres and rate
+	// limits fall back to the in-process limiter
+	rdb.AddHook(cache.NewBreaker(cfg.Redis.BreakerFailures, cfg.Redis.BreakerCooldown, log))
 	if err := rdb.Ping(context.Background()).Err(); err != nil {
-		log.Fatalf("redis ping: %v", err)
+		log.Warnf("redis ping: %v (continuing without cache)", err)
 	}
 
 	// 5. kafka writer
@@ -58,17 +74,67 @@ func main() {
 		Balancer: &kafka.LeastBytes{},
 	}
 
-	// 6. repo & service
+	// 6. repo, hot-reloadable config & service
 	repository := repo.NewRepository(gdb, rdb, kw, log)
-	svc := service.NewWalletService(repository, log)
+	useReplicas(repository, cfg.Postgres, log)
+	if err := repository.OpenShards(cfg.Postgres.ShardConnStrings(), func(db *gorm.DB) error {
+		m, err := migrate.New(db, log)
+		if err != nil {
+			return err
+		}
+		return m.CheckCurrent(context.Background())
+	}); err != nil {
+		log.Fatalf("shards: %v", err)
+	}
+	var settings config.SettingsFunc
+	if cfg.Runtime.DBSettings {
+		settings = repository.RuntimeSettings
+	}
+	rt := config.NewRuntime(*cfgPath, cfg, settings, log)
+	if err := rt.Reload(context.Background()); err != nil {
+		log.Fatalf("load runtime config: %v", err)
+	}
+	go rt.Watch(context.Background(), cfg.Runtime.ReloadInterval)
+	svc := service.NewWalletService(repository, log, service.WithRuntime(rt))
 
-	// 7. gin router
-	router := httptransport.NewRouter(svc, cfg.RateLimit, log)
+	// 7. rate limiter: shared state in redis, in-process fallback when redis is down
+	limiter := ratelimit.NewFallback(
+		ratelimit.NewRedisLimiter(rdb),
+		ratelimit.NewLocalLimiter(10*time.Minute),
+		5*time.Second, log)
 
-	// 8. serve
+	// 8. gin router
+	router := httptransport.NewRouter(svc, limiter, rt, log)
+
+	// 9. serve, operational endpoints on their own, internal listener
+	if admin := cfg.Server.AdminAddr; admin != "" {
+		go func() {
+			log.Infof("wallet-server admin endpoints on %s", admin)
+			if err := http.ListenAndServe(admin, httptransport.NewAdminHandler()); err != nil {
+				log.Errorf("admin listener: %v", err)
+			}
+		}()
+	}
 	addr := fmt.Sprintf(":%d", cfg.Server.Port)
 	log.Infof("wallet-server listening on %s", addr)
 	if err := http.ListenAndServe(addr, router); err != nil {
 		log.Fatalf("listen: %v", err)
 	}
 }
+
+// useReplicas opens the configured read replicas and starts their lag checks.
+func useReplicas(r *repo.Repository, cfg config.PostgresConfig, log *zap.SugaredLogger) {
+	if len(cfg.Replicas) == 0 {
+		return
+	}
+	var dbs []*gorm.DB
+	for i, dsn := range cfg.ReplicaConnStrings() {
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{PrepareStmt: true})
+		if err != nil {
+			log.Fatalf("open replica %d: %v", i, err)
+		}
+		dbs = append(dbs, db)
+	}
+	r.UseReplicas(dbs, cfg.MaxReplicaLag)
+	go r.MonitorReplicas(context.Background(), cfg.ReplicaCheckInterval)
+}
@@ -0,0 +1,137 @@
+// Command statement generates wallet statements in bulk, e.g.
+//
+//	statement -all -month 2026-09 -format pdf -out ./statements
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/logger"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/richardliu001/wallet-service/internal/service"
+	"github.com/richardliu001/wallet-service/internal/statement"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func main() {
+	cfgPath := flag.String("config", config.DefaultPath(), "path to config file")
+	wallets := flag.String("wallets", "", "comma-separated wallet IDs")
+	all := flag.Bool("all", false, "generate statements for every wallet")
+	month := flag.String("month", "", "statement month, YYYY-MM")
+	from := flag.String("from", "", "period start (RFC3339 or YYYY-MM-DD), used when -month is empty")
+	to := flag.String("to", "", "period end, exclusive")
+	formatName := flag.String("format", "pdf", "output format: csv, json or pdf")
+	outDir := flag.String("out", ".", "output directory")
+	flag.Parse()
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		panic(fmt.Errorf("load config: %w", err))
+	}
+
+	log, err := logger.NewLogger()
+	if err != nil {
+		panic(fmt.Errorf("init logger: %w", err))
+	}
+	defer log.Sync()
+
+	format, err := statement.ParseFormat(*formatName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	start, end, err := statement.ParsePeriod(*month, *from, *to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	gdb, err := gorm.Open(postgres.Open(cfg.Postgres.ConnString()), &gorm.Config{PrepareStmt: true})
+	if err != nil {
+		log.Fatalf("open postgres: %v", err)
+	}
+
+	ctx := context.Background()
+	// statements only read history, so no redis or kafka is needed
+	repository := repo.NewRepository(gdb, nil, nil, log)
+	if len(cfg.Postgres.Replicas) > 0 {
+		var replicas []*gorm.DB
+		for i, dsn := range cfg.Postgres.ReplicaConnStrings() {
+			db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{PrepareStmt: true})
+			if err != nil {
+				log.Fatalf("open replica %d: %v", i, err)
+			}
+			replicas = append(replicas, db)
+		}
+		repository.UseReplicas(replicas, cfg.Postgres.MaxReplicaLag)
+		go repository.MonitorReplicas(ctx, cfg.Postgres.ReplicaCheckInterval)
+	}
+	if err := repository.OpenShards(cfg.Postgres.ShardConnStrings(), nil); err != nil {
+		log.Fatalf("shards: %v", err)
+	}
+
+	var ids []uint64
+	switch {
+	case *all:
+		for _, shard := range repository.Shards() {
+			var onShard []uint64
+			if err := repository.DB(repo.OnShard(ctx, shard)).Model(&model.Wallet{}).
+				Where("status <> ?", model.WalletMoved).Order("id").Pluck("id", &onShard).Error; err != nil {
+				log.Fatalf("list wallets on shard %d: %v", shard, err)
+			}
+			ids = append(ids, onShard...)
+		}
+	case *wallets != "":
+		for _, s := range strings.Split(*wallets, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				log.Fatalf("invalid wallet id %q", s)
+			}
+			ids = append(ids, id)
+		}
+	default:
+		log.Fatal("one of -wallets or -all is required")
+	}
+
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		log.Fatalf("create output dir: %v", err)
+	}
+
+	stmts := service.NewStatementService(service.NewWalletService(repository, log))
+
+	failed := 0
+	for _, id := range ids {
+		if err := generate(ctx, stmts, id, start, end, format, *outDir); err != nil {
+			log.Errorf("wallet %d: %v", id, err)
+			failed++
+		}
+	}
+	log.Infof("generated %d statements, %d failed", len(ids)-failed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func generate(ctx context.Context, stmts *service.StatementService, id uint64, start, end time.Time, format statement.Format, dir string) error {
+	st, err := stmts.Generate(ctx, id, start, end)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, format.Filename(st)))
+	if err != nil {
+		return err
+	}
+	if err := statement.Render(f, st, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -36,23 +36,31 @@ docker push  ${REGISTRY}/wallet-server:latest
 docker build -t ${REGISTRY}/wallet-poller:latest -f cmd/poller/Dockerfile .
 docker push  ${REGISTRY}/wallet-poller:latest
 
+docker build -t ${REGISTRY}/wallet-scheduler:latest -f cmd/scheduler/Dockerfile .
+docker push  ${REGISTRY}/wallet-scheduler:latest
+
+docker build -t ${REGISTRY}/wallet-migrate:latest -f cmd/migrate/Dockerfile .
+docker push  ${REGISTRY}/wallet-migrate:latest
+
 # 2. 应用 Kubernetes 资源
 kubectl apply -f deploy/k8s/namespace.yaml
 kubectl apply -f deploy/k8s/wallet-db-secret.yaml
 kubectl apply -f deploy/k8s/wallet-config.yaml
-kubectl create configmap wallet-init-sql \
-  --from-file=deploy/sql/init/schema.sql \
-  -n ${NS} --dry-run=client -o yaml \
-  | kubectl apply -f -
-
 kubectl apply -f deploy/k8s/redis/
 kubectl apply -f deploy/k8s/postgres/
 kubectl apply -f deploy/k8s/zookeeper/
 kubectl apply -f deploy/k8s/kafka/
+kubectl -n ${NS} rollout status deploy/postgres --timeout=180s
+
+# schema migrations must finish before the server starts (it refuses an old schema)
+kubectl -n ${NS} delete job wallet-migrate --ignore-not-found
+kubectl apply -f deploy/k8s/wallet-migrate-job.yaml
+kubectl -n ${NS} wait --for=condition=complete job/wallet-migrate --timeout=300s
+
 kubectl apply -f deploy/k8s/wallet/
 kubectl apply -f deploy/k8s/ingress.yaml
 
-for D in redis postgres zookeeper kafka wallet-server wallet-poller; do
+for D in redis postgres zookeeper kafka wallet-server wallet-poller wallet-scheduler; do
   kubectl -n ${NS} rollout status deploy/${D} --timeout=180s
 done
 
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// ErrCircuitOpen is returned instead of running a Redis command while the
+// breaker is open.
+var ErrCircuitOpen = errors.New("redis circuit breaker open")
+
+var breakerStats = expvar.NewMap("redis_breaker")
+
+// Breaker is a circuit breaker installed as a go-redis hook. After failures
+// consecutive connection errors it opens and fails every command immediately
+// for cooldown; then one probe command is let through, closing the breaker on
+// success and reopening it on failure. Redis error replies (including
+// redis.Nil) don't count: the server answered.
+type Breaker struct {
+	failures int
+	cooldown time.Duration
+	log      *zap.SugaredLogger
+	now      func() time.Time
+
+	mu        sync.Mutex
+	failed    int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewBreaker returns a Breaker; add it to a client with AddHook.
+func NewBreaker(failures int, cooldown time.Duration, log *zap.SugaredLogger) *Breaker {
+	if failures < 1 {
+		failures = 1
+	}
+	return &Breaker{failures: failures, cooldown: cooldown, log: log, now: time.Now}
+}
+
+// Open reports whether commands are currently being rejected.
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.now().Before(b.openUntil)
+}
+
+// allow decides whether a command may run, letting a single probe through
+// once the cooldown is over.
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failed < b.failures {
+		return nil
+	}
+	if b.now().Before(b.openUntil) || b.probing {
+		breakerStats.Add("rejected", 1)
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+func (b *Breaker) record(err error) {
+	if errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	var reply redis.Error
+	ok := err == nil || errors.As(err, &reply)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		if b.failed >= b.failures {
+			b.log.Infof("redis circuit breaker closed")
+		}
+		b.failed = 0
+		return
+	}
+	b.failed++
+	breakerStats.Add("failures", 1)
+	if b.failed >= b.failures {
+		b.openUntil = b.now().Add(b.cooldown)
+		breakerStats.Add("opened", 1)
+		b.log.Warnf("redis circuit breaker open for %s after %d failures: %v", b.cooldown, b.failed, err)
+	}
+}
+
+// BeforeProcess implements redis.Hook.
+func (b *Breaker) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return ctx, b.allow()
+}
+
+// AfterProcess implements redis.Hook.
+func (b *Breaker) AfterProcess(_ context.Context, cmd redis.Cmder) error {
+	b.record(cmd.Err())
+	return nil
+}
+
+// BeforeProcessPipeline implements redis.Hook.
+func (b *Breaker) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, b.allow()
+}
+
+// AfterProcessPipeline implements redis.Hook.
+func (b *Breaker) AfterProcessPipeline(_ context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, c := range cmds {
+		if e := c.Err(); e != nil {
+			var reply redis.Error
+			if err == nil || !errors.As(e, &reply) {
+				err = e
+			}
+		}
+	}
+	b.record(err)
+	return nil
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/richardliu001/wallet-service/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	log, _ := logger.NewLogger()
+	b := NewBreaker(2, 5*time.Second, log)
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	run := func(err error) error {
+		cmd := redis.NewStringCmd(ctx, "get", "k")
+		if _, berr := b.BeforeProcess(ctx, cmd); berr != nil {
+			cmd.SetErr(berr)
+		} else {
+			cmd.SetErr(err)
+		}
+		require.NoError(t, b.AfterProcess(ctx, cmd))
+		return cmd.Err()
+	}
+	down := errors.New("dial tcp: connection refused")
+
+	// replies from the server, misses included, are not failures
+	assert.ErrorIs(t, run(redis.Nil), redis.Nil)
+	assert.Error(t, run(down))
+	assert.NoError(t, run(nil))
+	assert.False(t, b.Open())
+
+	// two consecutive connection errors open it
+	run(down)
+	run(down)
+	assert.True(t, b.Open())
+	assert.ErrorIs(t, run(nil), ErrCircuitOpen)
+
+	// after the cooldown a failed probe reopens it...
+	now = now.Add(5 * time.Second)
+	assert.False(t, b.Open())
+	assert.ErrorIs(t, run(down), down)
+	assert.ErrorIs(t, run(nil), ErrCircuitOpen)
+
+	// ...and a successful one closes it
+	now = now.Add(5 * time.Second)
+	assert.NoError(t, run(nil))
+	assert.NoError(t, run(nil))
+
+	// only one probe runs at a time
+	run(down)
+	run(down)
+	now = now.Add(5 * time.Second)
+	probe := redis.NewStringCmd(ctx, "get", "k")
+	_, err := b.BeforeProcess(ctx, probe)
+	require.NoError(t, err)
+	assert.ErrorIs(t, run(nil), ErrCircuitOpen)
+	require.NoError(t, b.AfterProcess(ctx, probe))
+	assert.NoError(t, run(nil))
+}
+
+func TestLRU(t *testing.T) {
+	c := NewLRU[uint64, string](2, time.Second)
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	c.Add(1, "a")
+	c.Add(2, "b")
+	_, _ = c.Get(1) // 2 is now least recently used
+	c.Add(3, "c")
+	_, ok := c.Get(2)
+	assert.False(t, ok)
+	v, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, "a", v)
+
+	now = now.Add(time.Second)
+	_, ok = c.Get(1)
+	assert.False(t, ok, "expired")
+
+	c.Add(4, "d")
+	c.Resize(1, time.Second)
+	assert.Equal(t, 1, c.Len())
+	_, ok = c.Get(4)
+	assert.True(t, ok)
+	c.Remove(4)
+	c.Resize(0, time.Second)
+	c.Add(5, "e")
+	assert.Zero(t, c.Len(), "zero capacity disables it")
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	val     V
+	expires time.Time
+}
+
+// LRU is a small in-process least-recently-used cache whose entries also
+// expire after a TTL. A capacity of zero disables it.
+type LRU[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // front is most recently used
+	items    map[K]*list.Element
+	now      func() time.Time
+}
+
+// NewLRU returns an LRU holding up to capacity entries for ttl each.
+func NewLRU[K comparable, V any](capacity int, ttl time.Duration) *LRU[K, V] {
+	return &LRU[K, V]{
+		capacity: capacity, ttl: ttl,
+		order: list.New(), items: make(map[K]*list.Element), now: time.Now,
+	}
+}
+
+// Get returns the live entry for key.
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	e := el.Value.(*lruEntry[K, V])
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return e.val, true
+}
+
+// Add stores val under key, evicting the least recently used entry when full.
+func (c *LRU[K, V]) Add(key K, val V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry[K, V])
+		e.val, e.expires = val, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[K, V]{key: key, val: val, expires: expires})
+	c.trim()
+}
+
+// Remove drops key.
+func (c *LRU[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Resize changes the capacity and TTL, evicting entries over the new capacity.
+// Entries already stored keep their expiry.
+func (c *LRU[K, V]) Resize(capacity int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity, c.ttl = capacity, ttl
+	c.trim()
+}
+
+// Len returns the number of entries, expired ones included.
+func (c *LRU[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRU[K, V]) trim() {
+	for c.order.Len() > c.capacity && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *LRU[K, V]) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*lruEntry[K, V]).key)
+}
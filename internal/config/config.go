@@ -1,57 +1,845 @@
 package config
 
 import (
-	"gopkg.in/yaml.v3"
-	"io/ioutil"
+	"encoding"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gopkg.in/yaml.v3"
 )
 
+// EnvPrefix prefixes every environment override, e.g. WALLET_REDIS_ADDR.
+const EnvPrefix = "WALLET"
+
 // Config top-level struct
 type Config struct {
-	Server    ServerConfig    `yaml:"server"`
-	Postgres  PostgresConfig  `yaml:"postgres"`
-	Redis     RedisConfig     `yaml:"redis"`
-	Kafka     KafkaConfig     `yaml:"kafka"`
-	RateLimit RateLimitConfig `yaml:"ratelimit"`
+	Server     ServerConfig     `yaml:"server"`
+	Postgres   PostgresConfig   `yaml:"postgres"`
+	Redis      RedisConfig      `yaml:"redis"`
+	Cache      CacheConfig      `yaml:"cache"`
+	Kafka      KafkaConfig      `yaml:"kafka"`
+	RateLimit  RateLimitConfig  `yaml:"ratelimit"`
+	Limits     LimitsConfig     `yaml:"limits"`
+	Fees       FeesConfig       `yaml:"fees"`
+	Escrow     EscrowConfig     `yaml:"escrow"`
+	Credit     CreditConfig     `yaml:"credit"`
+	Interest   InterestConfig   `yaml:"interest"`
+	Snapshots  SnapshotConfig   `yaml:"snapshots"`
+	Partitions PartitionConfig  `yaml:"partitions"`
+	Settlement SettlementConfig `yaml:"settlement"`
+	Deposits   DepositsConfig   `yaml:"deposits"`
+	Webhooks   WebhooksConfig   `yaml:"webhooks"`
+	Poller     PollerConfig     `yaml:"poller"`
+	Scheduler  SchedulerConfig  `yaml:"scheduler"`
+	Runtime    RuntimeConfig    `yaml:"runtime"`
+	Features   map[string]bool  `yaml:"features"`
 }
 
+// ServerConfig holds the public API port and AdminAddr, where operational
+// endpoints such as /debug/vars are served; keep it off the public network.
+// An empty AdminAddr disables them.
 type ServerConfig struct {
-	Port int `yaml:"port"`
+	Port      int    `yaml:"port"`
+	AdminAddr string `yaml:"admin_addr"`
 }
 
+// PostgresConfig holds the primary DSN and optional read replicas. Replicas
+// share the primary's password and serve history, statement and cached-miss
+// balance reads while their lag, checked every ReplicaCheckInterval, is at
+// most MaxReplicaLag; otherwise those reads go to the primary. Shards are
+// further databases that wallets are spread over, numbered from 1; DSN is
+// shard 0.
 type PostgresConfig struct {
-	DSN string `yaml:"dsn"`
+	DSN                  string        `yaml:"dsn"`
+	Password             string        `yaml:"password"`
+	Replicas             []string      `yaml:"replicas"`
+	MaxReplicaLag        time.Duration `yaml:"max_replica_lag"`
+	ReplicaCheckInterval time.Duration `yaml:"replica_check_interval"`
+	Shards               []string      `yaml:"shards"`
 }
 
+// RedisConfig holds the Redis connection. After BreakerFailures consecutive
+// connection errors every command fails fast for BreakerCooldown, so callers
+// fall back to the database instead of waiting on timeouts.
 type RedisConfig struct {
-	Addr     string `yaml:"addr"`
-	Password string `yaml:"password"`
-	DB       int    `yaml:"db"`
+	Addr            string        `yaml:"addr"`
+	Password        string        `yaml:"password"`
+	DB              int           `yaml:"db"`
+	BreakerFailures int           `yaml:"breaker_failures"`
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
 }
 
+// Balance cache modes.
+const (
+	CacheReadWrite = "read_write"
+	CacheWriteOnly = "write_only"
+	CacheOff       = "off"
+)
+
+// CacheConfig controls the Redis balance cache. In read_write mode balances
+// are served from the cache when present; write_only keeps the cache warm but
+// reads the database, so every read is strongly consistent; off does neither.
+//
+// LocalSize > 0 adds an in-process LRU of that many balances in front of Redis
+// in read_write mode. Other instances' writes show up there only after
+// LocalTTL, so keep it short.
+type CacheConfig struct {
+	Mode      string        `yaml:"mode"`
+	TTL       time.Duration `yaml:"ttl"`
+	LocalSize int           `yaml:"local_size"`
+	LocalTTL  time.Duration `yaml:"local_ttl"`
+}
+
+// Reads reports whether balance reads may be served from the cache.
+func (c CacheConfig) Reads() bool { return c.Mode == CacheReadWrite }
+
+// Writes reports whether balances are written to the cache.
+func (c CacheConfig) Writes() bool { return c.Mode != CacheOff }
+
 type KafkaConfig struct {
 	Brokers []string `yaml:"brokers"`
 	Topic   string   `yaml:"topic"`
 }
 
+// RateLimitConfig holds the default per-client limit (RPS/Burst) and
+// optional per-route-class overrides for clients and wallets. Clients are
+// told apart by ClientHeader only on requests from TrustedProxies (addresses
+// or CIDRs), and by their address otherwise.
 type RateLimitConfig struct {
-	RPS   int `yaml:"rps"`
-	Burst int `yaml:"burst"`
+	RPS            int              `yaml:"rps"`
+	Burst          int              `yaml:"burst"`
+	ClientHeader   string           `yaml:"client_header"`
+	TrustedProxies []string         `yaml:"trusted_proxies"`
+	Read           RouteClassConfig `yaml:"read"`
+	Money          RouteClassConfig `yaml:"money"`
+}
+
+// Trusts reports whether ip is one of the trusted proxies.
+func (c RateLimitConfig) Trusts(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, p := range c.TrustedProxies {
+		if prefix, err := parsePrefix(p); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix reads a CIDR or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// RouteClassConfig holds quotas for one route class (reads or money movement).
+type RouteClassConfig struct {
+	Client QuotaConfig `yaml:"client"`
+	Wallet QuotaConfig `yaml:"wallet"`
+}
+
+// QuotaConfig allows Limit requests per Period with the given Burst.
+type QuotaConfig struct {
+	Limit  int           `yaml:"limit"`
+	Period time.Duration `yaml:"period"`
+	Burst  int           `yaml:"burst"`
+}
+
+// LimitsConfig holds business limits applied to every money movement.
+type LimitsConfig struct {
+	// MaxAmount caps a single deposit, withdrawal or transfer; zero means no cap.
+	MaxAmount decimal.Decimal `yaml:"max_amount"`
+	// MaxBatchLegs caps the number of legs in one batch.
+	MaxBatchLegs int `yaml:"max_batch_legs"`
+}
+
+// EscrowConfig names the system wallets holding escrowed funds, per currency
+// like FeesConfig.HouseWallets. Without one, escrows can't be opened.
+type EscrowConfig struct {
+	WalletID uint64            `yaml:"wallet_id"`
+	Wallets  map[string]uint64 `yaml:"wallets"`
+}
+
+// Wallet returns the escrow wallet for currency, or 0 for none.
+func (e EscrowConfig) Wallet(currency string) uint64 {
+	if id, ok := e.Wallets[currency]; ok {
+		return id
+	}
+	return e.WalletID
+}
+
+// CreditConfig controls credit line monitoring.
+type CreditConfig struct {
+	// UtilizationThresholds are percentages of a wallet's credit limit; an
+	// event is emitted whenever utilization crosses one in either direction.
+	UtilizationThresholds []int `yaml:"utilization_thresholds"`
+}
+
+// Day-count conventions for interest accrual.
+const (
+	DayCountAct365 = "ACT/365"
+	DayCountAct360 = "ACT/360"
+	DayCountActAct = "ACT/ACT"
+	DayCount30360  = "30/360"
+)
+
+// Interest posting periods.
+const (
+	PostDaily   = "daily"
+	PostMonthly = "monthly"
+)
+
+// InterestConfig holds the rate plans wallets can be put on and the house
+// wallets paying the interest (per currency, like FeesConfig.HouseWallets).
+// Interest accrues daily and is paid once per Posting period. BackfillDays
+// complete days are (re)checked on each run, so short outages are caught up.
+type InterestConfig struct {
+	HouseWalletID uint64            `yaml:"house_wallet_id"`
+	HouseWallets  map[string]uint64 `yaml:"house_wallets"`
+	Posting       string            `yaml:"posting"`
+	BackfillDays  int               `yaml:"backfill_days"`
+	Plans         []RatePlan        `yaml:"plans"`
+}
+
+// HouseWallet returns the wallet paying interest in currency, or 0 for none.
+func (i InterestConfig) HouseWallet(currency string) uint64 {
+	if id, ok := i.HouseWallets[currency]; ok {
+		return id
+	}
+	return i.HouseWalletID
+}
+
+// Plan returns the named rate plan, or nil.
+func (i InterestConfig) Plan(name string) *RatePlan {
+	for k := range i.Plans {
+		if i.Plans[k].Name == name {
+			return &i.Plans[k]
+		}
+	}
+	return nil
+}
+
+// RatePlan pays AnnualRate percent a year on end-of-day balances of at least
+// MinBalance, using the DayCount convention to split the rate into days.
+type RatePlan struct {
+	Name       string          `yaml:"name"`
+	AnnualRate decimal.Decimal `yaml:"annual_rate"`
+	DayCount   string          `yaml:"day_count"`
+	MinBalance decimal.Decimal `yaml:"min_balance"`
+}
+
+func (i InterestConfig) validate() []error {
+	var errs []error
+	add := func(format string, args ...interface{}) { errs = append(errs, fmt.Errorf(format, args...)) }
+	if i.Posting != PostDaily && i.Posting != PostMonthly {
+		add("interest.posting: must be daily or monthly, got %q", i.Posting)
+	}
+	if i.BackfillDays < 1 {
+		add("interest.backfill_days: must be at least 1, got %d", i.BackfillDays)
+	}
+	if len(i.Plans) > 0 && i.HouseWalletID == 0 && len(i.HouseWallets) == 0 {
+		add("interest.house_wallet_id: required when rate plans are configured")
+	}
+	seen := map[string]bool{}
+	for k, p := range i.Plans {
+		name := fmt.Sprintf("interest.plans[%d]", k)
+		if p.Name == "" || seen[p.Name] {
+			add("%s.name: must be set and unique", name)
+		}
+		seen[p.Name] = true
+		if p.AnnualRate.IsNegative() || p.MinBalance.IsNegative() {
+			add("%s: annual_rate and min_balance must not be negative", name)
+		}
+		switch p.DayCount {
+		case DayCountAct365, DayCountAct360, DayCountActAct, DayCount30360:
+		default:
+			add("%s.day_count: unknown convention %q", name, p.DayCount)
+		}
+	}
+	return errs
+}
+
+// SnapshotConfig controls the daily balance snapshots. The last BackfillDays
+// complete days are (re)written on each run, so late ledger rows and outages
+// are caught up.
+type SnapshotConfig struct {
+	BackfillDays int `yaml:"backfill_days"`
+}
+
+// PartitionConfig controls the monthly partitions of the ledger. Partitions
+// are created AheadMonths in advance. With ArchiveAfterMonths > 0, months that
+// ended more than that many months ago are written to ArchiveDir and removed
+// from the database; history reads and balances as of a time still include
+// them, but idempotency keys of their rows are no longer recognised.
+type PartitionConfig struct {
+	AheadMonths        int    `yaml:"ahead_months"`
+	ArchiveAfterMonths int    `yaml:"archive_after_months"`
+	ArchiveDir         string `yaml:"archive_dir"`
+}
+
+// SettlementConfig controls withdrawals paid out through an external
+// provider. Provider names the adapter ("fake" is in-memory); without one they
+// can't be requested. Every provider call gets Timeout. Accepted payouts are
+// polled every PollInterval; failed calls are retried after RetryDelay,
+// doubling up to MaxRetryDelay.
+type SettlementConfig struct {
+	Provider      string        `yaml:"provider"`
+	Timeout       time.Duration `yaml:"timeout"`
+	PollInterval  time.Duration `yaml:"poll_interval"`
+	RetryDelay    time.Duration `yaml:"retry_delay"`
+	MaxRetryDelay time.Duration `yaml:"max_retry_delay"`
+}
+
+// DepositsConfig lists the payment providers whose deposit webhooks are
+// accepted, at /v1/webhooks/deposits/<name>. Providers maps each name to its
+// adapter ("fake" signs bodies with HMAC-SHA256) and Secrets to the key its
+// signatures are checked with.
+type DepositsConfig struct {
+	Providers map[string]string `yaml:"providers"`
+	Secrets   map[string]string `yaml:"secrets"`
+}
+
+// WebhooksConfig controls the delivery of wallet events to webhook
+// subscribers. Every request gets Timeout; a failed delivery is retried after
+// RetryDelay, doubling up to MaxRetryDelay, and given up after MaxAttempts. A
+// subscription none of whose deliveries has succeeded for DisableAfter is
+// disabled. Each run sends at most PerSubscription deliveries to a
+// subscription, one at a time, while subscriptions are served in parallel.
+type WebhooksConfig struct {
+	Timeout         time.Duration `yaml:"timeout"`
+	RetryDelay      time.Duration `yaml:"retry_delay"`
+	MaxRetryDelay   time.Duration `yaml:"max_retry_delay"`
+	MaxAttempts     int           `yaml:"max_attempts"`
+	DisableAfter    time.Duration `yaml:"disable_after"`
+	PerSubscription int           `yaml:"per_subscription"`
+}
+
+// Fee schedule types.
+const (
+	FeeFlat       = "flat"
+	FeePercentage = "percentage"
+	FeeTiered     = "tiered"
+)
+
+// FeesConfig holds the fee schedules and the house wallets collecting fees.
+// HouseWallets maps a currency to its house wallet; HouseWalletID is used for
+// currencies without an entry. Without a house wallet no fee is charged.
+type FeesConfig struct {
+	HouseWalletID uint64            `yaml:"house_wallet_id"`
+	HouseWallets  map[string]uint64 `yaml:"house_wallets"`
+	Schedules     []FeeSchedule     `yaml:"schedules"`
+}
+
+// HouseWallet returns the wallet collecting fees in currency, or 0 for none.
+func (f FeesConfig) HouseWallet(currency string) uint64 {
+	if id, ok := f.HouseWallets[currency]; ok {
+		return id
+	}
+	return f.HouseWalletID
+}
+
+// FeeSchedule prices one operation ("withdraw" or "transfer") in one currency
+// (empty matches any currency without a more specific schedule). Percentages
+// are in percent, e.g. 0.5 = 0.5%. Min/Max clamp the result; zero Max = no cap.
+type FeeSchedule struct {
+	Operation string          `yaml:"operation"`
+	Currency  string          `yaml:"currency"`
+	Type      string          `yaml:"type"`
+	Flat      decimal.Decimal `yaml:"flat"`
+	Percent   decimal.Decimal `yaml:"percent"`
+	Tiers     []FeeTier       `yaml:"tiers"`
+	Min       decimal.Decimal `yaml:"min"`
+	Max       decimal.Decimal `yaml:"max"`
+}
+
+// FeeTier applies Flat + Percent to amounts up to UpTo (zero = unbounded).
+// Tiers are checked in order and the first match prices the whole amount.
+type FeeTier struct {
+	UpTo    decimal.Decimal `yaml:"up_to"`
+	Flat    decimal.Decimal `yaml:"flat"`
+	Percent decimal.Decimal `yaml:"percent"`
+}
+
+// PollerConfig controls the outbox poller.
+type PollerConfig struct {
+	BatchSize int           `yaml:"batch_size"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+// SchedulerConfig controls the scheduled-transfer worker. A failed occurrence
+// is retried MaxRetries times, RetryDelay apart, before it is skipped.
+// Cross-shard transfer sagas still open after SagaRetryAfter are resumed.
+type SchedulerConfig struct {
+	Interval       time.Duration `yaml:"interval"`
+	BatchSize      int           `yaml:"batch_size"`
+	Lease          time.Duration `yaml:"lease"`
+	MaxRetries     int           `yaml:"max_retries"`
+	RetryDelay     time.Duration `yaml:"retry_delay"`
+	SagaRetryAfter time.Duration `yaml:"saga_retry_after"`
+}
+
+// RuntimeConfig controls hot reloading of the config (see Runtime).
+type RuntimeConfig struct {
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	DBSettings     bool          `yaml:"db_settings"`
+}
+
+// Feature reports whether the named feature toggle is on.
+func (c *Config) Feature(name string) bool { return c.Features[name] }
+
+// DefaultPath returns $WALLET_CONFIG, or the in-repo config file.
+func DefaultPath() string {
+	if p := os.Getenv(EnvPrefix + "_CONFIG"); p != "" {
+		return p
+	}
+	return "internal/config/config.yaml"
+}
+
+// Defaults returns the configuration used for anything not set in the file or env.
+func Defaults() Config {
+	return Config{
+		Server:     ServerConfig{Port: 8080, AdminAddr: "127.0.0.1:6060"},
+		Postgres:   PostgresConfig{MaxReplicaLag: 2 * time.Second, ReplicaCheckInterval: time.Second},
+		Redis:      RedisConfig{Addr: "localhost:6379", BreakerFailures: 5, BreakerCooldown: 5 * time.Second},
+		Cache:      CacheConfig{Mode: CacheReadWrite, TTL: 5 * time.Minute, LocalTTL: time.Second},
+		Kafka:      KafkaConfig{Topic: "wallet.events"},
+		RateLimit:  RateLimitConfig{RPS: 100, Burst: 200},
+		Limits:     LimitsConfig{MaxBatchLegs: 1000},
+		Credit:     CreditConfig{UtilizationThresholds: []int{50, 80, 100}},
+		Interest:   InterestConfig{Posting: PostMonthly, BackfillDays: 7},
+		Snapshots:  SnapshotConfig{BackfillDays: 2},
+		Partitions: PartitionConfig{AheadMonths: 3},
+		Settlement: SettlementConfig{
+			Timeout: 10 * time.Second, PollInterval: 30 * time.Second,
+			RetryDelay: 10 * time.Second, MaxRetryDelay: 10 * time.Minute,
+		},
+		Webhooks: WebhooksConfig{
+			Timeout: 10 * time.Second, RetryDelay: 10 * time.Second, MaxRetryDelay: time.Hour,
+			MaxAttempts: 12, DisableAfter: 24 * time.Hour, PerSubscription: 10,
+		},
+		Poller: PollerConfig{BatchSize: 100, Interval: time.Second},
+		Scheduler: SchedulerConfig{
+			Interval: 10 * time.Second, BatchSize: 100, Lease: time.Minute,
+			MaxRetries: 3, RetryDelay: time.Hour, SagaRetryAfter: 30 * time.Second,
+		},
+		Runtime: RuntimeConfig{ReloadInterval: 10 * time.Second},
+	}
 }
 
-// Load reads yaml file
+// Load builds the config from defaults, the yaml file at path (skipped when
+// path is empty) and environment overrides, then validates it.
+//
+// Every field can be overridden by WALLET_<SECTION>_<FIELD> (slices are
+// comma-separated), or by WALLET_<SECTION>_<FIELD>_FILE naming a file whose
+// content is used, which is how mounted secrets are read.
 func Load(path string) (*Config, error) {
-	data, err := ioutil.ReadFile(path)
+	cfg, err := load(path)
 	if err != nil {
 		return nil, err
 	}
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
-	// override DSN password from env if present
+	return cfg, nil
+}
+
+func load(path string) (*Config, error) {
+	cfg := Defaults()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	// legacy variable injected by the wallet-db-secret
 	if pw := os.Getenv("POSTGRES_PASSWORD"); pw != "" {
-		cfg.Postgres.DSN = cfg.Postgres.DSN + " password=" + pw
+		cfg.Postgres.Password = pw
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), EnvPrefix, os.LookupEnv); err != nil {
+		return nil, err
 	}
 	return &cfg, nil
 }
+
+// Validate reports every problem with the config at once.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...interface{}) { errs = append(errs, fmt.Errorf(format, args...)) }
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		add("server.port: %d is not a valid port", c.Server.Port)
+	}
+	if strings.TrimSpace(c.Postgres.DSN) == "" {
+		add("postgres.dsn: required")
+	}
+	for i, r := range c.Postgres.Replicas {
+		if strings.TrimSpace(r) == "" {
+			add("postgres.replicas[%d]: empty DSN", i)
+		}
+	}
+	if len(c.Postgres.Replicas) > 0 && (c.Postgres.MaxReplicaLag <= 0 || c.Postgres.ReplicaCheckInterval <= 0) {
+		add("postgres: max_replica_lag and replica_check_interval must be positive with replicas")
+	}
+	for i, s := range c.Postgres.Shards {
+		if strings.TrimSpace(s) == "" {
+			add("postgres.shards[%d]: empty DSN", i)
+		}
+	}
+	if c.Redis.Addr == "" {
+		add("redis.addr: required")
+	}
+	if c.Redis.DB < 0 {
+		add("redis.db: must not be negative")
+	}
+	if c.Redis.BreakerFailures < 1 || c.Redis.BreakerCooldown <= 0 {
+		add("redis: breaker_failures must be at least 1 and breaker_cooldown positive")
+	}
+	switch c.Cache.Mode {
+	case CacheReadWrite, CacheWriteOnly, CacheOff:
+	default:
+		add("cache.mode: want %s, %s or %s, got %q", CacheReadWrite, CacheWriteOnly, CacheOff, c.Cache.Mode)
+	}
+	if c.Cache.TTL <= 0 {
+		add("cache.ttl: must be positive")
+	}
+	if c.Cache.LocalSize < 0 {
+		add("cache.local_size: must not be negative")
+	}
+	if c.Cache.LocalSize > 0 && c.Cache.LocalTTL <= 0 {
+		add("cache.local_ttl: must be positive when local_size is set")
+	}
+	if len(c.Kafka.Brokers) == 0 {
+		add("kafka.brokers: at least one broker is required")
+	}
+	for i, b := range c.Kafka.Brokers {
+		if strings.TrimSpace(b) == "" {
+			add("kafka.brokers[%d]: empty broker address", i)
+		}
+	}
+	if c.Kafka.Topic == "" {
+		add("kafka.topic: required")
+	}
+	if c.RateLimit.RPS <= 0 {
+		add("ratelimit.rps: must be positive, got %d", c.RateLimit.RPS)
+	}
+	if c.RateLimit.Burst < 1 {
+		add("ratelimit.burst: must be at least 1, got %d", c.RateLimit.Burst)
+	}
+	for i, p := range c.RateLimit.TrustedProxies {
+		if _, err := parsePrefix(p); err != nil {
+			add("ratelimit.trusted_proxies[%d]: %v", i, err)
+		}
+	}
+	for name, q := range map[string]QuotaConfig{
+		"ratelimit.read.client":  c.RateLimit.Read.Client,
+		"ratelimit.read.wallet":  c.RateLimit.Read.Wallet,
+		"ratelimit.money.client": c.RateLimit.Money.Client,
+		"ratelimit.money.wallet": c.RateLimit.Money.Wallet,
+	} {
+		if err := q.validate(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.Limits.MaxAmount.IsNegative() {
+		add("limits.max_amount: must not be negative")
+	}
+	if c.Limits.MaxBatchLegs < 1 {
+		add("limits.max_batch_legs: must be at least 1, got %d", c.Limits.MaxBatchLegs)
+	}
+	for i, fs := range c.Fees.Schedules {
+		if err := fs.validate(fmt.Sprintf("fees.schedules[%d]", i)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(c.Fees.Schedules) > 0 && c.Fees.HouseWalletID == 0 && len(c.Fees.HouseWallets) == 0 {
+		add("fees.house_wallet_id: required when fee schedules are configured")
+	}
+	for i, t := range c.Credit.UtilizationThresholds {
+		if t < 1 || t > 100 || (i > 0 && t <= c.Credit.UtilizationThresholds[i-1]) {
+			add("credit.utilization_thresholds: want ascending percentages from 1 to 100, got %v", c.Credit.UtilizationThresholds)
+			break
+		}
+	}
+	errs = append(errs, c.Interest.validate()...)
+	if c.Snapshots.BackfillDays < 1 {
+		add("snapshots.backfill_days: must be at least 1, got %d", c.Snapshots.BackfillDays)
+	}
+	if c.Partitions.AheadMonths < 1 {
+		add("partitions.ahead_months: must be at least 1, got %d", c.Partitions.AheadMonths)
+	}
+	if c.Partitions.ArchiveAfterMonths < 0 {
+		add("partitions.archive_after_months: must not be negative")
+	}
+	if c.Partitions.ArchiveDir == "" && c.Partitions.ArchiveAfterMonths > 0 {
+		add("partitions.archive_dir: required when archive_after_months is set")
+	}
+	st := c.Settlement
+	if st.Timeout <= 0 || st.PollInterval <= 0 || st.RetryDelay <= 0 || st.MaxRetryDelay < st.RetryDelay {
+		add("settlement: timeout, poll_interval and retry_delay must be positive and max_retry_delay at least retry_delay")
+	}
+	for name := range c.Deposits.Providers {
+		if c.Deposits.Secrets[name] == "" {
+			add("deposits.secrets: provider %q has no secret", name)
+		}
+	}
+	wh := c.Webhooks
+	if wh.Timeout <= 0 || wh.RetryDelay <= 0 || wh.MaxRetryDelay < wh.RetryDelay || wh.DisableAfter <= 0 {
+		add("webhooks: timeout, retry_delay and disable_after must be positive and max_retry_delay at least retry_delay")
+	}
+	if wh.MaxAttempts < 1 {
+		add("webhooks.max_attempts: must be at least 1, got %d", wh.MaxAttempts)
+	}
+	if wh.PerSubscription < 1 {
+		add("webhooks.per_subscription: must be at least 1, got %d", wh.PerSubscription)
+	}
+	if c.Poller.BatchSize < 1 {
+		add("poller.batch_size: must be at least 1, got %d", c.Poller.BatchSize)
+	}
+	if c.Poller.Interval <= 0 {
+		add("poller.interval: must be positive")
+	}
+	if c.Scheduler.Interval <= 0 || c.Scheduler.Lease <= 0 || c.Scheduler.RetryDelay <= 0 || c.Scheduler.SagaRetryAfter <= 0 {
+		add("scheduler: interval, lease, retry_delay and saga_retry_after must be positive")
+	}
+	if c.Scheduler.BatchSize < 1 {
+		add("scheduler.batch_size: must be at least 1, got %d", c.Scheduler.BatchSize)
+	}
+	if c.Scheduler.MaxRetries < 0 {
+		add("scheduler.max_retries: must not be negative")
+	}
+	if c.Runtime.ReloadInterval < 0 {
+		add("runtime.reload_interval: must not be negative")
+	}
+	return errors.Join(errs...)
+}
+
+func (q QuotaConfig) validate(name string) error {
+	switch {
+	case q.Limit < 0:
+		return fmt.Errorf("%s.limit: must not be negative", name)
+	case q.Period < 0:
+		return fmt.Errorf("%s.period: must not be negative", name)
+	case q.Burst < 0:
+		return fmt.Errorf("%s.burst: must not be negative", name)
+	case q.Limit == 0 && (q.Period != 0 || q.Burst != 0):
+		return fmt.Errorf("%s: period/burst set without a limit", name)
+	}
+	return nil
+}
+
+func (f FeeSchedule) validate(name string) error {
+	if f.Operation != "withdraw" && f.Operation != "transfer" {
+		return fmt.Errorf("%s.operation: want withdraw or transfer, got %q", name, f.Operation)
+	}
+	for _, v := range []decimal.Decimal{f.Flat, f.Percent, f.Min, f.Max} {
+		if v.IsNegative() {
+			return fmt.Errorf("%s: amounts must not be negative", name)
+		}
+	}
+	if f.Max.IsPositive() && f.Min.GreaterThan(f.Max) {
+		return fmt.Errorf("%s: min is greater than max", name)
+	}
+	switch f.Type {
+	case FeeFlat, FeePercentage:
+	case FeeTiered:
+		if len(f.Tiers) == 0 {
+			return fmt.Errorf("%s.tiers: required for tiered fees", name)
+		}
+		for i, t := range f.Tiers {
+			if t.UpTo.IsNegative() || t.Flat.IsNegative() || t.Percent.IsNegative() {
+				return fmt.Errorf("%s.tiers[%d]: amounts must not be negative", name, i)
+			}
+			if i > 0 && !t.UpTo.IsZero() && t.UpTo.LessThanOrEqual(f.Tiers[i-1].UpTo) {
+				return fmt.Errorf("%s.tiers[%d]: up_to must increase", name, i)
+			}
+			if t.UpTo.IsZero() && i != len(f.Tiers)-1 {
+				return fmt.Errorf("%s.tiers[%d]: only the last tier may be unbounded", name, i)
+			}
+		}
+	default:
+		return fmt.Errorf("%s.type: want flat, percentage or tiered, got %q", name, f.Type)
+	}
+	return nil
+}
+
+// ConnString returns the DSN with Password applied, for both URL and
+// keyword/value DSNs.
+func (p PostgresConfig) ConnString() string { return p.connString(p.DSN) }
+
+// ReplicaConnStrings returns the replica DSNs with Password applied.
+func (p PostgresConfig) ReplicaConnStrings() []string {
+	out := make([]string, len(p.Replicas))
+	for i, dsn := range p.Replicas {
+		out[i] = p.connString(dsn)
+	}
+	return out
+}
+
+// ShardConnStrings returns the DSNs of shards 1..n with Password applied.
+func (p PostgresConfig) ShardConnStrings() []string {
+	out := make([]string, len(p.Shards))
+	for i, dsn := range p.Shards {
+		out[i] = p.connString(dsn)
+	}
+	return out
+}
+
+func (p PostgresConfig) connString(dsn string) string {
+	if p.Password == "" {
+		return dsn
+	}
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		user := ""
+		if u.User != nil {
+			user = u.User.Username()
+		}
+		u.User = url.UserPassword(user, p.Password)
+		return u.String()
+	}
+	pw := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p.Password)
+	return dsn + " password='" + pw + "'"
+}
+
+// applyEnv overrides the fields of v from env vars named prefix_<YAML_TAG>.
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		fv := v.Field(i)
+		if f.Type.Kind() == reflect.Struct && !isText(fv) {
+			if err := applyEnv(fv, name, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		raw, ok := lookup(name)
+		if !ok {
+			file, fok := lookup(name + "_FILE")
+			if !fok {
+				continue
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %w", name, err)
+			}
+			raw = strings.TrimRight(string(data), "\r\n")
+		}
+		if err := setField(fv, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// isText reports whether the field parses itself from text (e.g. decimal.Decimal).
+func isText(fv reflect.Value) bool {
+	return reflect.PointerTo(fv.Type()).Implements(textUnmarshalerType)
+}
+
+func setField(fv reflect.Value, raw string) error {
+	if isText(fv) {
+		return fv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(raw))
+	}
+	if fv.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	case reflect.Map:
+		// "a=true,b=false"
+		if fv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map type %s", fv.Type())
+		}
+		m := reflect.MakeMap(fv.Type())
+		for _, pair := range strings.Split(raw, ",") {
+			k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || k == "" {
+				continue
+			}
+			ev := reflect.New(fv.Type().Elem()).Elem()
+			if err := setField(ev, val); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			m.SetMapIndex(reflect.ValueOf(k), ev)
+		}
+		fv.Set(m)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() == reflect.Struct && !isText(reflect.New(fv.Type().Elem()).Elem()) {
+			return fmt.Errorf("unsupported slice type %s", fv.Type())
+		}
+		items := reflect.MakeSlice(fv.Type(), 0, 0)
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			ev := reflect.New(fv.Type().Elem()).Elem()
+			if err := setField(ev, s); err != nil {
+				return err
+			}
+			items = reflect.Append(items, ev)
+		}
+		fv.Set(items)
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SettingsFunc returns runtime overrides keyed by dotted yaml path,
+// e.g. "ratelimit.money.wallet.limit" -> "5". They win over file and env.
+type SettingsFunc func(ctx context.Context) (map[string]string, error)
+
+// restartOnly lists sections, and single settings, whose changes only take
+// effect after a restart.
+var restartOnly = []string{"server.", "postgres.", "redis.", "kafka.", "runtime.", "settlement.provider"}
+
+// Runtime holds the current config and swaps in a new, validated one whenever
+// the config file (e.g. a mounted ConfigMap) or the settings source changes.
+// Readers call Current on every use instead of caching values.
+type Runtime struct {
+	path     string
+	settings SettingsFunc
+	log      *zap.SugaredLogger
+
+	cur      atomic.Pointer[Config]
+	mu       sync.Mutex // serialises reloads
+	fileHash [sha256.Size]byte
+}
+
+// NewRuntime returns a Runtime starting from initial. settings may be nil.
+func NewRuntime(path string, initial *Config, settings SettingsFunc, log *zap.SugaredLogger) *Runtime {
+	r := &Runtime{path: path, settings: settings, log: log}
+	r.cur.Store(initial)
+	if path == "" {
+		return r
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		r.fileHash = sha256.Sum256(data)
+	}
+	return r
+}
+
+// Current returns the active config. The returned value must not be modified.
+func (r *Runtime) Current() *Config { return r.cur.Load() }
+
+// Watch reloads every interval until ctx is done.
+func (r *Runtime) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := r.Reload(ctx); err != nil {
+				r.log.Errorf("config reload rejected, keeping current config: %v", err)
+			}
+		}
+	}
+}
+
+// Reload rebuilds the config from file, env and settings; the new config is
+// only swapped in if it validates. Changes are logged field by field. With an
+// empty path, as Load("") allows, there is no file to read and only the
+// settings can change.
+func (r *Runtime) Reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var hash [sha256.Size]byte
+	if r.path != "" {
+		data, err := os.ReadFile(r.path)
+		if err != nil {
+			return err
+		}
+		hash = sha256.Sum256(data)
+	}
+	if hash == r.fileHash && r.settings == nil {
+		return nil
+	}
+
+	next, err := load(r.path)
+	if err != nil {
+		return err
+	}
+	if r.settings != nil {
+		kv, err := r.settings(ctx)
+		if err != nil {
+			return fmt.Errorf("load settings: %w", err)
+		}
+		keys := make([]string, 0, len(kv))
+		for k := range kv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := ApplySetting(next, k, kv[k]); err != nil {
+				return fmt.Errorf("setting %s: %w", k, err)
+			}
+		}
+	}
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	r.fileHash = hash
+
+	changes := Diff(r.Current(), next)
+	if len(changes) == 0 {
+		return nil
+	}
+	r.cur.Store(next)
+	for _, c := range changes {
+		if c.RestartOnly {
+			r.log.Warnf("config reload: %s changed %s -> %s (takes effect after restart)", c.Key, c.Old, c.New)
+		} else {
+			r.log.Infof("config reload: %s changed %s -> %s", c.Key, c.Old, c.New)
+		}
+	}
+	return nil
+}
+
+// Change is one field that differs between two configs.
+type Change struct {
+	Key         string
+	Old, New    string
+	RestartOnly bool
+}
+
+// Diff lists the fields that differ between a and b, secrets masked.
+func Diff(a, b *Config) []Change {
+	fa, fb := flatten(a), flatten(b)
+	keys := map[string]struct{}{}
+	for k := range fa {
+		keys[k] = struct{}{}
+	}
+	for k := range fb {
+		keys[k] = struct{}{}
+	}
+	var out []Change
+	for k := range keys {
+		if fa[k] == fb[k] {
+			continue
+		}
+		c := Change{Key: k, Old: fa[k], New: fb[k]}
+		if strings.Contains(k, "password") || strings.Contains(k, "secret") {
+			c.Old, c.New = "***", "***"
+		}
+		for _, p := range restartOnly {
+			if strings.HasPrefix(k, p) {
+				c.RestartOnly = true
+			}
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// ApplySetting sets the field at a dotted yaml path, e.g. "poller.batch_size".
+// Map fields take the next path element as key, e.g. "features.auto_create".
+func ApplySetting(cfg *Config, key, value string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		if v.Kind() == reflect.Map {
+			if i != len(parts)-1 {
+				return fmt.Errorf("unknown key")
+			}
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := setField(ev, value); err != nil {
+				return err
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			v.SetMapIndex(reflect.ValueOf(part), ev)
+			return nil
+		}
+		if v.Kind() != reflect.Struct || isText(v) {
+			return fmt.Errorf("unknown key")
+		}
+		f, ok := fieldByTag(v, part)
+		if !ok {
+			return fmt.Errorf("unknown key")
+		}
+		v = f
+	}
+	return setField(v, value)
+}
+
+func fieldByTag(v reflect.Value, tag string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0] == tag {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// flatten renders every leaf field as "dotted.path" -> string.
+func flatten(c *Config) map[string]string {
+	out := map[string]string{}
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		switch {
+		case v.Kind() == reflect.Struct && !isText(v):
+			t := v.Type()
+			for i := 0; i < t.NumField(); i++ {
+				tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+				if tag == "" || tag == "-" {
+					continue
+				}
+				walk(v.Field(i), join(prefix, tag))
+			}
+		case v.Kind() == reflect.Map:
+			for _, k := range v.MapKeys() {
+				walk(v.MapIndex(k), join(prefix, fmt.Sprint(k.Interface())))
+			}
+		case isText(v):
+			if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+				b, _ := m.MarshalText()
+				out[prefix] = string(b)
+				return
+			}
+			out[prefix] = fmt.Sprint(v.Interface())
+		case v.Kind() == reflect.Slice:
+			var buf bytes.Buffer
+			for i := 0; i < v.Len(); i++ {
+				if i > 0 {
+					buf.WriteString(",")
+				}
+				fmt.Fprint(&buf, v.Index(i).Interface())
+			}
+			out[prefix] = buf.String()
+		default:
+			out[prefix] = fmt.Sprint(v.Interface())
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return out
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
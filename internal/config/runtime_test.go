@@ -0,0 +1,80 @@
+package config
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRuntime_ReloadSwapsValidConfig(t *testing.T) {
+	path := writeFile(t, "c.yaml", minimalYAML)
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	rt := NewRuntime(path, cfg, nil, zap.NewNop().Sugar())
+
+	// unchanged file is a no-op
+	require.NoError(t, rt.Reload(context.Background()))
+	assert.Same(t, cfg, rt.Current())
+
+	require.NoError(t, os.WriteFile(path, []byte(minimalYAML+"ratelimit:\n  rps: 7\n  burst: 9\n"), 0o600))
+	require.NoError(t, rt.Reload(context.Background()))
+	assert.Equal(t, 7, rt.Current().RateLimit.RPS)
+
+	// invalid config is rejected and the previous one kept
+	require.NoError(t, os.WriteFile(path, []byte(minimalYAML+"ratelimit:\n  rps: -1\n"), 0o600))
+	assert.ErrorContains(t, rt.Reload(context.Background()), "ratelimit.rps")
+	assert.Equal(t, 7, rt.Current().RateLimit.RPS)
+}
+
+func TestRuntime_SettingsOverride(t *testing.T) {
+	path := writeFile(t, "c.yaml", minimalYAML)
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	settings := map[string]string{
+		"poller.batch_size":   "25",
+		"limits.max_amount":   "500.5",
+		"features.auto_thing": "true",
+	}
+	rt := NewRuntime(path, cfg, func(context.Context) (map[string]string, error) { return settings, nil }, zap.NewNop().Sugar())
+
+	require.NoError(t, rt.Reload(context.Background()))
+	cur := rt.Current()
+	assert.Equal(t, 25, cur.Poller.BatchSize)
+	assert.Equal(t, "500.5", cur.Limits.MaxAmount.String())
+	assert.True(t, cur.Feature("auto_thing"))
+
+	settings = map[string]string{"nope.nothing": "1"}
+	assert.ErrorContains(t, rt.Reload(context.Background()), "nope.nothing")
+}
+
+func TestRuntime_ReloadWithoutFile(t *testing.T) {
+	t.Setenv("WALLET_POSTGRES_DSN", "host=db dbname=wallet")
+	t.Setenv("WALLET_KAFKA_BROKERS", "k1:9092")
+	cfg, err := Load("")
+	require.NoError(t, err)
+	rt := NewRuntime("", cfg, nil, zap.NewNop().Sugar())
+	require.NoError(t, rt.Reload(context.Background()))
+	assert.Same(t, cfg, rt.Current())
+
+	settings := map[string]string{"poller.batch_size": "25"}
+	rt = NewRuntime("", cfg, func(context.Context) (map[string]string, error) { return settings, nil }, zap.NewNop().Sugar())
+	require.NoError(t, rt.Reload(context.Background()))
+	assert.Equal(t, 25, rt.Current().Poller.BatchSize)
+}
+
+func TestDiff(t *testing.T) {
+	a, b := Defaults(), Defaults()
+	b.RateLimit.Burst = 1
+	b.Server.Port = 9000
+	b.Postgres.Password = "secret"
+
+	changes := Diff(&a, &b)
+	require.Len(t, changes, 3)
+	assert.Equal(t, Change{Key: "postgres.password", Old: "***", New: "***", RestartOnly: true}, changes[0])
+	assert.Equal(t, Change{Key: "ratelimit.burst", Old: "200", New: "1"}, changes[1])
+	assert.True(t, changes[2].RestartOnly)
+}
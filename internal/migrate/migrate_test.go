@@ -0,0 +1,92 @@
+package migrate
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"0001_accounts.up.sql":   {Data: []byte("CREATE TABLE accounts (id INTEGER PRIMARY KEY);")},
+		"0001_accounts.down.sql": {Data: []byte("DROP TABLE accounts;")},
+		"0002_notes.up.sql":      {Data: []byte("CREATE TABLE notes (id INTEGER PRIMARY KEY); CREATE INDEX idx_notes ON notes(id);")},
+		"0002_notes.down.sql":    {Data: []byte("DROP TABLE notes;")},
+		"0003_broken.up.sql":     {Data: []byte("CREATE TABLE tags (id INTEGER PRIMARY KEY);")},
+		"0003_broken.down.sql":   {Data: []byte("DROP TABLE tags;")},
+	}
+}
+
+func newTestMigrator(t *testing.T, fsys fstest.MapFS) (*Migrator, *gorm.DB) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	m, err := NewFromFS(db, fsys, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return m, db
+}
+
+func appliedCount(t *testing.T, m *Migrator) int {
+	sts, err := m.Status(context.Background())
+	require.NoError(t, err)
+	n := 0
+	for _, st := range sts {
+		if st.Applied {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMigrator_UpDownTo(t *testing.T) {
+	ctx := context.Background()
+	m, db := newTestMigrator(t, testFS())
+
+	assert.ErrorIs(t, m.CheckCurrent(ctx), ErrSchemaOutOfDate)
+
+	require.NoError(t, m.Up(ctx))
+	assert.Equal(t, 3, appliedCount(t, m))
+	assert.True(t, db.Migrator().HasTable("notes"))
+	assert.NoError(t, m.CheckCurrent(ctx))
+
+	// idempotent
+	require.NoError(t, m.Up(ctx))
+
+	require.NoError(t, m.Down(ctx, 2))
+	assert.Equal(t, 1, appliedCount(t, m))
+	assert.False(t, db.Migrator().HasTable("notes"))
+	assert.True(t, db.Migrator().HasTable("accounts"))
+
+	require.NoError(t, m.To(ctx, 2))
+	assert.Equal(t, 2, appliedCount(t, m))
+	require.NoError(t, m.To(ctx, 0))
+	assert.Equal(t, 0, appliedCount(t, m))
+
+	assert.Error(t, m.To(ctx, 42))
+}
+
+func TestMigrator_FailedMigrationRollsBack(t *testing.T) {
+	fsys := testFS()
+	fsys["0003_broken.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE tags (id INTEGER PRIMARY KEY); NOT SQL;")}
+	m, db := newTestMigrator(t, fsys)
+
+	assert.Error(t, m.Up(context.Background()))
+	assert.Equal(t, 2, appliedCount(t, m))
+	assert.False(t, db.Migrator().HasTable("tags"))
+}
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	m, err := New(db, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, m.Latest(), int64(1))
+	for _, mg := range m.migrations {
+		assert.NotEmpty(t, mg.Down, "migration %d should be reversible", mg.Version)
+	}
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS event_outbox;
+DROP TABLE IF EXISTS transaction;
+DROP TABLE IF EXISTS wallet;
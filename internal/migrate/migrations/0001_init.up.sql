@@ -0,0 +1,37 @@
+-- Baseline schema. IF NOT EXISTS lets databases previously bootstrapped from
+-- deploy/sql/init/schema.sql or gorm AutoMigrate adopt versioned migrations.
+CREATE TABLE IF NOT EXISTS wallet (
+    id BIGSERIAL PRIMARY KEY,
+    balance NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (balance >= 0),
+    version BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS transaction (
+    id BIGSERIAL PRIMARY KEY,
+    wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    type VARCHAR(32) NOT NULL,
+    amount NUMERIC(20,8) NOT NULL CHECK (amount > 0),
+    balance_before NUMERIC(20,8) NOT NULL,
+    balance_after NUMERIC(20,8) NOT NULL,
+    related_wallet_id BIGINT NULL REFERENCES wallet(id),
+    idempotency_key VARCHAR(64) NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS event_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    aggregate VARCHAR(64) NOT NULL,
+    aggregate_id BIGINT NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    processed BOOLEAN NOT NULL DEFAULT FALSE,
+    processed_at TIMESTAMPTZ NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_event_outbox_unprocessed ON event_outbox(processed) WHERE processed = FALSE;
+
+-- keyset pagination over (created_at, id) for history queries
+CREATE INDEX IF NOT EXISTS idx_transaction_wallet_created ON transaction(wallet_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_transaction_wallet_type_created ON transaction(wallet_id, type, created_at, id);
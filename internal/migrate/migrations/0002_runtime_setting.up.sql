@@ -0,0 +1,5 @@
+CREATE TABLE runtime_setting (
+    key VARCHAR(128) PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
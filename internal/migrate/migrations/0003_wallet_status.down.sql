@@ -0,0 +1,3 @@
+ALTER TABLE wallet
+    DROP COLUMN status,
+    DROP COLUMN created_at;
@@ -0,0 +1,4 @@
+ALTER TABLE wallet
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'ACTIVE'
+        CHECK (status IN ('ACTIVE', 'FROZEN', 'DEBIT_BLOCKED', 'CREDIT_BLOCKED', 'CLOSED')),
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
@@ -0,0 +1,2 @@
+ALTER TABLE wallet DROP COLUMN limit_profile_id;
+DROP TABLE IF EXISTS limit_profile;
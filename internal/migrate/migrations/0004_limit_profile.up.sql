@@ -0,0 +1,14 @@
+CREATE TABLE limit_profile (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL UNIQUE,
+    per_tx_max NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (per_tx_max >= 0),
+    daily_withdraw NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (daily_withdraw >= 0),
+    monthly_withdraw NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (monthly_withdraw >= 0),
+    daily_transfer NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (daily_transfer >= 0),
+    monthly_transfer NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (monthly_transfer >= 0),
+    hourly_count INT NOT NULL DEFAULT 0 CHECK (hourly_count >= 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE wallet ADD COLUMN limit_profile_id BIGINT NULL REFERENCES limit_profile(id);
@@ -0,0 +1,2 @@
+-- Wallets hold a single ISO 4217 currency; fees are priced per currency.
+ALTER TABLE wallet ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS transfer_schedule_run;
+DROP TABLE IF EXISTS transfer_schedule;
@@ -0,0 +1,37 @@
+CREATE TABLE transfer_schedule (
+    id BIGSERIAL PRIMARY KEY,
+    wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    to_wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    amount NUMERIC(20,8) NOT NULL CHECK (amount > 0),
+    recurrence VARCHAR(16) NOT NULL CHECK (recurrence IN ('ONCE', 'DAILY', 'WEEKLY', 'MONTHLY')),
+    start_at TIMESTAMPTZ NOT NULL,
+    end_at TIMESTAMPTZ NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'ACTIVE'
+        CHECK (status IN ('ACTIVE', 'PAUSED', 'COMPLETED', 'CANCELLED')),
+    occurrence BIGINT NOT NULL DEFAULT 0,
+    next_run_at TIMESTAMPTZ NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    lease_until TIMESTAMPTZ NULL,
+    last_error VARCHAR(255) NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_transfer_schedule_wallet ON transfer_schedule(wallet_id);
+-- the scheduler's claim query
+CREATE INDEX idx_transfer_schedule_due ON transfer_schedule(next_attempt_at) WHERE status = 'ACTIVE';
+
+CREATE TABLE transfer_schedule_run (
+    id BIGSERIAL PRIMARY KEY,
+    schedule_id BIGINT NOT NULL REFERENCES transfer_schedule(id),
+    occurrence BIGINT NOT NULL,
+    scheduled_for TIMESTAMPTZ NOT NULL,
+    attempt INT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    error VARCHAR(255) NULL,
+    idempotency_key VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_transfer_schedule_run_schedule ON transfer_schedule_run(schedule_id, id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS batch_leg;
+DROP TABLE IF EXISTS batch;
@@ -0,0 +1,27 @@
+CREATE TABLE batch (
+    id BIGSERIAL PRIMARY KEY,
+    idempotency_key VARCHAR(64) NOT NULL UNIQUE,
+    mode VARCHAR(16) NOT NULL CHECK (mode IN ('ATOMIC', 'BEST_EFFORT')),
+    status VARCHAR(16) NOT NULL CHECK (status IN ('PROCESSING', 'COMPLETED', 'PARTIAL', 'FAILED')),
+    leg_count INT NOT NULL,
+    succeeded INT NOT NULL DEFAULT 0,
+    failed INT NOT NULL DEFAULT 0,
+    total_amount NUMERIC(20,8) NOT NULL,
+    error VARCHAR(255) NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ NULL
+);
+
+CREATE TABLE batch_leg (
+    id BIGSERIAL PRIMARY KEY,
+    batch_id BIGINT NOT NULL REFERENCES batch(id),
+    seq INT NOT NULL,
+    from_wallet_id BIGINT NOT NULL,
+    to_wallet_id BIGINT NOT NULL,
+    amount NUMERIC(20,8) NOT NULL CHECK (amount > 0),
+    fee NUMERIC(20,8) NOT NULL DEFAULT 0,
+    status VARCHAR(16) NOT NULL CHECK (status IN ('PENDING', 'SUCCEEDED', 'FAILED', 'SKIPPED')),
+    error VARCHAR(255) NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (batch_id, seq)
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS escrow_event;
+DROP TABLE IF EXISTS escrow;
@@ -0,0 +1,31 @@
+CREATE TABLE escrow (
+    id BIGSERIAL PRIMARY KEY,
+    idempotency_key VARCHAR(64) NOT NULL UNIQUE,
+    payer_wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    payee_wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    escrow_wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    amount NUMERIC(20,8) NOT NULL CHECK (amount > 0),
+    released NUMERIC(20,8) NOT NULL DEFAULT 0,
+    refunded NUMERIC(20,8) NOT NULL DEFAULT 0,
+    status VARCHAR(16) NOT NULL CHECK (status IN ('HELD', 'PARTIAL', 'RELEASED', 'REFUNDED', 'EXPIRED')),
+    condition VARCHAR(255) NULL,
+    expires_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (released + refunded <= amount)
+);
+
+CREATE INDEX idx_escrow_payer ON escrow(payer_wallet_id);
+CREATE INDEX idx_escrow_payee ON escrow(payee_wallet_id);
+CREATE INDEX idx_escrow_expires ON escrow(expires_at) WHERE status IN ('HELD', 'PARTIAL');
+
+CREATE TABLE escrow_event (
+    id BIGSERIAL PRIMARY KEY,
+    escrow_id BIGINT NOT NULL REFERENCES escrow(id),
+    action VARCHAR(16) NOT NULL,
+    amount NUMERIC(20,8) NOT NULL,
+    idempotency_key VARCHAR(64) NOT NULL,
+    note VARCHAR(255) NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (escrow_id, idempotency_key)
+);
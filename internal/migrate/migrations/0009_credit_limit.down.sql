@@ -0,0 +1,4 @@
+ALTER TABLE wallet
+    DROP CONSTRAINT IF EXISTS wallet_balance_check,
+    DROP COLUMN credit_limit,
+    ADD CONSTRAINT wallet_balance_check CHECK (balance >= 0);
@@ -0,0 +1,5 @@
+-- Wallets with an approved credit line may go negative down to -credit_limit.
+ALTER TABLE wallet
+    ADD COLUMN credit_limit NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (credit_limit >= 0),
+    DROP CONSTRAINT IF EXISTS wallet_balance_check,
+    ADD CONSTRAINT wallet_balance_check CHECK (balance >= -credit_limit);
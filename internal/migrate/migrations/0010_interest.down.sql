@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS interest_accrual;
+DROP TABLE IF EXISTS interest_posting;
+DROP INDEX IF EXISTS idx_wallet_rate_plan;
+ALTER TABLE wallet
+    DROP COLUMN interest_since,
+    DROP COLUMN rate_plan;
@@ -0,0 +1,34 @@
+ALTER TABLE wallet
+    ADD COLUMN rate_plan VARCHAR(32) NULL,
+    ADD COLUMN interest_since TIMESTAMPTZ NULL;
+
+CREATE INDEX idx_wallet_rate_plan ON wallet(rate_plan) WHERE rate_plan IS NOT NULL;
+
+CREATE TABLE interest_posting (
+    id BIGSERIAL PRIMARY KEY,
+    wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    period VARCHAR(10) NOT NULL,
+    house_wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    accrued NUMERIC(30,18) NOT NULL,
+    amount NUMERIC(20,8) NOT NULL CHECK (amount >= 0),
+    carry NUMERIC(30,18) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (wallet_id, period)
+);
+
+CREATE TABLE interest_accrual (
+    id BIGSERIAL PRIMARY KEY,
+    wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    day DATE NOT NULL,
+    period VARCHAR(10) NOT NULL,
+    plan VARCHAR(32) NOT NULL,
+    balance NUMERIC(20,8) NOT NULL,
+    rate NUMERIC(10,6) NOT NULL,
+    day_count VARCHAR(8) NOT NULL,
+    amount NUMERIC(30,18) NOT NULL CHECK (amount >= 0),
+    posting_id BIGINT NULL REFERENCES interest_posting(id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (wallet_id, day)
+);
+
+CREATE INDEX idx_interest_accrual_unposted ON interest_accrual(wallet_id, period) WHERE posting_id IS NULL;
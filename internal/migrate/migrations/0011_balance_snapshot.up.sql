@@ -0,0 +1,8 @@
+CREATE TABLE balance_snapshot (
+    wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    day DATE NOT NULL,
+    balance NUMERIC(20,8) NOT NULL,
+    last_transaction_id BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (wallet_id, day)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE wallet
+    DROP CONSTRAINT wallet_held_check,
+    DROP COLUMN pending_in,
+    DROP COLUMN held;
@@ -0,0 +1,5 @@
+-- held: reserved by operations in flight; pending_in: announced, unsettled credits.
+ALTER TABLE wallet
+    ADD COLUMN held NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (held >= 0),
+    ADD COLUMN pending_in NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (pending_in >= 0),
+    ADD CONSTRAINT wallet_held_check CHECK (balance - held >= -credit_limit);
@@ -0,0 +1,29 @@
+-- Archived months stay in their files; only live rows are moved back.
+DROP TABLE IF EXISTS transaction_archive;
+
+ALTER TABLE transaction RENAME TO transaction_partitioned;
+ALTER TABLE transaction_partitioned RENAME CONSTRAINT transaction_pkey TO transaction_partitioned_pkey;
+ALTER SEQUENCE transaction_id_seq OWNED BY NONE;
+
+CREATE TABLE transaction (
+    id BIGINT PRIMARY KEY DEFAULT nextval('transaction_id_seq'),
+    wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    type VARCHAR(32) NOT NULL,
+    amount NUMERIC(20,8) NOT NULL CHECK (amount > 0),
+    balance_before NUMERIC(20,8) NOT NULL,
+    balance_after NUMERIC(20,8) NOT NULL,
+    related_wallet_id BIGINT NULL REFERENCES wallet(id),
+    idempotency_key VARCHAR(64) NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER SEQUENCE transaction_id_seq OWNED BY transaction.id;
+
+INSERT INTO transaction (id, wallet_id, type, amount, balance_before, balance_after,
+                         related_wallet_id, idempotency_key, created_at)
+SELECT id, wallet_id, type, amount, balance_before, balance_after,
+       related_wallet_id, idempotency_key, created_at
+FROM transaction_partitioned;
+DROP TABLE transaction_partitioned;
+
+CREATE INDEX idx_transaction_wallet_created ON transaction(wallet_id, created_at, id);
+CREATE INDEX idx_transaction_wallet_type_created ON transaction(wallet_id, type, created_at, id);
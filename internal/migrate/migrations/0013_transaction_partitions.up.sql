@@ -0,0 +1,66 @@
+-- Range-partition the ledger by calendar month (UTC) on created_at. Existing
+-- rows are copied into monthly partitions; partitions for the coming months
+-- are created ahead of time by the scheduler, and transaction_default catches
+-- anything outside them so inserts never fail.
+ALTER TABLE transaction RENAME TO transaction_unpartitioned;
+ALTER TABLE transaction_unpartitioned RENAME CONSTRAINT transaction_pkey TO transaction_unpartitioned_pkey;
+ALTER SEQUENCE transaction_id_seq OWNED BY NONE;
+
+CREATE TABLE transaction (
+    id BIGINT NOT NULL DEFAULT nextval('transaction_id_seq'),
+    wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    type VARCHAR(32) NOT NULL,
+    amount NUMERIC(20,8) NOT NULL CHECK (amount > 0),
+    balance_before NUMERIC(20,8) NOT NULL,
+    balance_after NUMERIC(20,8) NOT NULL,
+    related_wallet_id BIGINT NULL REFERENCES wallet(id),
+    idempotency_key VARCHAR(64) NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
+ALTER SEQUENCE transaction_id_seq OWNED BY transaction.id;
+
+CREATE TABLE transaction_default PARTITION OF transaction DEFAULT;
+
+DO $$
+DECLARE
+    m DATE;
+BEGIN
+    FOR m IN
+        SELECT d::date FROM generate_series(
+            date_trunc('month', COALESCE((SELECT min(created_at) FROM transaction_unpartitioned), now()) AT TIME ZONE 'UTC'),
+            date_trunc('month', now() AT TIME ZONE 'UTC') + interval '3 months',
+            interval '1 month') AS d
+    LOOP
+        EXECUTE format('CREATE TABLE %I PARTITION OF transaction FOR VALUES FROM (%L) TO (%L)',
+            'transaction_p' || to_char(m, 'YYYY_MM'),
+            m::timestamp AT TIME ZONE 'UTC',
+            (m + interval '1 month')::timestamp AT TIME ZONE 'UTC');
+    END LOOP;
+END $$;
+
+INSERT INTO transaction (id, wallet_id, type, amount, balance_before, balance_after,
+                         related_wallet_id, idempotency_key, created_at)
+SELECT id, wallet_id, type, amount, balance_before, balance_after,
+       related_wallet_id, idempotency_key, created_at
+FROM transaction_unpartitioned;
+DROP TABLE transaction_unpartitioned;
+
+-- keyset pagination over (created_at, id) for history queries, on every partition
+CREATE INDEX idx_transaction_wallet_created ON transaction(wallet_id, created_at, id);
+CREATE INDEX idx_transaction_wallet_type_created ON transaction(wallet_id, type, created_at, id);
+
+-- Months moved out of the database. location is the file name in the archive
+-- directory; the file holds the month's rows as gzipped JSON lines ordered by
+-- (wallet_id, created_at, id).
+CREATE TABLE transaction_archive (
+    id BIGSERIAL PRIMARY KEY,
+    partition_name VARCHAR(64) NOT NULL UNIQUE,
+    range_from TIMESTAMPTZ NOT NULL,
+    range_to TIMESTAMPTZ NOT NULL,
+    location VARCHAR(255) NOT NULL,
+    row_count BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX idx_transaction_archive_range ON transaction_archive(range_from, range_to);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS transfer_saga;
+-- fails while ledger rows name wallets of other shards
+ALTER TABLE transaction ADD CONSTRAINT transaction_related_wallet_id_fkey
+    FOREIGN KEY (related_wallet_id) REFERENCES wallet(id);
+ALTER TABLE wallet DROP CONSTRAINT wallet_status_check;
+ALTER TABLE wallet ADD CONSTRAINT wallet_status_check
+    CHECK (status IN ('ACTIVE', 'FROZEN', 'DEBIT_BLOCKED', 'CREDIT_BLOCKED', 'CLOSED'));
+DROP TABLE IF EXISTS wallet_shard;
@@ -0,0 +1,40 @@
+-- Wallets can be spread over several databases (shards). Every shard runs the
+-- same migrations; the wallet_shard directory is only read on shard 0.
+CREATE TABLE wallet_shard (
+    wallet_id BIGSERIAL PRIMARY KEY,
+    shard_id INT NOT NULL CHECK (shard_id >= 0),
+    moving_to INT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+-- IDs handed out by the directory must not reuse those of existing wallets,
+-- which stay on shard 0 without a directory entry
+SELECT setval(pg_get_serial_sequence('wallet_shard', 'wallet_id'),
+              GREATEST((SELECT max(id) FROM wallet), 1));
+
+-- a wallet moved to another shard leaves a MOVED row behind
+ALTER TABLE wallet DROP CONSTRAINT wallet_status_check;
+ALTER TABLE wallet ADD CONSTRAINT wallet_status_check
+    CHECK (status IN ('ACTIVE', 'FROZEN', 'DEBIT_BLOCKED', 'CREDIT_BLOCKED', 'CLOSED', 'MOVED'));
+
+-- counterparties of a cross-shard transfer live in another database
+ALTER TABLE transaction DROP CONSTRAINT transaction_related_wallet_id_fkey;
+
+CREATE TABLE transfer_saga (
+    id BIGSERIAL PRIMARY KEY,
+    idempotency_key VARCHAR(64) NULL,
+    from_wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    to_wallet_id BIGINT NULL,
+    house_wallet_id BIGINT NULL,
+    currency VARCHAR(3) NOT NULL,
+    amount NUMERIC(20,8) NOT NULL CHECK (amount >= 0),
+    fee NUMERIC(20,8) NOT NULL DEFAULT 0,
+    state VARCHAR(16) NOT NULL CHECK (state IN ('DEBITED', 'CREDITED', 'COMPLETED', 'COMPENSATED')),
+    attempts INT NOT NULL DEFAULT 0,
+    last_error VARCHAR(255) NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX idx_transfer_saga_key ON transfer_saga(from_wallet_id, idempotency_key)
+    WHERE idempotency_key IS NOT NULL;
+CREATE INDEX idx_transfer_saga_open ON transfer_saga(updated_at) WHERE state IN ('DEBITED', 'CREDITED');
@@ -0,0 +1,25 @@
+CREATE TABLE withdrawal (
+    id BIGSERIAL PRIMARY KEY,
+    idempotency_key VARCHAR(64) NOT NULL,
+    wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    currency VARCHAR(3) NOT NULL,
+    amount NUMERIC(20,8) NOT NULL CHECK (amount > 0),
+    fee NUMERIC(20,8) NOT NULL DEFAULT 0 CHECK (fee >= 0),
+    house_wallet_id BIGINT NULL,
+    destination VARCHAR(255) NOT NULL,
+    provider VARCHAR(32) NOT NULL,
+    provider_ref VARCHAR(128) NULL,
+    status VARCHAR(16) NOT NULL CHECK (status IN ('PENDING', 'SUBMITTED', 'COMPLETED', 'FAILED')),
+    reason VARCHAR(255) NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    lease_until TIMESTAMPTZ NULL,
+    last_error VARCHAR(255) NULL,
+    settled_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (wallet_id, idempotency_key)
+);
+
+-- the executor's claim query
+CREATE INDEX idx_withdrawal_due ON withdrawal(next_attempt_at) WHERE status IN ('PENDING', 'SUBMITTED');
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS provider_webhook;
+DROP TABLE IF EXISTS provider_deposit;
@@ -0,0 +1,33 @@
+CREATE TABLE provider_deposit (
+    id BIGSERIAL PRIMARY KEY,
+    provider VARCHAR(32) NOT NULL,
+    reference VARCHAR(128) NOT NULL,
+    wallet_id BIGINT NOT NULL REFERENCES wallet(id),
+    currency VARCHAR(3) NOT NULL,
+    amount NUMERIC(20,8) NOT NULL CHECK (amount > 0),
+    status VARCHAR(16) NOT NULL CHECK (status IN ('PENDING', 'SETTLED', 'REVERSED')),
+    idempotency_key VARCHAR(64) NOT NULL,
+    settled_at TIMESTAMPTZ NULL,
+    reversed_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (provider, reference)
+);
+
+CREATE INDEX idx_provider_deposit_wallet_id ON provider_deposit(wallet_id);
+
+-- every signed webhook, verbatim, for audit
+CREATE TABLE provider_webhook (
+    id BIGSERIAL PRIMARY KEY,
+    provider VARCHAR(32) NOT NULL,
+    reference VARCHAR(128) NULL,
+    wallet_id BIGINT NOT NULL DEFAULT 0,
+    state VARCHAR(16) NULL,
+    payload TEXT NOT NULL,
+    outcome VARCHAR(16) NOT NULL,
+    error VARCHAR(255) NULL,
+    received_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_provider_webhook_ref ON provider_webhook(provider, reference);
+CREATE INDEX idx_provider_webhook_received_at ON provider_webhook(received_at);
@@ -0,0 +1,46 @@
+CREATE TABLE webhook_subscription (
+    id BIGSERIAL PRIMARY KEY,
+    url VARCHAR(512) NOT NULL,
+    event_types TEXT NOT NULL,
+    wallet_id BIGINT NULL,
+    secret VARCHAR(128) NOT NULL,
+    status VARCHAR(16) NOT NULL CHECK (status IN ('ACTIVE', 'DISABLED')),
+    failing_since TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE webhook_delivery (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id BIGINT NOT NULL REFERENCES webhook_subscription(id),
+    shard INT NOT NULL,
+    event_id BIGINT NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    aggregate VARCHAR(64) NOT NULL,
+    aggregate_id BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    status VARCHAR(16) NOT NULL CHECK (status IN ('PENDING', 'DELIVERED', 'FAILED')),
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    lease_until TIMESTAMPTZ NULL,
+    last_error VARCHAR(255) NULL,
+    delivered_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (subscription_id, shard, event_id)
+);
+
+-- the delivery worker's claim query
+CREATE INDEX idx_webhook_delivery_due ON webhook_delivery(next_attempt_at) WHERE status = 'PENDING';
+
+CREATE TABLE webhook_attempt (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id BIGINT NOT NULL REFERENCES webhook_delivery(id),
+    status_code INT NOT NULL DEFAULT 0,
+    error VARCHAR(255) NULL,
+    duration_ms BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_webhook_attempt_delivery_id ON webhook_attempt(delivery_id);
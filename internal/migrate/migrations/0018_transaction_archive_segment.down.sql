@@ -0,0 +1,3 @@
+-- Indexed archive files stay readable front to back without their segments.
+DROP TABLE IF EXISTS transaction_archive_segment;
+ALTER TABLE transaction_archive DROP COLUMN IF EXISTS indexed;
@@ -0,0 +1,13 @@
+-- Where each wallet's rows are in an archive file. Archives written from now
+-- on hold every wallet's rows as a gzip member of their own, so history reads
+-- decompress only the wallet's member instead of the whole month.
+ALTER TABLE transaction_archive ADD COLUMN indexed BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE transaction_archive_segment (
+    archive_id BIGINT NOT NULL REFERENCES transaction_archive(id),
+    wallet_id BIGINT NOT NULL,
+    start BIGINT NOT NULL,
+    size BIGINT NOT NULL,
+    PRIMARY KEY (archive_id, wallet_id)
+);
+CREATE INDEX idx_transaction_archive_segment_wallet ON transaction_archive_segment(wallet_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS batch_shard;
+DROP TABLE IF EXISTS escrow_shard;
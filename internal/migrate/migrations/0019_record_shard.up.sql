@@ -0,0 +1,16 @@
+-- Escrows and batches are stored on the shard of their wallets. Like wallets
+-- they get their IDs from a directory on shard 0, which says where each one
+-- is; those without an entry are on shard 0.
+CREATE TABLE escrow_shard (
+    id BIGSERIAL PRIMARY KEY,
+    shard_id INT NOT NULL CHECK (shard_id >= 0)
+);
+SELECT setval(pg_get_serial_sequence('escrow_shard', 'id'),
+              GREATEST((SELECT max(id) FROM escrow), 1));
+
+CREATE TABLE batch_shard (
+    id BIGSERIAL PRIMARY KEY,
+    shard_id INT NOT NULL CHECK (shard_id >= 0)
+);
+SELECT setval(pg_get_serial_sequence('batch_shard', 'id'),
+              GREATEST((SELECT max(id) FROM batch), 1));
@@ -0,0 +1,4 @@
+-- fails while schedules name recipients of other shards
+ALTER TABLE transfer_schedule ADD CONSTRAINT transfer_schedule_to_wallet_id_fkey
+    FOREIGN KEY (to_wallet_id) REFERENCES wallet(id);
+DROP TABLE IF EXISTS transfer_schedule_shard;
@@ -0,0 +1,11 @@
+-- Schedules are stored on the shard of the paying wallet and get their IDs
+-- from a directory on shard 0, like escrows and batches.
+CREATE TABLE transfer_schedule_shard (
+    id BIGSERIAL PRIMARY KEY,
+    shard_id INT NOT NULL CHECK (shard_id >= 0)
+);
+SELECT setval(pg_get_serial_sequence('transfer_schedule_shard', 'id'),
+              GREATEST((SELECT max(id) FROM transfer_schedule), 1));
+
+-- the recipient may live in another database
+ALTER TABLE transfer_schedule DROP CONSTRAINT IF EXISTS transfer_schedule_to_wallet_id_fkey;
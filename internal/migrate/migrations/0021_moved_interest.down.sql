@@ -0,0 +1,3 @@
+-- fails while postings name house wallets of other shards
+ALTER TABLE interest_posting ADD CONSTRAINT interest_posting_house_wallet_id_fkey
+    FOREIGN KEY (house_wallet_id) REFERENCES wallet(id);
@@ -0,0 +1,2 @@
+-- interest postings move with their wallet, away from the house wallet
+ALTER TABLE interest_posting DROP CONSTRAINT IF EXISTS interest_posting_house_wallet_id_fkey;
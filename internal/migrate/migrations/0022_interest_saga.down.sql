@@ -0,0 +1 @@
+ALTER TABLE transfer_saga DROP COLUMN IF EXISTS interest_period;
@@ -0,0 +1,2 @@
+-- interest paid by a house wallet on another shard goes through a saga
+ALTER TABLE transfer_saga ADD COLUMN interest_period VARCHAR(10) NULL;
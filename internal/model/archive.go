@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+// TransactionArchive records a month of ledger rows moved out of the database
+// into the archive. Location is the file name in the archive directory.
+// Indexed archives hold each wallet's rows in a gzip member of their own,
+// located by a TransactionArchiveSegment; older ones must be read through.
+type TransactionArchive struct {
+	ID            uint64    `gorm:"primaryKey" json:"id"`
+	PartitionName string    `gorm:"size:64;not null;uniqueIndex" json:"partition_name"`
+	RangeFrom     time.Time `gorm:"not null;index:idx_transaction_archive_range,priority:1" json:"range_from"`
+	RangeTo       time.Time `gorm:"not null;index:idx_transaction_archive_range,priority:2" json:"range_to"`
+	Location      string    `gorm:"size:255;not null" json:"location"`
+	RowCount      int64     `gorm:"not null" json:"row_count"`
+	SHA256        string    `gorm:"column:sha256;size:64;not null" json:"sha256"`
+	Indexed       bool      `gorm:"not null;default:false" json:"indexed"`
+	ArchivedAt    time.Time `gorm:"autoCreateTime" json:"archived_at"`
+}
+
+func (TransactionArchive) TableName() string { return "transaction_archive" }
+
+// TransactionArchiveSegment locates a wallet's rows in an indexed archive: the
+// gzip member of Size bytes at byte Start of the file.
+type TransactionArchiveSegment struct {
+	ArchiveID uint64 `gorm:"primaryKey;autoIncrement:false"`
+	WalletID  uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Start     int64  `gorm:"not null"`
+	Size      int64  `gorm:"not null"`
+}
+
+func (TransactionArchiveSegment) TableName() string { return "transaction_archive_segment" }
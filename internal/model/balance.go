@@ -0,0 +1,80 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/shopspring/decimal"
+)
+
+// Balance is the breakdown of a wallet's money. Ledger is the posted balance;
+// Held is reserved for operations in flight and PendingIn is announced but not
+// yet settled incoming money. Available = Ledger - Held + CreditLimit is what
+// the wallet can spend. Version is the wallet version it was read at.
+type Balance struct {
+	WalletID    uint64          `json:"wallet_id"`
+	Currency    string          `json:"currency"`
+	Ledger      decimal.Decimal `json:"ledger"`
+	Available   decimal.Decimal `json:"available"`
+	Held        decimal.Decimal `json:"held"`
+	PendingIn   decimal.Decimal `json:"pending_in"`
+	CreditLimit decimal.Decimal `json:"credit_limit"`
+	Version     uint64          `json:"version"`
+}
+
+// NewBalance returns the balance breakdown of w.
+func NewBalance(w *Wallet) Balance {
+	return Balance{
+		WalletID: w.ID, Currency: w.Currency, Ledger: w.Balance, Available: w.Available(),
+		Held: w.Held, PendingIn: w.PendingIn, CreditLimit: w.CreditLimit, Version: w.Version,
+	}
+}
+
+// MarshalJSON adds "balance", the ledger balance under the name it had
+// before the breakdown, for clients that still read it.
+func (b Balance) MarshalJSON() ([]byte, error) {
+	type plain Balance
+	return json.Marshal(struct {
+		plain
+		Balance decimal.Decimal `json:"balance"`
+	}{plain(b), b.Ledger})
+}
+
+// Fields returns b as a flat string map, e.g. for a Redis hash.
+func (b Balance) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"currency":     b.Currency,
+		"ledger":       b.Ledger.String(),
+		"available":    b.Available.String(),
+		"held":         b.Held.String(),
+		"pending_in":   b.PendingIn.String(),
+		"credit_limit": b.CreditLimit.String(),
+		"version":      strconv.FormatUint(b.Version, 10),
+	}
+}
+
+// ParseBalance is the inverse of Fields. Every field must be present.
+func ParseBalance(walletID uint64, fields map[string]string) (*Balance, error) {
+	b := &Balance{WalletID: walletID, Currency: fields["currency"]}
+	for name, dst := range map[string]*decimal.Decimal{
+		"ledger": &b.Ledger, "available": &b.Available, "held": &b.Held,
+		"pending_in": &b.PendingIn, "credit_limit": &b.CreditLimit,
+	} {
+		v, ok := fields[name]
+		if !ok {
+			return nil, fmt.Errorf("balance field %s missing", name)
+		}
+		d, err := decimal.NewFromString(v)
+		if err != nil {
+			return nil, fmt.Errorf("balance field %s: %w", name, err)
+		}
+		*dst = d
+	}
+	v, err := strconv.ParseUint(fields["version"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("balance field version: %w", err)
+	}
+	b.Version = v
+	return b, nil
+}
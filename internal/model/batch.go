@@ -0,0 +1,66 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Batch modes: ATOMIC posts every leg or none in one DB transaction,
+// BEST_EFFORT posts each leg on its own and reports per-leg results.
+const (
+	BatchAtomic     = "ATOMIC"
+	BatchBestEffort = "BEST_EFFORT"
+)
+
+// Batch statuses.
+const (
+	BatchProcessing = "PROCESSING"
+	BatchCompleted  = "COMPLETED"
+	BatchPartial    = "PARTIAL"
+	BatchFailed     = "FAILED"
+)
+
+// Batch leg statuses. SKIPPED legs were not posted because another leg of an
+// ATOMIC batch failed.
+const (
+	LegPending   = "PENDING"
+	LegSucceeded = "SUCCEEDED"
+	LegFailed    = "FAILED"
+	LegSkipped   = "SKIPPED"
+)
+
+// Batch is a set of transfers submitted together, e.g. a payroll run.
+type Batch struct {
+	ID             uint64          `gorm:"primaryKey" json:"id"`
+	IdempotencyKey string          `gorm:"size:64;not null;uniqueIndex" json:"idempotency_key"`
+	Mode           string          `gorm:"size:16;not null" json:"mode"`
+	Status         string          `gorm:"size:16;not null" json:"status"`
+	LegCount       int             `gorm:"not null" json:"leg_count"`
+	Succeeded      int             `gorm:"not null;default:0" json:"succeeded"`
+	Failed         int             `gorm:"not null;default:0" json:"failed"`
+	TotalAmount    decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"total_amount"`
+	Error          string          `gorm:"size:255" json:"error,omitempty"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	CompletedAt    *time.Time      `json:"completed_at,omitempty"`
+	Legs           []BatchLeg      `gorm:"foreignKey:BatchID" json:"legs,omitempty"`
+}
+
+func (Batch) TableName() string { return "batch" }
+
+// BatchLeg is one transfer of a batch. Its ledger rows carry the idempotency
+// key "batch:<batch id>:<seq>".
+type BatchLeg struct {
+	ID           uint64          `gorm:"primaryKey" json:"-"`
+	BatchID      uint64          `gorm:"not null;uniqueIndex:idx_batch_leg_seq,priority:1" json:"-"`
+	Seq          int             `gorm:"not null;uniqueIndex:idx_batch_leg_seq,priority:2" json:"seq"`
+	FromWalletID uint64          `gorm:"not null" json:"from_id"`
+	ToWalletID   uint64          `gorm:"not null" json:"to_id"`
+	Amount       decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"amount"`
+	Fee          decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"fee"`
+	Status       string          `gorm:"size:16;not null" json:"status"`
+	Error        string          `gorm:"size:255" json:"error,omitempty"`
+	UpdatedAt    time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (BatchLeg) TableName() string { return "batch_leg" }
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Provider deposit statuses, in the order a deposit can go through them.
+// PENDING deposits count in the wallet's PendingIn, SETTLED ones have been
+// credited and REVERSED ones taken back, or never credited.
+const (
+	ProviderDepositPending  = "PENDING"
+	ProviderDepositSettled  = "SETTLED"
+	ProviderDepositReversed = "REVERSED"
+)
+
+// ProviderDeposit is a payment an external provider reported for a wallet,
+// known by the provider's Reference. It lives on the wallet's shard; the
+// ledger rows it posts carry IdempotencyKey.
+type ProviderDeposit struct {
+	ID             uint64          `gorm:"primaryKey" json:"id"`
+	Provider       string          `gorm:"size:32;not null;uniqueIndex:idx_provider_deposit_ref,priority:1" json:"provider"`
+	Reference      string          `gorm:"size:128;not null;uniqueIndex:idx_provider_deposit_ref,priority:2" json:"reference"`
+	WalletID       uint64          `gorm:"not null;index" json:"wallet_id"`
+	Currency       string          `gorm:"size:3;not null" json:"currency"`
+	Amount         decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"amount"`
+	Status         string          `gorm:"size:16;not null" json:"status"`
+	IdempotencyKey string          `gorm:"size:64;not null" json:"-"`
+	SettledAt      *time.Time      `json:"settled_at,omitempty"`
+	ReversedAt     *time.Time      `json:"reversed_at,omitempty"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (ProviderDeposit) TableName() string { return "provider_deposit" }
+
+// Outcomes of a provider webhook. DUPLICATE ones repeat the deposit's
+// status and STALE ones report a status it has already moved past; neither
+// changes anything. INVALID ones can't be read and FAILED ones could not be
+// applied, so the provider should send them again.
+const (
+	WebhookReceived  = "RECEIVED"
+	WebhookApplied   = "APPLIED"
+	WebhookDuplicate = "DUPLICATE"
+	WebhookStale     = "STALE"
+	WebhookInvalid   = "INVALID"
+	WebhookFailed    = "FAILED"
+)
+
+// ProviderWebhook is the audit record of one signed webhook a provider sent,
+// kept verbatim with what became of it. All of them are on shard 0.
+type ProviderWebhook struct {
+	ID         uint64    `gorm:"primaryKey"`
+	Provider   string    `gorm:"size:32;not null;index:idx_provider_webhook_ref,priority:1"`
+	Reference  string    `gorm:"size:128;index:idx_provider_webhook_ref,priority:2"`
+	WalletID   uint64    `gorm:"not null;default:0"`
+	State      string    `gorm:"size:16"`
+	Payload    string    `gorm:"type:text;not null"`
+	Outcome    string    `gorm:"size:16;not null"`
+	Error      string    `gorm:"size:255"`
+	ReceivedAt time.Time `gorm:"not null;index"`
+}
+
+func (ProviderWebhook) TableName() string { return "provider_webhook" }
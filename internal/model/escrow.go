@@ -0,0 +1,65 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Escrow statuses. HELD and PARTIAL escrows still hold funds; the others are final.
+const (
+	EscrowHeld     = "HELD"
+	EscrowPartial  = "PARTIAL"
+	EscrowReleased = "RELEASED"
+	EscrowRefunded = "REFUNDED"
+	EscrowExpired  = "EXPIRED"
+)
+
+// Escrow actions recorded in escrow_event.
+const (
+	EscrowActionHold    = "HOLD"
+	EscrowActionRelease = "RELEASE"
+	EscrowActionRefund  = "REFUND"
+	EscrowActionExpire  = "EXPIRE"
+)
+
+// Escrow parks Amount taken from the payer in a system escrow wallet until it
+// is released to the payee or refunded, in one go or in parts. Whatever is
+// still held at ExpiresAt goes back to the payer.
+type Escrow struct {
+	ID             uint64          `gorm:"primaryKey" json:"id"`
+	IdempotencyKey string          `gorm:"size:64;not null;uniqueIndex" json:"idempotency_key"`
+	PayerWalletID  uint64          `gorm:"not null;index" json:"payer_id"`
+	PayeeWalletID  uint64          `gorm:"not null;index" json:"payee_id"`
+	EscrowWalletID uint64          `gorm:"not null" json:"escrow_wallet_id"`
+	Amount         decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"amount"`
+	Released       decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"released"`
+	Refunded       decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"refunded"`
+	Status         string          `gorm:"size:16;not null" json:"status"`
+	Condition      string          `gorm:"size:255" json:"condition,omitempty"`
+	ExpiresAt      *time.Time      `gorm:"index" json:"expires_at,omitempty"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+	Events         []EscrowEvent   `gorm:"foreignKey:EscrowID" json:"events,omitempty"`
+}
+
+func (Escrow) TableName() string { return "escrow" }
+
+// Remaining is what the escrow still holds.
+func (e *Escrow) Remaining() decimal.Decimal {
+	return e.Amount.Sub(e.Released).Sub(e.Refunded)
+}
+
+// EscrowEvent is the audit trail of an escrow: one row per action, unique per
+// idempotency key so a retried action is applied once.
+type EscrowEvent struct {
+	ID             uint64          `gorm:"primaryKey" json:"id"`
+	EscrowID       uint64          `gorm:"not null;uniqueIndex:idx_escrow_event_key,priority:1" json:"-"`
+	Action         string          `gorm:"size:16;not null" json:"action"`
+	Amount         decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"amount"`
+	IdempotencyKey string          `gorm:"size:64;not null;uniqueIndex:idx_escrow_event_key,priority:2" json:"idempotency_key"`
+	Note           string          `gorm:"size:255" json:"note,omitempty"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (EscrowEvent) TableName() string { return "escrow_event" }
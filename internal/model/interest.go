@@ -0,0 +1,41 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// InterestAccrual is the interest earned by a wallet on one day, kept at full
+// precision until it is paid out by an InterestPosting for its Period.
+type InterestAccrual struct {
+	ID        uint64          `gorm:"primaryKey" json:"id"`
+	WalletID  uint64          `gorm:"not null;uniqueIndex:idx_interest_accrual_day,priority:1;index:idx_interest_accrual_period,priority:1" json:"wallet_id"`
+	Day       time.Time       `gorm:"type:date;not null;uniqueIndex:idx_interest_accrual_day,priority:2" json:"day"`
+	Period    string          `gorm:"size:10;not null;index:idx_interest_accrual_period,priority:2" json:"period"`
+	Plan      string          `gorm:"size:32;not null" json:"plan"`
+	Balance   decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"balance"`
+	Rate      decimal.Decimal `gorm:"type:numeric(10,6);not null" json:"rate"`
+	DayCount  string          `gorm:"size:8;not null" json:"day_count"`
+	Amount    decimal.Decimal `gorm:"type:numeric(30,18);not null" json:"amount"`
+	PostingID *uint64         `json:"posting_id,omitempty"`
+	CreatedAt time.Time       `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (InterestAccrual) TableName() string { return "interest_accrual" }
+
+// InterestPosting pays a wallet the interest accrued over one period. Amount
+// is the accrued total plus the previous posting's Carry, rounded down to the
+// ledger's precision; what was rounded off is carried to the next posting.
+type InterestPosting struct {
+	ID            uint64          `gorm:"primaryKey" json:"id"`
+	WalletID      uint64          `gorm:"not null;uniqueIndex:idx_interest_posting_period,priority:1" json:"wallet_id"`
+	Period        string          `gorm:"size:10;not null;uniqueIndex:idx_interest_posting_period,priority:2" json:"period"`
+	HouseWalletID uint64          `gorm:"not null" json:"house_wallet_id"`
+	Accrued       decimal.Decimal `gorm:"type:numeric(30,18);not null" json:"accrued"`
+	Amount        decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"amount"`
+	Carry         decimal.Decimal `gorm:"type:numeric(30,18);not null" json:"carry"`
+	CreatedAt     time.Time       `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (InterestPosting) TableName() string { return "interest_posting" }
@@ -0,0 +1,27 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// LimitProfile is a tier of transaction limits assignable to wallets.
+// Zero values mean "no limit". Daily/monthly windows are rolling 24h/30d.
+type LimitProfile struct {
+	ID              uint64          `gorm:"primaryKey" json:"id"`
+	Name            string          `gorm:"size:64;not null;uniqueIndex" json:"name"`
+	PerTxMax        decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"per_tx_max"`
+	DailyWithdraw   decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"daily_withdraw"`
+	MonthlyWithdraw decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"monthly_withdraw"`
+	DailyTransfer   decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"daily_transfer"`
+	MonthlyTransfer decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"monthly_transfer"`
+	HourlyCount     int             `gorm:"not null;default:0" json:"hourly_count"`
+	CreatedAt       time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt       time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (LimitProfile) TableName() string { return "limit_profile" }
+
+// DefaultLimitProfile is applied to wallets without an explicit profile, if it exists.
+const DefaultLimitProfile = "default"
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Schedule recurrences.
+const (
+	RecurOnce    = "ONCE"
+	RecurDaily   = "DAILY"
+	RecurWeekly  = "WEEKLY"
+	RecurMonthly = "MONTHLY"
+)
+
+// Schedule statuses. Only ACTIVE schedules are picked up by the scheduler.
+const (
+	ScheduleActive    = "ACTIVE"
+	SchedulePaused    = "PAUSED"
+	ScheduleCompleted = "COMPLETED"
+	ScheduleCancelled = "CANCELLED"
+)
+
+// Schedule run outcomes.
+const (
+	RunSucceeded = "SUCCEEDED"
+	RunRetrying  = "RETRYING"
+	RunFailed    = "FAILED"
+)
+
+// TransferSchedule is a future-dated or recurring transfer (standing order).
+// Occurrence is the number of the next occurrence, due at NextRunAt; it is
+// attempted at NextAttemptAt, which moves forward on retries.
+type TransferSchedule struct {
+	ID            uint64          `gorm:"primaryKey" json:"id"`
+	WalletID      uint64          `gorm:"not null;index" json:"wallet_id"`
+	ToWalletID    uint64          `gorm:"not null" json:"to_wallet_id"`
+	Amount        decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"amount"`
+	Recurrence    string          `gorm:"size:16;not null" json:"recurrence"`
+	StartAt       time.Time       `gorm:"not null" json:"start_at"`
+	EndAt         *time.Time      `json:"end_at,omitempty"`
+	Status        string          `gorm:"size:16;not null;default:'ACTIVE'" json:"status"`
+	Occurrence    int64           `gorm:"not null;default:0" json:"occurrence"`
+	NextRunAt     time.Time       `gorm:"not null" json:"next_run_at"`
+	Attempts      int             `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt time.Time       `gorm:"not null;index" json:"next_attempt_at"`
+	LeaseUntil    *time.Time      `json:"-"`
+	LastError     string          `gorm:"size:255" json:"last_error,omitempty"`
+	CreatedAt     time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt     time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (TransferSchedule) TableName() string { return "transfer_schedule" }
+
+// TransferScheduleRun records one attempt at one occurrence of a schedule.
+type TransferScheduleRun struct {
+	ID             uint64    `gorm:"primaryKey" json:"id"`
+	ScheduleID     uint64    `gorm:"not null;index" json:"schedule_id"`
+	Occurrence     int64     `gorm:"not null" json:"occurrence"`
+	ScheduledFor   time.Time `gorm:"not null" json:"scheduled_for"`
+	Attempt        int       `gorm:"not null" json:"attempt"`
+	Status         string    `gorm:"size:16;not null" json:"status"`
+	Error          string    `gorm:"size:255" json:"error,omitempty"`
+	IdempotencyKey string    `gorm:"size:64;not null" json:"idempotency_key"`
+	CreatedAt      time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (TransferScheduleRun) TableName() string { return "transfer_schedule_run" }
@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// RuntimeSetting overrides one config field at runtime; Key is the dotted yaml path.
+type RuntimeSetting struct {
+	Key       string    `gorm:"primaryKey;size:128"`
+	Value     string    `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+func (RuntimeSetting) TableName() string { return "runtime_setting" }
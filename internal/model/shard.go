@@ -0,0 +1,61 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// WalletShard is a wallet's entry in the shard directory, which lives on
+// shard 0. MovingTo is set while the wallet is being moved to another shard.
+type WalletShard struct {
+	WalletID  uint64    `gorm:"primaryKey" json:"wallet_id"`
+	ShardID   int       `gorm:"not null" json:"shard_id"`
+	MovingTo  *int      `json:"moving_to,omitempty"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (WalletShard) TableName() string { return "wallet_shard" }
+
+// RecordShard is an entry in the directory of escrows, batches or schedules,
+// which live on the shard of their wallets but are looked up by their own ID.
+// Like the wallet directory it lives on shard 0, in a table per kind of
+// record.
+type RecordShard struct {
+	ID      uint64 `gorm:"primaryKey" json:"id"`
+	ShardID int    `gorm:"not null" json:"shard_id"`
+}
+
+// Transfer saga states. DEBITED sagas still owe the recipient, CREDITED ones
+// only the fee house; COMPLETED and COMPENSATED are final.
+const (
+	SagaDebited     = "DEBITED"
+	SagaCredited    = "CREDITED"
+	SagaCompleted   = "COMPLETED"
+	SagaCompensated = "COMPENSATED"
+)
+
+// TransferSaga tracks the credits a debit owes to wallets on other shards: the
+// recipient (ToWalletID) and the fee house (HouseWalletID), each unset when it
+// was posted with the debit. It lives on the payer's shard and is written in
+// the debit's transaction; if the recipient refuses the credit the debit is
+// refunded and the saga COMPENSATED. A saga with an InterestPeriod pays that
+// period's interest from a house wallet to a wallet on another shard.
+type TransferSaga struct {
+	ID             uint64          `gorm:"primaryKey" json:"id"`
+	IdempotencyKey *string         `gorm:"size:64;uniqueIndex:idx_transfer_saga_key,priority:2" json:"idempotency_key,omitempty"`
+	FromWalletID   uint64          `gorm:"not null;uniqueIndex:idx_transfer_saga_key,priority:1" json:"from"`
+	ToWalletID     *uint64         `json:"to,omitempty"`
+	HouseWalletID  *uint64         `json:"house,omitempty"`
+	Currency       string          `gorm:"size:3;not null" json:"currency"`
+	Amount         decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"amount"`
+	Fee            decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"fee"`
+	State          string          `gorm:"size:16;not null;index" json:"state"`
+	Attempts       int             `gorm:"not null;default:0" json:"attempts"`
+	LastError      string          `gorm:"size:255" json:"last_error,omitempty"`
+	InterestPeriod *string         `gorm:"size:10" json:"interest_period,omitempty"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (TransferSaga) TableName() string { return "transfer_saga" }
@@ -0,0 +1,19 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// BalanceSnapshot is a wallet's balance at the end of Day (UTC), so that
+// point-in-time lookups only read the ledger from the snapshot onwards.
+type BalanceSnapshot struct {
+	WalletID          uint64          `gorm:"primaryKey;autoIncrement:false" json:"wallet_id"`
+	Day               time.Time       `gorm:"primaryKey;type:date" json:"day"`
+	Balance           decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"balance"`
+	LastTransactionID uint64          `gorm:"not null;default:0" json:"last_transaction_id"`
+	CreatedAt         time.Time       `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (BalanceSnapshot) TableName() string { return "balance_snapshot" }
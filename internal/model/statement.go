@@ -0,0 +1,32 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Statement summarises a wallet's activity over [From, To). It is computed, not stored.
+type Statement struct {
+	WalletID       uint64                     `json:"wallet_id"`
+	From           time.Time                  `json:"from"`
+	To             time.Time                  `json:"to"`
+	OpeningBalance decimal.Decimal            `json:"opening_balance"`
+	ClosingBalance decimal.Decimal            `json:"closing_balance"`
+	TotalCredits   decimal.Decimal            `json:"total_credits"`
+	TotalDebits    decimal.Decimal            `json:"total_debits"`
+	TotalsByType   map[string]decimal.Decimal `json:"totals_by_type"`
+	Lines          []StatementLine            `json:"lines"`
+	GeneratedAt    time.Time                  `json:"generated_at"`
+}
+
+// StatementLine is one transaction on a statement. Amount is signed
+// (negative for debits) and Balance is the running balance after it.
+type StatementLine struct {
+	TransactionID   uint64          `json:"transaction_id"`
+	Time            time.Time       `json:"time"`
+	Type            string          `json:"type"`
+	Amount          decimal.Decimal `json:"amount"`
+	Balance         decimal.Decimal `json:"balance"`
+	RelatedWalletID *uint64         `json:"related_wallet_id,omitempty"`
+}
@@ -7,15 +7,15 @@ import (
 )
 
 type Transaction struct {
-	ID              uint64          `gorm:"primaryKey"`
-	WalletID        uint64          `gorm:"not null"`
-	Type            string          `gorm:"size:32;not null"`
+	ID              uint64          `gorm:"primaryKey;index:idx_transaction_wallet_created,priority:3;index:idx_transaction_wallet_type_created,priority:4"`
+	WalletID        uint64          `gorm:"not null;index:idx_transaction_wallet_created,priority:1;index:idx_transaction_wallet_type_created,priority:1"`
+	Type            string          `gorm:"size:32;not null;index:idx_transaction_wallet_type_created,priority:2"`
 	Amount          decimal.Decimal `gorm:"type:numeric(20,8);not null"`
 	BalanceBefore   decimal.Decimal `gorm:"type:numeric(20,8);not null"`
 	BalanceAfter    decimal.Decimal `gorm:"type:numeric(20,8);not null"`
 	RelatedWalletID *uint64
 	IdempotencyKey  *string   `gorm:"size:64"`
-	CreatedAt       time.Time `gorm:"autoCreateTime"`
+	CreatedAt       time.Time `gorm:"autoCreateTime;index:idx_transaction_wallet_created,priority:2;index:idx_transaction_wallet_type_created,priority:3"`
 }
 
 func (Transaction) TableName() string { return "transaction" }
@@ -6,11 +6,48 @@ import (
 	"github.com/shopspring/decimal"
 )
 
+// Wallet statuses. Debits are allowed in ACTIVE and CREDIT_BLOCKED, credits in
+// ACTIVE and DEBIT_BLOCKED; FROZEN blocks both and CLOSED is terminal. MOVED
+// marks the row a wallet leaves behind on its old shard; it can't be set.
+const (
+	WalletActive        = "ACTIVE"
+	WalletFrozen        = "FROZEN"
+	WalletDebitBlocked  = "DEBIT_BLOCKED"
+	WalletCreditBlocked = "CREDIT_BLOCKED"
+	WalletClosed        = "CLOSED"
+	WalletMoved         = "MOVED"
+)
+
+// DefaultCurrency is assigned to wallets created without an explicit currency.
+const DefaultCurrency = "USD"
+
 type Wallet struct {
-	ID        uint64          `gorm:"primaryKey;column:id"`
-	Balance   decimal.Decimal `gorm:"type:numeric(20,8);not null;default:'0'"`
-	Version   uint64          `gorm:"not null;default:0"`
-	UpdatedAt time.Time       `gorm:"autoUpdateTime"`
+	ID             uint64          `gorm:"primaryKey;column:id"`
+	Balance        decimal.Decimal `gorm:"type:numeric(20,8);not null;default:'0'"`
+	CreditLimit    decimal.Decimal `gorm:"type:numeric(20,8);not null;default:'0'"`
+	Held           decimal.Decimal `gorm:"type:numeric(20,8);not null;default:'0'"`
+	PendingIn      decimal.Decimal `gorm:"type:numeric(20,8);not null;default:'0'"`
+	Status         string          `gorm:"size:16;not null;default:'ACTIVE'"`
+	Currency       string          `gorm:"size:3;not null;default:'USD'"`
+	LimitProfileID *uint64
+	RatePlan       *string `gorm:"size:32"`
+	InterestSince  *time.Time
+	Version        uint64    `gorm:"not null;default:0"`
+	CreatedAt      time.Time `gorm:"autoCreateTime"`
+	UpdatedAt      time.Time `gorm:"autoUpdateTime"`
 }
 
 func (Wallet) TableName() string { return "wallet" }
+
+// Available is what the wallet can spend: its balance less holds, plus its
+// credit limit.
+func (w *Wallet) Available() decimal.Decimal { return w.Balance.Sub(w.Held).Add(w.CreditLimit) }
+
+// ValidWalletStatus reports whether s is a known wallet status.
+func ValidWalletStatus(s string) bool {
+	switch s {
+	case WalletActive, WalletFrozen, WalletDebitBlocked, WalletCreditBlocked, WalletClosed:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package model
+
+import "time"
+
+// Webhook subscription statuses. DISABLED subscriptions get no new deliveries
+// and their pending ones wait until they are enabled again.
+const (
+	SubscriptionActive   = "ACTIVE"
+	SubscriptionDisabled = "DISABLED"
+)
+
+// WebhookSubscription asks for wallet events to be POSTed to URL, signed with
+// Secret. EventTypes and WalletID narrow the events down; empty and nil match
+// all. FailingSince is when deliveries to it started failing, nil while they
+// succeed.
+type WebhookSubscription struct {
+	ID           uint64     `gorm:"primaryKey" json:"id"`
+	URL          string     `gorm:"size:512;not null" json:"url"`
+	EventTypes   []string   `gorm:"serializer:json;type:text;not null" json:"event_types"`
+	WalletID     *uint64    `json:"wallet_id,omitempty"`
+	Secret       string     `gorm:"size:128;not null" json:"-"`
+	Status       string     `gorm:"size:16;not null" json:"status"`
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt    time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (WebhookSubscription) TableName() string { return "webhook_subscription" }
+
+// Matches reports whether evt is one the subscription asked for.
+func (w *WebhookSubscription) Matches(evt *OutboxEvent) bool {
+	if w.WalletID != nil && (evt.Aggregate != "Wallet" || evt.AggregateID != *w.WalletID) {
+		return false
+	}
+	if len(w.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range w.EventTypes {
+		if t == evt.EventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook delivery statuses. DELIVERED and FAILED are final.
+const (
+	DeliveryPending   = "PENDING"
+	DeliveryDelivered = "DELIVERED"
+	DeliveryFailed    = "FAILED"
+)
+
+// WebhookDelivery is one outbox event on its way to one subscription; the
+// event is known by its shard and ID there. Attempts counts the requests
+// made, each logged in Log.
+type WebhookDelivery struct {
+	ID             uint64           `gorm:"primaryKey" json:"id"`
+	SubscriptionID uint64           `gorm:"not null;uniqueIndex:idx_webhook_delivery_event,priority:1" json:"subscription_id"`
+	Shard          int              `gorm:"not null;uniqueIndex:idx_webhook_delivery_event,priority:2" json:"shard"`
+	EventID        uint64           `gorm:"not null;uniqueIndex:idx_webhook_delivery_event,priority:3" json:"event_id"`
+	EventType      string           `gorm:"size:64;not null" json:"event_type"`
+	Aggregate      string           `gorm:"size:64;not null" json:"aggregate"`
+	AggregateID    uint64           `gorm:"not null" json:"aggregate_id"`
+	Payload        string           `gorm:"type:text;not null" json:"payload"`
+	OccurredAt     time.Time        `gorm:"not null" json:"occurred_at"`
+	Status         string           `gorm:"size:16;not null" json:"status"`
+	Attempts       int              `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  time.Time        `gorm:"not null;index" json:"next_attempt_at"`
+	LeaseUntil     *time.Time       `json:"-"`
+	LastError      string           `gorm:"size:255" json:"last_error,omitempty"`
+	DeliveredAt    *time.Time       `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time        `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time        `gorm:"autoUpdateTime" json:"updated_at"`
+	Log            []WebhookAttempt `gorm:"foreignKey:DeliveryID" json:"log,omitempty"`
+}
+
+func (WebhookDelivery) TableName() string { return "webhook_delivery" }
+
+// WebhookAttempt is one request made for a delivery. StatusCode is zero when
+// no response came back.
+type WebhookAttempt struct {
+	ID         uint64    `gorm:"primaryKey" json:"id"`
+	DeliveryID uint64    `gorm:"not null;index" json:"delivery_id"`
+	StatusCode int       `gorm:"not null;default:0" json:"status_code"`
+	Error      string    `gorm:"size:255" json:"error,omitempty"`
+	DurationMS int64     `gorm:"not null;default:0" json:"duration_ms"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (WebhookAttempt) TableName() string { return "webhook_attempt" }
@@ -0,0 +1,46 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Withdrawal statuses. PENDING and SUBMITTED withdrawals hold their funds;
+// COMPLETED and FAILED are final.
+const (
+	WithdrawalPending   = "PENDING"
+	WithdrawalSubmitted = "SUBMITTED"
+	WithdrawalCompleted = "COMPLETED"
+	WithdrawalFailed    = "FAILED"
+)
+
+// Withdrawal pays Amount out to an external Destination through a settlement
+// provider. Amount plus Fee are held on the wallet until the provider reports
+// the payout COMPLETED, when they are debited, or FAILED, when the hold is
+// released. PENDING withdrawals have not been accepted by the provider yet,
+// SUBMITTED ones have. The executor next looks at it at NextAttemptAt; Attempts
+// counts the provider calls that failed since the last one that didn't.
+type Withdrawal struct {
+	ID             uint64          `gorm:"primaryKey" json:"id"`
+	IdempotencyKey string          `gorm:"size:64;not null;uniqueIndex:idx_withdrawal_key,priority:2" json:"idempotency_key"`
+	WalletID       uint64          `gorm:"not null;uniqueIndex:idx_withdrawal_key,priority:1" json:"wallet_id"`
+	Currency       string          `gorm:"size:3;not null" json:"currency"`
+	Amount         decimal.Decimal `gorm:"type:numeric(20,8);not null" json:"amount"`
+	Fee            decimal.Decimal `gorm:"type:numeric(20,8);not null;default:0" json:"fee"`
+	HouseWalletID  *uint64         `json:"-"`
+	Destination    string          `gorm:"size:255;not null" json:"destination"`
+	Provider       string          `gorm:"size:32;not null" json:"provider"`
+	ProviderRef    string          `gorm:"size:128" json:"provider_ref,omitempty"`
+	Status         string          `gorm:"size:16;not null" json:"status"`
+	Reason         string          `gorm:"size:255" json:"reason,omitempty"`
+	Attempts       int             `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  time.Time       `gorm:"not null;index" json:"next_attempt_at"`
+	LeaseUntil     *time.Time      `json:"-"`
+	LastError      string          `gorm:"size:255" json:"last_error,omitempty"`
+	SettledAt      *time.Time      `json:"settled_at,omitempty"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (Withdrawal) TableName() string { return "withdrawal" }
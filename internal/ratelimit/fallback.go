@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Fallback uses the primary limiter (Redis) and switches to the secondary
+// (in-process) limiter when the primary errors. After a failure the primary is
+// skipped for cooldown so requests don't each pay a network timeout.
+type Fallback struct {
+	primary   Limiter
+	secondary Limiter
+	cooldown  time.Duration
+	downUntil atomic.Int64
+	log       *zap.SugaredLogger
+}
+
+// NewFallback returns a Fallback limiter.
+func NewFallback(primary, secondary Limiter, cooldown time.Duration, log *zap.SugaredLogger) *Fallback {
+	return &Fallback{primary: primary, secondary: secondary, cooldown: cooldown, log: log}
+}
+
+// Allow implements Limiter.
+func (f *Fallback) Allow(ctx context.Context, key string, q Quota) (Result, error) {
+	now := time.Now()
+	if now.UnixNano() >= f.downUntil.Load() {
+		res, err := f.primary.Allow(ctx, key, q)
+		if err == nil {
+			return res, nil
+		}
+		f.downUntil.Store(now.Add(f.cooldown).UnixNano())
+		f.log.Warnf("ratelimit: primary limiter failed, using local fallback for %s: %v", f.cooldown, err)
+	}
+	return f.secondary.Allow(ctx, key, q)
+}
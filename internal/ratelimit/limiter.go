@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Quota describes how many requests a key may make per period, with a burst allowance.
+type Quota struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// Enabled reports whether the quota should be enforced.
+func (q Quota) Enabled() bool { return q.Rate > 0 && q.Period > 0 }
+
+// emission is the GCRA emission interval: the time one request "costs".
+func (q Quota) emission() time.Duration { return q.Period / time.Duration(q.Rate) }
+
+func (q Quota) burst() int {
+	if q.Burst < 1 {
+		return 1
+	}
+	return q.Burst
+}
+
+// Result is the outcome of a single Allow call.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // how long until the next request would be allowed (0 if allowed)
+	ResetAfter time.Duration // how long until the key is back to its full burst
+}
+
+// Limiter decides whether a request identified by key fits in its quota.
+type Limiter interface {
+	Allow(ctx context.Context, key string, q Quota) (Result, error)
+}
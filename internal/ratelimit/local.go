@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type localEntry struct {
+	lim      *rate.Limiter
+	quota    Quota
+	lastSeen time.Time
+}
+
+// LocalLimiter is an in-process token bucket limiter. Keys that have been idle
+// for longer than idleTTL are evicted so memory stays bounded.
+type LocalLimiter struct {
+	mu        sync.Mutex
+	entries   map[string]*localEntry
+	idleTTL   time.Duration
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewLocalLimiter returns a LocalLimiter evicting keys idle for idleTTL.
+func NewLocalLimiter(idleTTL time.Duration) *LocalLimiter {
+	return &LocalLimiter{
+		entries: make(map[string]*localEntry),
+		idleTTL: idleTTL,
+		now:     time.Now,
+	}
+}
+
+// Allow implements Limiter.
+func (l *LocalLimiter) Allow(_ context.Context, key string, q Quota) (Result, error) {
+	now := l.now()
+	burst := q.burst()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &localEntry{lim: rate.NewLimiter(rate.Every(q.emission()), burst), quota: q}
+		l.entries[key] = e
+	} else if e.quota != q {
+		e.lim.SetLimitAt(now, rate.Every(q.emission()))
+		e.lim.SetBurstAt(now, burst)
+		e.quota = q
+	}
+	e.lastSeen = now
+
+	res := Result{Limit: burst}
+	r := e.lim.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+		r.CancelAt(now)
+		res.RetryAfter = delay
+	} else {
+		res.Allowed = true
+	}
+	tokens := e.lim.TokensAt(now)
+	if tokens > 0 {
+		res.Remaining = int(tokens)
+	}
+	res.ResetAfter = time.Duration((float64(burst) - tokens) * float64(q.emission()))
+	return res, nil
+}
+
+// Len returns the number of tracked keys.
+func (l *LocalLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+func (l *LocalLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idleTTL {
+		return
+	}
+	for k, e := range l.entries {
+		if now.Sub(e.lastSeen) > l.idleTTL {
+			delete(l.entries, k)
+		}
+	}
+	l.lastSweep = now
+}
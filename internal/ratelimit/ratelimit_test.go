@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLocalLimiter_BurstThenDeny(t *testing.T) {
+	l := NewLocalLimiter(time.Minute)
+	q := Quota{Rate: 1, Period: time.Second, Burst: 2}
+	ctx := context.Background()
+
+	r1, _ := l.Allow(ctx, "k", q)
+	r2, _ := l.Allow(ctx, "k", q)
+	r3, _ := l.Allow(ctx, "k", q)
+	assert.True(t, r1.Allowed)
+	assert.Equal(t, 1, r1.Remaining)
+	assert.True(t, r2.Allowed)
+	assert.False(t, r3.Allowed)
+	assert.Equal(t, 2, r3.Limit)
+	assert.Greater(t, r3.RetryAfter, time.Duration(0))
+
+	// other keys are independent
+	r4, _ := l.Allow(ctx, "other", q)
+	assert.True(t, r4.Allowed)
+}
+
+func TestLocalLimiter_EvictsIdleKeys(t *testing.T) {
+	l := NewLocalLimiter(time.Minute)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	q := Quota{Rate: 10, Period: time.Second, Burst: 10}
+
+	_, _ = l.Allow(context.Background(), "a", q)
+	_, _ = l.Allow(context.Background(), "b", q)
+	assert.Equal(t, 2, l.Len())
+
+	now = now.Add(2 * time.Minute)
+	_, _ = l.Allow(context.Background(), "c", q)
+	assert.Equal(t, 1, l.Len())
+}
+
+type failingLimiter struct{ calls int }
+
+func (f *failingLimiter) Allow(context.Context, string, Quota) (Result, error) {
+	f.calls++
+	return Result{}, errors.New("redis down")
+}
+
+func TestFallback_UsesLocalAndCoolsDown(t *testing.T) {
+	primary := &failingLimiter{}
+	f := NewFallback(primary, NewLocalLimiter(time.Minute), time.Minute, zap.NewNop().Sugar())
+	q := Quota{Rate: 1, Period: time.Second, Burst: 1}
+
+	r1, err := f.Allow(context.Background(), "k", q)
+	assert.NoError(t, err)
+	assert.True(t, r1.Allowed)
+	r2, err := f.Allow(context.Background(), "k", q)
+	assert.NoError(t, err)
+	assert.False(t, r2.Allowed)
+
+	// primary is only tried once during the cooldown window
+	assert.Equal(t, 1, primary.calls)
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// gcraScript implements the generic cell rate algorithm atomically in Redis.
+// The theoretical arrival time (TAT) is stored per key; Redis TIME is used so
+// that every replica agrees on "now".
+var gcraScript = redis.NewScript(`
+redis.replicate_commands()
+
+local key = KEYS[1]
+local burst = tonumber(ARGV[1])
+local emission = tonumber(ARGV[2])
+
+local t = redis.call("TIME")
+local now = (t[1] - 1600000000) + (t[2] / 1000000)
+
+local tat = tonumber(redis.call("GET", key))
+if not tat or tat < now then
+  tat = now
+end
+
+local new_tat = tat + emission
+local diff = now - (new_tat - emission * burst)
+local remaining = math.floor(diff / emission)
+
+if remaining < 0 then
+  return {0, 0, tostring(-diff), tostring(tat - now)}
+end
+
+local reset_after = new_tat - now
+redis.call("SET", key, new_tat, "EX", math.ceil(reset_after))
+return {1, remaining, "0", tostring(reset_after)}
+`)
+
+// RedisLimiter is a GCRA limiter whose state lives in Redis and is shared by all replicas.
+type RedisLimiter struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+// NewRedisLimiter returns a RedisLimiter storing its keys under "rl:".
+func NewRedisLimiter(rdb *redis.Client) *RedisLimiter {
+	return &RedisLimiter{rdb: rdb, prefix: "rl:"}
+}
+
+// Allow implements Limiter.
+func (l *RedisLimiter) Allow(ctx context.Context, key string, q Quota) (Result, error) {
+	burst := q.burst()
+	res, err := gcraScript.Run(ctx, l.rdb, []string{l.prefix + key},
+		burst, q.emission().Seconds()).Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(res) != 4 {
+		return Result{}, fmt.Errorf("ratelimit: unexpected script reply %v", res)
+	}
+	allowed, _ := res[0].(int64)
+	remaining, _ := res[1].(int64)
+	retry, err := parseSeconds(res[2])
+	if err != nil {
+		return Result{}, err
+	}
+	reset, err := parseSeconds(res[3])
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:    allowed == 1,
+		Limit:      burst,
+		Remaining:  int(remaining),
+		RetryAfter: retry,
+		ResetAfter: reset,
+	}, nil
+}
+
+func parseSeconds(v interface{}) (time.Duration, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("ratelimit: unexpected value %v", v)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
@@ -0,0 +1,118 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// replicaLag is each replica's last measured lag in seconds, -1 when it
+	// couldn't be checked.
+	replicaLag = expvar.NewMap("replica_lag_seconds")
+	// readRoutes counts ReadDB calls served by a replica or by the primary
+	// because no replica was healthy (primary_fallback).
+	readRoutes = expvar.NewMap("db_read_routes")
+)
+
+// replicaLagSQL is -1 on a replica that isn't streaming from the primary,
+// which may have replayed all it received long ago, 0 on one that has
+// replayed everything it received, otherwise the age of the last replayed
+// transaction. A var so tests can stand in for Postgres.
+var replicaLagSQL = `SELECT CASE
+	WHEN NOT EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming') THEN -1
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+
+type replica struct {
+	name string
+	db   *gorm.DB
+	lag  atomic.Int64 // nanoseconds; -1 until checked or when unreachable
+}
+
+type primaryKey struct{}
+
+// UsePrimary marks ctx so that ReadDB returns the primary. Transactions that
+// move money run with it, so nothing they read can come from a replica.
+func UsePrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// UseReplicas routes ReadDB to dbs while their lag is at most maxLag. Call
+// MonitorReplicas to measure the lag; until then reads stay on the primary.
+func (r *Repository) UseReplicas(dbs []*gorm.DB, maxLag time.Duration) {
+	r.replicas = make([]*replica, len(dbs))
+	for i, db := range dbs {
+		rp := &replica{name: fmt.Sprintf("replica%d", i), db: db}
+		rp.lag.Store(-1)
+		r.replicas[i] = rp
+	}
+	r.maxLag = maxLag
+}
+
+// ReadDB returns a *gorm.DB for reads that tolerate replica lag: one of the
+// replicas lagging at most maxLag, round robin, or else the primary. replica
+// reports which one it is. Replicas are shard 0's; other shards read from
+// their primary.
+func (r *Repository) ReadDB(ctx context.Context) (db *gorm.DB, replica bool) {
+	if len(r.replicas) == 0 || ctx.Value(primaryKey{}) != nil || ShardFrom(ctx) != 0 {
+		return r.DB(ctx), false
+	}
+	start := r.next.Add(1)
+	for i := range r.replicas {
+		rp := r.replicas[(int(start)+i)%len(r.replicas)]
+		if lag := rp.lag.Load(); lag >= 0 && time.Duration(lag) <= r.maxLag {
+			readRoutes.Add("replica", 1)
+			return rp.db.WithContext(ctx), true
+		}
+	}
+	readRoutes.Add("primary_fallback", 1)
+	return r.DB(ctx), false
+}
+
+// MonitorReplicas measures every replica's lag each interval until ctx is done.
+func (r *Repository) MonitorReplicas(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		for _, rp := range r.replicas {
+			r.checkReplica(ctx, rp, interval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (r *Repository) checkReplica(ctx context.Context, rp *replica, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var secs float64
+	err := rp.db.WithContext(ctx).Raw(replicaLagSQL).Scan(&secs).Error
+	if err == nil && secs < 0 {
+		err = errors.New("not streaming from the primary")
+	}
+	if err != nil {
+		if rp.lag.Swap(-1) >= 0 {
+			r.log.Warnf("%s: lag check failed, reading from primary: %v", rp.name, err)
+		}
+		replicaLag.Set(rp.name, floatVar(-1))
+		return
+	}
+	rp.lag.Store(int64(secs * float64(time.Second)))
+	replicaLag.Set(rp.name, floatVar(secs))
+}
+
+func floatVar(v float64) *expvar.Float {
+	f := new(expvar.Float)
+	f.Set(v)
+	return f
+}
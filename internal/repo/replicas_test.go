@@ -0,0 +1,80 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/logger"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestReadDB_Routing(t *testing.T) {
+	// each database holds wallet 1 with its own balance, so reads show where they went
+	open := func(name string, bal int64) *gorm.DB {
+		db, err := gorm.Open(sqlite.Open("file:"+t.Name()+name+"?mode=memory&cache=shared"), &gorm.Config{})
+		require.NoError(t, err)
+		require.NoError(t, db.AutoMigrate(&model.Wallet{}))
+		require.NoError(t, db.Create(&model.Wallet{ID: 1, Balance: decimal.NewFromInt(bal)}).Error)
+		return db
+	}
+	log, _ := logger.NewLogger()
+	r := NewRepository(open("primary", 0), nil, nil, log)
+	ctx := context.Background()
+	read := func(ctx context.Context) (int64, bool) {
+		db, replica := r.ReadDB(ctx)
+		var w model.Wallet
+		require.NoError(t, db.First(&w, 1).Error)
+		return w.Balance.IntPart(), replica
+	}
+	assertRead := func(ctx context.Context, want int64, wantReplica bool) {
+		t.Helper()
+		got, replica := read(ctx)
+		assert.Equal(t, want, got)
+		assert.Equal(t, wantReplica, replica)
+	}
+
+	// no replicas, or none checked yet
+	assertRead(ctx, 0, false)
+	r.UseReplicas([]*gorm.DB{open("r0", 10), open("r1", 11)}, 2*time.Second)
+	assertRead(ctx, 0, false)
+
+	// only replicas within the lag are used
+	r.replicas[0].lag.Store(int64(3 * time.Second))
+	r.replicas[1].lag.Store(int64(time.Second))
+	for i := 0; i < 3; i++ {
+		assertRead(ctx, 11, true)
+	}
+	// and both in turn when both are
+	r.replicas[0].lag.Store(0)
+	got := map[int64]bool{}
+	for i := 0; i < 4; i++ {
+		b, _ := read(ctx)
+		got[b] = true
+	}
+	assert.Equal(t, map[int64]bool{10: true, 11: true}, got)
+
+	// inside a money-moving transaction reads stay on the primary
+	assertRead(UsePrimary(ctx), 0, false)
+
+	// a replica whose lag can't be checked is taken out
+	r.checkReplica(ctx, r.replicas[0], time.Second)
+	r.checkReplica(ctx, r.replicas[1], time.Second)
+	assert.EqualValues(t, -1, r.replicas[0].lag.Load())
+	assertRead(ctx, 0, false)
+
+	// as is one that lost its connection to the primary, however caught up
+	defer func(q string) { replicaLagSQL = q }(replicaLagSQL)
+	replicaLagSQL = "SELECT 0"
+	r.checkReplica(ctx, r.replicas[1], time.Second)
+	assertRead(ctx, 11, true)
+	replicaLagSQL = "SELECT -1"
+	r.checkReplica(ctx, r.replicas[1], time.Second)
+	assert.EqualValues(t, -1, r.replicas[1].lag.Load())
+	assertRead(ctx, 0, false)
+}
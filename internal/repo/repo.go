@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -21,17 +23,31 @@ var ErrInsufficientFunds = errors.New("insufficient funds")
 // RepositoryInterface declares all repo operations.
 type RepositoryInterface interface {
 	DB(ctx context.Context) *gorm.DB
+	ReadDB(ctx context.Context) (db *gorm.DB, replica bool)
+	Shards() []int
+	ShardOf(ctx context.Context, walletID uint64) (int, error)
+	PlaceWallet(ctx context.Context, walletID uint64) (int, error)
+	AllocateWallet(ctx context.Context) (uint64, int, error)
+	AllocateRecord(ctx context.Context, dir string, shard int) (uint64, error)
+	RecordShard(ctx context.Context, dir string, id uint64) (int, error)
+	BeginMove(ctx context.Context, walletID uint64, to int) (int, error)
+	FinishMove(ctx context.Context, walletID uint64, to int) error
+	CancelMove(ctx context.Context, walletID uint64, to int) error
 	GetWalletForUpdate(ctx context.Context, tx *gorm.DB, walletID uint64) (*model.Wallet, error)
 	CreateWallet(ctx context.Context, tx *gorm.DB, w *model.Wallet) error
 	UpdateWallet(ctx context.Context, tx *gorm.DB, walletID uint64, newBalance decimal.Decimal, oldVersion uint64) error
+	UpdateWalletStatus(ctx context.Context, tx *gorm.DB, walletID uint64, status string, oldVersion uint64) error
+	UpdateCreditLimit(ctx context.Context, tx *gorm.DB, walletID uint64, limit decimal.Decimal, oldVersion uint64) error
+	UpdateHolds(ctx context.Context, tx *gorm.DB, walletID uint64, held, pendingIn decimal.Decimal, oldVersion uint64) error
 	CreateTransaction(ctx context.Context, tx *gorm.DB, t *model.Transaction) error
 	TxExists(ctx context.Context, tx *gorm.DB, walletID uint64, idemKey, txType string) (bool, *model.Transaction, error)
 	CreateOutboxEvent(ctx context.Context, tx *gorm.DB, evt *model.OutboxEvent) error
 	PollOutbox(ctx context.Context, limit int) ([]model.OutboxEvent, error)
 	MarkOutboxProcessed(ctx context.Context, id uint64) error
 	PublishEvent(ctx context.Context, evt model.OutboxEvent) error
-	CacheBalance(ctx context.Context, walletID uint64, bal decimal.Decimal) error
-	GetCachedBalance(ctx context.Context, walletID uint64) (decimal.Decimal, error)
+	CacheBalance(ctx context.Context, b model.Balance, ttl time.Duration) error
+	InvalidateBalance(ctx context.Context, walletIDs ...uint64) error
+	GetCachedBalance(ctx context.Context, walletID uint64) (*model.Balance, error)
 }
 
 // Repository implements RepositoryInterface.
@@ -40,6 +56,12 @@ type Repository struct {
 	rdb    *redis.Client
 	writer *kafka.Writer
 	log    *zap.SugaredLogger
+
+	replicas []*replica
+	maxLag   time.Duration
+	next     atomic.Uint64
+
+	shards []*gorm.DB // shards 1..n; shard 0 is db
 }
 
 // NewRepository returns Repository instance.
@@ -47,8 +69,10 @@ func NewRepository(db *gorm.DB, rdb *redis.Client, w *kafka.Writer, logger *zap.
 	return &Repository{db: db, rdb: rdb, writer: w, log: logger}
 }
 
-// DB returns *gorm.DB with ctx.
-func (r *Repository) DB(ctx context.Context) *gorm.DB { return r.db.WithContext(ctx) }
+// DB returns *gorm.DB with ctx, on the shard ctx is marked with (see OnShard).
+func (r *Repository) DB(ctx context.Context) *gorm.DB {
+	return r.shardDB(ShardFrom(ctx)).WithContext(ctx)
+}
 
 // GetWalletForUpdate locks a wallet row.
 func (r *Repository) GetWalletForUpdate(ctx context.Context, tx *gorm.DB, walletID uint64) (*model.Wallet, error) {
@@ -85,12 +109,72 @@ func (r *Repository) UpdateWallet(ctx context.Context, tx *gorm.DB, walletID uin
 	return nil
 }
 
+// UpdateWalletStatus changes the lifecycle status using optimistic locking.
+func (r *Repository) UpdateWalletStatus(ctx context.Context, tx *gorm.DB, walletID uint64, status string, oldVersion uint64) error {
+	res := tx.WithContext(ctx).
+		Model(&model.Wallet{}).
+		Where("id = ? AND version = ?", walletID, oldVersion).
+		Updates(map[string]interface{}{
+			"status":     status,
+			"version":    oldVersion + 1,
+			"updated_at": time.Now(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("optimistic lock conflict")
+	}
+	return nil
+}
+
+// UpdateCreditLimit changes the credit limit using optimistic locking.
+func (r *Repository) UpdateCreditLimit(ctx context.Context, tx *gorm.DB, walletID uint64, limit decimal.Decimal, oldVersion uint64) error {
+	res := tx.WithContext(ctx).
+		Model(&model.Wallet{}).
+		Where("id = ? AND version = ?", walletID, oldVersion).
+		Updates(map[string]interface{}{
+			"credit_limit": limit,
+			"version":      oldVersion + 1,
+			"updated_at":   time.Now(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("optimistic lock conflict")
+	}
+	return nil
+}
+
+// UpdateHolds changes the held and pending incoming amounts using optimistic locking.
+func (r *Repository) UpdateHolds(ctx context.Context, tx *gorm.DB, walletID uint64, held, pendingIn decimal.Decimal, oldVersion uint64) error {
+	res := tx.WithContext(ctx).
+		Model(&model.Wallet{}).
+		Where("id = ? AND version = ?", walletID, oldVersion).
+		Updates(map[string]interface{}{
+			"held":       held,
+			"pending_in": pendingIn,
+			"version":    oldVersion + 1,
+			"updated_at": time.Now(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("optimistic lock conflict")
+	}
+	return nil
+}
+
 // CreateTransaction inserts a transaction record.
 func (r *Repository) CreateTransaction(ctx context.Context, tx *gorm.DB, t *model.Transaction) error {
 	return tx.WithContext(ctx).Create(t).Error
 }
 
 // TxExists checks if a transaction with same idempotency key already exists.
+// Archived months are not searched, so a key is only recognised while its
+// rows are in the database.
 func (r *Repository) TxExists(ctx context.Context, tx *gorm.DB, walletID uint64, idemKey, txType string) (bool, *model.Transaction, error) {
 	if idemKey == "" {
 		return false, nil, nil
@@ -113,10 +197,10 @@ func (r *Repository) CreateOutboxEvent(ctx context.Context, tx *gorm.DB, evt *mo
 	return tx.WithContext(ctx).Create(evt).Error
 }
 
-// PollOutbox fetches unprocessed events.
+// PollOutbox fetches unprocessed events of the shard ctx is marked with.
 func (r *Repository) PollOutbox(ctx context.Context, limit int) ([]model.OutboxEvent, error) {
 	var evts []model.OutboxEvent
-	err := r.db.WithContext(ctx).
+	err := r.DB(ctx).
 		Where("processed=false").
 		Order("created_at").
 		Limit(limit).
@@ -127,7 +211,7 @@ func (r *Repository) PollOutbox(ctx context.Context, limit int) ([]model.OutboxE
 // MarkOutboxProcessed marks event as processed.
 func (r *Repository) MarkOutboxProcessed(ctx context.Context, id uint64) error {
 	now := time.Now()
-	return r.db.WithContext(ctx).
+	return r.DB(ctx).
 		Model(&model.OutboxEvent{}).
 		Where("id=?", id).
 		Updates(map[string]interface{}{"processed": true, "processed_at": &now}).Error
@@ -143,16 +227,72 @@ func (r *Repository) PublishEvent(ctx context.Context, evt model.OutboxEvent) er
 	return r.writer.WriteMessages(ctx, msg)
 }
 
-// CacheBalance caches balance in Redis.
-func (r *Repository) CacheBalance(ctx context.Context, walletID uint64, bal decimal.Decimal) error {
-	return r.rdb.Set(ctx, fmt.Sprintf("balance:%d", walletID), bal.String(), 5*time.Minute).Err()
+func balanceKey(walletID uint64) string { return fmt.Sprintf("balance:%d", walletID) }
+
+// cacheBalanceScript replaces the balance hash at KEYS[1] unless the cached
+// version is already at or past ARGV[1]. ARGV[2] is the TTL in milliseconds,
+// the rest are field/value pairs. Returns 1 when written, 0 when stale.
+var cacheBalanceScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], 'version')
+if cur and tonumber(cur) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], unpack(ARGV, 3))
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// CacheBalance caches the balance breakdown in Redis as one hash. The write is
+// a compare-and-set on the wallet version, so a writer holding an older
+// version never overwrites a newer one.
+func (r *Repository) CacheBalance(ctx context.Context, b model.Balance, ttl time.Duration) error {
+	fields := b.Fields()
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	args := []interface{}{b.Version, ttl.Milliseconds()}
+	for _, k := range names {
+		args = append(args, k, fields[k])
+	}
+	return cacheBalanceScript.Run(ctx, r.rdb, []string{balanceKey(b.WalletID)}, args...).Err()
+}
+
+// InvalidateBalance drops the cached balances of the wallets.
+func (r *Repository) InvalidateBalance(ctx context.Context, walletIDs ...uint64) error {
+	if len(walletIDs) == 0 {
+		return nil
+	}
+	keys := make([]string, len(walletIDs))
+	for i, id := range walletIDs {
+		keys[i] = balanceKey(id)
+	}
+	return r.rdb.Del(ctx, keys...).Err()
 }
 
-// GetCachedBalance retrieves balance from Redis.
-func (r *Repository) GetCachedBalance(ctx context.Context, walletID uint64) (decimal.Decimal, error) {
-	str, err := r.rdb.Get(ctx, fmt.Sprintf("balance:%d", walletID)).Result()
+// GetCachedBalance retrieves the balance breakdown from Redis; redis.Nil on a miss.
+func (r *Repository) GetCachedBalance(ctx context.Context, walletID uint64) (*model.Balance, error) {
+	fields, err := r.rdb.HGetAll(ctx, balanceKey(walletID)).Result()
 	if err != nil {
-		return decimal.Zero, err
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, redis.Nil
+	}
+	return model.ParseBalance(walletID, fields)
+}
+
+// RuntimeSettings returns the runtime_setting overrides as key -> value.
+func (r *Repository) RuntimeSettings(ctx context.Context) (map[string]string, error) {
+	var rows []model.RuntimeSetting
+	if err := r.db.WithContext(ctx).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(rows))
+	for _, s := range rows {
+		out[s.Key] = s.Value
 	}
-	return decimal.NewFromString(str)
+	return out, nil
 }
@@ -0,0 +1,290 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Wallets are spread over shards: shard 0 is the primary database, which also
+// holds the wallet_shard directory, and every AddShard adds the next one. A
+// wallet lives where its directory entry says, or on shard 0 when it has none,
+// as do all wallets created before sharding. New wallets are placed by a jump
+// consistent hash of their ID and their entry is written before the wallet.
+
+var (
+	// ErrWalletMoving means the wallet is being moved to another shard; retry shortly.
+	ErrWalletMoving = errors.New("wallet is being moved to another shard")
+	// ErrUnknownShard means a shard ID outside the configured shards.
+	ErrUnknownShard = errors.New("unknown shard")
+)
+
+type shardKey struct{}
+
+// OnShard marks ctx so that DB, and ReadDB, use the given shard.
+func OnShard(ctx context.Context, shard int) context.Context {
+	return context.WithValue(ctx, shardKey{}, shard)
+}
+
+// ShardFrom returns the shard ctx is marked with, 0 when none.
+func ShardFrom(ctx context.Context) int {
+	shard, _ := ctx.Value(shardKey{}).(int)
+	return shard
+}
+
+// AddShard adds db as the next shard and returns its ID.
+func (r *Repository) AddShard(db *gorm.DB) int {
+	r.shards = append(r.shards, db)
+	return len(r.shards)
+}
+
+// OpenShards opens the Postgres databases at dsns and adds them as the next
+// shards, in order. check, when set, vets each one first, e.g. its schema.
+func (r *Repository) OpenShards(dsns []string, check func(db *gorm.DB) error) error {
+	for _, dsn := range dsns {
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{PrepareStmt: true})
+		if err != nil {
+			return fmt.Errorf("open shard %d: %w", len(r.shards)+1, err)
+		}
+		if check != nil {
+			if err := check(db); err != nil {
+				return fmt.Errorf("shard %d: %w", len(r.shards)+1, err)
+			}
+		}
+		r.AddShard(db)
+	}
+	return nil
+}
+
+// Shards returns the IDs of all shards, 0 included.
+func (r *Repository) Shards() []int {
+	ids := make([]int, len(r.shards)+1)
+	for i := range ids {
+		ids[i] = i
+	}
+	return ids
+}
+
+func (r *Repository) shardDB(shard int) *gorm.DB {
+	if shard <= 0 || shard > len(r.shards) {
+		return r.db
+	}
+	return r.shards[shard-1]
+}
+
+func (r *Repository) validShard(shard int) error {
+	if shard < 0 || shard > len(r.shards) {
+		return fmt.Errorf("%w %d", ErrUnknownShard, shard)
+	}
+	return nil
+}
+
+// ShardOf returns the shard holding the wallet, which need not exist. It
+// fails with ErrWalletMoving while the wallet is being moved.
+func (r *Repository) ShardOf(ctx context.Context, walletID uint64) (int, error) {
+	if len(r.shards) == 0 {
+		return 0, nil
+	}
+	var e model.WalletShard
+	err := r.db.WithContext(ctx).Where("wallet_id = ?", walletID).Take(&e).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if e.MovingTo != nil {
+		return e.ShardID, ErrWalletMoving
+	}
+	return e.ShardID, nil
+}
+
+// PlaceWallet returns the shard a wallet about to be created goes to,
+// recording the placement unless the wallet already has one. A wallet that
+// exists on shard 0 without an entry stays there.
+func (r *Repository) PlaceWallet(ctx context.Context, walletID uint64) (int, error) {
+	if len(r.shards) == 0 {
+		return 0, nil
+	}
+	e := model.WalletShard{WalletID: walletID, ShardID: jumpHash(walletID, len(r.shards)+1)}
+	var n int64
+	if err := r.db.WithContext(ctx).Model(&model.Wallet{}).Where("id = ?", walletID).Count(&n).Error; err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		e.ShardID = 0
+	}
+	if err := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&e).Error; err != nil {
+		return 0, err
+	}
+	return r.ShardOf(ctx, walletID)
+}
+
+// AllocateWallet hands out an unused wallet ID and places it. Without extra
+// shards it returns 0, leaving the ID to the database.
+func (r *Repository) AllocateWallet(ctx context.Context) (uint64, int, error) {
+	if len(r.shards) == 0 {
+		return 0, 0, nil
+	}
+	for {
+		var e model.WalletShard
+		legacy := false
+		err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&e).Error; err != nil {
+				return err
+			}
+			// wallets created before sharding have no entry: record theirs
+			// on shard 0 and take the next ID
+			var n int64
+			if err := tx.Model(&model.Wallet{}).Where("id = ?", e.WalletID).Count(&n).Error; err != nil {
+				return err
+			}
+			if legacy = n > 0; legacy {
+				return nil
+			}
+			e.ShardID = jumpHash(e.WalletID, len(r.shards)+1)
+			return tx.Model(&e).Update("shard_id", e.ShardID).Error
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		if !legacy {
+			return e.WalletID, e.ShardID, nil
+		}
+	}
+}
+
+// Escrows, batches and schedules live on the shard of their wallets. Their
+// IDs come from a directory on shard 0 per kind of record, which says where
+// each one is; those without an entry are on shard 0.
+const (
+	EscrowDirectory   = "escrow_shard"
+	BatchDirectory    = "batch_shard"
+	ScheduleDirectory = "transfer_schedule_shard"
+)
+
+// directories maps each record directory to the table of its records.
+var directories = map[string]string{
+	EscrowDirectory: "escrow", BatchDirectory: "batch", ScheduleDirectory: "transfer_schedule",
+}
+
+// AllocateRecord hands out an unused ID for a record of directory dir that
+// goes to shard, and records where it is. Without extra shards it returns 0,
+// leaving the ID to the database.
+func (r *Repository) AllocateRecord(ctx context.Context, dir string, shard int) (uint64, error) {
+	if len(r.shards) == 0 {
+		return 0, nil
+	}
+	if err := r.validShard(shard); err != nil {
+		return 0, err
+	}
+	for {
+		var e model.RecordShard
+		legacy := false
+		err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Table(dir).Create(&e).Error; err != nil {
+				return err
+			}
+			// records created before sharding have no entry and keep theirs
+			// on shard 0
+			var n int64
+			if err := tx.Table(directories[dir]).Where("id = ?", e.ID).Count(&n).Error; err != nil {
+				return err
+			}
+			if legacy = n > 0; legacy {
+				return nil
+			}
+			return tx.Table(dir).Where("id = ?", e.ID).Update("shard_id", shard).Error
+		})
+		if err != nil {
+			return 0, err
+		}
+		if !legacy {
+			return e.ID, nil
+		}
+	}
+}
+
+// RecordShard returns the shard holding record id of directory dir, which
+// need not exist.
+func (r *Repository) RecordShard(ctx context.Context, dir string, id uint64) (int, error) {
+	if len(r.shards) == 0 {
+		return 0, nil
+	}
+	var e model.RecordShard
+	err := r.db.WithContext(ctx).Table(dir).Where("id = ?", id).Take(&e).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	return e.ShardID, err
+}
+
+// BeginMove marks the wallet as moving to shard to and returns the shard it
+// is on. Until FinishMove, ShardOf fails with ErrWalletMoving. Beginning the
+// same move again resumes it.
+func (r *Repository) BeginMove(ctx context.Context, walletID uint64, to int) (int, error) {
+	if err := r.validShard(to); err != nil {
+		return 0, err
+	}
+	var from int
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		e := model.WalletShard{WalletID: walletID}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&e).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("wallet_id = ?", walletID).Take(&e).Error; err != nil {
+			return err
+		}
+		from = e.ShardID
+		switch {
+		case e.MovingTo != nil && *e.MovingTo == to:
+			return nil
+		case e.MovingTo != nil:
+			return fmt.Errorf("wallet %d is already moving to shard %d", walletID, *e.MovingTo)
+		case e.ShardID == to:
+			return fmt.Errorf("wallet %d is already on shard %d", walletID, to)
+		}
+		return tx.Model(&e).Update("moving_to", to).Error
+	})
+	return from, err
+}
+
+// FinishMove points the wallet's directory entry at the shard it moved to.
+func (r *Repository) FinishMove(ctx context.Context, walletID uint64, to int) error {
+	res := r.db.WithContext(ctx).Model(&model.WalletShard{}).
+		Where("wallet_id = ? AND moving_to = ?", walletID, to).
+		Updates(map[string]interface{}{"shard_id": to, "moving_to": nil})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("wallet %d is not moving to shard %d", walletID, to)
+	}
+	return nil
+}
+
+// CancelMove clears a move that has not fenced the source wallet, leaving the
+// wallet where it was.
+func (r *Repository) CancelMove(ctx context.Context, walletID uint64, to int) error {
+	return r.db.WithContext(ctx).Model(&model.WalletShard{}).
+		Where("wallet_id = ? AND moving_to = ?", walletID, to).
+		Update("moving_to", nil).Error
+}
+
+// jumpHash maps key to one of buckets so that going from n to n+1 buckets
+// only moves 1/(n+1) of the keys (Lamping and Veach, "A Fast, Minimal Memory,
+// Consistent Hash Algorithm").
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/richardliu001/wallet-service/internal/logger"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestJumpHash(t *testing.T) {
+	// growing from 3 to 4 buckets only moves keys into the new one
+	counts := make([]int, 4)
+	for key := uint64(1); key <= 10000; key++ {
+		before, after := jumpHash(key, 3), jumpHash(key, 4)
+		if before != after {
+			assert.Equal(t, 3, after, "key %d", key)
+		}
+		counts[after]++
+	}
+	for _, n := range counts {
+		assert.InDelta(t, 2500, n, 250)
+	}
+}
+
+func TestShardDirectory(t *testing.T) {
+	open := func(name string) *gorm.DB {
+		db, err := gorm.Open(sqlite.Open("file:"+t.Name()+name+"?mode=memory&cache=shared"), &gorm.Config{})
+		require.NoError(t, err)
+		require.NoError(t, db.AutoMigrate(&model.Wallet{}, &model.WalletShard{}))
+		return db
+	}
+	log, _ := logger.NewLogger()
+	r := NewRepository(open("primary"), nil, nil, log)
+	ctx := context.Background()
+
+	// unsharded: everything is on shard 0 and nothing is recorded
+	id, shard, err := r.AllocateWallet(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, [2]int{0, 0}, [2]int{int(id), shard})
+	require.NoError(t, r.db.Create(&model.Wallet{ID: 1}).Error)
+
+	assert.Equal(t, 1, r.AddShard(open("s1")))
+	assert.Equal(t, []int{0, 1}, r.Shards())
+
+	// a wallet from before sharding stays put, new ones are hashed
+	shard, err = r.PlaceWallet(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, shard)
+	// allocation skips the legacy ID
+	id, shard, err = r.AllocateWallet(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), id)
+	assert.Equal(t, jumpHash(2, 2), shard)
+	shard, err = r.PlaceWallet(ctx, 7)
+	require.NoError(t, err)
+	assert.Equal(t, jumpHash(7, 2), shard)
+
+	// moves
+	_, err = r.BeginMove(ctx, 1, 2)
+	assert.ErrorIs(t, err, ErrUnknownShard)
+	from, err := r.BeginMove(ctx, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, from)
+	_, err = r.ShardOf(ctx, 1)
+	assert.ErrorIs(t, err, ErrWalletMoving)
+	from, err = r.BeginMove(ctx, 1, 1)
+	require.NoError(t, err, "resuming")
+	assert.Equal(t, 0, from)
+	_, err = r.BeginMove(ctx, 1, 0)
+	assert.Error(t, err)
+	require.NoError(t, r.FinishMove(ctx, 1, 1))
+	shard, err = r.ShardOf(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, shard)
+	assert.Error(t, r.FinishMove(ctx, 1, 1))
+
+	_, err = r.BeginMove(ctx, 1, 0)
+	require.NoError(t, err)
+	require.NoError(t, r.CancelMove(ctx, 1, 0))
+	shard, err = r.ShardOf(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, shard)
+}
+
+func TestRecordDirectory(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&model.Escrow{}))
+	require.NoError(t, db.Table(EscrowDirectory).AutoMigrate(&model.RecordShard{}))
+	log, _ := logger.NewLogger()
+	r := NewRepository(db, nil, nil, log)
+	ctx := context.Background()
+
+	// unsharded: the database picks IDs
+	id, err := r.AllocateRecord(ctx, EscrowDirectory, 0)
+	require.NoError(t, err)
+	assert.Zero(t, id)
+	require.NoError(t, db.Exec("INSERT INTO escrow (id, idempotency_key, payer_wallet_id, payee_wallet_id, escrow_wallet_id, amount, status) VALUES (1, 'k', 1, 2, 9, 1, 'HELD')").Error)
+
+	r.AddShard(db)
+	_, err = r.AllocateRecord(ctx, EscrowDirectory, 2)
+	assert.ErrorIs(t, err, ErrUnknownShard)
+	// the escrow from before sharding keeps its ID on shard 0
+	id, err = r.AllocateRecord(ctx, EscrowDirectory, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), id)
+	for want, id := range map[int]uint64{0: 1, 1: 2} {
+		shard, err := r.RecordShard(ctx, EscrowDirectory, id)
+		require.NoError(t, err)
+		assert.Equal(t, want, shard, "escrow %d", id)
+	}
+	shard, err := r.RecordShard(ctx, EscrowDirectory, 99)
+	require.NoError(t, err)
+	assert.Zero(t, shard)
+}
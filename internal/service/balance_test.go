@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v8"
+	"github.com/richardliu001/wallet-service/internal/cache"
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/logger"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestGetBalance_Breakdown(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&model.Wallet{}))
+	require.NoError(t, db.Create(&model.Wallet{
+		ID: 1, Balance: d("100"), Held: d("30"), PendingIn: d("5"), CreditLimit: d("50"), Currency: "EUR", Version: 4,
+	}).Error)
+	want := model.Balance{
+		WalletID: 1, Currency: "EUR", Ledger: d("100"), Available: d("120"),
+		Held: d("30"), PendingIn: d("5"), CreditLimit: d("50"), Version: 4,
+	}
+
+	rdb, mock := redismock.NewClientMock()
+	log, _ := logger.NewLogger()
+	svc := NewWalletService(repo.NewRepository(db, rdb, nil, log), log)
+	ctx := context.Background()
+
+	// miss: read from the DB and cache the whole breakdown, stamped with its version
+	mock.ExpectHGetAll("balance:1").SetVal(map[string]string{})
+	expectCacheBalance(mock, want, 5*time.Minute).SetVal(int64(1))
+	b, err := svc.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assertBalance(t, want, *b)
+
+	// hit: the same breakdown comes back from the hash
+	fields := map[string]string{}
+	for k, v := range want.Fields() {
+		fields[k] = v.(string)
+	}
+	mock.ExpectHGetAll("balance:1").SetVal(fields)
+	b, err = svc.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assertBalance(t, want, *b)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// the ledger balance is still served under its old name
+	body, err := json.Marshal(b)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"balance":"100"`)
+	assert.Contains(t, string(body), `"ledger":"100"`)
+
+	// write_only never reads the cache but keeps it warm; off leaves it alone
+	cfg := config.Defaults()
+	cfg.Cache.Mode = config.CacheWriteOnly
+	svc.cfg = func() *config.Config { return &cfg }
+	expectCacheBalance(mock, want, 5*time.Minute).SetVal(int64(0))
+	b, err = svc.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assertBalance(t, want, *b)
+	cfg.Cache.Mode = config.CacheOff
+	b, err = svc.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assertBalance(t, want, *b)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// a partial hash is treated as a miss
+	_, err = model.ParseBalance(1, map[string]string{"ledger": "1"})
+	assert.Error(t, err)
+}
+
+func TestGetBalance_Tiers(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&model.Wallet{}))
+	require.NoError(t, db.Create(&model.Wallet{ID: 1, Balance: d("100"), Currency: "EUR", Version: 3}).Error)
+	want := model.Balance{WalletID: 1, Currency: "EUR", Ledger: d("100"), Available: d("100"), Version: 3}
+
+	rdb, mock := redismock.NewClientMock()
+	log, _ := logger.NewLogger()
+	cfg := config.Defaults()
+	cfg.Cache.LocalSize = 10
+	cfg.Cache.LocalTTL = time.Minute
+	svc := NewWalletService(repo.NewRepository(db, rdb, nil, log), log)
+	svc.cfg = func() *config.Config { return &cfg }
+	ctx := context.Background()
+	reads := func(tier string) int64 {
+		if v, ok := balanceReads.Get(tier).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := map[string]int64{}
+	for _, tier := range []string{"local", "redis", "db", "redis_open"} {
+		before[tier] = reads(tier)
+	}
+
+	// Redis is down: no waiting on it, straight to the DB
+	mock.ExpectHGetAll("balance:1").SetErr(cache.ErrCircuitOpen)
+	expectCacheBalance(mock, want, 5*time.Minute).SetErr(cache.ErrCircuitOpen)
+	mock.ExpectDel("balance:1").SetErr(cache.ErrCircuitOpen)
+	b, err := svc.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assertBalance(t, want, *b)
+
+	// served from Redis and kept in process, after which Redis isn't asked
+	fields := map[string]string{}
+	for k, v := range want.Fields() {
+		fields[k] = v.(string)
+	}
+	mock.ExpectHGetAll("balance:1").SetVal(fields)
+	for i := 0; i < 3; i++ {
+		b, err = svc.GetBalance(ctx, 1)
+		require.NoError(t, err)
+		assertBalance(t, want, *b)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	for tier, n := range map[string]int64{"redis_open": 1, "db": 1, "redis": 1, "local": 2} {
+		assert.Equal(t, n, reads(tier)-before[tier], tier)
+	}
+}
+
+func TestTransaction_CachesAfterCommit(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	rdb, mock := redismock.NewClientMock()
+	log, _ := logger.NewLogger()
+	svc := NewWalletService(repo.NewRepository(db, rdb, nil, log), log)
+	ctx := context.Background()
+	b1 := model.Balance{WalletID: 1, Currency: "EUR", Ledger: d("10"), Available: d("10"), Version: 2}
+	b2 := model.Balance{WalletID: 2, Currency: "EUR", Ledger: d("5"), Available: d("5"), Version: 7}
+
+	// nothing reaches Redis until the commit, and then only the last version
+	err = svc.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		svc.cacheAfterCommit(ctx, model.Balance{WalletID: 1, Currency: "EUR", Version: 1})
+		svc.cacheAfterCommit(ctx, b1)
+		svc.cacheAfterCommit(ctx, b2)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		expectCacheBalance(mock, b1, 5*time.Minute).SetVal(int64(1))
+		expectCacheBalance(mock, b2, 5*time.Minute).SetErr(errors.New("connection reset"))
+		mock.ExpectDel("balance:2").SetVal(1) // a failed write invalidates
+		return nil
+	})
+	require.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// a rollback never caches and drops whatever was cached before
+	mock.ExpectDel("balance:1", "balance:2").SetVal(2)
+	err = svc.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		svc.cacheAfterCommit(ctx, b2)
+		svc.cacheAfterCommit(ctx, b1)
+		return errors.New("boom")
+	})
+	assert.EqualError(t, err, "boom")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// expectCacheBalance expects the compare-and-set script caching b.
+func expectCacheBalance(mock redismock.ClientMock, b model.Balance, ttl time.Duration) *redismock.ExpectedCmd {
+	fields := b.Fields()
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	args := []interface{}{fmt.Sprintf("^%d$", b.Version), fmt.Sprintf("^%d$", ttl.Milliseconds())}
+	for _, k := range names {
+		args = append(args, "^"+regexp.QuoteMeta(k)+"$", "^"+regexp.QuoteMeta(fields[k].(string))+"$")
+	}
+	return mock.Regexp().ExpectEvalSha("^[0-9a-f]{40}$", []string{"balance:" + strconv.FormatUint(b.WalletID, 10)}, args...)
+}
+
+func assertBalance(t *testing.T, want, got model.Balance) {
+	t.Helper()
+	assert.Equal(t, want.Fields(), got.Fields())
+	assert.Equal(t, want.WalletID, got.WalletID)
+}
@@ -0,0 +1,413 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrBatchNotFound means no batch has that ID.
+	ErrBatchNotFound = errors.New("batch not found")
+	// ErrInvalidBatch means the batch request is malformed.
+	ErrInvalidBatch = errors.New("invalid batch")
+)
+
+// errLegDone aborts a leg's transaction when another worker already recorded it.
+var errLegDone = errors.New("batch leg already processed")
+
+// legFailure reports whether a leg's error is final: the transfer itself is
+// refused, so posting the leg again would fail the same way.
+func legFailure(err error) bool {
+	for _, target := range []error{
+		repo.ErrInsufficientFunds, ErrLimitExceeded, ErrCurrencyMismatch, ErrWalletNotFound,
+		ErrWalletFrozen, ErrWalletClosed, ErrDebitBlocked, ErrCreditBlocked,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func legKey(batchID uint64, seq int) string { return fmt.Sprintf("batch:%d:%d", batchID, seq) }
+
+// SubmitBatch executes legs (FromWalletID, ToWalletID and Amount set) as one
+// batch in the given mode. The batch is kept on the shard of its wallets,
+// which fails with ErrCrossShard unless they all share one; fee houses on
+// other shards are credited by a saga. Resubmitting an idempotency key
+// returns the stored batch, resuming a BEST_EFFORT batch that was interrupted
+// part-way.
+func (s *WalletService) SubmitBatch(ctx context.Context, key, mode string, legs []model.BatchLeg) (*model.Batch, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%w: idempotency key required", ErrInvalidBatch)
+	}
+	if mode != model.BatchAtomic && mode != model.BatchBestEffort {
+		return nil, fmt.Errorf("%w: mode must be ATOMIC or BEST_EFFORT", ErrInvalidBatch)
+	}
+	if max := s.cfg().Limits.MaxBatchLegs; len(legs) == 0 || len(legs) > max {
+		return nil, fmt.Errorf("%w: want 1 to %d legs, got %d", ErrInvalidBatch, max, len(legs))
+	}
+	b := &model.Batch{IdempotencyKey: key, Mode: mode, Status: model.BatchProcessing, LegCount: len(legs), TotalAmount: decimal.Zero}
+	ids := make([]uint64, 0, 2*len(legs))
+	for i, leg := range legs {
+		if err := s.checkAmount(leg.Amount); err != nil {
+			return nil, fmt.Errorf("leg %d: %w", i+1, err)
+		}
+		if leg.FromWalletID == 0 || leg.ToWalletID == 0 || leg.FromWalletID == leg.ToWalletID {
+			return nil, fmt.Errorf("%w: leg %d needs two different wallets", ErrInvalidBatch, i+1)
+		}
+		b.Legs = append(b.Legs, model.BatchLeg{
+			Seq: i + 1, FromWalletID: leg.FromWalletID, ToWalletID: leg.ToWalletID,
+			Amount: leg.Amount, Fee: decimal.Zero, Status: model.LegPending,
+		})
+		b.TotalAmount = b.TotalAmount.Add(leg.Amount)
+		ids = append(ids, leg.FromWalletID, leg.ToWalletID)
+	}
+	ctx, err := s.routeTogether(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	if stored, err := s.batchByKey(ctx, key); err != nil || stored != nil {
+		if stored != nil && stored.Status == model.BatchProcessing && stored.Mode == model.BatchBestEffort {
+			return s.runBestEffort(ctx, stored)
+		}
+		return stored, err
+	}
+	if b.ID, err = s.repo.AllocateRecord(ctx, repo.BatchDirectory, repo.ShardFrom(ctx)); err != nil {
+		return nil, err
+	}
+	if mode == model.BatchAtomic {
+		return s.runAtomic(ctx, b)
+	}
+	if err := s.repo.DB(ctx).Create(b).Error; err != nil {
+		// lost a race with a concurrent submit of the same key
+		if existing, _ := s.batchByKey(ctx, key); existing != nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return s.runBestEffort(ctx, b)
+}
+
+// GetBatch returns a batch with its legs.
+func (s *WalletService) GetBatch(ctx context.Context, id uint64) (*model.Batch, error) {
+	shard, err := s.repo.RecordShard(ctx, repo.BatchDirectory, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.batch(repo.OnShard(ctx, shard), id)
+}
+
+// batch reads batch id from the shard ctx is marked with.
+func (s *WalletService) batch(ctx context.Context, id uint64) (*model.Batch, error) {
+	var b model.Batch
+	err := s.repo.DB(ctx).Preload("Legs", func(db *gorm.DB) *gorm.DB { return db.Order("seq") }).
+		Where("id = ?", id).First(&b).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrBatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *WalletService) batchByKey(ctx context.Context, key string) (*model.Batch, error) {
+	var b model.Batch
+	err := s.repo.DB(ctx).Select("id").Where("idempotency_key = ?", key).First(&b).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.batch(ctx, b.ID)
+}
+
+// legFees resolves the fee and house wallet of each leg before any lock is taken.
+func (s *WalletService) legFees(ctx context.Context, tx *gorm.DB, legs []model.BatchLeg) ([]decimal.Decimal, []uint64, error) {
+	fees, houses := make([]decimal.Decimal, len(legs)), make([]uint64, len(legs))
+	currencies := map[uint64]string{}
+	for i, leg := range legs {
+		cur, ok := currencies[leg.FromWalletID]
+		if !ok {
+			var err error
+			if cur, err = s.walletCurrency(ctx, tx, leg.FromWalletID); err != nil {
+				return nil, nil, err
+			}
+			currencies[leg.FromWalletID] = cur
+		}
+		fees[i], houses[i] = s.feeFor(LimitKindTransfer, cur, leg.FromWalletID, leg.Amount)
+	}
+	return fees, houses, nil
+}
+
+// houseShards returns the shard of each fee house in houses.
+func (s *WalletService) houseShards(ctx context.Context, houses ...uint64) (map[uint64]int, error) {
+	out := map[uint64]int{}
+	for _, h := range houses {
+		if _, ok := out[h]; ok || h == 0 {
+			continue
+		}
+		shard, err := s.repo.ShardOf(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		out[h] = shard
+	}
+	return out, nil
+}
+
+// batchLock locks the wallets of a batch on shard like transferLock, except
+// for fee houses on other shards, which are only read; feeAcross credits them.
+func (s *WalletService) batchLock(shard int, houses map[uint64]int) lockFunc {
+	return func(ctx context.Context, tx *gorm.DB, id uint64) (*model.Wallet, error) {
+		hs, ok := houses[id]
+		switch {
+		case ok && hs != shard:
+			return s.peekWallet(ctx, id, hs, true)
+		case ok:
+			return s.lockHouse(ctx, tx, id)
+		}
+		return s.lockOrCreate(ctx, tx, id)
+	}
+}
+
+// advanceFees advances the sagas crediting the fees of a batch's legs to
+// houses on other shards. The legs stand either way; ResumeSagas retries.
+func (s *WalletService) advanceFees(ctx context.Context, batchID uint64, sagas []*model.TransferSaga) {
+	for _, sg := range sagas {
+		if _, err := s.advanceSaga(ctx, repo.ShardFrom(ctx), sg.ID); err != nil {
+			s.log.Warnf("batch %d fee of wallet %d, saga %d: %v", batchID, sg.FromWalletID, sg.ID, err)
+		}
+	}
+}
+
+// runAtomic posts every leg in one DB transaction, locking all wallets
+// involved up front in ID order. If any leg fails nothing is posted and the
+// batch is stored as FAILED with that leg's error.
+func (s *WalletService) runAtomic(ctx context.Context, b *model.Batch) (*model.Batch, error) {
+	failed, id, shard := -1, b.ID, repo.ShardFrom(ctx)
+	var legErr error
+	var sagas []*model.TransferSaga
+	err := s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Create(b).Error; err != nil {
+			return err
+		}
+		fees, houses, err := s.legFees(ctx, tx, b.Legs)
+		if err != nil {
+			return err
+		}
+		hs, err := s.houseShards(ctx, houses...)
+		if err != nil {
+			return err
+		}
+		ids := make([]uint64, 0, 3*len(b.Legs))
+		for i, leg := range b.Legs {
+			ids = append(ids, leg.FromWalletID, leg.ToWalletID, houses[i])
+		}
+		ws, err := s.lockWallets(ctx, tx, s.batchLock(shard, hs), ids...)
+		if err != nil {
+			return err
+		}
+		p := newPostings(ws)
+		for i := range b.Legs {
+			leg := &b.Legs[i]
+			key := legKey(b.ID, leg.Seq)
+			if err := s.transferLocked(ctx, tx, p, leg.FromWalletID, leg.ToWalletID, leg.Amount, fees[i], houses[i], key); err != nil {
+				failed, legErr = i, err
+				return err
+			}
+			if h := houses[i]; h != 0 && hs[h] != shard {
+				sg, err := s.feeAcross(ctx, tx, p, leg.FromWalletID, h, ws[leg.FromWalletID].Currency, leg.Amount, fees[i], key)
+				if err != nil {
+					return err
+				}
+				sagas = append(sagas, sg)
+			}
+			// flushed per leg so limit checks of later legs see earlier ones
+			if err := s.flush(ctx, tx, p); err != nil {
+				return err
+			}
+			leg.Fee, leg.Status = fees[i], model.LegSucceeded
+			if err := tx.Model(leg).Updates(map[string]interface{}{"fee": leg.Fee, "status": leg.Status}).Error; err != nil {
+				return err
+			}
+			if err := s.emitLeg(ctx, tx, b.ID, leg); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		b.Status, b.Succeeded, b.CompletedAt = model.BatchCompleted, len(b.Legs), &now
+		if err := tx.Model(b).Updates(map[string]interface{}{
+			"status": b.Status, "succeeded": b.Succeeded, "completed_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		return s.emitBatch(ctx, tx, b)
+	})
+	if err == nil {
+		s.advanceFees(ctx, b.ID, sagas)
+		return b, nil
+	}
+	if failed < 0 {
+		if existing, _ := s.batchByKey(ctx, b.IdempotencyKey); existing != nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+
+	// everything was rolled back: store the batch as failed
+	now := time.Now()
+	b.ID, b.Status, b.Failed, b.CompletedAt = id, model.BatchFailed, 1, &now
+	b.Error = truncate(fmt.Sprintf("leg %d: %v", b.Legs[failed].Seq, legErr), 255)
+	for i := range b.Legs {
+		b.Legs[i].ID, b.Legs[i].BatchID, b.Legs[i].Fee, b.Legs[i].Status = 0, 0, decimal.Zero, model.LegSkipped
+	}
+	b.Legs[failed].Status, b.Legs[failed].Error = model.LegFailed, truncate(legErr.Error(), 255)
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Create(b).Error; err != nil {
+			return err
+		}
+		return s.emitBatch(ctx, tx, b)
+	})
+	if err != nil {
+		if existing, _ := s.batchByKey(ctx, b.IdempotencyKey); existing != nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// runBestEffort posts each PENDING leg in its own DB transaction, then
+// finalises the batch.
+func (s *WalletService) runBestEffort(ctx context.Context, b *model.Batch) (*model.Batch, error) {
+	for i := range b.Legs {
+		if b.Legs[i].Status != model.LegPending {
+			continue
+		}
+		if err := s.runLeg(ctx, b.ID, &b.Legs[i]); err != nil {
+			return nil, err
+		}
+	}
+	b.Succeeded, b.Failed = 0, 0
+	for _, leg := range b.Legs {
+		switch leg.Status {
+		case model.LegSucceeded:
+			b.Succeeded++
+		case model.LegFailed:
+			b.Failed++
+		}
+	}
+	switch {
+	case b.Failed == 0:
+		b.Status = model.BatchCompleted
+	case b.Succeeded == 0:
+		b.Status = model.BatchFailed
+	default:
+		b.Status = model.BatchPartial
+	}
+	now := time.Now()
+	b.CompletedAt = &now
+	err := s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		res := tx.Model(&model.Batch{}).Where("id = ? AND status = ?", b.ID, model.BatchProcessing).
+			Updates(map[string]interface{}{
+				"status": b.Status, "succeeded": b.Succeeded, "failed": b.Failed, "completed_at": now,
+			})
+		if res.Error != nil || res.RowsAffected == 0 {
+			// a concurrent resume finalised it first
+			return res.Error
+		}
+		return s.emitBatch(ctx, tx, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// runLeg posts one best-effort leg and records its outcome. A leg is only
+// ever posted once: its status flips from PENDING in the posting transaction.
+// Other errors than the transfer being refused leave the leg PENDING and are
+// returned, so resubmitting the batch tries it again.
+func (s *WalletService) runLeg(ctx context.Context, batchID uint64, leg *model.BatchLeg) error {
+	var fee decimal.Decimal
+	var saga *model.TransferSaga
+	shard, key := repo.ShardFrom(ctx), legKey(batchID, leg.Seq)
+	err := s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		currency, err := s.walletCurrency(ctx, tx, leg.FromWalletID)
+		if err != nil {
+			return err
+		}
+		var house uint64
+		fee, house = s.feeFor(LimitKindTransfer, currency, leg.FromWalletID, leg.Amount)
+		hs, err := s.houseShards(ctx, house)
+		if err != nil {
+			return err
+		}
+		ws, err := s.lockWallets(ctx, tx, s.batchLock(shard, hs), leg.FromWalletID, leg.ToWalletID, house)
+		if err != nil {
+			return err
+		}
+		p := newPostings(ws)
+		if err := s.transferLocked(ctx, tx, p, leg.FromWalletID, leg.ToWalletID, leg.Amount, fee, house, key); err != nil {
+			return err
+		}
+		if house != 0 && hs[house] != shard {
+			if saga, err = s.feeAcross(ctx, tx, p, leg.FromWalletID, house, currency, leg.Amount, fee, key); err != nil {
+				return err
+			}
+		}
+		res := tx.Model(&model.BatchLeg{}).Where("id = ? AND status = ?", leg.ID, model.LegPending).
+			Updates(map[string]interface{}{"fee": fee, "status": model.LegSucceeded})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errLegDone
+		}
+		if err := s.flush(ctx, tx, p); err != nil {
+			return err
+		}
+		leg.Fee, leg.Status = fee, model.LegSucceeded
+		return s.emitLeg(ctx, tx, batchID, leg)
+	})
+	switch {
+	case err == nil:
+		if saga != nil {
+			s.advanceFees(ctx, batchID, []*model.TransferSaga{saga})
+		}
+		return nil
+	case errors.Is(err, errLegDone):
+		return s.repo.DB(ctx).Where("id = ?", leg.ID).First(leg).Error
+	case !legFailure(err):
+		return fmt.Errorf("leg %d: %w", leg.Seq, err)
+	}
+	leg.Status, leg.Error = model.LegFailed, truncate(err.Error(), 255)
+	return s.repo.DB(ctx).Model(&model.BatchLeg{}).Where("id = ? AND status = ?", leg.ID, model.LegPending).
+		Updates(map[string]interface{}{"status": leg.Status, "error": leg.Error}).Error
+}
+
+// emitLeg writes the Transfer event of a posted leg.
+func (s *WalletService) emitLeg(ctx context.Context, tx *gorm.DB, batchID uint64, leg *model.BatchLeg) error {
+	return s.emit(ctx, tx, leg.FromWalletID, "Transfer", map[string]interface{}{
+		"from": leg.FromWalletID, "to": leg.ToWalletID, "amount": leg.Amount, "fee": leg.Fee,
+		"batch_id": batchID, "seq": leg.Seq,
+	})
+}
+
+// emitBatch writes the batch summary event.
+func (s *WalletService) emitBatch(ctx context.Context, tx *gorm.DB, b *model.Batch) error {
+	return s.emitFor(ctx, tx, "Batch", b.ID, "BatchFinished", map[string]interface{}{
+		"batch_id": b.ID, "mode": b.Mode, "status": b.Status, "legs": b.LegCount,
+		"succeeded": b.Succeeded, "failed": b.Failed, "total_amount": b.TotalAmount, "error": b.Error,
+	})
+}
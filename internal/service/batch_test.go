@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func payroll(amounts ...string) []model.BatchLeg {
+	legs := make([]model.BatchLeg, len(amounts))
+	for i, a := range amounts {
+		legs[i] = model.BatchLeg{FromWalletID: 1, ToWalletID: uint64(i + 2), Amount: d(a)}
+	}
+	return legs
+}
+
+func newBatchService(t *testing.T) (*WalletService, context.Context, func(id uint64) string) {
+	svc, ctx := newTestService(t)
+	for _, id := range []uint64{1, 2, 3, 4} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, d("100"), "d1")
+	require.NoError(t, err)
+	return svc, ctx, func(id uint64) string {
+		w, err := svc.GetWallet(ctx, id)
+		require.NoError(t, err)
+		return w.Balance.String()
+	}
+}
+
+func TestBatch_Atomic(t *testing.T) {
+	svc, ctx, balance := newBatchService(t)
+
+	b, err := svc.SubmitBatch(ctx, "pay-1", model.BatchAtomic, payroll("30", "20", "10"))
+	require.NoError(t, err)
+	assert.Equal(t, model.BatchCompleted, b.Status)
+	assert.Equal(t, 3, b.Succeeded)
+	assert.Equal(t, "40", balance(1))
+	assert.Equal(t, "10", balance(4))
+
+	// all-or-nothing: the last leg can't be covered, so nothing moves
+	b, err = svc.SubmitBatch(ctx, "pay-2", model.BatchAtomic, payroll("30", "5", "6"))
+	require.NoError(t, err)
+	assert.Equal(t, model.BatchFailed, b.Status)
+	assert.Equal(t, model.LegSkipped, b.Legs[0].Status)
+	assert.Equal(t, model.LegFailed, b.Legs[2].Status)
+	assert.Contains(t, b.Error, "leg 3")
+	assert.Equal(t, "40", balance(1))
+
+	// replay returns the stored batch
+	again, err := svc.SubmitBatch(ctx, "pay-1", model.BatchAtomic, payroll("1"))
+	require.NoError(t, err)
+	assert.Equal(t, model.BatchCompleted, again.Status)
+	assert.Len(t, again.Legs, 3)
+	assert.Equal(t, "40", balance(1))
+
+	var summaries int64
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.OutboxEvent{}).Where("event_type = ?", "BatchFinished").Count(&summaries).Error)
+	assert.Equal(t, int64(2), summaries)
+}
+
+func TestBatch_BestEffort(t *testing.T) {
+	svc, ctx, balance := newBatchService(t)
+
+	b, err := svc.SubmitBatch(ctx, "pay-1", model.BatchBestEffort, payroll("60", "50", "40"))
+	require.NoError(t, err)
+	assert.Equal(t, model.BatchPartial, b.Status)
+	assert.Equal(t, 2, b.Succeeded)
+	assert.Equal(t, 1, b.Failed)
+	assert.Equal(t, model.LegFailed, b.Legs[1].Status)
+	assert.Equal(t, "0", balance(1))
+	assert.Equal(t, "40", balance(4))
+
+	got, err := svc.GetBatch(ctx, b.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.BatchPartial, got.Status)
+	assert.Equal(t, []string{model.LegSucceeded, model.LegFailed, model.LegSucceeded},
+		[]string{got.Legs[0].Status, got.Legs[1].Status, got.Legs[2].Status})
+
+	_, err = svc.SubmitBatch(ctx, "pay-2", model.BatchBestEffort, nil)
+	assert.ErrorIs(t, err, ErrInvalidBatch)
+}
+
+// flakyRepo fails the next lock of wallet id, as a dropped connection would.
+type flakyRepo struct {
+	repo.RepositoryInterface
+	id uint64
+}
+
+func (r *flakyRepo) GetWalletForUpdate(ctx context.Context, tx *gorm.DB, id uint64) (*model.Wallet, error) {
+	if id == r.id {
+		r.id = 0
+		return nil, errors.New("connection reset by peer")
+	}
+	return r.RepositoryInterface.GetWalletForUpdate(ctx, tx, id)
+}
+
+func TestBatch_BestEffortResumesAfterError(t *testing.T) {
+	svc, ctx, balance := newBatchService(t)
+	svc.repo = &flakyRepo{RepositoryInterface: svc.repo, id: 3}
+
+	_, err := svc.SubmitBatch(ctx, "pay-1", model.BatchBestEffort, payroll("10", "20", "30"))
+	require.Error(t, err)
+	b, err := svc.batchByKey(ctx, "pay-1")
+	require.NoError(t, err)
+	assert.Equal(t, model.BatchProcessing, b.Status)
+	assert.Equal(t, []string{model.LegSucceeded, model.LegPending, model.LegPending},
+		[]string{b.Legs[0].Status, b.Legs[1].Status, b.Legs[2].Status})
+
+	// resubmitting the key posts the legs left pending
+	b, err = svc.SubmitBatch(ctx, "pay-1", model.BatchBestEffort, payroll("10", "20", "30"))
+	require.NoError(t, err)
+	assert.Equal(t, model.BatchCompleted, b.Status)
+	assert.Equal(t, 3, b.Succeeded)
+	assert.Equal(t, "40", balance(1))
+	assert.Equal(t, "20", balance(3))
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"expvar"
+	"sort"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"gorm.io/gorm"
+)
+
+// balanceReads counts balance reads by the tier that served them (local,
+// redis, replica, db), reads that joined another's database load (coalesced) and Redis
+// lookups skipped by the open circuit breaker (redis_open).
+var balanceReads = expvar.NewMap("balance_reads")
+
+// txCacheKey carries the *txCache of the surrounding transaction in a context.
+type txCacheKey struct{}
+
+// txCache collects the balances a transaction changed, to be cached once it
+// commits. The latest version of each wallet wins.
+type txCache struct {
+	balances map[uint64]model.Balance
+}
+
+func (c *txCache) ids() []uint64 {
+	ids := make([]uint64, 0, len(c.balances))
+	for id := range c.balances {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// transaction runs fn in a DB transaction, with every read in it on the
+// primary. Balances queued by cacheAfterCommit are written to the cache only
+// after the commit succeeds; if it fails they are invalidated instead, as the
+// commit outcome may be unknown.
+func (s *WalletService) transaction(ctx context.Context, fn func(ctx context.Context, tx *gorm.DB) error) error {
+	c := &txCache{balances: map[uint64]model.Balance{}}
+	ctx = repo.UsePrimary(context.WithValue(ctx, txCacheKey{}, c))
+	if err := s.repo.DB(ctx).Transaction(func(tx *gorm.DB) error { return fn(ctx, tx) }); err != nil {
+		s.invalidateBalances(ctx, c.ids()...)
+		return err
+	}
+	for _, id := range c.ids() {
+		s.cacheBalance(ctx, c.balances[id])
+	}
+	return nil
+}
+
+// cacheAfterCommit queues b to be cached when the transaction in ctx commits.
+// Outside of one the commit can't be observed, so the entry is dropped.
+func (s *WalletService) cacheAfterCommit(ctx context.Context, b model.Balance) {
+	if c, ok := ctx.Value(txCacheKey{}).(*txCache); ok {
+		c.balances[b.WalletID] = b
+		return
+	}
+	s.invalidateBalances(ctx, b.WalletID)
+}
+
+// cacheBalance writes b to the cache unless caching is off. A failed write
+// invalidates the entry, so readers fall back to the database.
+func (s *WalletService) cacheBalance(ctx context.Context, b model.Balance) {
+	cc := s.cfg().Cache
+	if !cc.Writes() {
+		return
+	}
+	s.storeLocal(b)
+	if err := s.repo.CacheBalance(ctx, b, cc.TTL); err != nil {
+		s.log.Warnf("cache balance of wallet %d: %v", b.WalletID, err)
+		s.invalidateBalances(ctx, b.WalletID)
+	}
+}
+
+// storeLocal puts b in the in-process tier unless it holds a newer version.
+func (s *WalletService) storeLocal(b model.Balance) {
+	if cur, ok := s.local.Get(b.WalletID); ok && cur.Version >= b.Version {
+		return
+	}
+	s.local.Add(b.WalletID, b)
+}
+
+func (s *WalletService) invalidateBalances(ctx context.Context, ids ...uint64) {
+	if len(ids) == 0 {
+		return
+	}
+	for _, id := range ids {
+		s.local.Remove(id)
+	}
+	if err := s.repo.InvalidateBalance(ctx, ids...); err != nil {
+		s.log.Warnf("invalidate cached balances %v: %v", ids, err)
+	}
+}
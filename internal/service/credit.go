@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidCreditLimit means the credit limit is negative or too large.
+	ErrInvalidCreditLimit = errors.New("invalid credit limit")
+	// ErrCreditInUse means the new limit is below the credit already drawn.
+	ErrCreditInUse = errors.New("credit limit below credit in use")
+)
+
+// CreditLine describes a wallet's balance against its credit limit.
+// Utilization is the percentage of the limit drawn.
+type CreditLine struct {
+	WalletID    uint64          `json:"wallet_id"`
+	Balance     decimal.Decimal `json:"balance"`
+	CreditLimit decimal.Decimal `json:"credit_limit"`
+	CreditUsed  decimal.Decimal `json:"credit_used"`
+	Available   decimal.Decimal `json:"available"`
+	Utilization decimal.Decimal `json:"utilization"`
+}
+
+func newCreditLine(id uint64, balance, limit decimal.Decimal) *CreditLine {
+	return &CreditLine{
+		WalletID: id, Balance: balance, CreditLimit: limit,
+		CreditUsed: creditUsed(balance), Available: balance.Add(limit),
+		Utilization: utilization(balance, limit),
+	}
+}
+
+// creditUsed is how far balance is below zero.
+func creditUsed(balance decimal.Decimal) decimal.Decimal {
+	if balance.IsNegative() {
+		return balance.Neg()
+	}
+	return decimal.Zero
+}
+
+// utilization returns the percentage of limit drawn at balance.
+func utilization(balance, limit decimal.Decimal) decimal.Decimal {
+	if !limit.IsPositive() {
+		return decimal.Zero
+	}
+	return creditUsed(balance).Mul(hundred).Div(limit).Round(2)
+}
+
+// SetCreditLimit approves a credit line of limit for the wallet (zero removes
+// it). The limit can't be cut below the credit already drawn.
+func (s *WalletService) SetCreditLimit(ctx context.Context, id uint64, limit decimal.Decimal, reason string) (*CreditLine, error) {
+	if limit.IsNegative() {
+		return nil, fmt.Errorf("%w: must not be negative", ErrInvalidCreditLimit)
+	}
+	if max := s.cfg().Limits.MaxAmount; max.IsPositive() && limit.GreaterThan(max) {
+		return nil, fmt.Errorf("%w: exceeds %s", ErrInvalidCreditLimit, max)
+	}
+	ctx, err := s.route(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var out *CreditLine
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrWalletNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if w.Status == model.WalletClosed {
+			return ErrWalletClosed
+		}
+		if w.Status == model.WalletMoved {
+			return ErrWalletMoved
+		}
+		if creditUsed(w.Balance).GreaterThan(limit) {
+			return fmt.Errorf("%w: %s drawn", ErrCreditInUse, creditUsed(w.Balance))
+		}
+		out = newCreditLine(id, w.Balance, limit)
+		if w.CreditLimit.Equal(limit) {
+			return nil
+		}
+		if err := s.repo.UpdateCreditLimit(ctx, tx, id, limit, w.Version); err != nil {
+			return err
+		}
+		before := utilization(w.Balance, w.CreditLimit)
+		if err := s.emit(ctx, tx, id, "CreditLimitChanged", map[string]interface{}{
+			"wallet_id": id, "from": w.CreditLimit, "to": limit, "reason": reason,
+		}); err != nil {
+			return err
+		}
+		w.CreditLimit, w.Version = limit, w.Version+1
+		s.cacheAfterCommit(ctx, model.NewBalance(w))
+		return s.checkUtilization(ctx, tx, w, before)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// checkUtilization emits a CreditUtilizationCrossed event for every configured
+// threshold crossed between before (a percentage) and w's current utilization.
+func (s *WalletService) checkUtilization(ctx context.Context, tx *gorm.DB, w *model.Wallet, before decimal.Decimal) error {
+	after := utilization(w.Balance, w.CreditLimit)
+	if after.Equal(before) {
+		return nil
+	}
+	for _, t := range s.cfg().Credit.UtilizationThresholds {
+		th := decimal.NewFromInt(int64(t))
+		var direction string
+		switch {
+		case before.LessThan(th) && !after.LessThan(th):
+			direction = "UP"
+		case !before.LessThan(th) && after.LessThan(th):
+			direction = "DOWN"
+		default:
+			continue
+		}
+		if err := s.emit(ctx, tx, w.ID, "CreditUtilizationCrossed", map[string]interface{}{
+			"wallet_id": w.ID, "threshold": t, "direction": direction, "utilization": after,
+			"balance": w.Balance, "credit_limit": w.CreditLimit,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
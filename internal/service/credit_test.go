@@ -0,0 +1,70 @@
+package service
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreditLine(t *testing.T) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	svc.cfg = func() *config.Config { return &cfg }
+	for _, id := range []uint64{1, 2} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, d("20"), "d1")
+	require.NoError(t, err)
+
+	// no credit line: can't go negative
+	_, err = svc.Withdraw(ctx, 1, d("30"), "w0")
+	assert.ErrorIs(t, err, repo.ErrInsufficientFunds)
+
+	cl, err := svc.SetCreditLimit(ctx, 1, d("100"), "approved")
+	require.NoError(t, err)
+	assert.Equal(t, "120", cl.Available.String())
+
+	// draw 60 of the 100 limit: crosses 50%
+	_, err = svc.Withdraw(ctx, 1, d("80"), "w1")
+	require.NoError(t, err)
+	w, err := svc.GetWallet(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "-60", w.Balance.String())
+	assert.Equal(t, "60", utilization(w.Balance, w.CreditLimit).String())
+
+	// a transfer beyond what's available fails, up to it succeeds and crosses 80% and 100%
+	_, _, err = svc.Transfer(ctx, 1, 2, d("40.01"), "t1")
+	assert.ErrorIs(t, err, repo.ErrInsufficientFunds)
+	_, _, err = svc.Transfer(ctx, 1, 2, d("40"), "t2")
+	require.NoError(t, err)
+
+	// can't cut the limit below what is drawn
+	_, err = svc.SetCreditLimit(ctx, 1, d("50"), "")
+	assert.ErrorIs(t, err, ErrCreditInUse)
+	_, err = svc.SetCreditLimit(ctx, 1, d("-1"), "")
+	assert.ErrorIs(t, err, ErrInvalidCreditLimit)
+
+	// repaying drops back below every threshold
+	_, err = svc.Deposit(ctx, 1, d("100"), "d2")
+	require.NoError(t, err)
+
+	var events []model.OutboxEvent
+	require.NoError(t, svc.Repo().DB(ctx).Where("event_type = ?", "CreditUtilizationCrossed").Order("id").Find(&events).Error)
+	var got []string
+	for _, e := range events {
+		var p struct {
+			Threshold int    `json:"threshold"`
+			Direction string `json:"direction"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(e.Payload), &p))
+		got = append(got, p.Direction+":"+strconv.Itoa(p.Threshold))
+	}
+	assert.Equal(t, []string{"UP:50", "UP:80", "UP:100", "DOWN:50", "DOWN:80", "DOWN:100"}, got)
+}
@@ -0,0 +1,348 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Transaction types of an escrow. HOLD/IN move funds from the payer into the
+// escrow wallet; OUT/RELEASE and OUT/REFUND move them on to payee or payer.
+const (
+	TxEscrowHold    = "ESCROW_HOLD"
+	TxEscrowIn      = "ESCROW_IN"
+	TxEscrowOut     = "ESCROW_OUT"
+	TxEscrowRelease = "ESCROW_RELEASE"
+	TxEscrowRefund  = "ESCROW_REFUND"
+)
+
+var (
+	// ErrEscrowNotFound means no escrow has that ID.
+	ErrEscrowNotFound = errors.New("escrow not found")
+	// ErrInvalidEscrow means the escrow request is malformed.
+	ErrInvalidEscrow = errors.New("invalid escrow")
+	// ErrEscrowClosed means the escrow no longer holds funds or has expired.
+	ErrEscrowClosed = errors.New("escrow closed")
+)
+
+// expireKey is the action key used by ExpireDueEscrows, so concurrent
+// schedulers expire an escrow once.
+const expireKey = "system:expire"
+
+func escrowKey(escrowID, eventID uint64) string {
+	return fmt.Sprintf("escrow:%d:%d", escrowID, eventID)
+}
+
+// CreateEscrow moves amt from payer into the escrow wallet of the payer's
+// currency, to be released to payee or refunded later. The hold counts
+// against the payer's transfer limits. The escrow is kept on the shard of its
+// wallets, which fails with ErrCrossShard unless payer, payee and escrow
+// wallet share one. Reusing key returns the stored escrow.
+func (s *WalletService) CreateEscrow(ctx context.Context, key string, payerID, payeeID uint64, amt decimal.Decimal, condition string, expiresAt *time.Time) (*model.Escrow, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%w: idempotency key required", ErrInvalidEscrow)
+	}
+	if payerID == 0 || payeeID == 0 || payerID == payeeID {
+		return nil, fmt.Errorf("%w: need two different wallets", ErrInvalidEscrow)
+	}
+	if err := s.checkAmount(amt); err != nil {
+		return nil, err
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: expires_at is in the past", ErrInvalidEscrow)
+	}
+	ctx, err := s.routeTogether(ctx, payerID, payeeID)
+	if err != nil {
+		return nil, err
+	}
+	if e, err := s.escrowByKey(ctx, key); err != nil || e != nil {
+		return e, err
+	}
+	id, err := s.repo.AllocateRecord(ctx, repo.EscrowDirectory, repo.ShardFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	e := &model.Escrow{
+		ID:             id,
+		IdempotencyKey: key, PayerWalletID: payerID, PayeeWalletID: payeeID,
+		Amount: amt, Released: decimal.Zero, Refunded: decimal.Zero,
+		Status: model.EscrowHeld, Condition: truncate(condition, 255), ExpiresAt: expiresAt,
+	}
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		currency, err := s.walletCurrency(ctx, tx, payerID)
+		if err != nil {
+			return err
+		}
+		e.EscrowWalletID = s.cfg().Escrow.Wallet(currency)
+		if e.EscrowWalletID == 0 {
+			return fmt.Errorf("%w: no escrow wallet for %s", ErrInvalidEscrow, currency)
+		}
+		if e.EscrowWalletID == payerID || e.EscrowWalletID == payeeID {
+			return fmt.Errorf("%w: the escrow wallet can't be a party", ErrInvalidEscrow)
+		}
+		if err := s.onShardOf(ctx, "escrow", e.EscrowWalletID); err != nil {
+			return err
+		}
+		ws, err := s.lockWallets(ctx, tx, s.systemLock("escrow", e.EscrowWalletID), payerID, payeeID, e.EscrowWalletID)
+		if err != nil {
+			return err
+		}
+		payer, payee, ew := ws[payerID], ws[payeeID], ws[e.EscrowWalletID]
+		if err := checkDebit(payer); err != nil {
+			return err
+		}
+		if err := checkCredit(payee); err != nil {
+			return err
+		}
+		if err := checkCredit(ew); err != nil {
+			return fmt.Errorf("escrow wallet %d: %w", ew.ID, err)
+		}
+		if payee.Currency != currency || ew.Currency != currency {
+			return ErrCurrencyMismatch
+		}
+		if err := s.checkLimits(ctx, tx, payer, LimitKindTransfer, amt); err != nil {
+			return err
+		}
+		if payer.Available().LessThan(amt) {
+			return repo.ErrInsufficientFunds
+		}
+		if err := tx.Create(e).Error; err != nil {
+			return err
+		}
+		ev := model.EscrowEvent{EscrowID: e.ID, Action: model.EscrowActionHold, Amount: amt, IdempotencyKey: key}
+		if err := tx.Create(&ev).Error; err != nil {
+			return err
+		}
+		e.Events = []model.EscrowEvent{ev}
+		p := newPostings(ws)
+		p.debit(payerID, TxEscrowHold, amt, &e.EscrowWalletID, escrowKey(e.ID, ev.ID))
+		p.credit(e.EscrowWalletID, TxEscrowIn, amt, &payerID, escrowKey(e.ID, ev.ID))
+		if err := s.flush(ctx, tx, p); err != nil {
+			return err
+		}
+		return s.emitFor(ctx, tx, "Escrow", e.ID, "EscrowCreated", e)
+	})
+	if err != nil {
+		// lost a race with a concurrent create of the same key
+		if existing, _ := s.escrowByKey(ctx, key); existing != nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+// GetEscrow returns an escrow with its audit trail.
+func (s *WalletService) GetEscrow(ctx context.Context, id uint64) (*model.Escrow, error) {
+	ctx, err := s.routeEscrow(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.escrow(ctx, id)
+}
+
+// routeEscrow marks ctx with the shard holding escrow id.
+func (s *WalletService) routeEscrow(ctx context.Context, id uint64) (context.Context, error) {
+	shard, err := s.repo.RecordShard(ctx, repo.EscrowDirectory, id)
+	if err != nil {
+		return ctx, err
+	}
+	return repo.OnShard(ctx, shard), nil
+}
+
+// escrow reads escrow id from the shard ctx is marked with.
+func (s *WalletService) escrow(ctx context.Context, id uint64) (*model.Escrow, error) {
+	var e model.Escrow
+	err := s.repo.DB(ctx).Preload("Events", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Where("id = ?", id).First(&e).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrEscrowNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *WalletService) escrowByKey(ctx context.Context, key string) (*model.Escrow, error) {
+	var e model.Escrow
+	err := s.repo.DB(ctx).Select("id").Where("idempotency_key = ?", key).First(&e).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.escrow(ctx, e.ID)
+}
+
+// ReleaseEscrow pays amt (nil: everything still held) to the payee. Releases
+// are refused once the escrow has expired.
+func (s *WalletService) ReleaseEscrow(ctx context.Context, id uint64, amt *decimal.Decimal, key, note string) (*model.Escrow, error) {
+	return s.settleEscrow(ctx, id, model.EscrowActionRelease, amt, key, note, time.Now())
+}
+
+// RefundEscrow returns amt (nil: everything still held) to the payer.
+func (s *WalletService) RefundEscrow(ctx context.Context, id uint64, amt *decimal.Decimal, key, note string) (*model.Escrow, error) {
+	return s.settleEscrow(ctx, id, model.EscrowActionRefund, amt, key, note, time.Now())
+}
+
+// ExpireDueEscrows refunds whatever is still held by up to limit escrows per
+// shard that expired at or before now, marking them EXPIRED. It returns the
+// escrows it expired; failures on single escrows or shards are joined into
+// the error.
+func (s *WalletService) ExpireDueEscrows(ctx context.Context, now time.Time, limit int) ([]model.Escrow, error) {
+	var out []model.Escrow
+	var errs []error
+	for _, shard := range s.repo.Shards() {
+		var ids []uint64
+		if err := s.repo.DB(repo.OnShard(ctx, shard)).Model(&model.Escrow{}).
+			Where("status IN ? AND expires_at <= ?", []string{model.EscrowHeld, model.EscrowPartial}, now).
+			Order("expires_at").Limit(limit).Pluck("id", &ids).Error; err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", shard, err))
+			continue
+		}
+		for _, id := range ids {
+			e, err := s.settleEscrow(ctx, id, model.EscrowActionExpire, nil, expireKey, "", now)
+			if err != nil {
+				if !errors.Is(err, ErrEscrowClosed) {
+					errs = append(errs, fmt.Errorf("escrow %d: %w", id, err))
+				}
+				continue
+			}
+			out = append(out, *e)
+		}
+	}
+	return out, errors.Join(errs...)
+}
+
+// settleEscrow moves amt out of the escrow wallet: to the payee on release,
+// back to the payer on refund or expiry. The escrow row is locked first, so
+// actions on one escrow are serialised, and each action key is applied once.
+func (s *WalletService) settleEscrow(ctx context.Context, id uint64, action string, amt *decimal.Decimal, key, note string, now time.Time) (*model.Escrow, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%w: idempotency key required", ErrInvalidEscrow)
+	}
+	if amt != nil {
+		if err := s.checkAmount(*amt); err != nil {
+			return nil, err
+		}
+	}
+	ctx, err := s.routeEscrow(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		var e model.Escrow
+		err := tx.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&e).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrEscrowNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var prev model.EscrowEvent
+		err = tx.WithContext(ctx).Where("escrow_id = ? AND idempotency_key = ?", id, key).First(&prev).Error
+		if err == nil {
+			if prev.Action != action {
+				return fmt.Errorf("%w: idempotency key %q was used for a %s", ErrInvalidEscrow, key, prev.Action)
+			}
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if e.Status != model.EscrowHeld && e.Status != model.EscrowPartial {
+			return fmt.Errorf("%w: escrow is %s", ErrEscrowClosed, e.Status)
+		}
+		expired := e.ExpiresAt != nil && !e.ExpiresAt.After(now)
+		if action == model.EscrowActionRelease && expired {
+			return fmt.Errorf("%w: escrow expired at %s", ErrEscrowClosed, e.ExpiresAt.Format(time.RFC3339))
+		}
+		remaining := e.Remaining()
+		out := remaining
+		if amt != nil {
+			if amt.GreaterThan(remaining) {
+				return fmt.Errorf("%w: only %s is held", ErrInvalidEscrow, remaining)
+			}
+			out = *amt
+		}
+
+		to, typ := e.PayerWalletID, TxEscrowRefund
+		if action == model.EscrowActionRelease {
+			to, typ = e.PayeeWalletID, TxEscrowRelease
+		}
+		ws, err := s.lockWallets(ctx, tx, s.systemLock("escrow", e.EscrowWalletID), e.EscrowWalletID, to)
+		if err != nil {
+			return err
+		}
+		if err := checkDebit(ws[e.EscrowWalletID]); err != nil {
+			return fmt.Errorf("escrow wallet %d: %w", e.EscrowWalletID, err)
+		}
+		if err := checkCredit(ws[to]); err != nil {
+			return err
+		}
+		if ws[e.EscrowWalletID].Balance.LessThan(out) {
+			return fmt.Errorf("escrow wallet %d: %w", e.EscrowWalletID, repo.ErrInsufficientFunds)
+		}
+
+		ev := model.EscrowEvent{EscrowID: id, Action: action, Amount: out, IdempotencyKey: key, Note: truncate(note, 255)}
+		if err := tx.Create(&ev).Error; err != nil {
+			return err
+		}
+		p := newPostings(ws)
+		p.debit(e.EscrowWalletID, TxEscrowOut, out, &to, escrowKey(id, ev.ID))
+		p.credit(to, typ, out, &e.EscrowWalletID, escrowKey(id, ev.ID))
+		if err := s.flush(ctx, tx, p); err != nil {
+			return err
+		}
+
+		released, refunded := e.Released, e.Refunded
+		if action == model.EscrowActionRelease {
+			released = released.Add(out)
+		} else {
+			refunded = refunded.Add(out)
+		}
+		status := model.EscrowPartial
+		if remaining.Equal(out) {
+			switch action {
+			case model.EscrowActionRelease:
+				status = model.EscrowReleased
+			case model.EscrowActionRefund:
+				status = model.EscrowRefunded
+			default:
+				status = model.EscrowExpired
+			}
+		}
+		if err := tx.Model(&model.Escrow{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"released": released, "refunded": refunded, "status": status, "updated_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		return s.emitFor(ctx, tx, "Escrow", id, escrowEvent(action), map[string]interface{}{
+			"escrow_id": id, "to": to, "amount": out, "remaining": remaining.Sub(out),
+			"status": status, "idempotency_key": key, "note": ev.Note,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.escrow(ctx, id)
+}
+
+func escrowEvent(action string) string {
+	switch action {
+	case model.EscrowActionRelease:
+		return "EscrowReleased"
+	case model.EscrowActionRefund:
+		return "EscrowRefunded"
+	}
+	return "EscrowExpired"
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscrow(t *testing.T) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	cfg.Escrow.WalletID = 9
+	svc.cfg = func() *config.Config { return &cfg }
+	for _, id := range []uint64{1, 2, 9} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, d("100"), "d1")
+	require.NoError(t, err)
+	balance := func(id uint64) string {
+		w, err := svc.GetWallet(ctx, id)
+		require.NoError(t, err)
+		return w.Balance.String()
+	}
+
+	e, err := svc.CreateEscrow(ctx, "order-1", 1, 2, d("60"), "goods delivered", nil)
+	require.NoError(t, err)
+	assert.Equal(t, model.EscrowHeld, e.Status)
+	assert.Equal(t, "40", balance(1))
+	assert.Equal(t, "60", balance(9))
+
+	// replay returns the same escrow without moving funds again
+	again, err := svc.CreateEscrow(ctx, "order-1", 1, 2, d("60"), "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, e.ID, again.ID)
+	assert.Equal(t, "40", balance(1))
+
+	// partial release, then replayed
+	amt := d("25")
+	e, err = svc.ReleaseEscrow(ctx, e.ID, &amt, "r1", "first shipment")
+	require.NoError(t, err)
+	assert.Equal(t, model.EscrowPartial, e.Status)
+	_, err = svc.ReleaseEscrow(ctx, e.ID, &amt, "r1", "first shipment")
+	require.NoError(t, err)
+	assert.Equal(t, "25", balance(2))
+
+	// can't release more than is held, or reuse a key for another action
+	over := d("50")
+	_, err = svc.ReleaseEscrow(ctx, e.ID, &over, "r2", "")
+	assert.ErrorIs(t, err, ErrInvalidEscrow)
+	_, err = svc.RefundEscrow(ctx, e.ID, nil, "r1", "")
+	assert.ErrorIs(t, err, ErrInvalidEscrow)
+
+	// refund the rest
+	e, err = svc.RefundEscrow(ctx, e.ID, nil, "cancel", "rest cancelled")
+	require.NoError(t, err)
+	assert.Equal(t, model.EscrowRefunded, e.Status)
+	assert.Equal(t, "75", balance(1))
+	assert.Equal(t, "0", balance(9))
+	require.Len(t, e.Events, 3)
+	assert.Equal(t, model.EscrowActionRefund, e.Events[2].Action)
+
+	_, err = svc.ReleaseEscrow(ctx, e.ID, nil, "r3", "")
+	assert.ErrorIs(t, err, ErrEscrowClosed)
+	_, err = svc.GetEscrow(ctx, 999)
+	assert.ErrorIs(t, err, ErrEscrowNotFound)
+
+	var events []model.OutboxEvent
+	require.NoError(t, svc.Repo().DB(ctx).Where("aggregate = ?", "Escrow").Find(&events).Error)
+	assert.Len(t, events, 3)
+}
+
+func TestEscrow_Expiry(t *testing.T) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	cfg.Escrow.WalletID = 9
+	svc.cfg = func() *config.Config { return &cfg }
+	for _, id := range []uint64{1, 2, 9} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, d("100"), "d1")
+	require.NoError(t, err)
+
+	expires := time.Now().Add(time.Hour)
+	e, err := svc.CreateEscrow(ctx, "order-2", 1, 2, d("30"), "", &expires)
+	require.NoError(t, err)
+
+	out, err := svc.ExpireDueEscrows(ctx, time.Now(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	later := expires.Add(time.Minute)
+	out, err = svc.ExpireDueEscrows(ctx, later, 10)
+	require.NoError(t, err)
+	require.Len(t, out, 1)
+	assert.Equal(t, model.EscrowExpired, out[0].Status)
+	assert.Equal(t, "30", out[0].Refunded.String())
+
+	w, err := svc.GetWallet(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "100", w.Balance.String())
+
+	// nothing left to expire; the escrow can't be released any more
+	out, err = svc.ExpireDueEscrows(ctx, later, 10)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+	_, err = svc.ReleaseEscrow(ctx, e.ID, nil, "late", "")
+	assert.ErrorIs(t, err, ErrEscrowClosed)
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// Transaction types written when a fee is charged: FEE on the payer and
+// FEE_INCOME on the house wallet, both carrying the operation's idempotency key.
+const (
+	TxFee       = "FEE"
+	TxFeeIncome = "FEE_INCOME"
+)
+
+var (
+	// ErrCurrencyMismatch means the wallets involved hold different currencies.
+	ErrCurrencyMismatch = errors.New("wallet currencies differ")
+	// ErrUnknownOperation means a fee was asked for something other than withdraw or transfer.
+	ErrUnknownOperation = errors.New("operation must be withdraw or transfer")
+)
+
+var hundred = decimal.NewFromInt(100)
+
+// FeeQuote previews what an operation would cost.
+type FeeQuote struct {
+	Operation string          `json:"operation"`
+	Currency  string          `json:"currency"`
+	Amount    decimal.Decimal `json:"amount"`
+	Fee       decimal.Decimal `json:"fee"`
+	Total     decimal.Decimal `json:"total"`
+}
+
+// matchSchedule picks the schedule for op in currency, preferring an exact
+// currency match over a wildcard one.
+func matchSchedule(schedules []config.FeeSchedule, op, currency string) *config.FeeSchedule {
+	var wildcard *config.FeeSchedule
+	for i := range schedules {
+		fs := &schedules[i]
+		if fs.Operation != op {
+			continue
+		}
+		if fs.Currency == currency {
+			return fs
+		}
+		if fs.Currency == "" && wildcard == nil {
+			wildcard = fs
+		}
+	}
+	return wildcard
+}
+
+// computeFee prices amt under fs. Percentage schedules charge Percent of the
+// amount plus Flat; tiered ones use the first tier the amount fits in.
+func computeFee(fs config.FeeSchedule, amt decimal.Decimal) decimal.Decimal {
+	var fee decimal.Decimal
+	switch fs.Type {
+	case config.FeeFlat:
+		fee = fs.Flat
+	case config.FeePercentage:
+		fee = fs.Flat.Add(amt.Mul(fs.Percent).Div(hundred))
+	case config.FeeTiered:
+		for _, t := range fs.Tiers {
+			if t.UpTo.IsZero() || amt.LessThanOrEqual(t.UpTo) {
+				fee = t.Flat.Add(amt.Mul(t.Percent).Div(hundred))
+				break
+			}
+		}
+	}
+	if fee.LessThan(fs.Min) {
+		fee = fs.Min
+	}
+	if fs.Max.IsPositive() && fee.GreaterThan(fs.Max) {
+		fee = fs.Max
+	}
+	return fee.Round(8)
+}
+
+// feeFor returns the fee payer owes for op and the house wallet receiving it.
+// house is 0 when no fee applies.
+func (s *WalletService) feeFor(op, currency string, payer uint64, amt decimal.Decimal) (fee decimal.Decimal, house uint64) {
+	fees := s.cfg().Fees
+	house = fees.HouseWallet(currency)
+	if house == 0 || house == payer {
+		return decimal.Zero, 0
+	}
+	fs := matchSchedule(fees.Schedules, op, currency)
+	if fs == nil {
+		return decimal.Zero, 0
+	}
+	fee = computeFee(*fs, amt)
+	if !fee.IsPositive() {
+		return decimal.Zero, 0
+	}
+	return fee, house
+}
+
+// QuoteFee previews the fee for op on amt. The currency comes from the wallet
+// when walletID is set, otherwise from currency (default USD).
+func (s *WalletService) QuoteFee(ctx context.Context, op string, walletID uint64, currency string, amt decimal.Decimal) (*FeeQuote, error) {
+	if op != LimitKindWithdraw && op != LimitKindTransfer {
+		return nil, ErrUnknownOperation
+	}
+	if err := s.checkAmount(amt); err != nil {
+		return nil, err
+	}
+	if walletID != 0 {
+		w, err := s.GetWallet(ctx, walletID)
+		if err != nil {
+			return nil, err
+		}
+		currency = w.Currency
+	}
+	if currency == "" {
+		currency = model.DefaultCurrency
+	}
+	fee, _ := s.feeFor(op, currency, walletID, amt)
+	return &FeeQuote{Operation: op, Currency: currency, Amount: amt, Fee: fee, Total: amt.Add(fee)}, nil
+}
+
+// walletCurrency reads the (immutable) currency of a wallet without locking it,
+// so the matching house wallet can be locked in order with the others.
+func (s *WalletService) walletCurrency(ctx context.Context, tx *gorm.DB, id uint64) (string, error) {
+	var w model.Wallet
+	err := tx.WithContext(ctx).Select("currency").Where("id = ?", id).First(&w).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return model.DefaultCurrency, nil
+	}
+	return w.Currency, err
+}
+
+// lockHouse locks the fee house wallet and checks it can take the fee.
+func (s *WalletService) lockHouse(ctx context.Context, tx *gorm.DB, id uint64) (*model.Wallet, error) {
+	w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("fee house wallet %d does not exist", id)
+	}
+	return w, err
+}
+
+// chargeFee debits fee from payer and credits it to house.
+func chargeFee(p *postings, payer, house uint64, fee decimal.Decimal, key string) {
+	p.debit(payer, TxFee, fee, &house, key)
+	p.credit(house, TxFeeIncome, fee, &payer, key)
+}
+
+// checkHouse verifies the house wallet holds currency and accepts credits.
+func checkHouse(w *model.Wallet, currency string) error {
+	if w.Currency != currency {
+		return fmt.Errorf("fee house wallet %d: %w", w.ID, ErrCurrencyMismatch)
+	}
+	return checkCredit(w)
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func d(s string) decimal.Decimal { return decimal.RequireFromString(s) }
+
+func TestComputeFee(t *testing.T) {
+	tiered := config.FeeSchedule{Type: config.FeeTiered, Tiers: []config.FeeTier{
+		{UpTo: d("100"), Flat: d("1")},
+		{UpTo: d("1000"), Percent: d("1")},
+		{Percent: d("0.5")},
+	}}
+	cases := []struct {
+		name string
+		fs   config.FeeSchedule
+		amt  string
+		want string
+	}{
+		{"flat", config.FeeSchedule{Type: config.FeeFlat, Flat: d("0.25")}, "10", "0.25"},
+		{"percent", config.FeeSchedule{Type: config.FeePercentage, Percent: d("1.5")}, "200", "3"},
+		{"percent plus flat", config.FeeSchedule{Type: config.FeePercentage, Percent: d("1"), Flat: d("0.3")}, "10", "0.4"},
+		{"min", config.FeeSchedule{Type: config.FeePercentage, Percent: d("1"), Min: d("2")}, "10", "2"},
+		{"max", config.FeeSchedule{Type: config.FeePercentage, Percent: d("1"), Max: d("5")}, "1000", "5"},
+		{"tier 1", tiered, "100", "1"},
+		{"tier 2", tiered, "500", "5"},
+		{"tier 3", tiered, "10000", "50"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, computeFee(c.fs, d(c.amt)).String())
+		})
+	}
+}
+
+func TestFees(t *testing.T) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	cfg.Postgres.DSN, cfg.Kafka.Brokers = "postgres://test", []string{"kafka:9092"}
+	cfg.Fees = config.FeesConfig{
+		HouseWalletID: 9,
+		Schedules: []config.FeeSchedule{
+			{Operation: "withdraw", Type: config.FeeFlat, Flat: d("1")},
+			{Operation: "transfer", Type: config.FeePercentage, Percent: d("2")},
+			{Operation: "transfer", Currency: "EUR", Type: config.FeeFlat, Flat: d("0.5")},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+	svc.cfg = func() *config.Config { return &cfg }
+
+	for _, id := range []uint64{1, 2, 9} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, d("100"), "d1")
+	require.NoError(t, err)
+
+	q, err := svc.QuoteFee(ctx, "transfer", 1, "", d("50"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", q.Fee.String())
+	assert.Equal(t, "51", q.Total.String())
+	q, err = svc.QuoteFee(ctx, "transfer", 0, "EUR", d("50"))
+	require.NoError(t, err)
+	assert.Equal(t, "0.5", q.Fee.String())
+
+	bal, fee, err := svc.WithdrawWithFee(ctx, 1, d("10"), "w1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", fee.String())
+	assert.Equal(t, "89", bal.String())
+
+	// replay returns the same result without charging again
+	bal, fee, err = svc.WithdrawWithFee(ctx, 1, d("10"), "w1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", fee.String())
+	assert.Equal(t, "89", bal.String())
+
+	fromBal, toBal, fee, err := svc.TransferWithFee(ctx, 1, 2, d("50"), "t1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", fee.String())
+	assert.Equal(t, "38", fromBal.String())
+	assert.Equal(t, "50", toBal.String())
+
+	// the fee counts towards the funds needed
+	_, _, err = svc.Transfer(ctx, 1, 2, d("38"), "t2")
+	assert.Error(t, err)
+
+	house, err := svc.GetWallet(ctx, 9)
+	require.NoError(t, err)
+	assert.Equal(t, "2", house.Balance.String())
+
+	var rows []model.Transaction
+	require.NoError(t, svc.Repo().DB(ctx).Where("type IN ?", []string{TxFee, TxFeeIncome}).Order("id").Find(&rows).Error)
+	require.Len(t, rows, 4)
+	assert.Equal(t, "w1", *rows[0].IdempotencyKey)
+	assert.Equal(t, uint64(9), rows[1].WalletID)
+
+	// house wallet pays no fee itself; currencies must match
+	_, fee, err = svc.WithdrawWithFee(ctx, 9, d("1"), "hw")
+	require.NoError(t, err)
+	assert.True(t, fee.IsZero())
+	_, err = svc.CreateWallet(ctx, 3, "EUR")
+	require.NoError(t, err)
+	_, _, err = svc.Transfer(ctx, 2, 3, d("1"), "t3")
+	assert.ErrorIs(t, err, ErrCurrencyMismatch)
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// DefaultHistoryLimit is used when the caller doesn't specify a page size.
+	DefaultHistoryLimit = 50
+	// MaxHistoryLimit caps the page size.
+	MaxHistoryLimit = 500
+)
+
+var (
+	// ErrInvalidCursor means the cursor could not be decoded.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidLimit means the page size is out of range.
+	ErrInvalidLimit = fmt.Errorf("limit must be between 1 and %d", MaxHistoryLimit)
+)
+
+// HistoryQuery filters and pages a wallet's transaction history.
+// Zero values mean "no filter".
+type HistoryQuery struct {
+	Limit        int
+	Cursor       string
+	Desc         bool
+	Types        []string
+	MinAmount    *decimal.Decimal
+	MaxAmount    *decimal.Decimal
+	Counterparty *uint64
+	Since        *time.Time // inclusive
+	Until        *time.Time // exclusive
+}
+
+// HistoryPage is one page of history; NextCursor is empty on the last page.
+type HistoryPage struct {
+	Items      []model.Transaction `json:"items"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// GetHistory returns a page of transactions using keyset pagination over (created_at, id).
+// It reads from a replica when one is within the allowed lag.
+func (s *WalletService) GetHistory(ctx context.Context, walletID uint64, q HistoryQuery) (*HistoryPage, error) {
+	if q.Limit == 0 {
+		q.Limit = DefaultHistoryLimit
+	}
+	if q.Limit < 0 || q.Limit > MaxHistoryLimit {
+		return nil, ErrInvalidLimit
+	}
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	var c *historyCursor
+	if q.Cursor != "" {
+		ts, id, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		c = &historyCursor{ts: ts, id: id}
+	}
+
+	db, _ := s.repo.ReadDB(ctx)
+	db = db.Where("wallet_id = ?", walletID)
+	if len(q.Types) > 0 {
+		db = db.Where("type IN ?", q.Types)
+	}
+	if q.MinAmount != nil {
+		db = db.Where("amount >= ?", *q.MinAmount)
+	}
+	if q.MaxAmount != nil {
+		db = db.Where("amount <= ?", *q.MaxAmount)
+	}
+	if q.Counterparty != nil {
+		db = db.Where("related_wallet_id = ?", *q.Counterparty)
+	}
+	if q.Since != nil {
+		db = db.Where("created_at >= ?", *q.Since)
+	}
+	if q.Until != nil {
+		db = db.Where("created_at < ?", *q.Until)
+	}
+	if c != nil {
+		if q.Desc {
+			db = db.Where("created_at < ? OR (created_at = ? AND id < ?)", c.ts, c.ts, c.id)
+		} else {
+			db = db.Where("created_at > ? OR (created_at = ? AND id > ?)", c.ts, c.ts, c.id)
+		}
+	}
+	if q.Desc {
+		db = db.Order("created_at desc, id desc")
+	} else {
+		db = db.Order("created_at asc, id asc")
+	}
+
+	// fetch one extra row to learn whether another page exists
+	var txs []model.Transaction
+	if err := db.Limit(q.Limit + 1).Find(&txs).Error; err != nil {
+		return nil, err
+	}
+	// archived months are older than every live row, so they come first in
+	// ascending order and are only needed in descending order to fill the page
+	if !q.Desc || len(txs) <= q.Limit {
+		arch, err := s.archivedHistory(ctx, walletID, q, c, q.Limit+1)
+		if err != nil {
+			return nil, err
+		}
+		if q.Desc {
+			txs = append(txs, arch...)
+		} else {
+			txs = append(arch, txs...)
+		}
+		if len(txs) > q.Limit+1 {
+			txs = txs[:q.Limit+1]
+		}
+	}
+	page := &HistoryPage{Items: txs}
+	if len(txs) > q.Limit {
+		page.Items = txs[:q.Limit]
+		last := page.Items[q.Limit-1]
+		page.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+	}
+	return page, nil
+}
+
+// historyCursor is the (created_at, id) position a page continues from.
+type historyCursor struct {
+	ts time.Time
+	id uint64
+}
+
+// matches applies q's filters and the cursor to t as GetHistory's query does.
+func (q HistoryQuery) matches(t *model.Transaction, c *historyCursor) bool {
+	switch {
+	case len(q.Types) > 0 && !slices.Contains(q.Types, t.Type),
+		q.MinAmount != nil && t.Amount.LessThan(*q.MinAmount),
+		q.MaxAmount != nil && t.Amount.GreaterThan(*q.MaxAmount),
+		q.Counterparty != nil && (t.RelatedWalletID == nil || *t.RelatedWalletID != *q.Counterparty),
+		q.Since != nil && t.CreatedAt.Before(*q.Since),
+		q.Until != nil && !t.CreatedAt.Before(*q.Until):
+		return false
+	}
+	if c == nil {
+		return true
+	}
+	at := historyCursor{ts: t.CreatedAt, id: t.ID}
+	if q.Desc {
+		return at.before(*c)
+	}
+	return c.before(at)
+}
+
+func (a historyCursor) before(b historyCursor) bool {
+	return a.ts.Before(b.ts) || (a.ts.Equal(b.ts) && a.id < b.id)
+}
+
+// sortHistory orders txs by (created_at, id), descending if desc.
+func sortHistory(txs []model.Transaction, desc bool) {
+	sort.Slice(txs, func(i, j int) bool {
+		a := historyCursor{ts: txs[i].CreatedAt, id: txs[i].ID}
+		b := historyCursor{ts: txs[j].CreatedAt, id: txs[j].ID}
+		if desc {
+			return b.before(a)
+		}
+		return a.before(b)
+	})
+}
+
+func encodeCursor(ts time.Time, id uint64) string {
+	raw := strconv.FormatInt(ts.UnixNano(), 10) + ":" + strconv.FormatUint(id, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(c string) (time.Time, uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	tsPart, idPart, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(tsPart, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	id, err := strconv.ParseUint(idPart, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	return time.Unix(0, nanos), id, nil
+}
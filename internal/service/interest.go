@@ -0,0 +1,559 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Transaction types of an interest posting.
+const (
+	TxInterest        = "INTEREST"
+	TxInterestExpense = "INTEREST_EXPENSE"
+)
+
+// ErrUnknownRatePlan means no rate plan of that name is configured.
+var ErrUnknownRatePlan = errors.New("unknown rate plan")
+
+// accrualScale is the number of decimal places accruals are kept at.
+const accrualScale = 18
+
+// InterestSummary is a wallet's rate plan, the interest accrued but not yet
+// paid and its latest postings.
+type InterestSummary struct {
+	WalletID uint64                  `json:"wallet_id"`
+	RatePlan string                  `json:"rate_plan,omitempty"`
+	Since    *time.Time              `json:"since,omitempty"`
+	Accrued  decimal.Decimal         `json:"accrued"`
+	Postings []model.InterestPosting `json:"postings"`
+}
+
+// startOfDay truncates t to midnight UTC.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// periodOf names the posting period that day belongs to.
+func periodOf(posting string, day time.Time) string {
+	if posting == config.PostDaily {
+		return day.Format("2006-01-02")
+	}
+	return day.Format("2006-01")
+}
+
+// periodEnd returns the first day after period.
+func periodEnd(period string) (time.Time, error) {
+	if t, err := time.Parse("2006-01", period); err == nil {
+		return t.AddDate(0, 1, 0), nil
+	}
+	t, err := time.Parse("2006-01-02", period)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+// dayCount returns how many days day counts for and the days in the year
+// under convention. 30/360 treats every month as 30 days: the 31st counts for
+// nothing and the last day of February makes up the missing days.
+func dayCount(convention string, day time.Time) (days, year int64) {
+	switch convention {
+	case config.DayCountAct360:
+		return 1, 360
+	case config.DayCountActAct:
+		return 1, int64(time.Date(day.Year(), 12, 31, 0, 0, 0, 0, time.UTC).YearDay())
+	case config.DayCount30360:
+		switch {
+		case day.Day() == 31:
+			return 0, 360
+		case day.Month() == time.February && day.AddDate(0, 0, 1).Month() == time.March:
+			return int64(30 - day.Day() + 1), 360
+		}
+		return 1, 360
+	}
+	return 1, 365
+}
+
+// accrual returns the interest plan pays on balance for day.
+func accrual(plan config.RatePlan, balance decimal.Decimal, day time.Time) decimal.Decimal {
+	if !balance.IsPositive() || balance.LessThan(plan.MinBalance) {
+		return decimal.Zero
+	}
+	days, year := dayCount(plan.DayCount, day)
+	num := balance.Mul(plan.AnnualRate).Mul(decimal.NewFromInt(days))
+	return num.DivRound(decimal.NewFromInt(100*year), accrualScale)
+}
+
+// SetRatePlan puts the wallet on the named rate plan, or takes it off with "".
+// Interest accrues from the first full day on a plan.
+func (s *WalletService) SetRatePlan(ctx context.Context, id uint64, plan string) (*model.Wallet, error) {
+	if plan != "" && s.cfg().Interest.Plan(plan) == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownRatePlan, plan)
+	}
+	ctx, err := s.route(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var out *model.Wallet
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrWalletNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if w.Status == model.WalletClosed {
+			return ErrWalletClosed
+		}
+		out = w
+		from := ""
+		if w.RatePlan != nil {
+			from = *w.RatePlan
+		}
+		if from == plan {
+			return nil
+		}
+		now := time.Now()
+		updates := map[string]interface{}{"version": w.Version + 1, "updated_at": now}
+		switch {
+		case plan == "":
+			updates["rate_plan"], updates["interest_since"] = nil, nil
+			w.RatePlan, w.InterestSince = nil, nil
+		case from == "":
+			updates["rate_plan"], updates["interest_since"] = plan, now
+			w.RatePlan, w.InterestSince = &plan, &now
+		default:
+			// switching plans keeps accruing without a gap
+			updates["rate_plan"] = plan
+			w.RatePlan = &plan
+		}
+		res := tx.Model(&model.Wallet{}).Where("id = ? AND version = ?", id, w.Version).Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.New("optimistic lock conflict")
+		}
+		w.Version++
+		return s.emit(ctx, tx, id, "RatePlanChanged", map[string]interface{}{"wallet_id": id, "from": from, "to": plan})
+	})
+	return out, err
+}
+
+// InterestSummary returns the wallet's accrued interest and its last postings.
+func (s *WalletService) InterestSummary(ctx context.Context, id uint64, limit int) (*InterestSummary, error) {
+	ctx, err := s.route(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.GetWallet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	out := &InterestSummary{WalletID: id, Since: w.InterestSince, Accrued: decimal.Zero}
+	if w.RatePlan != nil {
+		out.RatePlan = *w.RatePlan
+	}
+	var accs []model.InterestAccrual
+	db := s.repo.DB(ctx)
+	if err := db.Select("amount").Where("wallet_id = ? AND posting_id IS NULL", id).Find(&accs).Error; err != nil {
+		return nil, err
+	}
+	for _, a := range accs {
+		out.Accrued = out.Accrued.Add(a.Amount)
+	}
+	if err := db.Where("wallet_id = ?", id).Order("id desc").Limit(limit).Find(&out.Postings).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RunInterest accrues interest for the last BackfillDays complete days (days
+// already accrued are skipped) and pays out every period that has ended.
+func (s *WalletService) RunInterest(ctx context.Context, now time.Time) (accrued, posted int, err error) {
+	cfg := s.cfg().Interest
+	if len(cfg.Plans) == 0 {
+		return 0, 0, nil
+	}
+	today := startOfDay(now)
+	var errs []error
+	for i := cfg.BackfillDays; i >= 1; i-- {
+		n, err := s.AccrueInterest(ctx, today.AddDate(0, 0, -i))
+		accrued += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	posted, err = s.PostInterest(ctx, now)
+	return accrued, posted, errors.Join(append(errs, err)...)
+}
+
+// AccrueInterest records a day's interest for every wallet on every shard
+// that was on a rate plan for all of that day, based on its end-of-day
+// balance. A wallet/day is accrued once, so reruns are harmless. It returns
+// the number of accruals added.
+func (s *WalletService) AccrueInterest(ctx context.Context, day time.Time) (int, error) {
+	added := 0
+	for _, shard := range s.repo.Shards() {
+		n, err := s.accrueShard(repo.OnShard(ctx, shard), day)
+		added += n
+		if err != nil {
+			return added, fmt.Errorf("shard %d: %w", shard, err)
+		}
+	}
+	return added, nil
+}
+
+// accrueShard accrues a day's interest for the wallets on the shard ctx is
+// marked with.
+func (s *WalletService) accrueShard(ctx context.Context, day time.Time) (int, error) {
+	cfg := s.cfg().Interest
+	day = startOfDay(day)
+	period := periodOf(cfg.Posting, day)
+	db := s.repo.DB(ctx)
+	added := 0
+	var lastID uint64
+	for {
+		var ws []model.Wallet
+		if err := db.Select("id", "currency", "rate_plan").
+			Where("rate_plan IS NOT NULL AND interest_since <= ? AND status <> ? AND id > ?", day, model.WalletMoved, lastID).
+			Order("id").Limit(500).Find(&ws).Error; err != nil {
+			return added, err
+		}
+		if len(ws) == 0 {
+			return added, nil
+		}
+		lastID = ws[len(ws)-1].ID
+		for _, w := range ws {
+			plan := cfg.Plan(*w.RatePlan)
+			if plan == nil || w.ID == cfg.HouseWallet(w.Currency) {
+				continue
+			}
+			ok, err := s.accrueWallet(ctx, w.ID, *plan, day, period)
+			if err != nil {
+				return added, err
+			}
+			if ok {
+				added++
+			}
+		}
+	}
+}
+
+// accrueWallet records the wallet's interest for day, unless period has been
+// paid out already.
+func (s *WalletService) accrueWallet(ctx context.Context, id uint64, plan config.RatePlan, day time.Time, period string) (bool, error) {
+	added := false
+	err := s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		// postInterest pays a period out under the wallet lock, so checking
+		// under it too keeps an accrual from landing after the payout
+		if _, err := s.repo.GetWalletForUpdate(ctx, tx, id); err != nil {
+			return err
+		}
+		var posted int64
+		if err := tx.Model(&model.InterestPosting{}).Where("wallet_id = ? AND period = ?", id, period).
+			Count(&posted).Error; err != nil || posted > 0 {
+			// too late: the period has been paid out already
+			return err
+		}
+		bal, _, err := s.balanceAt(ctx, id, day.AddDate(0, 0, 1))
+		if err != nil {
+			return err
+		}
+		a := model.InterestAccrual{
+			WalletID: id, Day: day, Period: period, Plan: plan.Name, Balance: bal,
+			Rate: plan.AnnualRate, DayCount: plan.DayCount, Amount: accrual(plan, bal, day),
+		}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&a)
+		added = res.RowsAffected > 0
+		return res.Error
+	})
+	return added, err
+}
+
+// PostInterest pays out the accruals of every period that ended by now, on
+// every shard. It returns the number of postings made; failures on single
+// wallets or shards are joined into the error and retried on the next run.
+func (s *WalletService) PostInterest(ctx context.Context, now time.Time) (int, error) {
+	today := startOfDay(now)
+	posted := 0
+	var errs []error
+	for _, shard := range s.repo.Shards() {
+		ctx := repo.OnShard(ctx, shard)
+		var due []struct {
+			WalletID uint64
+			Period   string
+		}
+		if err := s.repo.DB(ctx).Model(&model.InterestAccrual{}).Select("wallet_id, period").
+			Where("posting_id IS NULL").Group("wallet_id, period").Order("wallet_id, period").
+			Scan(&due).Error; err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", shard, err))
+			continue
+		}
+		for _, d := range due {
+			end, err := periodEnd(d.Period)
+			if err != nil || end.After(today) {
+				continue
+			}
+			ok, err := s.postInterest(ctx, d.WalletID, d.Period)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("wallet %d period %s: %w", d.WalletID, d.Period, err))
+				continue
+			}
+			if ok {
+				posted++
+			}
+		}
+	}
+	return posted, errors.Join(errs...)
+}
+
+// postInterest pays one wallet's accruals for period from the house wallet.
+// The wallet is on the shard ctx is marked with; a house on another shard
+// pays through postInterestAcross. The posting row is unique per wallet and
+// period, and the ledger rows carry the key "interest:<period>", so a period
+// is never paid twice.
+func (s *WalletService) postInterest(ctx context.Context, walletID uint64, period string) (bool, error) {
+	currency, err := s.walletCurrency(ctx, s.repo.DB(ctx), walletID)
+	if err != nil {
+		return false, err
+	}
+	house := s.cfg().Interest.HouseWallet(currency)
+	if house == 0 {
+		return false, fmt.Errorf("no interest house wallet for %s", currency)
+	}
+	houseShard, err := s.repo.ShardOf(ctx, house)
+	if err != nil {
+		return false, err
+	}
+	if houseShard != repo.ShardFrom(ctx) {
+		return s.postInterestAcross(ctx, walletID, house, houseShard, currency, period)
+	}
+	var posting *model.InterestPosting
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		ws, err := s.lockWallets(ctx, tx, s.systemLock("interest house", house), walletID, house)
+		if err != nil {
+			return err
+		}
+		// the wallet lock serialises postings; recheck under it
+		if done, err := interestPosted(tx, walletID, period); err != nil || done {
+			return err
+		}
+		ids, sum, total, err := interestOwed(tx, walletID, period)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		amount := total.Truncate(8)
+		posting = &model.InterestPosting{
+			WalletID: walletID, Period: period, HouseWalletID: house,
+			Accrued: sum, Amount: amount, Carry: total.Sub(amount),
+		}
+		if err := recordPosting(tx, posting, ids); err != nil {
+			return err
+		}
+		if amount.IsPositive() {
+			w, h := ws[walletID], ws[house]
+			if err := checkCredit(w); err != nil {
+				return err
+			}
+			if err := checkInterestHouse(h, currency, amount); err != nil {
+				return err
+			}
+			key := "interest:" + period
+			p := newPostings(ws)
+			p.debit(house, TxInterestExpense, amount, &walletID, key)
+			p.credit(walletID, TxInterest, amount, &house, key)
+			if err := s.flush(ctx, tx, p); err != nil {
+				return err
+			}
+		}
+		return s.emit(ctx, tx, walletID, "InterestPosted", posting)
+	})
+	return posting != nil && err == nil, err
+}
+
+// postInterestAcross pays a wallet's interest for period from a house wallet
+// on houseShard. The house is debited there together with a saga, keyed by
+// wallet and period, whose credit records the posting on the wallet's shard.
+// A saga left DEBITED is retried by ResumeSagas or the next run; one the
+// wallet refused was refunded to the house, and the next run tries again.
+func (s *WalletService) postInterestAcross(ctx context.Context, walletID, house uint64, houseShard int, currency, period string) (bool, error) {
+	db := s.repo.DB(ctx)
+	if done, err := interestPosted(db, walletID, period); err != nil || done {
+		return false, err
+	}
+	ids, _, total, err := interestOwed(db, walletID, period)
+	if err != nil || len(ids) == 0 {
+		return false, err
+	}
+	amount := total.Truncate(8)
+	if !amount.IsPositive() {
+		// nothing to move, only the carry to record
+		err := s.creditInterest(ctx, walletID, house, currency, period, amount)
+		return err == nil, err
+	}
+	// a credit bound to be refused fails before the house is debited
+	w, err := s.peekWallet(ctx, walletID, repo.ShardFrom(ctx), false)
+	if err != nil {
+		return false, err
+	}
+	if err := checkCredit(w); err != nil {
+		return false, err
+	}
+	key := fmt.Sprintf("interest:%s:%d", period, walletID)
+	var sg *model.TransferSaga
+	err = s.transaction(repo.OnShard(ctx, houseShard), func(ctx context.Context, tx *gorm.DB) error {
+		h, err := s.systemLock("interest house", house)(ctx, tx, house)
+		if err != nil {
+			return err
+		}
+		if sg, err = s.sagaByKey(ctx, tx, house, key); err != nil {
+			return err
+		}
+		if sg != nil && sg.State != model.SagaCompensated {
+			return nil
+		}
+		if sg != nil {
+			// refused before and refunded; the key is free for another try
+			if err := tx.Model(sg).Update("idempotency_key", nil).Error; err != nil {
+				return err
+			}
+		}
+		if err := checkInterestHouse(h, currency, amount); err != nil {
+			return err
+		}
+		p := newPostings(map[uint64]*model.Wallet{house: h})
+		p.debit(house, TxInterestExpense, amount, &walletID, "interest:"+period)
+		if err := s.flush(ctx, tx, p); err != nil {
+			return err
+		}
+		sg = &model.TransferSaga{
+			FromWalletID: house, ToWalletID: &walletID, Currency: currency,
+			Amount: amount, State: model.SagaDebited, InterestPeriod: &period,
+		}
+		return s.createSaga(ctx, tx, sg, key)
+	})
+	if err != nil {
+		return false, err
+	}
+	if sg.State == model.SagaDebited {
+		if sg, err = s.advanceSaga(ctx, houseShard, sg.ID); sg == nil {
+			return false, err
+		}
+	}
+	if sg.State == model.SagaCompensated {
+		return false, fmt.Errorf("%w: house wallet %d refunded: %s", ErrTransferReversed, house, sg.LastError)
+	}
+	return sg.State == model.SagaCompleted, err
+}
+
+// creditInterest is the credit leg of an interest saga: on the wallet's shard
+// it records the posting of period for amt, the house having been debited,
+// and credits the wallet. It does nothing if the period is already posted.
+func (s *WalletService) creditInterest(ctx context.Context, walletID, house uint64, currency, period string, amt decimal.Decimal) error {
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	return s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		w, err := s.repo.GetWalletForUpdate(ctx, tx, walletID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrWalletNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if done, err := interestPosted(tx, walletID, period); err != nil || done {
+			return err
+		}
+		if amt.IsPositive() {
+			if err := checkCredit(w); err != nil {
+				return err
+			}
+			if w.Currency != currency {
+				return ErrCurrencyMismatch
+			}
+		}
+		ids, sum, total, err := interestOwed(tx, walletID, period)
+		if err != nil {
+			return err
+		}
+		posting := &model.InterestPosting{
+			WalletID: walletID, Period: period, HouseWalletID: house,
+			Accrued: sum, Amount: amt, Carry: total.Sub(amt),
+		}
+		if err := recordPosting(tx, posting, ids); err != nil {
+			return err
+		}
+		if amt.IsPositive() {
+			p := newPostings(map[uint64]*model.Wallet{walletID: w})
+			p.credit(walletID, TxInterest, amt, &house, "interest:"+period)
+			if err := s.flush(ctx, tx, p); err != nil {
+				return err
+			}
+		}
+		return s.emit(ctx, tx, walletID, "InterestPosted", posting)
+	})
+}
+
+// interestPosted reports whether the wallet's interest for period is posted.
+func interestPosted(tx *gorm.DB, walletID uint64, period string) (bool, error) {
+	var done int64
+	err := tx.Model(&model.InterestPosting{}).Where("wallet_id = ? AND period = ?", walletID, period).Count(&done).Error
+	return done > 0, err
+}
+
+// interestOwed returns the wallet's unposted accruals for period, their sum
+// and the total owed, which adds the carry of its last posting.
+func interestOwed(tx *gorm.DB, walletID uint64, period string) (ids []uint64, sum, total decimal.Decimal, err error) {
+	var accs []model.InterestAccrual
+	if err = tx.Where("wallet_id = ? AND period = ? AND posting_id IS NULL", walletID, period).
+		Find(&accs).Error; err != nil || len(accs) == 0 {
+		return nil, sum, total, err
+	}
+	ids = make([]uint64, len(accs))
+	for i, a := range accs {
+		sum, ids[i] = sum.Add(a.Amount), a.ID
+	}
+	var prev model.InterestPosting
+	if err = tx.Where("wallet_id = ?", walletID).Order("id desc").Limit(1).Find(&prev).Error; err != nil {
+		return nil, sum, total, err
+	}
+	return ids, sum, sum.Add(prev.Carry), nil
+}
+
+// recordPosting stores posting and marks the accruals ids as paid by it.
+func recordPosting(tx *gorm.DB, posting *model.InterestPosting, ids []uint64) error {
+	if err := tx.Create(posting).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return tx.Model(&model.InterestAccrual{}).Where("id IN ?", ids).Update("posting_id", posting.ID).Error
+}
+
+// checkInterestHouse verifies the interest house wallet h can pay amount in
+// currency.
+func checkInterestHouse(h *model.Wallet, currency string, amount decimal.Decimal) error {
+	if err := checkDebit(h); err != nil {
+		return fmt.Errorf("interest house wallet %d: %w", h.ID, err)
+	}
+	if h.Currency != currency {
+		return fmt.Errorf("interest house wallet %d: %w", h.ID, ErrCurrencyMismatch)
+	}
+	if h.Available().LessThan(amount) {
+		return fmt.Errorf("interest house wallet %d: %w", h.ID, repo.ErrInsufficientFunds)
+	}
+	return nil
+}
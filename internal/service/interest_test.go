@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestDayCount(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		require.NoError(t, err)
+		return d
+	}
+	for _, tc := range []struct {
+		convention, day string
+		days, year      int64
+	}{
+		{config.DayCountAct365, "2028-02-29", 1, 365},
+		{config.DayCountActAct, "2028-06-01", 1, 366},
+		{config.DayCountActAct, "2027-06-01", 1, 365},
+		{config.DayCount30360, "2026-01-31", 0, 360},
+		{config.DayCount30360, "2026-02-28", 3, 360},
+		{config.DayCount30360, "2028-02-29", 2, 360},
+		{config.DayCount30360, "2028-02-28", 1, 360},
+	} {
+		days, year := dayCount(tc.convention, day(tc.day))
+		assert.Equal(t, tc.days, days, tc.convention+" "+tc.day)
+		assert.Equal(t, tc.year, year, tc.convention+" "+tc.day)
+	}
+
+	plan := config.RatePlan{AnnualRate: d("1"), DayCount: config.DayCountAct360, MinBalance: d("10")}
+	assert.Equal(t, "0.027777777777777778", accrual(plan, d("1000"), day("2026-01-05")).String())
+	assert.True(t, accrual(plan, d("9.99"), day("2026-01-05")).IsZero())
+}
+
+func TestInterest(t *testing.T) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	cfg.Interest.HouseWalletID = 9
+	cfg.Interest.Plans = []config.RatePlan{{Name: "savings", AnnualRate: d("3.65"), DayCount: config.DayCountAct365}}
+	svc.cfg = func() *config.Config { return &cfg }
+	for _, id := range []uint64{1, 9} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+		_, err = svc.Deposit(ctx, id, d("1000"), "d1")
+		require.NoError(t, err)
+	}
+
+	_, err := svc.SetRatePlan(ctx, 1, "gold")
+	assert.ErrorIs(t, err, ErrUnknownRatePlan)
+	_, err = svc.SetRatePlan(ctx, 1, "savings")
+	require.NoError(t, err)
+
+	// pretend the wallet was funded and put on the plan at the start of January
+	jan1 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := svc.Repo().DB(ctx)
+	require.NoError(t, db.Model(&model.Wallet{}).Where("id = 1").Update("interest_since", jan1).Error)
+	require.NoError(t, db.Model(&model.Transaction{}).Where("wallet_id = 1").Update("created_at", jan1).Error)
+
+	for _, day := range []int{10, 11, 11} {
+		_, err := svc.AccrueInterest(ctx, time.Date(2026, 1, day, 0, 0, 0, 0, time.UTC))
+		require.NoError(t, err)
+	}
+	sum, err := svc.InterestSummary(ctx, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, "savings", sum.RatePlan)
+	assert.Equal(t, "0.2", sum.Accrued.String()) // 1000 * 3.65% / 365 = 0.1 a day, accrued once per day
+
+	// January isn't over yet
+	n, err := svc.PostInterest(ctx, time.Date(2026, 1, 20, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	feb1 := time.Date(2026, 2, 1, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		n, err = svc.PostInterest(ctx, feb1)
+		require.NoError(t, err)
+		assert.Equal(t, 1-i, n)
+	}
+	w, err := svc.GetWallet(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "1000.2", w.Balance.String())
+	h, err := svc.GetWallet(ctx, 9)
+	require.NoError(t, err)
+	assert.Equal(t, "999.8", h.Balance.String())
+
+	// a paid period takes no more accruals
+	added, err := svc.AccrueInterest(ctx, time.Date(2026, 1, 12, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Zero(t, added)
+
+	sum, err = svc.InterestSummary(ctx, 1, 10)
+	require.NoError(t, err)
+	assert.True(t, sum.Accrued.IsZero())
+	require.Len(t, sum.Postings, 1)
+	assert.Equal(t, "2026-01", sum.Postings[0].Period)
+}
+
+// payingRepo pays out period for wallet id while AccrueInterest waits for the
+// wallet's lock, as a concurrent PostInterest would.
+type payingRepo struct {
+	repo.RepositoryInterface
+	id     uint64
+	period string
+}
+
+func (r *payingRepo) GetWalletForUpdate(ctx context.Context, tx *gorm.DB, id uint64) (*model.Wallet, error) {
+	if id == r.id && r.period != "" {
+		err := tx.Create(&model.InterestPosting{
+			WalletID: id, Period: r.period, HouseWalletID: 9, Accrued: decimal.Zero, Amount: decimal.Zero, Carry: decimal.Zero,
+		}).Error
+		if r.period = ""; err != nil {
+			return nil, err
+		}
+	}
+	return r.RepositoryInterface.GetWalletForUpdate(ctx, tx, id)
+}
+
+func TestAccrueInterest_PostedWhileLocking(t *testing.T) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	cfg.Interest.HouseWalletID = 9
+	cfg.Interest.Plans = []config.RatePlan{{Name: "savings", AnnualRate: d("3.65"), DayCount: config.DayCountAct365}}
+	svc.cfg = func() *config.Config { return &cfg }
+	_, err := svc.CreateWallet(ctx, 1, "")
+	require.NoError(t, err)
+	_, err = svc.Deposit(ctx, 1, d("1000"), "d1")
+	require.NoError(t, err)
+	_, err = svc.SetRatePlan(ctx, 1, "savings")
+	require.NoError(t, err)
+	jan1 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.Wallet{}).Where("id = 1").Update("interest_since", jan1).Error)
+
+	svc.repo = &payingRepo{RepositoryInterface: svc.repo, id: 1, period: "2026-01"}
+	added, err := svc.AccrueInterest(ctx, time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Zero(t, added)
+	var n int64
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.InterestAccrual{}).Count(&n).Error)
+	assert.Zero(t, n)
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// FeatureAutoCreate lets Deposit and Transfer create wallets that don't exist
+// yet (the historical behaviour). Off by default; toggled via features.
+const FeatureAutoCreate = "wallet_auto_create"
+
+var (
+	// ErrWalletNotFound means the wallet doesn't exist (and auto-create is off).
+	ErrWalletNotFound = errors.New("wallet not found")
+	// ErrWalletExists means CreateWallet was asked for an ID already in use.
+	ErrWalletExists = errors.New("wallet already exists")
+	// ErrWalletFrozen means the wallet is frozen and can't move funds.
+	ErrWalletFrozen = errors.New("wallet is frozen")
+	// ErrWalletClosed means the wallet is closed.
+	ErrWalletClosed = errors.New("wallet is closed")
+	// ErrDebitBlocked means the wallet may not be debited.
+	ErrDebitBlocked = errors.New("wallet is blocked for debits")
+	// ErrCreditBlocked means the wallet may not be credited.
+	ErrCreditBlocked = errors.New("wallet is blocked for credits")
+	// ErrBalanceNotZero means a wallet with funds can't be closed.
+	ErrBalanceNotZero = errors.New("wallet balance must be zero to close")
+	// ErrInvalidStatus means an unknown status or a disallowed transition.
+	ErrInvalidStatus = errors.New("invalid wallet status change")
+	// ErrInvalidCurrency means the currency isn't a three-letter ISO 4217 code.
+	ErrInvalidCurrency = errors.New("currency must be a three-letter ISO 4217 code")
+)
+
+// checkDebit returns why funds may not leave w, if they may not.
+func checkDebit(w *model.Wallet) error {
+	switch w.Status {
+	case model.WalletActive, model.WalletCreditBlocked:
+		return nil
+	case model.WalletFrozen:
+		return ErrWalletFrozen
+	case model.WalletDebitBlocked:
+		return ErrDebitBlocked
+	case model.WalletClosed:
+		return ErrWalletClosed
+	case model.WalletMoved:
+		return ErrWalletMoved
+	}
+	return ErrInvalidStatus
+}
+
+// checkCredit returns why funds may not enter w, if they may not.
+func checkCredit(w *model.Wallet) error {
+	switch w.Status {
+	case model.WalletActive, model.WalletDebitBlocked:
+		return nil
+	case model.WalletFrozen:
+		return ErrWalletFrozen
+	case model.WalletCreditBlocked:
+		return ErrCreditBlocked
+	case model.WalletClosed:
+		return ErrWalletClosed
+	case model.WalletMoved:
+		return ErrWalletMoved
+	}
+	return ErrInvalidStatus
+}
+
+// lockOrCreate locks the wallet row, creating it when auto-create is enabled.
+func (s *WalletService) lockOrCreate(ctx context.Context, tx *gorm.DB, id uint64) (*model.Wallet, error) {
+	w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+	if err == nil {
+		return w, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if !s.cfg().Feature(FeatureAutoCreate) {
+		return nil, ErrWalletNotFound
+	}
+	w = &model.Wallet{ID: id, Balance: decimal.Zero, Status: model.WalletActive, Currency: model.DefaultCurrency}
+	if err := s.repo.CreateWallet(ctx, tx, w); err != nil {
+		return nil, err
+	}
+	if err := s.emit(ctx, tx, id, "WalletCreated", map[string]interface{}{"wallet_id": id, "auto": true}); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// emit writes a Wallet outbox event inside tx.
+func (s *WalletService) emit(ctx context.Context, tx *gorm.DB, walletID uint64, eventType string, payload interface{}) error {
+	return s.emitFor(ctx, tx, "Wallet", walletID, eventType, payload)
+}
+
+// emitFor writes an outbox event for any aggregate inside tx.
+func (s *WalletService) emitFor(ctx context.Context, tx *gorm.DB, aggregate string, id uint64, eventType string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return s.repo.CreateOutboxEvent(ctx, tx, &model.OutboxEvent{
+		Aggregate: aggregate, AggregateID: id, EventType: eventType, Payload: string(body),
+	})
+}
+
+// CreateWallet opens a new ACTIVE wallet. id 0 lets the database, or with
+// several shards the shard directory, assign one; an empty currency means USD.
+func (s *WalletService) CreateWallet(ctx context.Context, id uint64, currency string) (*model.Wallet, error) {
+	if currency == "" {
+		currency = model.DefaultCurrency
+	}
+	if !validCurrency(currency) {
+		return nil, ErrInvalidCurrency
+	}
+	var shard int
+	var err error
+	if id == 0 {
+		id, shard, err = s.repo.AllocateWallet(ctx)
+	} else {
+		shard, err = s.repo.PlaceWallet(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx = repo.OnShard(ctx, shard)
+	w := &model.Wallet{ID: id, Balance: decimal.Zero, Status: model.WalletActive, Currency: currency}
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if id != 0 {
+			var n int64
+			if err := tx.Model(&model.Wallet{}).Where("id = ?", id).Count(&n).Error; err != nil {
+				return err
+			}
+			if n > 0 {
+				return ErrWalletExists
+			}
+		}
+		if err := s.repo.CreateWallet(ctx, tx, w); err != nil {
+			return err
+		}
+		return s.emit(ctx, tx, w.ID, "WalletCreated", map[string]interface{}{"wallet_id": w.ID, "currency": w.Currency})
+	})
+	if err != nil {
+		// a concurrent create of the same ID won between the check and the
+		// insert, which then failed on the primary key
+		var n int64
+		if id != 0 && s.repo.DB(ctx).Model(&model.Wallet{}).Where("id = ?", id).Count(&n).Error == nil && n > 0 {
+			return nil, ErrWalletExists
+		}
+		return nil, err
+	}
+	return w, nil
+}
+
+func validCurrency(c string) bool {
+	if len(c) != 3 {
+		return false
+	}
+	for _, r := range c {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// GetWallet returns the wallet row.
+func (s *WalletService) GetWallet(ctx context.Context, id uint64) (*model.Wallet, error) {
+	ctx, err := s.route(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var w model.Wallet
+	if err := s.repo.DB(ctx).Where("id = ?", id).First(&w).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWalletNotFound
+		}
+		return nil, err
+	}
+	return &w, nil
+}
+
+// Freeze blocks all movements on the wallet.
+func (s *WalletService) Freeze(ctx context.Context, id uint64, reason string) (*model.Wallet, error) {
+	return s.SetStatus(ctx, id, model.WalletFrozen, reason)
+}
+
+// Unfreeze returns a frozen wallet to ACTIVE.
+func (s *WalletService) Unfreeze(ctx context.Context, id uint64, reason string) (*model.Wallet, error) {
+	return s.changeStatus(ctx, id, model.WalletActive, reason, func(w *model.Wallet) error {
+		if w.Status != model.WalletFrozen {
+			return ErrInvalidStatus
+		}
+		return nil
+	})
+}
+
+// Close permanently closes a wallet whose balance is zero.
+func (s *WalletService) Close(ctx context.Context, id uint64, reason string) (*model.Wallet, error) {
+	return s.changeStatus(ctx, id, model.WalletClosed, reason, func(w *model.Wallet) error {
+		if !w.Balance.IsZero() || !w.Held.IsZero() || !w.PendingIn.IsZero() {
+			return ErrBalanceNotZero
+		}
+		return nil
+	})
+}
+
+// SetStatus moves a wallet to any non-CLOSED status (use Close to close).
+func (s *WalletService) SetStatus(ctx context.Context, id uint64, status, reason string) (*model.Wallet, error) {
+	if !model.ValidWalletStatus(status) || status == model.WalletClosed {
+		return nil, ErrInvalidStatus
+	}
+	return s.changeStatus(ctx, id, status, reason, nil)
+}
+
+// changeStatus locks the wallet, applies check, updates the status and emits an event.
+func (s *WalletService) changeStatus(ctx context.Context, id uint64, status, reason string, check func(w *model.Wallet) error) (*model.Wallet, error) {
+	ctx, err := s.route(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var out *model.Wallet
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrWalletNotFound
+			}
+			return err
+		}
+		if w.Status == model.WalletClosed {
+			return ErrWalletClosed
+		}
+		if w.Status == model.WalletMoved {
+			return ErrWalletMoved
+		}
+		if check != nil {
+			if err := check(w); err != nil {
+				return err
+			}
+		}
+		if w.Status == status {
+			out = w
+			return nil
+		}
+		if err := s.repo.UpdateWalletStatus(ctx, tx, id, status, w.Version); err != nil {
+			return err
+		}
+		if err := s.emit(ctx, tx, id, statusEvent(status), map[string]interface{}{
+			"wallet_id": id, "from": w.Status, "to": status, "reason": reason,
+		}); err != nil {
+			return err
+		}
+		w.Status, w.Version = status, w.Version+1
+		out = w
+		return nil
+	})
+	return out, err
+}
+
+func statusEvent(status string) string {
+	switch status {
+	case model.WalletFrozen:
+		return "WalletFrozen"
+	case model.WalletActive:
+		return "WalletActivated"
+	case model.WalletClosed:
+		return "WalletClosed"
+	}
+	return "WalletStatusChanged"
+}
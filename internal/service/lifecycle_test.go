@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestWalletLifecycle(t *testing.T) {
+	svc, ctx := newTestService(t)
+
+	w1, err := svc.CreateWallet(ctx, 1, "")
+	require.NoError(t, err)
+	assert.Equal(t, model.WalletActive, w1.Status)
+	_, err = svc.CreateWallet(ctx, 1, "")
+	assert.ErrorIs(t, err, ErrWalletExists)
+	_, err = svc.CreateWallet(ctx, 2, "")
+	require.NoError(t, err)
+
+	// no implicit creation
+	_, err = svc.Deposit(ctx, 99, decimal.NewFromInt(1), "d99")
+	assert.ErrorIs(t, err, ErrWalletNotFound)
+
+	_, err = svc.Deposit(ctx, 1, decimal.NewFromInt(100), "d1")
+	require.NoError(t, err)
+
+	// frozen blocks both directions
+	_, err = svc.Freeze(ctx, 1, "fraud review")
+	require.NoError(t, err)
+	_, err = svc.Withdraw(ctx, 1, decimal.NewFromInt(1), "w1")
+	assert.ErrorIs(t, err, ErrWalletFrozen)
+	_, _, err = svc.Transfer(ctx, 2, 1, decimal.NewFromInt(1), "t0")
+	assert.ErrorIs(t, err, ErrWalletFrozen)
+	_, err = svc.Unfreeze(ctx, 1, "cleared")
+	require.NoError(t, err)
+
+	// debit-blocked wallets still receive funds
+	_, err = svc.SetStatus(ctx, 2, model.WalletDebitBlocked, "")
+	require.NoError(t, err)
+	_, _, err = svc.Transfer(ctx, 1, 2, decimal.NewFromInt(40), "t1")
+	require.NoError(t, err)
+	_, _, err = svc.Transfer(ctx, 2, 1, decimal.NewFromInt(10), "t2")
+	assert.ErrorIs(t, err, ErrDebitBlocked)
+
+	// close requires zero balance and is terminal
+	_, err = svc.Close(ctx, 1, "")
+	assert.ErrorIs(t, err, ErrBalanceNotZero)
+	_, err = svc.Withdraw(ctx, 1, decimal.NewFromInt(60), "w2")
+	require.NoError(t, err)
+	closed, err := svc.Close(ctx, 1, "customer request")
+	require.NoError(t, err)
+	assert.Equal(t, model.WalletClosed, closed.Status)
+	_, err = svc.Unfreeze(ctx, 1, "")
+	assert.ErrorIs(t, err, ErrWalletClosed)
+	_, err = svc.Deposit(ctx, 1, decimal.NewFromInt(1), "d2")
+	assert.ErrorIs(t, err, ErrWalletClosed)
+
+	var events []model.OutboxEvent
+	require.NoError(t, svc.Repo().DB(ctx).Where("event_type LIKE ?", "Wallet%").Order("id").Find(&events).Error)
+	var types []string
+	for _, e := range events {
+		types = append(types, e.EventType)
+	}
+	assert.Equal(t, []string{"WalletCreated", "WalletCreated", "WalletFrozen", "WalletActivated", "WalletStatusChanged", "WalletClosed"}, types)
+}
+
+// racingRepo loses every wallet insert to a concurrent create of the same ID,
+// which commits as the losing transaction rolls back.
+type racingRepo struct {
+	repo.RepositoryInterface
+	lost *model.Wallet
+}
+
+func (r *racingRepo) CreateWallet(ctx context.Context, tx *gorm.DB, w *model.Wallet) error {
+	r.lost = w
+	return errors.New("UNIQUE constraint failed: wallet.id")
+}
+
+func (r *racingRepo) DB(ctx context.Context) *gorm.DB {
+	if w := r.lost; w != nil {
+		r.lost = nil
+		r.RepositoryInterface.DB(ctx).Create(&model.Wallet{ID: w.ID, Status: model.WalletActive, Currency: w.Currency})
+	}
+	return r.RepositoryInterface.DB(ctx)
+}
+
+func TestCreateWallet_Race(t *testing.T) {
+	svc, ctx := newTestService(t)
+	svc.repo = &racingRepo{RepositoryInterface: svc.repo}
+	_, err := svc.CreateWallet(ctx, 7, "")
+	assert.ErrorIs(t, err, ErrWalletExists)
+}
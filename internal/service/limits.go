@@ -0,0 +1,328 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Operation kinds checked by the limits engine.
+const (
+	LimitKindWithdraw = "withdraw"
+	LimitKindTransfer = "transfer"
+)
+
+const (
+	dayWindow   = 24 * time.Hour
+	monthWindow = 30 * 24 * time.Hour
+)
+
+// ErrLimitExceeded is matched (errors.Is) by every *LimitExceededError.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// ErrLimitProfileNotFound means the referenced limit profile doesn't exist.
+var ErrLimitProfileNotFound = errors.New("limit profile not found")
+
+// LimitExceededError says which limit was hit and when enough of it frees up
+// for the attempted amount to fit.
+type LimitExceededError struct {
+	Limit     string          `json:"limit"`
+	Max       decimal.Decimal `json:"max"`
+	Used      decimal.Decimal `json:"used"`
+	Attempted decimal.Decimal `json:"attempted"`
+	ResetsAt  *time.Time      `json:"resets_at,omitempty"`
+}
+
+func (e *LimitExceededError) Error() string {
+	msg := fmt.Sprintf("limit exceeded: %s (max %s, used %s, attempted %s)", e.Limit, e.Max, e.Used, e.Attempted)
+	if e.ResetsAt != nil {
+		msg += " resets at " + e.ResetsAt.UTC().Format(time.RFC3339)
+	}
+	return msg
+}
+
+// Is makes errors.Is(err, ErrLimitExceeded) work.
+func (e *LimitExceededError) Is(target error) bool { return target == ErrLimitExceeded }
+
+// LimitUsage reports one limit's consumption for a wallet.
+type LimitUsage struct {
+	Limit     string          `json:"limit"`
+	Max       decimal.Decimal `json:"max"`
+	Used      decimal.Decimal `json:"used"`
+	Remaining decimal.Decimal `json:"remaining"`
+}
+
+// windowLimit is an amount cap over a rolling window for some transaction types.
+type windowLimit struct {
+	name   string
+	max    decimal.Decimal
+	window time.Duration
+	types  []string
+}
+
+func amountLimits(p *model.LimitProfile, kind string) []windowLimit {
+	switch kind {
+	case LimitKindWithdraw:
+		return []windowLimit{
+			{"daily_withdraw", p.DailyWithdraw, dayWindow, []string{"WITHDRAW"}},
+			{"monthly_withdraw", p.MonthlyWithdraw, monthWindow, []string{"WITHDRAW"}},
+		}
+	case LimitKindTransfer:
+		return []windowLimit{
+			{"daily_transfer", p.DailyTransfer, dayWindow, []string{"TRANSFER_OUT", TxSplitOut, TxEscrowHold}},
+			{"monthly_transfer", p.MonthlyTransfer, monthWindow, []string{"TRANSFER_OUT", TxSplitOut, TxEscrowHold}},
+		}
+	}
+	return nil
+}
+
+// debitTypes are counted by the hourly velocity limit.
+var debitTypes = []string{"WITHDRAW", "TRANSFER_OUT", TxSplitOut, TxEscrowHold}
+
+// profileFor returns the wallet's limit profile, the "default" profile, or nil.
+func (s *WalletService) profileFor(ctx context.Context, tx *gorm.DB, w *model.Wallet) (*model.LimitProfile, error) {
+	var p model.LimitProfile
+	q := tx.WithContext(ctx)
+	if w.LimitProfileID != nil {
+		q = q.Where("id = ?", *w.LimitProfileID)
+	} else {
+		q = q.Where("name = ?", model.DefaultLimitProfile)
+	}
+	err := q.First(&p).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// checkLimits enforces w's limit profile for a debit of amt. It must run
+// inside tx after w is locked, so concurrent debits see each other's rows.
+func (s *WalletService) checkLimits(ctx context.Context, tx *gorm.DB, w *model.Wallet, kind string, amt decimal.Decimal) error {
+	p, err := s.profileFor(ctx, tx, w)
+	if err != nil || p == nil {
+		return err
+	}
+	now := time.Now()
+	if p.PerTxMax.IsPositive() && amt.GreaterThan(p.PerTxMax) {
+		return &LimitExceededError{Limit: "per_tx_max", Max: p.PerTxMax, Used: decimal.Zero, Attempted: amt}
+	}
+	for _, l := range amountLimits(p, kind) {
+		if !l.max.IsPositive() {
+			continue
+		}
+		rows, err := s.windowRows(ctx, tx, w.ID, l.types, now.Add(-l.window))
+		if err != nil {
+			return err
+		}
+		used := decimal.Zero
+		for _, r := range rows {
+			used = used.Add(r.Amount)
+		}
+		if used.Add(amt).LessThanOrEqual(l.max) {
+			continue
+		}
+		e := &LimitExceededError{Limit: l.name, Max: l.max, Used: used, Attempted: amt}
+		if amt.LessThanOrEqual(l.max) {
+			// walk rows oldest first until enough has left the window
+			freed := decimal.Zero
+			for _, r := range rows {
+				freed = freed.Add(r.Amount)
+				if used.Sub(freed).Add(amt).LessThanOrEqual(l.max) {
+					at := r.CreatedAt.Add(l.window)
+					e.ResetsAt = &at
+					break
+				}
+			}
+		}
+		return e
+	}
+	if p.HourlyCount > 0 {
+		rows, err := s.windowRows(ctx, tx, w.ID, debitTypes, now.Add(-time.Hour))
+		if err != nil {
+			return err
+		}
+		if len(rows) >= p.HourlyCount {
+			at := rows[len(rows)-p.HourlyCount].CreatedAt.Add(time.Hour)
+			return &LimitExceededError{
+				Limit: "hourly_count", Max: decimal.NewFromInt(int64(p.HourlyCount)),
+				Used: decimal.NewFromInt(int64(len(rows))), Attempted: decimal.NewFromInt(1), ResetsAt: &at,
+			}
+		}
+	}
+	return nil
+}
+
+// windowRows returns the wallet's transactions of the given types since t,
+// oldest first. External withdrawals still in flight count as withdrawn when
+// they were requested.
+func (s *WalletService) windowRows(ctx context.Context, tx *gorm.DB, walletID uint64, types []string, since time.Time) ([]model.Transaction, error) {
+	var rows []model.Transaction
+	err := tx.WithContext(ctx).
+		Select("amount", "created_at").
+		Where("wallet_id = ? AND type IN ? AND created_at > ?", walletID, types, since).
+		Order("created_at asc").
+		Find(&rows).Error
+	if err != nil || !slices.Contains(types, "WITHDRAW") {
+		return rows, err
+	}
+	var open []model.Transaction
+	if err := tx.WithContext(ctx).Model(&model.Withdrawal{}).
+		Select("amount", "created_at").
+		Where("wallet_id = ? AND status IN ? AND created_at > ?",
+			walletID, []string{model.WithdrawalPending, model.WithdrawalSubmitted}, since).
+		Find(&open).Error; err != nil {
+		return nil, err
+	}
+	if len(open) == 0 {
+		return rows, nil
+	}
+	rows = append(rows, open...)
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].CreatedAt.Before(rows[j].CreatedAt) })
+	return rows, nil
+}
+
+// LimitUsage reports current consumption of every limit in the wallet's profile.
+func (s *WalletService) LimitUsage(ctx context.Context, walletID uint64) (*model.LimitProfile, []LimitUsage, error) {
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := s.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, nil, err
+	}
+	db := s.repo.DB(ctx)
+	p, err := s.profileFor(ctx, db, w)
+	if err != nil || p == nil {
+		return p, nil, err
+	}
+	now := time.Now()
+	var out []LimitUsage
+	for _, kind := range []string{LimitKindWithdraw, LimitKindTransfer} {
+		for _, l := range amountLimits(p, kind) {
+			if !l.max.IsPositive() {
+				continue
+			}
+			rows, err := s.windowRows(ctx, db, walletID, l.types, now.Add(-l.window))
+			if err != nil {
+				return nil, nil, err
+			}
+			used := decimal.Zero
+			for _, r := range rows {
+				used = used.Add(r.Amount)
+			}
+			out = append(out, LimitUsage{Limit: l.name, Max: l.max, Used: used, Remaining: decimal.Max(l.max.Sub(used), decimal.Zero)})
+		}
+	}
+	if p.HourlyCount > 0 {
+		rows, err := s.windowRows(ctx, db, walletID, debitTypes, now.Add(-time.Hour))
+		if err != nil {
+			return nil, nil, err
+		}
+		max, used := decimal.NewFromInt(int64(p.HourlyCount)), decimal.NewFromInt(int64(len(rows)))
+		out = append(out, LimitUsage{Limit: "hourly_count", Max: max, Used: used, Remaining: decimal.Max(max.Sub(used), decimal.Zero)})
+	}
+	return p, out, nil
+}
+
+// SaveLimitProfile creates the profile (ID 0) or updates it. Profiles are
+// kept on shard 0 and copied to the other shards, where the wallets using
+// them read them; saving a profile again repairs a copy that failed.
+func (s *WalletService) SaveLimitProfile(ctx context.Context, p *model.LimitProfile) error {
+	for _, v := range []decimal.Decimal{p.PerTxMax, p.DailyWithdraw, p.MonthlyWithdraw, p.DailyTransfer, p.MonthlyTransfer} {
+		if v.IsNegative() {
+			return ErrInvalidAmount
+		}
+	}
+	if p.HourlyCount < 0 || p.Name == "" {
+		return errors.New("limit profile needs a name and non-negative limits")
+	}
+	if p.ID == 0 {
+		if err := s.repo.DB(ctx).Create(p).Error; err != nil {
+			return err
+		}
+		return s.copyLimitProfile(ctx, p.ID)
+	}
+	res := s.repo.DB(ctx).Model(&model.LimitProfile{}).Where("id = ?", p.ID).Updates(map[string]interface{}{
+		"name":             p.Name,
+		"per_tx_max":       p.PerTxMax,
+		"daily_withdraw":   p.DailyWithdraw,
+		"monthly_withdraw": p.MonthlyWithdraw,
+		"daily_transfer":   p.DailyTransfer,
+		"monthly_transfer": p.MonthlyTransfer,
+		"hourly_count":     p.HourlyCount,
+		"updated_at":       time.Now(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrLimitProfileNotFound
+	}
+	return s.copyLimitProfile(ctx, p.ID)
+}
+
+// copyLimitProfile writes profile id as it is on shard 0 to the other shards.
+func (s *WalletService) copyLimitProfile(ctx context.Context, id uint64) error {
+	var p model.LimitProfile
+	if err := s.repo.DB(ctx).Where("id = ?", id).First(&p).Error; err != nil {
+		return err
+	}
+	for _, shard := range s.repo.Shards()[1:] {
+		if err := s.repo.DB(repo.OnShard(ctx, shard)).Clauses(clause.OnConflict{UpdateAll: true}).Create(&p).Error; err != nil {
+			return fmt.Errorf("shard %d: %w", shard, err)
+		}
+	}
+	return nil
+}
+
+// ListLimitProfiles returns all profiles.
+func (s *WalletService) ListLimitProfiles(ctx context.Context) ([]model.LimitProfile, error) {
+	var ps []model.LimitProfile
+	err := s.repo.DB(ctx).Order("id").Find(&ps).Error
+	return ps, err
+}
+
+// AssignLimitProfile sets (or with nil clears) the wallet's limit profile.
+func (s *WalletService) AssignLimitProfile(ctx context.Context, walletID uint64, profileID *uint64) error {
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	return s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if _, err := s.repo.GetWalletForUpdate(ctx, tx, walletID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrWalletNotFound
+			}
+			return err
+		}
+		if profileID != nil {
+			var n int64
+			if err := tx.Model(&model.LimitProfile{}).Where("id = ?", *profileID).Count(&n).Error; err != nil {
+				return err
+			}
+			if n == 0 {
+				return ErrLimitProfileNotFound
+			}
+		}
+		if err := tx.Model(&model.Wallet{}).Where("id = ?", walletID).
+			Update("limit_profile_id", profileID).Error; err != nil {
+			return err
+		}
+		return s.emit(ctx, tx, walletID, "WalletLimitProfileChanged", map[string]interface{}{
+			"wallet_id": walletID, "limit_profile_id": profileID,
+		})
+	})
+}
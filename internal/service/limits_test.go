@@ -0,0 +1,68 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits_Enforced(t *testing.T) {
+	svc, ctx := newTestService(t)
+	for _, id := range []uint64{1, 2} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, decimal.NewFromInt(1000), "seed")
+	require.NoError(t, err)
+
+	p := &model.LimitProfile{
+		Name:          "basic",
+		PerTxMax:      decimal.NewFromInt(300),
+		DailyWithdraw: decimal.NewFromInt(250),
+		DailyTransfer: decimal.NewFromInt(500),
+		HourlyCount:   3,
+	}
+	require.NoError(t, svc.SaveLimitProfile(ctx, p))
+	require.NoError(t, svc.AssignLimitProfile(ctx, 1, &p.ID))
+
+	_, err = svc.Withdraw(ctx, 1, decimal.NewFromInt(301), "w0")
+	var le *LimitExceededError
+	require.ErrorAs(t, err, &le)
+	assert.Equal(t, "per_tx_max", le.Limit)
+
+	_, err = svc.Withdraw(ctx, 1, decimal.NewFromInt(200), "w1")
+	require.NoError(t, err)
+	_, err = svc.Withdraw(ctx, 1, decimal.NewFromInt(100), "w2")
+	require.ErrorIs(t, err, ErrLimitExceeded)
+	require.ErrorAs(t, err, &le)
+	assert.Equal(t, "daily_withdraw", le.Limit)
+	assert.Equal(t, "200", le.Used.String())
+	require.NotNil(t, le.ResetsAt)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), *le.ResetsAt, time.Minute)
+
+	// transfers have their own budget, but share the hourly count
+	_, _, err = svc.Transfer(ctx, 1, 2, decimal.NewFromInt(50), "t1")
+	require.NoError(t, err)
+	_, _, err = svc.Transfer(ctx, 1, 2, decimal.NewFromInt(50), "t2")
+	require.NoError(t, err)
+	_, _, err = svc.Transfer(ctx, 1, 2, decimal.NewFromInt(50), "t3")
+	require.ErrorAs(t, err, &le)
+	assert.Equal(t, "hourly_count", le.Limit)
+
+	_, usage, err := svc.LimitUsage(ctx, 1)
+	require.NoError(t, err)
+	got := map[string]string{}
+	for _, u := range usage {
+		got[u.Limit] = fmt.Sprintf("%s/%s", u.Used, u.Max)
+	}
+	assert.Equal(t, map[string]string{"daily_withdraw": "200/250", "daily_transfer": "100/500", "hourly_count": "3/3"}, got)
+
+	// wallet 2 has no profile and no default exists: unlimited
+	_, err = svc.Withdraw(ctx, 2, decimal.NewFromInt(100), "w3")
+	assert.NoError(t, err)
+}
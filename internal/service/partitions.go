@@ -0,0 +1,540 @@
+package service
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"gorm.io/gorm"
+)
+
+// defaultPartition catches ledger rows of months without a partition.
+const defaultPartition = "transaction_default"
+
+// archiveLockID is the advisory lock serialising archiving between scheduler
+// replicas, an arbitrary constant like the migrator's.
+const archiveLockID = 727274002
+
+// ErrArchiveUnavailable means history reaches into archived months but the
+// archive can't be read.
+var ErrArchiveUnavailable = errors.New("transaction archive unavailable")
+
+func startOfMonth(t time.Time) time.Time {
+	y, m, _ := t.UTC().Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// partitionName names the ledger partition holding month.
+func partitionName(month time.Time) string {
+	return "transaction_p" + month.Format("2006_01")
+}
+
+func parsePartitionName(name string) (time.Time, bool) {
+	m, err := time.Parse("2006_01", strings.TrimPrefix(name, "transaction_p"))
+	return m, err == nil && strings.HasPrefix(name, "transaction_p")
+}
+
+// partitioned reports whether the ledger is a partitioned Postgres table;
+// elsewhere (tests) it is a plain table and archiving deletes rows instead.
+func (s *WalletService) partitioned(ctx context.Context) bool {
+	return s.repo.DB(ctx).Dialector.Name() == "postgres"
+}
+
+// MaintainPartitions creates the coming months' ledger partitions and
+// archives the months past the retention.
+func (s *WalletService) MaintainPartitions(ctx context.Context, now time.Time) ([]string, []model.TransactionArchive, error) {
+	created, err := s.EnsurePartitions(ctx, now)
+	if err != nil {
+		return created, nil, err
+	}
+	archived, err := s.ArchivePartitions(ctx, now)
+	return created, archived, err
+}
+
+// EnsurePartitions creates the partitions from now's month through
+// AheadMonths ahead and returns the ones it created.
+func (s *WalletService) EnsurePartitions(ctx context.Context, now time.Time) ([]string, error) {
+	if !s.partitioned(ctx) {
+		return nil, nil
+	}
+	var created []string
+	month := startOfMonth(now)
+	for i := 0; i <= s.cfg().Partitions.AheadMonths; i++ {
+		ok, err := s.createPartition(ctx, month.AddDate(0, i, 0))
+		if err != nil {
+			return created, err
+		}
+		if ok {
+			created = append(created, partitionName(month.AddDate(0, i, 0)))
+		}
+	}
+	return created, nil
+}
+
+// createPartition creates month's partition unless it exists. Rows of the
+// month already in the default partition are moved into it.
+func (s *WalletService) createPartition(ctx context.Context, month time.Time) (bool, error) {
+	name := partitionName(month)
+	db := s.repo.DB(ctx)
+	var exists bool
+	if err := db.Raw("SELECT to_regclass(?) IS NOT NULL", name).Scan(&exists).Error; err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	from, to := month, month.AddDate(0, 1, 0)
+	create := fmt.Sprintf("CREATE TABLE %s PARTITION OF transaction FOR VALUES FROM ('%s') TO ('%s')",
+		name, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var stray int64
+		if err := tx.Table(defaultPartition).Where("created_at >= ? AND created_at < ?", from, to).
+			Count(&stray).Error; err != nil {
+			return err
+		}
+		if stray == 0 {
+			return tx.Exec(create).Error
+		}
+		rng := map[string]interface{}{"from": from, "to": to}
+		for _, st := range []struct {
+			sql  string
+			args []interface{}
+		}{
+			{"ALTER TABLE transaction DETACH PARTITION " + defaultPartition, nil},
+			{create, nil},
+			{"INSERT INTO transaction SELECT * FROM " + defaultPartition + " WHERE created_at >= @from AND created_at < @to", []interface{}{rng}},
+			{"DELETE FROM " + defaultPartition + " WHERE created_at >= @from AND created_at < @to", []interface{}{rng}},
+			{"ALTER TABLE transaction ATTACH PARTITION " + defaultPartition + " DEFAULT", nil},
+		} {
+			if err := tx.Exec(st.sql, st.args...).Error; err != nil {
+				return err
+			}
+		}
+		s.log.Warnf("moved %d rows from %s into %s", stray, defaultPartition, name)
+		return nil
+	})
+	return err == nil, err
+}
+
+// ArchivePartitions moves every month that ended more than ArchiveAfterMonths
+// months before now out of the database into ArchiveDir. Replicas running it
+// at once take turns, and the later ones find the months gone.
+func (s *WalletService) ArchivePartitions(ctx context.Context, now time.Time) ([]model.TransactionArchive, error) {
+	pc := s.cfg().Partitions
+	if pc.ArchiveAfterMonths == 0 {
+		return nil, nil
+	}
+	var out []model.TransactionArchive
+	err := s.withArchiveLock(ctx, func() error {
+		months, err := s.liveMonthsBefore(ctx, startOfMonth(now).AddDate(0, -pc.ArchiveAfterMonths, 0))
+		if err != nil {
+			return err
+		}
+		for _, m := range months {
+			a, err := s.archiveMonth(ctx, pc.ArchiveDir, m)
+			if err != nil {
+				return fmt.Errorf("archive %s: %w", partitionName(m), err)
+			}
+			out = append(out, *a)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// withArchiveLock runs fn holding the archive lock on ctx's shard, taken on a
+// dedicated connection as the migrator takes its lock.
+func (s *WalletService) withArchiveLock(ctx context.Context, fn func() error) error {
+	if !s.partitioned(ctx) {
+		return fn()
+	}
+	sqlDB, err := s.repo.DB(ctx).DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", archiveLockID); err != nil {
+		return fmt.Errorf("acquire archive lock: %w", err)
+	}
+	defer func() {
+		// use a fresh context so the lock is released even if ctx was cancelled
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", archiveLockID); err != nil {
+			s.log.Warnf("release archive lock: %v", err)
+		}
+	}()
+	return fn()
+}
+
+// liveMonthsBefore lists the months before cutoff still in the database.
+func (s *WalletService) liveMonthsBefore(ctx context.Context, cutoff time.Time) ([]time.Time, error) {
+	db := s.repo.DB(ctx)
+	var months []time.Time
+	if s.partitioned(ctx) {
+		var names []string
+		if err := db.Raw(`SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+			WHERE i.inhparent = 'transaction'::regclass`).Scan(&names).Error; err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if m, ok := parsePartitionName(n); ok && m.Before(cutoff) {
+				months = append(months, m)
+			}
+		}
+		sort.Slice(months, func(i, j int) bool { return months[i].Before(months[j]) })
+		return months, nil
+	}
+	var oldest []model.Transaction
+	if err := db.Where("created_at < ?", cutoff).Order("created_at").Limit(1).Find(&oldest).Error; err != nil {
+		return nil, err
+	}
+	if len(oldest) == 0 {
+		return nil, nil
+	}
+	for m := startOfMonth(oldest[0].CreatedAt); m.Before(cutoff); m = m.AddDate(0, 1, 0) {
+		months = append(months, m)
+	}
+	return months, nil
+}
+
+// archiveMonth writes month's rows to dir, then records the archive and drops
+// the partition in one transaction. The row count is checked again inside it,
+// so nothing written after the export can be dropped unarchived, and the file
+// is read back so nothing is dropped that the archive doesn't hold.
+func (s *WalletService) archiveMonth(ctx context.Context, dir string, month time.Time) (*model.TransactionArchive, error) {
+	name := partitionName(month)
+	from, to := month, month.AddDate(0, 1, 0)
+	a := &model.TransactionArchive{
+		PartitionName: name, RangeFrom: from, RangeTo: to, Location: name + ".jsonl.gz", Indexed: true,
+	}
+	if shard := repo.ShardFrom(ctx); shard != 0 {
+		// shards have partitions of the same names
+		a.Location = filepath.Join(fmt.Sprintf("shard%d", shard), a.Location)
+	}
+	n, sum, segs, err := s.exportMonth(ctx, filepath.Join(dir, a.Location), from, to)
+	if err != nil {
+		return nil, err
+	}
+	a.RowCount, a.SHA256 = n, sum
+	err = s.repo.DB(ctx).Transaction(func(tx *gorm.DB) error {
+		var live int64
+		if err := tx.Model(&model.Transaction{}).Where("created_at >= ? AND created_at < ?", from, to).
+			Count(&live).Error; err != nil {
+			return err
+		}
+		if live != n {
+			return fmt.Errorf("%d rows exported but %d in the database", n, live)
+		}
+		if err := verifyArchive(filepath.Join(dir, a.Location), n, sum); err != nil {
+			return err
+		}
+		if err := tx.Create(a).Error; err != nil {
+			return err
+		}
+		for i := range segs {
+			segs[i].ArchiveID = a.ID
+		}
+		if err := tx.CreateInBatches(segs, 1000).Error; err != nil {
+			return err
+		}
+		if !s.partitioned(ctx) {
+			return tx.Where("created_at >= ? AND created_at < ?", from, to).Delete(&model.Transaction{}).Error
+		}
+		// stray rows of the month in the default partition were exported too
+		if err := tx.Table(defaultPartition).Where("created_at >= ? AND created_at < ?", from, to).
+			Delete(&model.Transaction{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("ALTER TABLE transaction DETACH PARTITION " + name).Error; err != nil {
+			return err
+		}
+		return tx.Exec("DROP TABLE " + name).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.log.Infof("archived %d ledger rows of %s to %s", n, name, a.Location)
+	return a, nil
+}
+
+// exportMonth writes the rows in [from, to) to path as gzipped JSON lines
+// ordered by (wallet_id, created_at, id), each wallet's in a gzip member of
+// its own, and returns their count, the file's SHA-256 and where each
+// wallet's member is. The file only appears under path once complete.
+func (s *WalletService) exportMonth(ctx context.Context, path string, from, to time.Time) (int64, string, []model.TransactionArchiveSegment, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, "", nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, "", nil, err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	var (
+		segs []model.TransactionArchiveSegment
+		zw   *gzip.Writer
+		enc  *json.Encoder
+		end  int64
+	)
+	// endSegment completes the member being written
+	endSegment := func() error {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		start := end
+		end, err = f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if len(segs) > 0 {
+			segs[len(segs)-1].Size = end - start
+		}
+		return nil
+	}
+	db := s.repo.DB(ctx)
+	rows, err := db.Model(&model.Transaction{}).Where("created_at >= ? AND created_at < ?", from, to).
+		Order("wallet_id, created_at, id").Rows()
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer rows.Close()
+	var n int64
+	for rows.Next() {
+		var t model.Transaction
+		if err := db.ScanRows(rows, &t); err != nil {
+			return 0, "", nil, err
+		}
+		if len(segs) == 0 || segs[len(segs)-1].WalletID != t.WalletID {
+			if zw != nil {
+				if err := endSegment(); err != nil {
+					return 0, "", nil, err
+				}
+			}
+			segs = append(segs, model.TransactionArchiveSegment{WalletID: t.WalletID, Start: end})
+			zw = gzip.NewWriter(w)
+			enc = json.NewEncoder(zw)
+		}
+		if err := enc.Encode(&t); err != nil {
+			return 0, "", nil, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, "", nil, err
+	}
+	if zw == nil {
+		// an empty month is still a valid gzip file
+		zw = gzip.NewWriter(w)
+	}
+	if err := endSegment(); err != nil {
+		return 0, "", nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, "", nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, "", nil, err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), segs, nil
+}
+
+// verifyArchive reads the archive at path back and checks that it has the
+// given SHA-256 and holds rows rows.
+func verifyArchive(path string, rows int64, sum string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("%s has SHA-256 %s, want %s", path, got, sum)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer zr.Close()
+	var n int64
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if n != rows {
+		return fmt.Errorf("%s holds %d rows, want %d", path, n, rows)
+	}
+	return nil
+}
+
+// archivedHistory returns up to limit rows of walletID from the archived
+// months that match q, in q's order.
+func (s *WalletService) archivedHistory(ctx context.Context, walletID uint64, q HistoryQuery, c *historyCursor, limit int) ([]model.Transaction, error) {
+	db, _ := s.repo.ReadDB(ctx)
+	db = db.Model(&model.TransactionArchive{})
+	if q.Since != nil {
+		db = db.Where("range_to > ?", *q.Since)
+	}
+	if q.Until != nil {
+		db = db.Where("range_from < ?", *q.Until)
+	}
+	if c != nil && q.Desc {
+		db = db.Where("range_from <= ?", c.ts)
+	} else if c != nil {
+		db = db.Where("range_to > ?", c.ts)
+	}
+	order := "range_from"
+	if q.Desc {
+		order += " desc"
+	}
+	var archives []model.TransactionArchive
+	if err := db.Order(order).Find(&archives).Error; err != nil {
+		return nil, err
+	}
+	segs, err := s.archiveSegments(ctx, walletID, archives)
+	if err != nil {
+		return nil, err
+	}
+	var out []model.Transaction
+	for _, a := range archives {
+		rows, err := s.readArchive(a, segs[a.ID], walletID, func(t *model.Transaction) bool { return q.matches(t, c) })
+		if err != nil {
+			return nil, err
+		}
+		sortHistory(rows, q.Desc)
+		out = append(out, rows...)
+		if len(out) >= limit {
+			return out[:limit], nil
+		}
+	}
+	return out, nil
+}
+
+// archiveSegments finds walletID's segments in archives, by archive ID.
+func (s *WalletService) archiveSegments(ctx context.Context, walletID uint64, archives []model.TransactionArchive) (map[uint64]*model.TransactionArchiveSegment, error) {
+	var ids []uint64
+	for _, a := range archives {
+		if a.Indexed {
+			ids = append(ids, a.ID)
+		}
+	}
+	out := map[uint64]*model.TransactionArchiveSegment{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	db, _ := s.repo.ReadDB(ctx)
+	var segs []model.TransactionArchiveSegment
+	if err := db.Where("wallet_id = ? AND archive_id IN ?", walletID, ids).Find(&segs).Error; err != nil {
+		return nil, err
+	}
+	for i := range segs {
+		out[segs[i].ArchiveID] = &segs[i]
+	}
+	return out, nil
+}
+
+// readArchive returns walletID's rows in archive a that keep accepts. Of an
+// indexed archive only the wallet's segment seg is read, and nothing when it
+// has none; other archives are scanned up to the wallet's rows.
+func (s *WalletService) readArchive(a model.TransactionArchive, seg *model.TransactionArchiveSegment, walletID uint64, keep func(*model.Transaction) bool) ([]model.Transaction, error) {
+	if a.Indexed && seg == nil {
+		return nil, nil
+	}
+	dir := s.cfg().Partitions.ArchiveDir
+	if dir == "" {
+		return nil, fmt.Errorf("%w: partitions.archive_dir not set", ErrArchiveUnavailable)
+	}
+	f, err := os.Open(filepath.Join(dir, a.Location))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrArchiveUnavailable, err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if seg != nil {
+		r = io.NewSectionReader(f, seg.Start, seg.Size)
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrArchiveUnavailable, a.Location, err)
+	}
+	defer zr.Close()
+	dec := json.NewDecoder(zr)
+	var out []model.Transaction
+	for {
+		var t model.Transaction
+		if err := dec.Decode(&t); err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrArchiveUnavailable, a.Location, err)
+		}
+		if t.WalletID > walletID {
+			return out, nil // rows are ordered by wallet
+		}
+		if t.WalletID == walletID && keep(&t) {
+			out = append(out, t)
+		}
+	}
+}
+
+// archivedBalance returns walletID's last archived row in [from, to), if
+// any; from may be zero.
+func (s *WalletService) archivedBalance(ctx context.Context, walletID uint64, from, to time.Time) (*model.Transaction, error) {
+	db := s.repo.DB(ctx).Where("range_from < ?", to)
+	if !from.IsZero() {
+		db = db.Where("range_to > ?", from)
+	}
+	var archives []model.TransactionArchive
+	if err := db.Order("range_from desc").Find(&archives).Error; err != nil || len(archives) == 0 {
+		return nil, err
+	}
+	segs, err := s.archiveSegments(ctx, walletID, archives)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range archives {
+		rows, err := s.readArchive(a, segs[a.ID], walletID, func(t *model.Transaction) bool {
+			return t.CreatedAt.Before(to) && !t.CreatedAt.Before(from)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) > 0 {
+			// rows are ordered by (created_at, id) within a wallet
+			return &rows[len(rows)-1], nil
+		}
+	}
+	return nil, nil
+}
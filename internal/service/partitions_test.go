@@ -0,0 +1,136 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchivePartitions(t *testing.T) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	cfg.Partitions.ArchiveAfterMonths = 2
+	cfg.Partitions.ArchiveDir = t.TempDir()
+	svc.cfg = func() *config.Config { return &cfg }
+	for _, id := range []uint64{1, 2} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	// two rows in each of January to April, in a different wallet order than by time
+	db := svc.Repo().DB(ctx)
+	for i, month := range []time.Month{1, 1, 2, 2, 3, 3, 4, 4} {
+		_, err := svc.Deposit(ctx, uint64(2-i%2), d("10"), "d"+string(rune('a'+i)))
+		require.NoError(t, err)
+		require.NoError(t, db.Model(&model.Transaction{}).Where("id = ?", i+1).
+			Update("created_at", time.Date(2026, month, 10+i, 0, 0, 0, 0, time.UTC)).Error)
+	}
+	all := func(desc bool, types ...string) []uint64 {
+		var ids []uint64
+		q := HistoryQuery{Limit: 1, Desc: desc, Types: types}
+		for {
+			page, err := svc.GetHistory(ctx, 1, q)
+			require.NoError(t, err)
+			for _, t := range page.Items {
+				ids = append(ids, t.ID)
+			}
+			if page.NextCursor == "" {
+				return ids
+			}
+			q.Cursor = page.NextCursor
+		}
+	}
+	before, beforeDesc := all(false), all(true)
+	require.Equal(t, []uint64{2, 4, 6, 8}, before)
+
+	// nothing to create without Postgres partitions
+	created, err := svc.EnsurePartitions(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, created)
+
+	// on May 2nd, January and February are more than two months past
+	archived, err := svc.ArchivePartitions(ctx, time.Date(2026, 5, 2, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, archived, 2)
+	assert.Equal(t, "transaction_p2026_01", archived[0].PartitionName)
+	assert.EqualValues(t, 2, archived[1].RowCount)
+	assert.Len(t, archived[0].SHA256, 64)
+	assert.FileExists(t, filepath.Join(cfg.Partitions.ArchiveDir, "transaction_p2026_02.jsonl.gz"))
+	var live int64
+	require.NoError(t, db.Model(&model.Transaction{}).Count(&live).Error)
+	assert.EqualValues(t, 4, live)
+
+	// already archived months are not touched again
+	again, err := svc.ArchivePartitions(ctx, time.Date(2026, 5, 3, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Empty(t, again)
+
+	// history pages across archived and live rows as before
+	assert.Equal(t, before, all(false))
+	assert.Equal(t, beforeDesc, all(true))
+	assert.Equal(t, []uint64{2, 4, 6, 8}, all(false, "DEPOSIT"))
+	since := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	page, err := svc.GetHistory(ctx, 1, HistoryQuery{Limit: 10, Since: &since})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 3)
+	assert.Equal(t, "10", page.Items[0].Amount.String())
+
+	// each wallet's rows of a month are found through its segment
+	var segs int64
+	require.NoError(t, db.Model(&model.TransactionArchiveSegment{}).Count(&segs).Error)
+	assert.EqualValues(t, 4, segs)
+	// and balances as of archived months come from the archive
+	for day, want := range map[time.Time]string{
+		time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC):  "0",
+		time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC): "10",
+		time.Date(2026, 2, 20, 0, 0, 0, 0, time.UTC): "20",
+	} {
+		bal, err := svc.GetBalanceAt(ctx, 1, day)
+		require.NoError(t, err)
+		assert.Equal(t, want, bal.String(), day)
+	}
+	// archives without segments are read through
+	require.NoError(t, db.Model(&model.TransactionArchive{}).Where("1 = 1").Update("indexed", false).Error)
+	assert.Equal(t, before, all(false))
+	bal, err := svc.GetBalanceAt(ctx, 1, time.Date(2026, 2, 20, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, "20", bal.String())
+
+	// a missing archive fails loudly rather than returning a gap
+	require.NoError(t, os.Remove(filepath.Join(cfg.Partitions.ArchiveDir, "transaction_p2026_01.jsonl.gz")))
+	_, err = svc.GetHistory(ctx, 1, HistoryQuery{Limit: 10})
+	assert.ErrorIs(t, err, ErrArchiveUnavailable)
+}
+
+func TestVerifyArchive(t *testing.T) {
+	svc, ctx := newTestService(t)
+	_, err := svc.CreateWallet(ctx, 1, "")
+	require.NoError(t, err)
+	for _, key := range []string{"d1", "d2"} {
+		_, err := svc.Deposit(ctx, 1, d("10"), key)
+		require.NoError(t, err)
+	}
+	path := filepath.Join(t.TempDir(), "month.jsonl.gz")
+	now := time.Now()
+	n, sum, segs, err := svc.exportMonth(ctx, path, now.AddDate(0, 0, -1), now.AddDate(0, 0, 1))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, n)
+	require.Len(t, segs, 1)
+	tmps, err := filepath.Glob(path + ".*.tmp")
+	require.NoError(t, err)
+	assert.Empty(t, tmps)
+
+	assert.NoError(t, verifyArchive(path, n, sum))
+	assert.ErrorContains(t, verifyArchive(path, 3, sum), "holds 2 rows")
+
+	// a file replaced after the export no longer matches
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data[:len(data)/2], 0o644))
+	assert.ErrorContains(t, verifyArchive(path, n, sum), "SHA-256")
+}
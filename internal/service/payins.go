@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/settlement"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TxDepositReversal is the transaction type taking back a settled provider
+// deposit the provider reversed.
+const TxDepositReversal = "DEPOSIT_REVERSAL"
+
+var (
+	// ErrUnknownDepositProvider means no deposit provider of that name is
+	// configured.
+	ErrUnknownDepositProvider = errors.New("unknown deposit provider")
+	// ErrDepositMismatch means a notification disagrees with the deposit
+	// already recorded under its reference.
+	ErrDepositMismatch = errors.New("deposit does not match earlier notifications")
+)
+
+// DepositWebhookResult is what became of one deposit webhook, with the
+// deposit it is about.
+type DepositWebhookResult struct {
+	Outcome string                 `json:"outcome"`
+	Deposit *model.ProviderDeposit `json:"deposit,omitempty"`
+}
+
+// depositRank orders deposit statuses; a deposit only ever moves up.
+var depositRank = map[string]int{
+	model.ProviderDepositPending:  1,
+	model.ProviderDepositSettled:  2,
+	model.ProviderDepositReversed: 3,
+}
+
+// depositKey is the idempotency key of the legs a provider deposit posts,
+// hashed when provider and reference don't fit.
+func depositKey(provider, reference string) string {
+	key := provider + ":" + reference
+	if len(key) > 64 {
+		sum := sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// ReceiveDepositWebhook verifies a deposit webhook from provider with its
+// adapter, records the payload for audit and applies it. A deposit goes from
+// PENDING, announced in the wallet's PendingIn, to SETTLED, credited, and may
+// end REVERSED, when a settled amount is debited even into the negative.
+// Steps may be skipped, and notifications repeating or going back on a later
+// status are recorded but change nothing, so providers can deliver them
+// twice and out of order.
+func (s *WalletService) ReceiveDepositWebhook(ctx context.Context, provider string, header http.Header, body []byte) (*DepositWebhookResult, error) {
+	dc := s.cfg().Deposits
+	kind, ok := dc.Providers[provider]
+	if !ok {
+		return nil, ErrUnknownDepositProvider
+	}
+	adapter, err := settlement.NewAdapter(kind, dc.Secrets[provider])
+	if err != nil {
+		return nil, err
+	}
+	if err := adapter.Verify(header, body); err != nil {
+		s.log.Warnf("deposit webhook from %s: %v", provider, err)
+		return nil, err
+	}
+	hook := &model.ProviderWebhook{
+		Provider: provider, Payload: string(body), Outcome: model.WebhookReceived, ReceivedAt: time.Now(),
+	}
+	n, perr := adapter.Parse(body)
+	if perr == nil && len(n.Reference) > 128 {
+		perr = fmt.Errorf("%w: reference longer than 128 characters", settlement.ErrBadPayload)
+	}
+	if perr != nil {
+		hook.Outcome, hook.Error = model.WebhookInvalid, truncate(perr.Error(), 255)
+	} else {
+		hook.Reference, hook.WalletID, hook.State = n.Reference, n.WalletID, n.State
+	}
+	// the record is kept before anything is applied, so every signed
+	// payload can be audited whatever happens next
+	if err := s.repo.DB(ctx).Create(hook).Error; err != nil {
+		return nil, err
+	}
+	if perr != nil {
+		return nil, perr
+	}
+	res, err := s.applyDeposit(ctx, provider, n)
+	outcome, msg := model.WebhookFailed, ""
+	if err != nil {
+		msg = truncate(err.Error(), 255)
+	} else {
+		outcome = res.Outcome
+	}
+	if uerr := s.repo.DB(ctx).Model(hook).Updates(map[string]interface{}{"outcome": outcome, "error": msg}).Error; uerr != nil {
+		s.log.Warnf("deposit webhook %d: recording outcome %s: %v", hook.ID, outcome, uerr)
+	}
+	return res, err
+}
+
+// applyDeposit moves the deposit n is about to n's status, if that is ahead
+// of the status recorded.
+func (s *WalletService) applyDeposit(ctx context.Context, provider string, n settlement.Notification) (*DepositWebhookResult, error) {
+	if err := s.checkAmount(n.Amount); err != nil {
+		return nil, err
+	}
+	ctx, err := s.route(ctx, n.WalletID)
+	if err != nil {
+		return nil, err
+	}
+	res := &DepositWebhookResult{Outcome: model.WebhookApplied}
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		w, err := s.repo.GetWalletForUpdate(ctx, tx, n.WalletID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrWalletNotFound
+		}
+		if err != nil {
+			return err
+		}
+		dep := &model.ProviderDeposit{}
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("provider = ? AND reference = ?", provider, n.Reference).First(dep).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if n.Currency != w.Currency {
+				return ErrCurrencyMismatch
+			}
+			if n.State != model.ProviderDepositReversed {
+				if err := checkCredit(w); err != nil {
+					return err
+				}
+			}
+			dep = &model.ProviderDeposit{
+				Provider: provider, Reference: n.Reference, WalletID: n.WalletID, Currency: n.Currency,
+				Amount: n.Amount, IdempotencyKey: depositKey(provider, n.Reference),
+			}
+		case err != nil:
+			return err
+		case dep.WalletID != n.WalletID || dep.Currency != n.Currency || !dep.Amount.Equal(n.Amount):
+			return ErrDepositMismatch
+		}
+		res.Deposit = dep
+		switch {
+		case depositRank[n.State] == depositRank[dep.Status]:
+			res.Outcome = model.WebhookDuplicate
+			return nil
+		case depositRank[n.State] < depositRank[dep.Status]:
+			res.Outcome = model.WebhookStale
+			return nil
+		}
+		return s.advanceDeposit(ctx, tx, w, dep, n.State)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// advanceDeposit moves dep, new when it has no ID, to status on w, which is
+// locked in tx.
+func (s *WalletService) advanceDeposit(ctx context.Context, tx *gorm.DB, w *model.Wallet, dep *model.ProviderDeposit, status string) error {
+	from, now := dep.Status, time.Now()
+	if from == model.ProviderDepositPending {
+		if err := s.hold(ctx, tx, w, decimal.Zero, dep.Amount.Neg()); err != nil {
+			return err
+		}
+	}
+	p := newPostings(map[uint64]*model.Wallet{w.ID: w})
+	event := "DepositReversed"
+	switch status {
+	case model.ProviderDepositPending:
+		event = "DepositPending"
+		if err := s.hold(ctx, tx, w, decimal.Zero, dep.Amount); err != nil {
+			return err
+		}
+	case model.ProviderDepositSettled:
+		event = "Deposit"
+		p.credit(w.ID, "DEPOSIT", dep.Amount, nil, dep.IdempotencyKey)
+		dep.SettledAt = &now
+	case model.ProviderDepositReversed:
+		if from == model.ProviderDepositSettled {
+			p.debit(w.ID, TxDepositReversal, dep.Amount, nil, dep.IdempotencyKey)
+		}
+		dep.ReversedAt = &now
+	}
+	if err := s.flush(ctx, tx, p); err != nil {
+		return err
+	}
+	dep.Status = status
+	if err := tx.Save(dep).Error; err != nil {
+		return err
+	}
+	return s.emit(ctx, tx, w.ID, event, map[string]interface{}{
+		"wallet_id": w.ID, "amount": dep.Amount, "balance": w.Balance,
+		"provider": dep.Provider, "reference": dep.Reference,
+	})
+}
+
+// ListProviderDeposits lists the deposits providers reported for the wallet,
+// newest first.
+func (s *WalletService) ListProviderDeposits(ctx context.Context, walletID uint64) ([]model.ProviderDeposit, error) {
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	var out []model.ProviderDeposit
+	err = s.repo.DB(ctx).Where("wallet_id = ?", walletID).Order("id desc").Find(&out).Error
+	return out, err
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/settlement"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPayinService returns a service taking deposit webhooks from "acme", a
+// fake provider, for wallet 1; send posts one signed with acme's secret.
+func newPayinService(t *testing.T) (*WalletService, context.Context, func(ref, status, amount string) (*DepositWebhookResult, error)) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	cfg.Cache.Mode = config.CacheOff
+	cfg.Deposits = config.DepositsConfig{
+		Providers: map[string]string{"acme": "fake"},
+		Secrets:   map[string]string{"acme": "s3cr3t"},
+	}
+	svc.cfg = func() *config.Config { return &cfg }
+	_, err := svc.CreateWallet(ctx, 1, "")
+	require.NoError(t, err)
+	fake := settlement.FakeWebhooks{Secret: "s3cr3t"}
+	send := func(ref, status, amount string) (*DepositWebhookResult, error) {
+		body := []byte(fmt.Sprintf(`{"id":%q,"wallet_id":1,"currency":"usd","amount":%q,"status":%q}`, ref, amount, status))
+		h := http.Header{}
+		h.Set(settlement.FakeSignatureHeader, fake.Sign(time.Now(), body))
+		return svc.ReceiveDepositWebhook(ctx, "acme", h, body)
+	}
+	return svc, ctx, send
+}
+
+func TestReceiveDepositWebhook(t *testing.T) {
+	svc, ctx, send := newPayinService(t)
+	balance := func() []string {
+		t.Helper()
+		b, err := svc.GetBalanceConsistent(ctx, 1)
+		require.NoError(t, err)
+		return []string{b.Ledger.String(), b.PendingIn.String()}
+	}
+	outcome := func(ref, status string) string {
+		t.Helper()
+		res, err := send(ref, status, "10")
+		require.NoError(t, err)
+		return res.Outcome
+	}
+
+	// pending deposits are announced, settled ones credited once
+	assert.Equal(t, model.WebhookApplied, outcome("pay_1", "pending"))
+	assert.Equal(t, []string{"0", "10"}, balance())
+	assert.Equal(t, model.WebhookDuplicate, outcome("pay_1", "pending"))
+	assert.Equal(t, model.WebhookApplied, outcome("pay_1", "settled"))
+	assert.Equal(t, model.WebhookDuplicate, outcome("pay_1", "settled"))
+	assert.Equal(t, []string{"10", "0"}, balance())
+
+	// a late pending notification changes nothing; a reversal takes it back
+	assert.Equal(t, model.WebhookStale, outcome("pay_1", "pending"))
+	assert.Equal(t, model.WebhookApplied, outcome("pay_1", "reversed"))
+	assert.Equal(t, model.WebhookStale, outcome("pay_1", "settled"))
+	assert.Equal(t, []string{"0", "0"}, balance())
+	page, err := svc.GetHistory(ctx, 1, HistoryQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 2)
+	assert.ElementsMatch(t, []string{"DEPOSIT", TxDepositReversal}, []string{page.Items[0].Type, page.Items[1].Type})
+
+	deps, err := svc.ListProviderDeposits(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, deps, 1)
+	assert.Equal(t, model.ProviderDepositReversed, deps[0].Status)
+	assert.Equal(t, "acme:pay_1", deps[0].IdempotencyKey)
+
+	// every signed payload is kept with its outcome
+	var hooks []model.ProviderWebhook
+	require.NoError(t, svc.Repo().DB(ctx).Order("id").Find(&hooks).Error)
+	require.Len(t, hooks, 7)
+	assert.Equal(t, model.WebhookStale, hooks[6].Outcome)
+	assert.Contains(t, hooks[0].Payload, `"status":"pending"`)
+}
+
+func TestReceiveDepositWebhook_OutOfOrder(t *testing.T) {
+	svc, ctx, send := newPayinService(t)
+
+	// settled before pending: credited, and the pending one is stale
+	res, err := send("pay_1", "settled", "10")
+	require.NoError(t, err)
+	assert.Equal(t, model.WebhookApplied, res.Outcome)
+	res, err = send("pay_1", "pending", "10")
+	require.NoError(t, err)
+	assert.Equal(t, model.WebhookStale, res.Outcome)
+
+	// reversed before anything else: recorded, nothing ever credited
+	res, err = send("pay_2", "reversed", "5")
+	require.NoError(t, err)
+	assert.Equal(t, model.ProviderDepositReversed, res.Deposit.Status)
+	res, err = send("pay_2", "settled", "5")
+	require.NoError(t, err)
+	assert.Equal(t, model.WebhookStale, res.Outcome)
+
+	// pending, then reversed: the announcement is withdrawn
+	_, err = send("pay_3", "pending", "7")
+	require.NoError(t, err)
+	_, err = send("pay_3", "reversed", "7")
+	require.NoError(t, err)
+
+	b, err := svc.GetBalanceConsistent(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10", "0"}, []string{b.Ledger.String(), b.PendingIn.String()})
+
+	_, err = send("pay_1", "reversed", "11")
+	assert.ErrorIs(t, err, ErrDepositMismatch)
+	var failed model.ProviderWebhook
+	require.NoError(t, svc.Repo().DB(ctx).Order("id desc").First(&failed).Error)
+	assert.Equal(t, model.WebhookFailed, failed.Outcome)
+}
+
+func TestReceiveDepositWebhook_Rejected(t *testing.T) {
+	svc, ctx, _ := newPayinService(t)
+	body := []byte(`{"id":"pay_1","wallet_id":1,"currency":"USD","amount":"10","status":"settled"}`)
+	h := http.Header{}
+	h.Set(settlement.FakeSignatureHeader, settlement.FakeWebhooks{Secret: "guess"}.Sign(time.Now(), body))
+	_, err := svc.ReceiveDepositWebhook(ctx, "acme", h, body)
+	assert.ErrorIs(t, err, settlement.ErrBadSignature)
+	_, err = svc.ReceiveDepositWebhook(ctx, "other", h, body)
+	assert.ErrorIs(t, err, ErrUnknownDepositProvider)
+	// a replay of a genuine payload signed too long ago
+	h.Set(settlement.FakeSignatureHeader, settlement.FakeWebhooks{Secret: "s3cr3t"}.Sign(time.Now().Add(-time.Hour), body))
+	_, err = svc.ReceiveDepositWebhook(ctx, "acme", h, body)
+	assert.ErrorIs(t, err, settlement.ErrBadSignature)
+
+	// unsigned payloads aren't kept; signed but unreadable ones are
+	var n int64
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.ProviderWebhook{}).Count(&n).Error)
+	assert.Zero(t, n)
+	body = []byte(`{"id":"pay_1","wallet_id":1,"amount":"10","status":"lost"}`)
+	h.Set(settlement.FakeSignatureHeader, settlement.FakeWebhooks{Secret: "s3cr3t"}.Sign(time.Now(), body))
+	_, err = svc.ReceiveDepositWebhook(ctx, "acme", h, body)
+	assert.ErrorIs(t, err, settlement.ErrBadPayload)
+	var hook model.ProviderWebhook
+	require.NoError(t, svc.Repo().DB(ctx).First(&hook).Error)
+	assert.Equal(t, model.WebhookInvalid, hook.Outcome)
+	assert.Equal(t, string(body), hook.Payload)
+}
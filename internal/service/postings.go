@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// lockFunc locks a single wallet row inside tx.
+type lockFunc func(ctx context.Context, tx *gorm.DB, id uint64) (*model.Wallet, error)
+
+// lockWallets locks ids in ascending order so concurrent multi-wallet
+// operations can't deadlock. Zero and duplicate IDs are skipped.
+func (s *WalletService) lockWallets(ctx context.Context, tx *gorm.DB, lock lockFunc, ids ...uint64) (map[uint64]*model.Wallet, error) {
+	sorted := make([]uint64, 0, len(ids))
+	for _, id := range ids {
+		if id != 0 {
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	out := make(map[uint64]*model.Wallet, len(sorted))
+	for _, id := range sorted {
+		if _, ok := out[id]; ok {
+			continue
+		}
+		w, err := lock(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+		out[id] = w
+	}
+	return out, nil
+}
+
+// systemLock locks wallets that must already exist. The system wallet is
+// named after kind in the error when it is missing.
+func (s *WalletService) systemLock(kind string, system uint64) lockFunc {
+	return func(ctx context.Context, tx *gorm.DB, id uint64) (*model.Wallet, error) {
+		w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if id == system {
+				return nil, fmt.Errorf("%s wallet %d does not exist", kind, id)
+			}
+			return nil, ErrWalletNotFound
+		}
+		return w, err
+	}
+}
+
+// postings collects the ledger rows of one operation over wallets locked in
+// the same DB transaction, tracking running balances so that each wallet row
+// is written once however many legs touch it.
+type postings struct {
+	wallets map[uint64]*model.Wallet
+	bal     map[uint64]decimal.Decimal
+	rows    []*model.Transaction
+}
+
+func newPostings(wallets map[uint64]*model.Wallet) *postings {
+	p := &postings{wallets: wallets, bal: make(map[uint64]decimal.Decimal, len(wallets))}
+	for id, w := range wallets {
+		p.bal[id] = w.Balance
+	}
+	return p
+}
+
+// balance returns the wallet's balance after the legs posted so far.
+func (p *postings) balance(id uint64) decimal.Decimal { return p.bal[id] }
+
+// available returns what the wallet can still spend, net of holds and
+// including its credit line.
+func (p *postings) available(id uint64) decimal.Decimal {
+	w := p.wallets[id]
+	return p.bal[id].Sub(w.Held).Add(w.CreditLimit)
+}
+
+func (p *postings) debit(id uint64, typ string, amt decimal.Decimal, related *uint64, key string) {
+	p.post(id, typ, amt, amt.Neg(), related, key)
+}
+
+func (p *postings) credit(id uint64, typ string, amt decimal.Decimal, related *uint64, key string) {
+	p.post(id, typ, amt, amt, related, key)
+}
+
+func (p *postings) post(id uint64, typ string, amt, delta decimal.Decimal, related *uint64, key string) {
+	before := p.bal[id]
+	after := before.Add(delta)
+	p.bal[id] = after
+	t := &model.Transaction{
+		WalletID: id, Type: typ, Amount: amt,
+		BalanceBefore: before, BalanceAfter: after, RelatedWalletID: related,
+	}
+	if key != "" {
+		t.IdempotencyKey = &key
+	}
+	p.rows = append(p.rows, t)
+}
+
+// flush writes the new balances (in lock order) and the ledger rows posted
+// since the last flush. The locked wallets are updated to match, so the same
+// postings can be flushed again after further legs. Wallets drawing on a
+// credit line get utilization events.
+func (s *WalletService) flush(ctx context.Context, tx *gorm.DB, p *postings) error {
+	touched := map[uint64]bool{}
+	for _, r := range p.rows {
+		touched[r.WalletID] = true
+	}
+	ids := make([]uint64, 0, len(touched))
+	for id := range touched {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		w := p.wallets[id]
+		if err := s.repo.UpdateWallet(ctx, tx, id, p.bal[id], w.Version); err != nil {
+			return err
+		}
+		before := utilization(w.Balance, w.CreditLimit)
+		w.Balance, w.Version = p.bal[id], w.Version+1
+		if err := s.checkUtilization(ctx, tx, w, before); err != nil {
+			return err
+		}
+	}
+	for _, r := range p.rows {
+		if err := s.repo.CreateTransaction(ctx, tx, r); err != nil {
+			return err
+		}
+	}
+	p.rows = nil
+	for _, id := range ids {
+		s.cacheAfterCommit(ctx, model.NewBalance(p.wallets[id]))
+	}
+	return nil
+}
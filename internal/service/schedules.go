@@ -0,0 +1,343 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrScheduleNotFound means the schedule doesn't exist on that wallet.
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrInvalidSchedule means the schedule definition or change is not acceptable.
+	ErrInvalidSchedule = errors.New("invalid schedule")
+	// ErrRunAlreadyRecorded means another worker already recorded the result
+	// of that attempt at the occurrence.
+	ErrRunAlreadyRecorded = errors.New("schedule run already recorded")
+)
+
+// SchedulePatch changes an existing schedule; nil fields are left alone.
+// Status may only move between ACTIVE and PAUSED.
+type SchedulePatch struct {
+	Amount *decimal.Decimal
+	EndAt  *time.Time
+	Status *string
+}
+
+// OccurrenceAt returns when occurrence n (0-based) of a schedule starting at
+// start is due. Monthly schedules keep the day of month, falling back to the
+// last day of shorter months.
+func OccurrenceAt(start time.Time, recurrence string, n int64) time.Time {
+	switch recurrence {
+	case model.RecurDaily:
+		return start.AddDate(0, 0, int(n))
+	case model.RecurWeekly:
+		return start.AddDate(0, 0, 7*int(n))
+	case model.RecurMonthly:
+		t := start.AddDate(0, int(n), 0)
+		if t.Day() != start.Day() {
+			// overflowed into the following month
+			t = t.AddDate(0, 0, -t.Day())
+		}
+		return t
+	}
+	return start
+}
+
+// CreateSchedule validates sc and stores it as an ACTIVE schedule on the
+// paying wallet's shard. A zero StartAt means now.
+func (s *WalletService) CreateSchedule(ctx context.Context, sc *model.TransferSchedule) error {
+	if err := s.checkAmount(sc.Amount); err != nil {
+		return err
+	}
+	switch sc.Recurrence {
+	case model.RecurOnce, model.RecurDaily, model.RecurWeekly, model.RecurMonthly:
+	default:
+		return fmt.Errorf("%w: recurrence must be ONCE, DAILY, WEEKLY or MONTHLY", ErrInvalidSchedule)
+	}
+	if sc.WalletID == sc.ToWalletID {
+		return fmt.Errorf("%w: cannot transfer to self", ErrInvalidSchedule)
+	}
+	if sc.StartAt.IsZero() {
+		sc.StartAt = time.Now()
+	}
+	if sc.EndAt != nil && sc.EndAt.Before(sc.StartAt) {
+		return fmt.Errorf("%w: end_at is before start_at", ErrInvalidSchedule)
+	}
+	for _, id := range []uint64{sc.WalletID, sc.ToWalletID} {
+		if _, err := s.GetWallet(ctx, id); err != nil {
+			return err
+		}
+	}
+	ctx, err := s.route(ctx, sc.WalletID)
+	if err != nil {
+		return err
+	}
+	id, err := s.repo.AllocateRecord(ctx, repo.ScheduleDirectory, repo.ShardFrom(ctx))
+	if err != nil {
+		return err
+	}
+	sc.ID, sc.Status, sc.Occurrence, sc.Attempts = id, model.ScheduleActive, 0, 0
+	sc.NextRunAt, sc.NextAttemptAt = sc.StartAt, sc.StartAt
+	return s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Create(sc).Error; err != nil {
+			return err
+		}
+		return s.emit(ctx, tx, sc.WalletID, "TransferScheduled", sc)
+	})
+}
+
+// ListSchedules returns the wallet's schedules, newest first. Those created
+// before the wallet moved are still on its old shard, so every shard is read.
+func (s *WalletService) ListSchedules(ctx context.Context, walletID uint64) ([]model.TransferSchedule, error) {
+	var out []model.TransferSchedule
+	for _, shard := range s.repo.Shards() {
+		var part []model.TransferSchedule
+		if err := s.repo.DB(repo.OnShard(ctx, shard)).Where("wallet_id = ?", walletID).Find(&part).Error; err != nil {
+			return nil, err
+		}
+		out = append(out, part...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out, nil
+}
+
+// GetSchedule returns one of the wallet's schedules.
+func (s *WalletService) GetSchedule(ctx context.Context, walletID, id uint64) (*model.TransferSchedule, error) {
+	ctx, err := s.routeSchedule(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.schedule(ctx, walletID, id)
+}
+
+// routeSchedule marks ctx with the shard holding schedule id.
+func (s *WalletService) routeSchedule(ctx context.Context, id uint64) (context.Context, error) {
+	shard, err := s.repo.RecordShard(ctx, repo.ScheduleDirectory, id)
+	if err != nil {
+		return ctx, err
+	}
+	return repo.OnShard(ctx, shard), nil
+}
+
+// schedule reads schedule id of the wallet from the shard ctx is marked with.
+func (s *WalletService) schedule(ctx context.Context, walletID, id uint64) (*model.TransferSchedule, error) {
+	var sc model.TransferSchedule
+	err := s.repo.DB(ctx).Where("id = ? AND wallet_id = ?", id, walletID).First(&sc).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrScheduleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// ScheduleRuns lists the attempts made for a schedule, newest first.
+func (s *WalletService) ScheduleRuns(ctx context.Context, walletID, id uint64) ([]model.TransferScheduleRun, error) {
+	ctx, err := s.routeSchedule(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.schedule(ctx, walletID, id); err != nil {
+		return nil, err
+	}
+	var out []model.TransferScheduleRun
+	err = s.repo.DB(ctx).Where("schedule_id = ?", id).Order("id desc").Find(&out).Error
+	return out, err
+}
+
+// UpdateSchedule applies p to an ACTIVE or PAUSED schedule.
+func (s *WalletService) UpdateSchedule(ctx context.Context, walletID, id uint64, p SchedulePatch) (*model.TransferSchedule, error) {
+	ctx, err := s.routeSchedule(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := s.schedule(ctx, walletID, id)
+	if err != nil {
+		return nil, err
+	}
+	if sc.Status != model.ScheduleActive && sc.Status != model.SchedulePaused {
+		return nil, fmt.Errorf("%w: schedule is %s", ErrInvalidSchedule, sc.Status)
+	}
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	if p.Amount != nil {
+		if err := s.checkAmount(*p.Amount); err != nil {
+			return nil, err
+		}
+		updates["amount"] = *p.Amount
+	}
+	if p.EndAt != nil {
+		if p.EndAt.Before(sc.StartAt) {
+			return nil, fmt.Errorf("%w: end_at is before start_at", ErrInvalidSchedule)
+		}
+		updates["end_at"] = *p.EndAt
+	}
+	if p.Status != nil {
+		if *p.Status != model.ScheduleActive && *p.Status != model.SchedulePaused {
+			return nil, fmt.Errorf("%w: status must be ACTIVE or PAUSED", ErrInvalidSchedule)
+		}
+		updates["status"] = *p.Status
+	}
+	res := s.repo.DB(ctx).Model(&model.TransferSchedule{}).
+		Where("id = ? AND status IN ?", id, []string{model.ScheduleActive, model.SchedulePaused}).
+		Updates(updates)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, fmt.Errorf("%w: schedule changed concurrently", ErrInvalidSchedule)
+	}
+	return s.schedule(ctx, walletID, id)
+}
+
+// CancelSchedule stops a schedule for good. An occurrence already claimed by
+// the scheduler may still complete.
+func (s *WalletService) CancelSchedule(ctx context.Context, walletID, id uint64) error {
+	ctx, err := s.routeSchedule(ctx, id)
+	if err != nil {
+		return err
+	}
+	sc, err := s.schedule(ctx, walletID, id)
+	if err != nil {
+		return err
+	}
+	if sc.Status == model.ScheduleCancelled || sc.Status == model.ScheduleCompleted {
+		return nil
+	}
+	return s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Model(&model.TransferSchedule{}).Where("id = ?", id).
+			Updates(map[string]interface{}{"status": model.ScheduleCancelled, "updated_at": time.Now()}).Error; err != nil {
+			return err
+		}
+		return s.emit(ctx, tx, walletID, "TransferScheduleCancelled", map[string]interface{}{"schedule_id": id})
+	})
+}
+
+// ClaimDueSchedules leases up to limit ACTIVE schedules due at now on the
+// shard ctx is marked with. Rows locked by another replica are skipped, and a
+// lease keeps them from being claimed again until it expires, so each due
+// schedule goes to a single worker.
+func (s *WalletService) ClaimDueSchedules(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]model.TransferSchedule, error) {
+	var out []model.TransferSchedule
+	err := s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ? AND (lease_until IS NULL OR lease_until < ?)",
+				model.ScheduleActive, now, now).
+			Order("next_attempt_at").Limit(limit).Find(&out).Error; err != nil {
+			return err
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		ids := make([]uint64, len(out))
+		for i, sc := range out {
+			ids[i] = sc.ID
+		}
+		return tx.Model(&model.TransferSchedule{}).Where("id IN ?", ids).Update("lease_until", now.Add(lease)).Error
+	})
+	return out, err
+}
+
+// permanentScheduleError reports transfer failures that retrying won't fix.
+func permanentScheduleError(err error) bool {
+	for _, target := range []error{
+		ErrWalletNotFound, ErrWalletFrozen, ErrWalletClosed, ErrDebitBlocked, ErrCreditBlocked,
+		ErrCurrencyMismatch, ErrInvalidAmount, ErrAmountTooLarge, ErrTransferReversed,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunSchedule executes the current occurrence of a claimed schedule. The
+// transfer's idempotency key is derived from the schedule and occurrence, so a
+// worker that dies before recording the result can't pay twice. Insufficient
+// funds and other transient failures are retried up to maxRetries times,
+// retryDelay apart; after that, or on a permanent failure, the occurrence is
+// recorded as FAILED and the schedule moves on to the next one. If another
+// worker recorded the attempt first, nothing is recorded and
+// ErrRunAlreadyRecorded is returned.
+func (s *WalletService) RunSchedule(ctx context.Context, sc model.TransferSchedule, now time.Time, maxRetries int, retryDelay time.Duration) (*model.TransferScheduleRun, error) {
+	ctx, err := s.routeSchedule(ctx, sc.ID)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("sched:%d:%d", sc.ID, sc.Occurrence)
+	_, _, terr := s.Transfer(ctx, sc.WalletID, sc.ToWalletID, sc.Amount, key)
+
+	run := &model.TransferScheduleRun{
+		ScheduleID: sc.ID, Occurrence: sc.Occurrence, ScheduledFor: sc.NextRunAt,
+		Attempt: sc.Attempts + 1, IdempotencyKey: key,
+	}
+	updates := map[string]interface{}{"lease_until": nil, "updated_at": now}
+	advance := func() {
+		next := OccurrenceAt(sc.StartAt, sc.Recurrence, sc.Occurrence+1)
+		updates["occurrence"] = sc.Occurrence + 1
+		updates["attempts"] = 0
+		updates["next_run_at"] = next
+		updates["next_attempt_at"] = next
+		if sc.Recurrence == model.RecurOnce || (sc.EndAt != nil && next.After(*sc.EndAt)) {
+			updates["status"] = model.ScheduleCompleted
+		}
+	}
+	switch {
+	case terr == nil:
+		run.Status = model.RunSucceeded
+		updates["last_error"] = ""
+		advance()
+	case !permanentScheduleError(terr) && run.Attempt <= maxRetries:
+		run.Status = model.RunRetrying
+		updates["attempts"] = run.Attempt
+		updates["next_attempt_at"] = now.Add(retryDelay)
+	default:
+		run.Status = model.RunFailed
+		advance()
+	}
+	if terr != nil {
+		run.Error = truncate(terr.Error(), 255)
+		updates["last_error"] = run.Error
+	}
+
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		// the occurrence guard makes recording idempotent if the lease expired
+		// and another worker already recorded this occurrence
+		res := tx.Model(&model.TransferSchedule{}).
+			Where("id = ? AND occurrence = ? AND attempts = ?", sc.ID, sc.Occurrence, sc.Attempts).
+			Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrRunAlreadyRecorded
+		}
+		if err := tx.Create(run).Error; err != nil {
+			return err
+		}
+		if run.Status != model.RunFailed {
+			return nil
+		}
+		return s.emit(ctx, tx, sc.WalletID, "ScheduledTransferFailed", run)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
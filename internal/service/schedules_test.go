@@ -0,0 +1,117 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOccurrenceAt(t *testing.T) {
+	start := time.Date(2024, 1, 31, 9, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, 2, 29, 9, 0, 0, 0, time.UTC), OccurrenceAt(start, model.RecurMonthly, 1))
+	assert.Equal(t, time.Date(2024, 3, 31, 9, 0, 0, 0, time.UTC), OccurrenceAt(start, model.RecurMonthly, 2))
+	assert.Equal(t, time.Date(2024, 2, 14, 9, 0, 0, 0, time.UTC), OccurrenceAt(start, model.RecurWeekly, 2))
+	assert.Equal(t, time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC), OccurrenceAt(start, model.RecurDaily, 1))
+}
+
+func TestScheduledTransfers(t *testing.T) {
+	svc, ctx := newTestService(t)
+	for _, id := range []uint64{1, 2} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, d("15"), "d1")
+	require.NoError(t, err)
+
+	start := time.Now().Add(-time.Minute).UTC()
+	sc := &model.TransferSchedule{WalletID: 1, ToWalletID: 2, Amount: d("10"), Recurrence: model.RecurDaily, StartAt: start}
+	require.NoError(t, svc.CreateSchedule(ctx, sc))
+	assert.ErrorIs(t, svc.CreateSchedule(ctx, &model.TransferSchedule{WalletID: 1, ToWalletID: 2, Amount: d("1"), Recurrence: "HOURLY"}), ErrInvalidSchedule)
+
+	now := time.Now()
+	due, err := svc.ClaimDueSchedules(ctx, now, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	// leased: a second worker gets nothing
+	again, err := svc.ClaimDueSchedules(ctx, now, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, again)
+
+	run, err := svc.RunSchedule(ctx, due[0], now, 1, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, model.RunSucceeded, run.Status)
+	assert.Equal(t, "sched:1:0", run.IdempotencyKey)
+	// recording the same occurrence twice is a no-op, and so is the transfer
+	_, err = svc.RunSchedule(ctx, due[0], now, 1, time.Hour)
+	assert.ErrorIs(t, err, ErrRunAlreadyRecorded)
+	bal, err := svc.GetWallet(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "5", bal.Balance.String())
+
+	got, err := svc.GetSchedule(ctx, 1, sc.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), got.Occurrence)
+	assert.True(t, got.NextRunAt.Equal(start.AddDate(0, 0, 1)))
+
+	// next occurrence: insufficient funds is retried, then given up on
+	later := got.NextRunAt.Add(time.Second)
+	due, err = svc.ClaimDueSchedules(ctx, later, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	run, err = svc.RunSchedule(ctx, due[0], later, 1, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, model.RunRetrying, run.Status)
+
+	due, err = svc.ClaimDueSchedules(ctx, later, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, due, "retry is not due yet")
+	later = later.Add(time.Hour)
+	due, err = svc.ClaimDueSchedules(ctx, later, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	run, err = svc.RunSchedule(ctx, due[0], later, 1, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, model.RunFailed, run.Status)
+	assert.Equal(t, 2, run.Attempt)
+
+	got, err = svc.GetSchedule(ctx, 1, sc.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), got.Occurrence)
+	assert.Equal(t, 0, got.Attempts)
+	runs, err := svc.ScheduleRuns(ctx, 1, sc.ID)
+	require.NoError(t, err)
+	assert.Len(t, runs, 3)
+
+	require.NoError(t, svc.CancelSchedule(ctx, 1, sc.ID))
+	due, err = svc.ClaimDueSchedules(ctx, later.AddDate(0, 0, 5), 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+}
+
+func TestScheduledTransfer_Once(t *testing.T) {
+	svc, ctx := newTestService(t)
+	for _, id := range []uint64{1, 2} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, d("10"), "d1")
+	require.NoError(t, err)
+	sc := &model.TransferSchedule{WalletID: 1, ToWalletID: 2, Amount: d("10"), Recurrence: model.RecurOnce, StartAt: time.Now().Add(time.Hour)}
+	require.NoError(t, svc.CreateSchedule(ctx, sc))
+
+	due, err := svc.ClaimDueSchedules(ctx, time.Now(), 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, due, "future-dated")
+
+	due, err = svc.ClaimDueSchedules(ctx, time.Now().Add(2*time.Hour), 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	_, err = svc.RunSchedule(ctx, due[0], time.Now(), 3, time.Hour)
+	require.NoError(t, err)
+	got, err := svc.GetSchedule(ctx, 1, sc.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.ScheduleCompleted, got.Status)
+}
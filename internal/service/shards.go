@@ -0,0 +1,536 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Ledger row types of a reversed cross-shard transfer.
+const (
+	TxTransferReversal = "TRANSFER_REVERSAL"
+	TxFeeRefund        = "FEE_REFUND"
+)
+
+var (
+	// ErrWalletMoved means the wallet was moved to another shard while the
+	// request was on its way; retrying routes it to the new one.
+	ErrWalletMoved = errors.New("wallet moved to another shard")
+	// ErrTransferPending means a cross-shard transfer was debited but not yet
+	// credited; it completes in the background, or on a retry with the same key.
+	ErrTransferPending = errors.New("transfer debited, credit pending")
+	// ErrTransferReversed means the recipient refused a cross-shard transfer
+	// after the debit, which was refunded.
+	ErrTransferReversed = errors.New("transfer reversed")
+	// ErrFundsInFlight means a wallet with holds, pending credits, open
+	// transfer sagas, escrows, batch legs or withdrawals can't be moved.
+	ErrFundsInFlight = errors.New("wallet has funds in flight")
+	// ErrCrossShard means the wallets of a request that posts to all of them
+	// in one transaction, such as a split, are on different shards.
+	ErrCrossShard = errors.New("wallets are on different shards")
+)
+
+// route marks ctx with the shard holding wallet id.
+func (s *WalletService) route(ctx context.Context, id uint64) (context.Context, error) {
+	shard, err := s.repo.ShardOf(ctx, id)
+	if err != nil {
+		return ctx, err
+	}
+	return repo.OnShard(ctx, shard), nil
+}
+
+// routeTogether marks ctx with the shard holding all wallets ids, zero IDs
+// aside, failing with ErrCrossShard when they are spread over several.
+func (s *WalletService) routeTogether(ctx context.Context, ids ...uint64) (context.Context, error) {
+	shard, first := -1, uint64(0)
+	for _, id := range ids {
+		if id == 0 {
+			continue
+		}
+		sh, err := s.repo.ShardOf(ctx, id)
+		if err != nil {
+			return ctx, err
+		}
+		switch {
+		case shard < 0:
+			shard, first = sh, id
+		case sh != shard:
+			return ctx, fmt.Errorf("%w: wallet %d is on shard %d, wallet %d on shard %d", ErrCrossShard, first, shard, id, sh)
+		}
+	}
+	return repo.OnShard(ctx, max(shard, 0)), nil
+}
+
+// onShardOf fails with ErrCrossShard unless the system wallet id, named after
+// kind, is on the shard ctx is marked with.
+func (s *WalletService) onShardOf(ctx context.Context, kind string, id uint64) error {
+	shard, err := s.repo.ShardOf(ctx, id)
+	if err != nil {
+		return err
+	}
+	if want := repo.ShardFrom(ctx); shard != want {
+		return fmt.Errorf("%w: %s wallet %d is on shard %d, not %d", ErrCrossShard, kind, id, shard, want)
+	}
+	return nil
+}
+
+// Shards returns the IDs of all shards, for jobs that visit each of them.
+func (s *WalletService) Shards() []int { return s.repo.Shards() }
+
+// sagaKey is the idempotency key of the legs a saga posts.
+func sagaKey(shard int, id uint64) string { return fmt.Sprintf("saga:%d:%d", shard, id) }
+
+// peekWallet reads a wallet on its shard without locking it, so that a credit
+// bound to be refused fails before the debit. A missing recipient reads as a
+// new wallet when auto-create is on.
+func (s *WalletService) peekWallet(ctx context.Context, id uint64, shard int, house bool) (*model.Wallet, error) {
+	var w model.Wallet
+	err := s.repo.DB(repo.OnShard(ctx, shard)).Where("id = ?", id).First(&w).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		switch {
+		case house:
+			return nil, fmt.Errorf("fee house wallet %d does not exist", id)
+		case !s.cfg().Feature(FeatureAutoCreate):
+			return nil, ErrWalletNotFound
+		}
+		return &model.Wallet{ID: id, Status: model.WalletActive, Currency: model.DefaultCurrency}, nil
+	}
+	return &w, err
+}
+
+// drop discards the legs posted to ids, which are applied on another shard.
+func (p *postings) drop(ids ...uint64) {
+	rows := p.rows[:0]
+	for _, r := range p.rows {
+		keep := true
+		for _, id := range ids {
+			keep = keep && r.WalletID != id
+		}
+		if keep {
+			rows = append(rows, r)
+		}
+	}
+	p.rows = rows
+	for _, id := range ids {
+		p.bal[id] = p.wallets[id].Balance
+	}
+}
+
+// transferAcross debits a transfer whose recipient or fee house is on another
+// shard and records the saga that credits them. Only the payer is locked; the
+// others are checked as last read, and the saga credits them later, even when
+// one shares the payer's shard.
+func (s *WalletService) transferAcross(ctx context.Context, tx *gorm.DB, fromID, toID, house uint64, toShard, houseShard int, amt, fee decimal.Decimal, currency, key string) (*model.TransferSaga, decimal.Decimal, error) {
+	w, err := s.repo.GetWalletForUpdate(ctx, tx, fromID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, decimal.Zero, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, decimal.Zero, err
+	}
+	ws := map[uint64]*model.Wallet{fromID: w}
+	if ws[toID], err = s.peekWallet(ctx, toID, toShard, false); err != nil {
+		return nil, decimal.Zero, err
+	}
+	if house != 0 {
+		if ws[house], err = s.peekWallet(ctx, house, houseShard, true); err != nil {
+			return nil, decimal.Zero, err
+		}
+	}
+	p := newPostings(ws)
+	if err := s.transferLocked(ctx, tx, p, fromID, toID, amt, fee, house, key); err != nil {
+		return nil, decimal.Zero, err
+	}
+	p.drop(toID, house)
+	if err := s.flush(ctx, tx, p); err != nil {
+		return nil, decimal.Zero, err
+	}
+	sg := &model.TransferSaga{
+		FromWalletID: fromID, ToWalletID: &toID, Currency: currency,
+		Amount: amt, Fee: fee, State: model.SagaDebited,
+	}
+	if house != 0 {
+		sg.HouseWalletID = &house
+	}
+	if err := s.createSaga(ctx, tx, sg, key); err != nil {
+		return nil, decimal.Zero, err
+	}
+	return sg, p.balance(fromID), nil
+}
+
+func (s *WalletService) createSaga(ctx context.Context, tx *gorm.DB, sg *model.TransferSaga, key string) error {
+	if key != "" {
+		sg.IdempotencyKey = &key
+	}
+	return tx.WithContext(ctx).Create(sg).Error
+}
+
+// sagaByKey returns the saga of a payer's keyed request, or nil if there is none.
+func (s *WalletService) sagaByKey(ctx context.Context, tx *gorm.DB, fromID uint64, key string) (*model.TransferSaga, error) {
+	if key == "" {
+		return nil, nil
+	}
+	var sg model.TransferSaga
+	err := tx.WithContext(ctx).Where("from_wallet_id = ? AND idempotency_key = ?", fromID, key).First(&sg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &sg, err
+}
+
+// finishTransfer advances the saga of a cross-shard transfer made on
+// fromShard and returns the recipient's balance after the credit.
+func (s *WalletService) finishTransfer(ctx context.Context, fromShard int, sg *model.TransferSaga) (decimal.Decimal, error) {
+	sg, err := s.advanceSaga(ctx, fromShard, sg.ID)
+	switch {
+	case sg == nil:
+		return decimal.Zero, fmt.Errorf("%w: %v", ErrTransferPending, err)
+	case sg.State == model.SagaCompensated:
+		return decimal.Zero, fmt.Errorf("%w: %s", ErrTransferReversed, sg.LastError)
+	case sg.State == model.SagaDebited:
+		return decimal.Zero, fmt.Errorf("%w: %v", ErrTransferPending, err)
+	}
+	ctx, err = s.route(ctx, *sg.ToWalletID)
+	if err != nil {
+		// credited; only the balance can't be looked up right now
+		return decimal.Zero, nil
+	}
+	_, row, err := s.repo.TxExists(ctx, s.repo.DB(ctx), *sg.ToWalletID, sagaKey(fromShard, sg.ID), "TRANSFER_IN")
+	if err != nil || row == nil {
+		return decimal.Zero, err
+	}
+	return row.BalanceAfter, nil
+}
+
+// refusedCredit reports credit failures that retrying won't fix, which
+// reverse the transfer.
+func refusedCredit(err error) bool {
+	for _, target := range []error{
+		ErrWalletNotFound, ErrWalletFrozen, ErrWalletClosed, ErrCreditBlocked, ErrCurrencyMismatch, ErrInvalidStatus,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// advanceSaga applies the credits a saga on shard still owes, each in its own
+// transaction on the wallet's shard, and records how far it got. The saga row
+// stays locked meanwhile, so only one caller advances it at a time. A credit
+// the recipient refuses refunds the payer instead. The returned error is that
+// of the last failed step, if any.
+func (s *WalletService) advanceSaga(ctx context.Context, shard int, id uint64) (*model.TransferSaga, error) {
+	var sg model.TransferSaga
+	var stepErr error
+	err := s.transaction(repo.OnShard(ctx, shard), func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&sg, id).Error; err != nil {
+			return err
+		}
+		key := sagaKey(shard, sg.ID)
+		if sg.State == model.SagaDebited {
+			if sg.InterestPeriod != nil {
+				stepErr = s.creditInterest(ctx, *sg.ToWalletID, sg.FromWalletID, sg.Currency, *sg.InterestPeriod, sg.Amount)
+			} else {
+				stepErr = s.creditAcross(ctx, *sg.ToWalletID, "TRANSFER_IN", sg.Amount, sg.FromWalletID, sg.Currency, key,
+					map[string]interface{}{"from": sg.FromWalletID, "to": *sg.ToWalletID, "amount": sg.Amount, "fee": sg.Fee})
+			}
+			if refusedCredit(stepErr) {
+				return s.compensate(ctx, tx, shard, &sg, stepErr)
+			}
+			if stepErr == nil {
+				sg.State = model.SagaCredited
+			}
+		}
+		if sg.State == model.SagaCredited {
+			if sg.HouseWalletID != nil {
+				stepErr = s.creditAcross(ctx, *sg.HouseWalletID, TxFeeIncome, sg.Fee, sg.FromWalletID, sg.Currency, key, nil)
+			}
+			if stepErr == nil {
+				sg.State = model.SagaCompleted
+			}
+		}
+		if stepErr != nil {
+			sg.Attempts++
+			sg.LastError = truncate(stepErr.Error(), 255)
+		}
+		return s.saveSaga(ctx, tx, &sg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sg, stepErr
+}
+
+func (s *WalletService) saveSaga(ctx context.Context, tx *gorm.DB, sg *model.TransferSaga) error {
+	return tx.WithContext(ctx).Model(sg).Updates(map[string]interface{}{
+		"state": sg.State, "attempts": sg.Attempts, "last_error": sg.LastError, "updated_at": time.Now(),
+	}).Error
+}
+
+// creditAcross credits amt to wallet id on its shard, once per key, and emits
+// event with payload unless event is nil. Fee house wallets must exist; other
+// wallets are created if auto-create is on.
+func (s *WalletService) creditAcross(ctx context.Context, id uint64, typ string, amt decimal.Decimal, related uint64, currency, key string, payload map[string]interface{}) error {
+	ctx, err := s.route(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		lock := s.lockOrCreate
+		if typ == TxFeeIncome {
+			lock = s.lockHouse
+		}
+		// locked first, so a concurrent credit under the same key is seen
+		w, err := lock(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if ok, _, err := s.repo.TxExists(ctx, tx, id, key, typ); err != nil || ok {
+			return err
+		}
+		if err := checkCredit(w); err != nil {
+			return err
+		}
+		if w.Currency != currency {
+			return ErrCurrencyMismatch
+		}
+		p := newPostings(map[uint64]*model.Wallet{id: w})
+		p.credit(id, typ, amt, &related, key)
+		if err := s.flush(ctx, tx, p); err != nil {
+			return err
+		}
+		if payload == nil {
+			return nil
+		}
+		return s.emit(ctx, tx, id, "Transfer", payload)
+	})
+}
+
+// compensate refunds the amount and fee of a saga whose recipient refused
+// the credit. The fee house is credited only after the recipient, so it has
+// nothing to give back.
+func (s *WalletService) compensate(ctx context.Context, tx *gorm.DB, shard int, sg *model.TransferSaga, cause error) error {
+	w, err := s.repo.GetWalletForUpdate(ctx, tx, sg.FromWalletID)
+	if err != nil {
+		return err
+	}
+	key := sagaKey(shard, sg.ID)
+	p := newPostings(map[uint64]*model.Wallet{w.ID: w})
+	p.credit(w.ID, TxTransferReversal, sg.Amount, sg.ToWalletID, key)
+	if sg.Fee.IsPositive() {
+		p.credit(w.ID, TxFeeRefund, sg.Fee, sg.HouseWalletID, key)
+	}
+	if err := s.flush(ctx, tx, p); err != nil {
+		return err
+	}
+	sg.State, sg.LastError = model.SagaCompensated, truncate(cause.Error(), 255)
+	if err := s.emit(ctx, tx, w.ID, "TransferReversed", map[string]interface{}{
+		"from": w.ID, "to": sg.ToWalletID, "amount": sg.Amount, "fee": sg.Fee, "reason": sg.LastError,
+	}); err != nil {
+		return err
+	}
+	return s.saveSaga(ctx, tx, sg)
+}
+
+// ResumeSagas advances the transfer sagas on every shard left open for at
+// least after, at most limit per shard, and returns how many it finished.
+func (s *WalletService) ResumeSagas(ctx context.Context, now time.Time, after time.Duration, limit int) (int, error) {
+	done := 0
+	var errs []error
+	for _, shard := range s.repo.Shards() {
+		var ids []uint64
+		err := s.repo.DB(repo.OnShard(ctx, shard)).Model(&model.TransferSaga{}).
+			Where("state IN ? AND updated_at <= ?", []string{model.SagaDebited, model.SagaCredited}, now.Add(-after)).
+			Order("updated_at").Limit(limit).Pluck("id", &ids).Error
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", shard, err))
+			continue
+		}
+		for _, id := range ids {
+			sg, err := s.advanceSaga(ctx, shard, id)
+			if err != nil {
+				s.log.Warnf("transfer saga %d on shard %d: %v", id, shard, err)
+			}
+			if sg != nil && (sg.State == model.SagaCompleted || sg.State == model.SagaCompensated) {
+				done++
+			}
+		}
+	}
+	return done, errors.Join(errs...)
+}
+
+// MoveWallet moves a wallet with its ledger, balance snapshots, provider
+// deposits, withdrawals and interest records to shard to; requests for it
+// fail with repo.ErrWalletMoving meanwhile. The old shard keeps a MOVED row
+// with a zero balance. If it fails, running it again resumes the move.
+// Wallets with funds in flight are refused and stay put, as are those with
+// open escrows, pending batch legs or withdrawals still being paid out; rows
+// kept by their own ID, such as closed escrows, batches and schedules, stay
+// where they are.
+func (s *WalletService) MoveWallet(ctx context.Context, id uint64, to int) error {
+	from, err := s.repo.BeginMove(ctx, id, to)
+	if err != nil {
+		return err
+	}
+	dst := repo.OnShard(ctx, to)
+	err = s.transaction(repo.OnShard(ctx, from), func(ctx context.Context, tx *gorm.DB) error {
+		w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrWalletNotFound
+		}
+		if err != nil || w.Status == model.WalletMoved {
+			return err
+		}
+		var open int64
+		if err := tx.Model(&model.TransferSaga{}).
+			Where("from_wallet_id = ? AND state IN ?", id, []string{model.SagaDebited, model.SagaCredited}).
+			Count(&open).Error; err != nil {
+			return err
+		}
+		// escrows and batches stay on this shard, so those still due to post
+		// to the wallet keep it here
+		var escrows, legs int64
+		if err := tx.Model(&model.Escrow{}).
+			Where("(payer_wallet_id = ? OR payee_wallet_id = ?) AND status IN ?", id, id, []string{model.EscrowHeld, model.EscrowPartial}).
+			Count(&escrows).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&model.BatchLeg{}).
+			Where("(from_wallet_id = ? OR to_wallet_id = ?) AND status = ?", id, id, model.LegPending).
+			Count(&legs).Error; err != nil {
+			return err
+		}
+		// payouts are submitted under a reference naming this shard
+		var payouts int64
+		if err := tx.Model(&model.Withdrawal{}).
+			Where("wallet_id = ? AND status IN ?", id, []string{model.WithdrawalPending, model.WithdrawalSubmitted}).
+			Count(&payouts).Error; err != nil {
+			return err
+		}
+		if !w.Held.IsZero() || !w.PendingIn.IsZero() || open+escrows+legs+payouts > 0 {
+			return ErrFundsInFlight
+		}
+		var rows walletRows
+		if err := tx.Where("wallet_id = ?", id).Order("created_at, id").Find(&rows.ledger).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("wallet_id = ?", id).Find(&rows.snaps).Error; err != nil {
+			return err
+		}
+		// the copies get new IDs in the same order
+		for _, dst := range []interface{}{&rows.deposits, &rows.withdrawals, &rows.accruals, &rows.postings} {
+			if err := tx.Where("wallet_id = ?", id).Order("id").Find(dst).Error; err != nil {
+				return err
+			}
+		}
+		// the copy commits first; should this transaction fail after it, the
+		// next run replaces it
+		if err := copyWallet(s.repo.DB(dst), w, rows); err != nil {
+			return err
+		}
+		for _, m := range movedModels {
+			if err := tx.Where("wallet_id = ?", id).Delete(m).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&model.Wallet{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"status": model.WalletMoved, "balance": decimal.Zero, "credit_limit": decimal.Zero,
+			"version": w.Version + 1, "updated_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return s.emit(ctx, tx, id, "WalletMoved", map[string]interface{}{"wallet_id": id, "from": from, "to": to})
+	})
+	if errors.Is(err, ErrFundsInFlight) || errors.Is(err, ErrWalletNotFound) {
+		// the source was never fenced, so it stays authoritative
+		if cerr := s.repo.CancelMove(ctx, id, to); cerr != nil {
+			return cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.repo.FinishMove(ctx, id, to)
+}
+
+// walletRows are the rows of a wallet that move with it.
+type walletRows struct {
+	ledger      []model.Transaction
+	snaps       []model.BalanceSnapshot
+	deposits    []model.ProviderDeposit
+	withdrawals []model.Withdrawal
+	accruals    []model.InterestAccrual
+	postings    []model.InterestPosting
+}
+
+// movedModels are the tables of walletRows, in an order they can be deleted
+// in.
+var movedModels = []interface{}{
+	&model.Transaction{}, &model.BalanceSnapshot{}, &model.ProviderDeposit{},
+	&model.Withdrawal{}, &model.InterestAccrual{}, &model.InterestPosting{},
+}
+
+// copyWallet writes w and its rows to db, replacing any earlier copy. A
+// wallet row already there, such as the MOVED row of a wallet moving back, is
+// updated in place as other wallets' rows may refer to it. Rows get new IDs
+// there; snapshots and accruals follow those of the rows they refer to.
+func copyWallet(db *gorm.DB, w *model.Wallet, rows walletRows) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, m := range movedModels {
+			if err := tx.Where("wallet_id = ?", w.ID).Delete(m).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(w).Error; err != nil {
+			return err
+		}
+		ledgerID := make(map[uint64]uint64, len(rows.ledger))
+		for i := range rows.ledger {
+			old := rows.ledger[i].ID
+			rows.ledger[i].ID = 0
+			if err := tx.Create(&rows.ledger[i]).Error; err != nil {
+				return err
+			}
+			ledgerID[old] = rows.ledger[i].ID
+		}
+		for i := range rows.snaps {
+			rows.snaps[i].LastTransactionID = ledgerID[rows.snaps[i].LastTransactionID]
+		}
+		postingID := make(map[uint64]uint64, len(rows.postings))
+		for i := range rows.postings {
+			old := rows.postings[i].ID
+			rows.postings[i].ID = 0
+			if err := tx.Create(&rows.postings[i]).Error; err != nil {
+				return err
+			}
+			postingID[old] = rows.postings[i].ID
+		}
+		for i := range rows.accruals {
+			rows.accruals[i].ID = 0
+			if p := rows.accruals[i].PostingID; p != nil {
+				id := postingID[*p]
+				rows.accruals[i].PostingID = &id
+			}
+		}
+		for i := range rows.deposits {
+			rows.deposits[i].ID = 0
+		}
+		for i := range rows.withdrawals {
+			rows.withdrawals[i].ID = 0
+		}
+		for _, batch := range []interface{}{&rows.snaps, &rows.deposits, &rows.withdrawals, &rows.accruals} {
+			if err := tx.CreateInBatches(batch, 100).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,515 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/richardliu001/wallet-service/internal/settlement"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newShardedService returns a service over shard 0 and two more shards, with
+// wallets placed as given and a 2% transfer fee going to house wallet 9.
+func newShardedService(t *testing.T, placement map[uint64]int) (*WalletService, context.Context) {
+	svc, ctx := newTestService(t)
+	r := svc.Repo().(*repo.Repository)
+	for i := 1; i <= 2; i++ {
+		db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s_shard%d?mode=memory&cache=shared", t.Name(), i)), &gorm.Config{})
+		require.NoError(t, err)
+		require.NoError(t, db.AutoMigrate(&model.Wallet{}, &model.Transaction{}, &model.OutboxEvent{}, &model.LimitProfile{},
+			&model.BalanceSnapshot{}, &model.TransactionArchive{}, &model.TransactionArchiveSegment{}, &model.TransferSaga{}, &model.ProviderDeposit{},
+			&model.Batch{}, &model.BatchLeg{}, &model.Escrow{}, &model.EscrowEvent{}, &model.InterestAccrual{}, &model.InterestPosting{},
+			&model.TransferSchedule{}, &model.TransferScheduleRun{}, &model.Withdrawal{}))
+		r.AddShard(db)
+	}
+	for _, dir := range []string{repo.EscrowDirectory, repo.BatchDirectory, repo.ScheduleDirectory} {
+		require.NoError(t, r.DB(ctx).Table(dir).AutoMigrate(&model.RecordShard{}))
+	}
+	cfg := config.Defaults()
+	cfg.Cache.Mode = config.CacheOff
+	cfg.Fees = config.FeesConfig{HouseWalletID: 9, Schedules: []config.FeeSchedule{
+		{Operation: "transfer", Type: config.FeePercentage, Percent: d("2")},
+		{Operation: "withdraw", Type: config.FeeFlat, Flat: d("1")},
+	}}
+	svc.cfg = func() *config.Config { return &cfg }
+	for id, shard := range placement {
+		require.NoError(t, r.DB(ctx).Create(&model.WalletShard{WalletID: id, ShardID: shard}).Error)
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	return svc, ctx
+}
+
+// walletOn reads a wallet row straight from a shard.
+func walletOn(t *testing.T, svc *WalletService, shard int, id uint64) model.Wallet {
+	var w model.Wallet
+	require.NoError(t, svc.Repo().DB(repo.OnShard(context.Background(), shard)).First(&w, id).Error)
+	return w
+}
+
+func TestTransfer_AcrossShards(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{1: 1, 2: 1, 3: 2, 9: 0})
+	_, err := svc.Deposit(ctx, 1, d("100"), "dep")
+	require.NoError(t, err)
+	assert.Equal(t, "100", walletOn(t, svc, 1, 1).Balance.String())
+
+	// same shard, house elsewhere: the fee still reaches it
+	from, to, fee, err := svc.TransferWithFee(ctx, 1, 2, d("10"), "t1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"89.8", "10", "0.2"}, []string{from.String(), to.String(), fee.String()})
+
+	// across shards
+	from, to, fee, err = svc.TransferWithFee(ctx, 1, 3, d("50"), "t2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"38.8", "50", "1"}, []string{from.String(), to.String(), fee.String()})
+	assert.Equal(t, "50", walletOn(t, svc, 2, 3).Balance.String())
+	assert.Equal(t, "1.2", walletOn(t, svc, 0, 9).Balance.String())
+	var sg model.TransferSaga
+	require.NoError(t, svc.Repo().DB(repo.OnShard(ctx, 1)).Where("idempotency_key = ?", "t2").First(&sg).Error)
+	assert.Equal(t, model.SagaCompleted, sg.State)
+
+	// a retry is answered from the ledger and the saga
+	from, to, err = svc.Transfer(ctx, 1, 3, d("50"), "t2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"38.8", "50"}, []string{from.String(), to.String()})
+	assert.Equal(t, "50", walletOn(t, svc, 2, 3).Balance.String())
+
+	// a recipient known to refuse fails before the debit
+	_, err = svc.Freeze(ctx, 3, "")
+	require.NoError(t, err)
+	_, _, err = svc.Transfer(ctx, 1, 3, d("5"), "t3")
+	assert.ErrorIs(t, err, ErrWalletFrozen)
+	assert.Equal(t, "38.8", walletOn(t, svc, 1, 1).Balance.String())
+}
+
+func TestResumeSagas(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{1: 1, 3: 2, 4: 2, 9: 0})
+	on1 := repo.OnShard(ctx, 1)
+	_, err := svc.Deposit(ctx, 1, d("100"), "dep")
+	require.NoError(t, err)
+	// sagas whose debit committed but whose credits didn't run
+	to3, to4, house := uint64(3), uint64(4), uint64(9)
+	ok := model.TransferSaga{FromWalletID: 1, ToWalletID: &to3, HouseWalletID: &house, Currency: "USD",
+		Amount: d("10"), Fee: d("0.2"), State: model.SagaDebited}
+	refused := model.TransferSaga{FromWalletID: 1, ToWalletID: &to4, HouseWalletID: &house, Currency: "USD",
+		Amount: d("20"), Fee: d("0.4"), State: model.SagaDebited}
+	require.NoError(t, svc.Repo().DB(on1).Create(&ok).Error)
+	require.NoError(t, svc.Repo().DB(on1).Create(&refused).Error)
+	_, err = svc.Close(ctx, 4, "")
+	require.NoError(t, err)
+
+	// too recent
+	n, err := svc.ResumeSagas(ctx, time.Now().Add(-time.Minute), time.Second, 10)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	n, err = svc.ResumeSagas(ctx, time.Now().Add(time.Minute), time.Second, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "10", walletOn(t, svc, 2, 3).Balance.String())
+	assert.Equal(t, "0.2", walletOn(t, svc, 0, 9).Balance.String())
+	// the refused one is refunded with its fee, which the house never got
+	assert.Equal(t, "120.4", walletOn(t, svc, 1, 1).Balance.String())
+	require.NoError(t, svc.Repo().DB(on1).First(&refused, refused.ID).Error)
+	assert.Equal(t, model.SagaCompensated, refused.State)
+	assert.Contains(t, refused.LastError, "closed")
+	var evt model.OutboxEvent
+	require.NoError(t, svc.Repo().DB(on1).Where("event_type = ?", "TransferReversed").First(&evt).Error)
+
+	// finished sagas are left alone
+	n, err = svc.ResumeSagas(ctx, time.Now().Add(time.Minute), time.Second, 10)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, "10", walletOn(t, svc, 2, 3).Balance.String())
+}
+
+func TestMoveWallet(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{1: 1, 2: 1, 9: 2})
+	for i, amt := range []string{"10", "20", "30"} {
+		_, err := svc.Deposit(ctx, 1, d(amt), fmt.Sprintf("d%d", i))
+		require.NoError(t, err)
+	}
+	_, err := svc.SnapshotBalances(repo.OnShard(ctx, 1), time.Now())
+	require.NoError(t, err)
+	require.NoError(t, svc.Repo().DB(repo.OnShard(ctx, 1)).Create(&model.ProviderDeposit{
+		Provider: "acme", Reference: "pay_1", WalletID: 1, Currency: "USD", Amount: d("10"),
+		Status: model.ProviderDepositSettled, IdempotencyKey: "acme:pay_1",
+	}).Error)
+
+	// funds in flight keep it in place
+	require.NoError(t, svc.Repo().DB(repo.OnShard(ctx, 1)).Model(&model.Wallet{}).Where("id = 2").Update("held", d("1")).Error)
+	assert.ErrorIs(t, svc.MoveWallet(ctx, 2, 2), ErrFundsInFlight)
+	shard, err := svc.Repo().ShardOf(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, shard)
+
+	require.NoError(t, svc.MoveWallet(ctx, 1, 2))
+	shard, err = svc.Repo().ShardOf(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, shard)
+	b, err := svc.GetBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "60", b.Ledger.String())
+	page, err := svc.GetHistory(ctx, 1, HistoryQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 3)
+	at, err := svc.GetBalanceAt(ctx, 1, time.Now().Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, "60", at.String())
+	deps, err := svc.ListProviderDeposits(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, deps, 1)
+	assert.Equal(t, "pay_1", deps[0].Reference)
+
+	// the old shard keeps an empty MOVED row that refuses stale requests
+	old := walletOn(t, svc, 1, 1)
+	assert.Equal(t, model.WalletMoved, old.Status)
+	assert.True(t, old.Balance.IsZero())
+	var rows int64
+	require.NoError(t, svc.Repo().DB(repo.OnShard(ctx, 1)).Model(&model.Transaction{}).Where("wallet_id = 1").Count(&rows).Error)
+	assert.Zero(t, rows)
+	assert.ErrorIs(t, checkCredit(&old), ErrWalletMoved)
+
+	// idempotency keys moved along, and it can move again
+	bal, err := svc.Deposit(ctx, 1, d("10"), "d0")
+	require.NoError(t, err)
+	assert.Equal(t, "10", bal.String())
+	// back to a shard where other wallets' ledger rows still refer to its
+	// MOVED row, which Postgres' foreign keys would not let go
+	db1 := svc.Repo().DB(repo.OnShard(ctx, 1))
+	require.NoError(t, db1.Exec(`CREATE TRIGGER wallet_referenced BEFORE DELETE ON wallet
+		WHEN EXISTS (SELECT 1 FROM "transaction" WHERE related_wallet_id = OLD.id)
+		BEGIN SELECT RAISE(ABORT, 'FOREIGN KEY constraint failed'); END`).Error)
+	one := uint64(1)
+	require.NoError(t, db1.Create(&model.Transaction{
+		WalletID: 2, Type: "TRANSFER_IN", Amount: d("1"), BalanceBefore: d("0"), BalanceAfter: d("1"), RelatedWalletID: &one,
+	}).Error)
+	require.NoError(t, svc.MoveWallet(ctx, 1, 1))
+	assert.Equal(t, model.WalletActive, walletOn(t, svc, 1, 1).Status)
+	_, _, err = svc.Transfer(ctx, 1, 2, d("5"), "")
+	require.NoError(t, err)
+}
+
+func TestMoveWallet_WithdrawalsAndInterest(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{1: 1, 9: 2})
+	svc.cfg().Settlement.Provider = "fake"
+	svc.cfg().Fees.Schedules = nil
+	fake := settlement.NewFake()
+	svc.settle = fake
+	_, err := svc.Deposit(ctx, 1, d("100"), "dep")
+	require.NoError(t, err)
+	wd, err := svc.RequestWithdrawal(ctx, 1, d("30"), "iban:DE89", "w1")
+	require.NoError(t, err)
+
+	// a payout under way keeps it in place
+	assert.ErrorIs(t, svc.MoveWallet(ctx, 1, 2), ErrFundsInFlight)
+	for i := 0; i < 3 && wd.Status != model.WithdrawalCompleted; i++ {
+		_, err = svc.RunWithdrawals(ctx, time.Now().Add(time.Duration(i)*time.Hour), 10, time.Minute)
+		require.NoError(t, err)
+		wd, err = svc.GetWithdrawal(ctx, 1, wd.ID)
+		require.NoError(t, err)
+	}
+	require.Equal(t, model.WithdrawalCompleted, wd.Status)
+	src := svc.Repo().DB(repo.OnShard(ctx, 1))
+	posting := &model.InterestPosting{WalletID: 1, Period: "2026-01", HouseWalletID: 9, Accrued: d("0.1"), Amount: d("0.1"), Carry: decimal.Zero}
+	require.NoError(t, src.Create(posting).Error)
+	require.NoError(t, src.Create(&[]model.InterestAccrual{
+		{WalletID: 1, Day: time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC), Period: "2026-01", Plan: "savings", Balance: d("70"),
+			Rate: d("3.65"), DayCount: config.DayCountAct365, Amount: d("0.1"), PostingID: &posting.ID},
+		{WalletID: 1, Day: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), Period: "2026-02", Plan: "savings", Balance: d("70"),
+			Rate: d("3.65"), DayCount: config.DayCountAct365, Amount: d("0.007")},
+	}).Error)
+
+	require.NoError(t, svc.MoveWallet(ctx, 1, 2))
+	// replaying the request finds the withdrawal instead of paying again
+	again, err := svc.RequestWithdrawal(ctx, 1, d("30"), "iban:DE89", "w1")
+	require.NoError(t, err)
+	assert.Equal(t, model.WithdrawalCompleted, again.Status)
+	list, err := svc.ListWithdrawals(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "70", walletOn(t, svc, 2, 1).Balance.String())
+
+	sum, err := svc.InterestSummary(ctx, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, "0.007", sum.Accrued.String())
+	require.Len(t, sum.Postings, 1)
+	var paid model.InterestAccrual
+	require.NoError(t, svc.Repo().DB(repo.OnShard(ctx, 2)).Where("wallet_id = 1 AND period = ?", "2026-01").First(&paid).Error)
+	assert.Equal(t, sum.Postings[0].ID, *paid.PostingID)
+	for _, m := range []interface{}{&model.Withdrawal{}, &model.InterestAccrual{}, &model.InterestPosting{}} {
+		var n int64
+		require.NoError(t, src.Model(m).Where("wallet_id = 1").Count(&n).Error)
+		assert.Zero(t, n)
+	}
+}
+func TestEscrow_OnWalletsShard(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{1: 1, 2: 1, 3: 2, 8: 1, 9: 0})
+	svc.cfg().Escrow.WalletID = 8
+	_, err := svc.Deposit(ctx, 1, d("100"), "dep")
+	require.NoError(t, err)
+
+	expires := time.Now().Add(time.Hour)
+	e, err := svc.CreateEscrow(ctx, "o1", 1, 2, d("60"), "", &expires)
+	require.NoError(t, err)
+	assert.Equal(t, "60", walletOn(t, svc, 1, 8).Balance.String())
+	got, err := svc.GetEscrow(ctx, e.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), got.PayeeWalletID)
+	var n int64
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.Escrow{}).Count(&n).Error)
+	assert.Zero(t, n)
+
+	// the payee can't leave while the escrow may still pay it
+	assert.ErrorIs(t, svc.MoveWallet(ctx, 2, 2), ErrFundsInFlight)
+
+	amt := d("20")
+	_, err = svc.ReleaseEscrow(ctx, e.ID, &amt, "r1", "")
+	require.NoError(t, err)
+	assert.Equal(t, "20", walletOn(t, svc, 1, 2).Balance.String())
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.Wallet{}).Where("id = 2").Count(&n).Error)
+	assert.Zero(t, n, "no stray payee wallet on shard 0")
+
+	expired, err := svc.ExpireDueEscrows(ctx, time.Now().Add(2*time.Hour), 10)
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.Equal(t, "80", walletOn(t, svc, 1, 1).Balance.String())
+
+	_, err = svc.CreateEscrow(ctx, "o2", 1, 3, d("10"), "", nil)
+	assert.ErrorIs(t, err, ErrCrossShard)
+	svc.cfg().Escrow.WalletID = 9
+	_, err = svc.CreateEscrow(ctx, "o3", 1, 2, d("10"), "", nil)
+	assert.ErrorIs(t, err, ErrCrossShard)
+	assert.Equal(t, "80", walletOn(t, svc, 1, 1).Balance.String())
+}
+
+func TestSchedule_OnWalletsShard(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{1: 1, 3: 2, 9: 0})
+	_, err := svc.Deposit(ctx, 1, d("100"), "dep")
+	require.NoError(t, err)
+
+	// kept with the payer; the recipient may be anywhere
+	sc := &model.TransferSchedule{WalletID: 1, ToWalletID: 3, Amount: d("10"), Recurrence: model.RecurDaily}
+	require.NoError(t, svc.CreateSchedule(ctx, sc))
+	var n int64
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.TransferSchedule{}).Count(&n).Error)
+	assert.Zero(t, n)
+	got, err := svc.GetSchedule(ctx, 1, sc.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), got.ToWalletID)
+	list, err := svc.ListSchedules(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	now := time.Now()
+	due, err := svc.ClaimDueSchedules(ctx, now, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = svc.ClaimDueSchedules(repo.OnShard(ctx, 1), now, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	run, err := svc.RunSchedule(ctx, due[0], now, 1, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, model.RunSucceeded, run.Status)
+	assert.Equal(t, "10", walletOn(t, svc, 2, 3).Balance.String())
+	runs, err := svc.ScheduleRuns(ctx, 1, sc.ID)
+	require.NoError(t, err)
+	assert.Len(t, runs, 1)
+
+	// a schedule stays behind when its wallet moves, and still pays from it
+	require.NoError(t, svc.MoveWallet(ctx, 1, 2))
+	five := d("5")
+	_, err = svc.UpdateSchedule(ctx, 1, sc.ID, SchedulePatch{Amount: &five})
+	require.NoError(t, err)
+	due, err = svc.ClaimDueSchedules(repo.OnShard(ctx, 1), now.Add(25*time.Hour), 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	_, err = svc.RunSchedule(ctx, due[0], now.Add(25*time.Hour), 1, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "15", walletOn(t, svc, 2, 3).Balance.String())
+	require.NoError(t, svc.CancelSchedule(ctx, 1, sc.ID))
+}
+
+func TestBatch_OnWalletsShard(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{1: 1, 2: 1, 3: 2, 9: 0})
+	_, err := svc.Deposit(ctx, 1, d("100"), "dep")
+	require.NoError(t, err)
+
+	// fees reach the house on shard 0 through sagas
+	b, err := svc.SubmitBatch(ctx, "b1", model.BatchAtomic, []model.BatchLeg{
+		{FromWalletID: 1, ToWalletID: 2, Amount: d("10")},
+		{FromWalletID: 1, ToWalletID: 2, Amount: d("20")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, model.BatchCompleted, b.Status)
+	b, err = svc.SubmitBatch(ctx, "b2", model.BatchBestEffort, []model.BatchLeg{
+		{FromWalletID: 1, ToWalletID: 2, Amount: d("5")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, model.BatchCompleted, b.Status)
+	assert.Equal(t, "64.3", walletOn(t, svc, 1, 1).Balance.String())
+	assert.Equal(t, "35", walletOn(t, svc, 1, 2).Balance.String())
+	assert.Equal(t, "0.7", walletOn(t, svc, 0, 9).Balance.String())
+
+	got, err := svc.GetBatch(ctx, b.ID)
+	require.NoError(t, err)
+	require.Len(t, got.Legs, 1)
+	assert.Equal(t, "0.1", got.Legs[0].Fee.String())
+	again, err := svc.SubmitBatch(ctx, "b1", model.BatchAtomic, []model.BatchLeg{{FromWalletID: 1, ToWalletID: 2, Amount: d("10")}})
+	require.NoError(t, err)
+	assert.NotEqual(t, b.ID, again.ID)
+	var n int64
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.Batch{}).Count(&n).Error)
+	assert.Zero(t, n)
+
+	_, err = svc.SubmitBatch(ctx, "b3", model.BatchBestEffort, []model.BatchLeg{
+		{FromWalletID: 1, ToWalletID: 2, Amount: d("5")},
+		{FromWalletID: 1, ToWalletID: 3, Amount: d("5")},
+	})
+	assert.ErrorIs(t, err, ErrCrossShard)
+	assert.Equal(t, "64.3", walletOn(t, svc, 1, 1).Balance.String())
+}
+
+func TestSplit_OnWalletsShard(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{1: 1, 2: 1, 3: 2})
+	_, err := svc.Deposit(ctx, 1, d("100"), "dep")
+	require.NoError(t, err)
+
+	_, err = svc.Split(ctx, []SplitLeg{{WalletID: 1, Amount: d("30")}}, []SplitLeg{{WalletID: 2, Amount: d("30")}}, "s1")
+	require.NoError(t, err)
+	assert.Equal(t, "30", walletOn(t, svc, 1, 2).Balance.String())
+
+	_, err = svc.Split(ctx, []SplitLeg{{WalletID: 1, Amount: d("30")}},
+		[]SplitLeg{{WalletID: 2, Amount: d("10")}, {WalletID: 3, Amount: d("20")}}, "s2")
+	assert.ErrorIs(t, err, ErrCrossShard)
+	assert.Equal(t, "70", walletOn(t, svc, 1, 1).Balance.String())
+}
+
+func TestInterest_OnEveryShard(t *testing.T) {
+	shards := map[uint64]int{1: 1, 2: 1, 3: 2, 4: 2}
+	svc, ctx := newShardedService(t, shards)
+	cfg := svc.cfg()
+	cfg.Interest.HouseWalletID = 2
+	cfg.Interest.Plans = []config.RatePlan{{Name: "savings", AnnualRate: d("3.65"), DayCount: config.DayCountAct365}}
+	jan1 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, id := range []uint64{1, 2, 3, 4} {
+		_, err := svc.Deposit(ctx, id, d("1000"), "dep")
+		require.NoError(t, err)
+		if id == 2 {
+			continue
+		}
+		_, err = svc.SetRatePlan(ctx, id, "savings")
+		require.NoError(t, err)
+		db := svc.Repo().DB(repo.OnShard(ctx, shards[id]))
+		require.NoError(t, db.Model(&model.Wallet{}).Where("id = ?", id).Update("interest_since", jan1).Error)
+		require.NoError(t, db.Model(&model.Transaction{}).Where("wallet_id = ?", id).Update("created_at", jan1).Error)
+	}
+
+	n, err := svc.AccrueInterest(ctx, time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	sum, err := svc.InterestSummary(ctx, 3, 10)
+	require.NoError(t, err)
+	assert.Equal(t, "0.1", sum.Accrued.String())
+	_, err = svc.Freeze(ctx, 4, "kyc")
+	require.NoError(t, err)
+
+	// the house pays wallets on other shards through sagas; a frozen wallet
+	// is skipped before the house is debited
+	feb1 := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	n, err = svc.PostInterest(ctx, feb1)
+	assert.ErrorIs(t, err, ErrWalletFrozen)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "1000.1", walletOn(t, svc, 1, 1).Balance.String())
+	assert.Equal(t, "1000.1", walletOn(t, svc, 2, 3).Balance.String())
+	assert.Equal(t, "1000", walletOn(t, svc, 2, 4).Balance.String())
+	assert.Equal(t, "999.8", walletOn(t, svc, 1, 2).Balance.String())
+	var sg model.TransferSaga
+	require.NoError(t, svc.Repo().DB(repo.OnShard(ctx, 1)).Where("to_wallet_id = ?", 3).First(&sg).Error)
+	assert.Equal(t, model.SagaCompleted, sg.State)
+	assert.Equal(t, "2026-01", *sg.InterestPeriod)
+	var posting model.InterestPosting
+	require.NoError(t, svc.Repo().DB(repo.OnShard(ctx, 2)).Where("wallet_id = ?", 3).First(&posting).Error)
+	assert.Equal(t, "0.1", posting.Amount.String())
+	assert.Equal(t, uint64(2), posting.HouseWalletID)
+
+	// paid periods are not paid again; the frozen wallet is paid once thawed
+	_, err = svc.Unfreeze(ctx, 4, "kyc done")
+	require.NoError(t, err)
+	n, err = svc.PostInterest(ctx, feb1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "1000.1", walletOn(t, svc, 2, 3).Balance.String())
+	assert.Equal(t, "1000.1", walletOn(t, svc, 2, 4).Balance.String())
+	assert.Equal(t, "999.7", walletOn(t, svc, 1, 2).Balance.String())
+}
+
+func TestInterest_RefusedAcrossShards(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{2: 1, 3: 2})
+	cfg := svc.cfg()
+	cfg.Interest.HouseWalletID = 2
+	_, err := svc.Deposit(ctx, 2, d("1000"), "dep")
+	require.NoError(t, err)
+	_, err = svc.Deposit(ctx, 3, d("1000"), "dep")
+	require.NoError(t, err)
+	db := svc.Repo().DB(repo.OnShard(ctx, 2))
+	require.NoError(t, db.Create(&model.InterestAccrual{WalletID: 3, Period: "2026-01", Day: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Amount: d("0.5")}).Error)
+	require.NoError(t, db.Model(&model.Wallet{}).Where("id = ?", 3).Update("status", model.WalletFrozen).Error)
+
+	// a wallet frozen between the check and the credit refuses it
+	period, key := "2026-01", "interest:2026-01:3"
+	to := uint64(3)
+	sg := &model.TransferSaga{
+		FromWalletID: 2, ToWalletID: &to, Currency: model.DefaultCurrency,
+		Amount: d("0.5"), State: model.SagaDebited, InterestPeriod: &period, IdempotencyKey: &key,
+	}
+	require.NoError(t, svc.Repo().DB(repo.OnShard(ctx, 1)).Create(sg).Error)
+	sg, err = svc.advanceSaga(ctx, 1, sg.ID)
+	assert.ErrorIs(t, err, ErrWalletFrozen)
+	assert.Equal(t, model.SagaCompensated, sg.State)
+	assert.Equal(t, "1000.5", walletOn(t, svc, 1, 2).Balance.String())
+
+	// the next run tries again under the same key
+	require.NoError(t, db.Model(&model.Wallet{}).Where("id = ?", 3).Update("status", model.WalletActive).Error)
+	n, err := svc.PostInterest(ctx, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "1000", walletOn(t, svc, 1, 2).Balance.String())
+	assert.Equal(t, "1000.5", walletOn(t, svc, 2, 3).Balance.String())
+}
+
+func TestLimitProfile_OnEveryShard(t *testing.T) {
+	svc, ctx := newShardedService(t, map[uint64]int{1: 1, 2: 1, 9: 1})
+	_, err := svc.Deposit(ctx, 1, d("100"), "dep")
+	require.NoError(t, err)
+
+	p := &model.LimitProfile{Name: "tight", PerTxMax: d("5")}
+	require.NoError(t, svc.SaveLimitProfile(ctx, p))
+	for _, shard := range []int{1, 2} {
+		var copied model.LimitProfile
+		require.NoError(t, svc.Repo().DB(repo.OnShard(ctx, shard)).First(&copied, p.ID).Error)
+		assert.Equal(t, "tight", copied.Name)
+	}
+	require.NoError(t, svc.AssignLimitProfile(ctx, 1, &p.ID))
+	assert.Equal(t, p.ID, *walletOn(t, svc, 1, 1).LimitProfileID)
+	_, _, err = svc.Transfer(ctx, 1, 2, d("10"), "t1")
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	got, _, err := svc.LimitUsage(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "tight", got.Name)
+
+	// updates reach the copies
+	p.PerTxMax = d("50")
+	require.NoError(t, svc.SaveLimitProfile(ctx, p))
+	_, _, err = svc.Transfer(ctx, 1, 2, d("10"), "t2")
+	require.NoError(t, err)
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetBalanceAt returns the wallet's balance at t: the balance after its last
+// ledger row before t, or zero if it had none yet.
+func (s *WalletService) GetBalanceAt(ctx context.Context, walletID uint64, t time.Time) (decimal.Decimal, error) {
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if _, err := s.GetWallet(ctx, walletID); err != nil {
+		return decimal.Zero, err
+	}
+	bal, _, err := s.balanceAt(ctx, walletID, t)
+	return bal, err
+}
+
+// balanceAt finds the balance at t and the ID of the ledger row it comes from.
+// Only the rows after the latest snapshot ending by t are searched, archived
+// months included.
+func (s *WalletService) balanceAt(ctx context.Context, walletID uint64, t time.Time) (decimal.Decimal, uint64, error) {
+	db := s.repo.DB(ctx)
+	var snap model.BalanceSnapshot
+	if err := db.Where("wallet_id = ? AND day < ?", walletID, startOfDay(t)).
+		Order("day desc").Limit(1).Find(&snap).Error; err != nil {
+		return decimal.Zero, 0, err
+	}
+	var from time.Time
+	q := db.Select("id", "balance_after").Where("wallet_id = ? AND created_at < ?", walletID, t)
+	if snap.WalletID != 0 {
+		from = snap.Day.AddDate(0, 0, 1)
+		q = q.Where("created_at >= ?", from)
+	}
+	var tx model.Transaction
+	err := q.Order("created_at desc, id desc").First(&tx).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		row, err := s.archivedBalance(ctx, walletID, from, t)
+		switch {
+		case err != nil:
+			return decimal.Zero, 0, err
+		case row != nil:
+			return row.BalanceAfter, row.ID, nil
+		case snap.WalletID != 0:
+			return snap.Balance, snap.LastTransactionID, nil
+		}
+		return decimal.Zero, 0, nil
+	}
+	if err != nil {
+		return decimal.Zero, 0, err
+	}
+	return tx.BalanceAfter, tx.ID, nil
+}
+
+// SnapshotBalances records the end-of-day balance of every wallet that
+// existed on day. Existing snapshots for the day are overwritten, so a rerun
+// picks up ledger rows committed late. It returns the number of snapshots.
+func (s *WalletService) SnapshotBalances(ctx context.Context, day time.Time) (int, error) {
+	day = startOfDay(day)
+	end := day.AddDate(0, 0, 1)
+	db := s.repo.DB(ctx)
+	n := 0
+	var lastID uint64
+	for {
+		var ids []uint64
+		if err := db.Model(&model.Wallet{}).Where("created_at < ? AND id > ?", end, lastID).
+			Order("id").Limit(500).Pluck("id", &ids).Error; err != nil {
+			return n, err
+		}
+		if len(ids) == 0 {
+			return n, nil
+		}
+		lastID = ids[len(ids)-1]
+		for _, id := range ids {
+			bal, txID, err := s.balanceAt(ctx, id, end)
+			if err != nil {
+				return n, err
+			}
+			snap := model.BalanceSnapshot{WalletID: id, Day: day, Balance: bal, LastTransactionID: txID}
+			if err := db.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "wallet_id"}, {Name: "day"}},
+				DoUpdates: clause.AssignmentColumns([]string{"balance", "last_transaction_id"}),
+			}).Create(&snap).Error; err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+// RunSnapshots writes the snapshots of the last BackfillDays complete days,
+// oldest first so each day can start from the one before.
+func (s *WalletService) RunSnapshots(ctx context.Context, now time.Time) (int, error) {
+	today := startOfDay(now)
+	total := 0
+	for i := s.cfg().Snapshots.BackfillDays; i >= 1; i-- {
+		n, err := s.SnapshotBalances(ctx, today.AddDate(0, 0, -i))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
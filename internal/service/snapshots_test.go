@@ -0,0 +1,66 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBalanceAt(t *testing.T) {
+	svc, ctx := newTestService(t)
+	_, err := svc.CreateWallet(ctx, 1, "")
+	require.NoError(t, err)
+	db := svc.Repo().DB(ctx)
+	day := func(d, h int) time.Time { return time.Date(2026, 9, d, h, 0, 0, 0, time.UTC) }
+	require.NoError(t, db.Model(&model.Wallet{}).Where("id = 1").Update("created_at", day(1, 0)).Error)
+
+	// ledger: +100 on the 1st, +50 on the 2nd, -30 on the 3rd
+	for i, amt := range []string{"100", "50"} {
+		_, err := svc.Deposit(ctx, 1, d(amt), "d"+amt)
+		require.NoError(t, err)
+		require.NoError(t, db.Model(&model.Transaction{}).Where("idempotency_key = ?", "d"+amt).
+			Update("created_at", day(i+1, 12)).Error)
+	}
+	_, err = svc.Withdraw(ctx, 1, d("30"), "w1")
+	require.NoError(t, err)
+	require.NoError(t, db.Model(&model.Transaction{}).Where("idempotency_key = ?", "w1").Update("created_at", day(3, 12)).Error)
+
+	check := func(at time.Time, want string) {
+		t.Helper()
+		bal, err := svc.GetBalanceAt(ctx, 1, at)
+		require.NoError(t, err)
+		assert.Equal(t, want, bal.String(), at.String())
+	}
+	check(day(1, 0), "0")
+	check(day(2, 0), "100")
+	check(day(3, 11), "150")
+	check(day(30, 23), "120")
+
+	// same answers once the 1st and 2nd have been snapshotted
+	for _, d := range []int{1, 2} {
+		n, err := svc.SnapshotBalances(ctx, day(d, 0))
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+	var snaps []model.BalanceSnapshot
+	require.NoError(t, db.Order("day").Find(&snaps).Error)
+	require.Len(t, snaps, 2)
+	assert.Equal(t, "150", snaps[1].Balance.String())
+	check(day(2, 0), "100")
+	check(day(3, 0), "150")
+	check(day(3, 11), "150")
+	check(day(30, 23), "120")
+
+	// reruns overwrite rather than duplicate
+	_, err = svc.SnapshotBalances(ctx, day(2, 0))
+	require.NoError(t, err)
+	var count int64
+	require.NoError(t, db.Model(&model.BalanceSnapshot{}).Count(&count).Error)
+	assert.EqualValues(t, 2, count)
+
+	_, err = svc.GetBalanceAt(ctx, 42, day(3, 0))
+	assert.ErrorIs(t, err, ErrWalletNotFound)
+}
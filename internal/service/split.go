@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// Transaction types of a split.
+const (
+	TxSplitOut = "SPLIT_OUT"
+	TxSplitIn  = "SPLIT_IN"
+)
+
+// ErrInvalidSplit means the split legs are malformed or don't balance.
+var ErrInvalidSplit = errors.New("invalid split")
+
+// SplitLeg is one wallet on either side of a split and its share.
+type SplitLeg struct {
+	WalletID uint64          `json:"wallet_id"`
+	Amount   decimal.Decimal `json:"amount"`
+}
+
+// SplitPosting is the outcome of one leg.
+type SplitPosting struct {
+	WalletID uint64          `json:"wallet_id"`
+	Type     string          `json:"type"`
+	Amount   decimal.Decimal `json:"amount"`
+	Balance  decimal.Decimal `json:"balance"`
+}
+
+// Split debits every wallet in debits and credits every wallet in credits in
+// one DB transaction, e.g. a buyer paying seller, platform and tax at once.
+// The two sides must sum to exactly the same amount, all wallets must share a
+// currency and no wallet may appear twice; a split whose wallets are on
+// different shards fails with ErrCrossShard. All ledger rows carry key.
+func (s *WalletService) Split(ctx context.Context, debits, credits []SplitLeg, key string) ([]SplitPosting, error) {
+	total, err := s.checkSplit(debits, credits)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, 0, len(debits)+len(credits))
+	for _, l := range append(append([]SplitLeg{}, debits...), credits...) {
+		ids = append(ids, l.WalletID)
+	}
+	ctx, err = s.routeTogether(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	var out []SplitPosting
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if existed, _, err := s.repo.TxExists(ctx, tx, debits[0].WalletID, key, TxSplitOut); err != nil || existed {
+			if existed {
+				out, err = s.splitPostings(ctx, tx, debits, credits, key)
+			}
+			return err
+		}
+		ws, err := s.lockWallets(ctx, tx, s.transferLock(), ids...)
+		if err != nil {
+			return err
+		}
+		currency := ws[debits[0].WalletID].Currency
+		for _, w := range ws {
+			if w.Currency != currency {
+				return ErrCurrencyMismatch
+			}
+		}
+		for _, l := range credits {
+			if err := checkCredit(ws[l.WalletID]); err != nil {
+				return fmt.Errorf("wallet %d: %w", l.WalletID, err)
+			}
+		}
+		p := newPostings(ws)
+		for _, l := range debits {
+			w := ws[l.WalletID]
+			if err := checkDebit(w); err != nil {
+				return fmt.Errorf("wallet %d: %w", l.WalletID, err)
+			}
+			if err := s.checkLimits(ctx, tx, w, LimitKindTransfer, l.Amount); err != nil {
+				return err
+			}
+			if w.Available().LessThan(l.Amount) {
+				return fmt.Errorf("wallet %d: %w", l.WalletID, repo.ErrInsufficientFunds)
+			}
+			p.debit(l.WalletID, TxSplitOut, l.Amount, counterparty(credits), key)
+		}
+		for _, l := range credits {
+			p.credit(l.WalletID, TxSplitIn, l.Amount, counterparty(debits), key)
+		}
+		if err := s.flush(ctx, tx, p); err != nil {
+			return err
+		}
+		for _, l := range debits {
+			out = append(out, SplitPosting{WalletID: l.WalletID, Type: TxSplitOut, Amount: l.Amount, Balance: p.balance(l.WalletID)})
+		}
+		for _, l := range credits {
+			out = append(out, SplitPosting{WalletID: l.WalletID, Type: TxSplitIn, Amount: l.Amount, Balance: p.balance(l.WalletID)})
+		}
+		return s.emit(ctx, tx, debits[0].WalletID, "Split", map[string]interface{}{
+			"idempotency_key": key, "currency": currency, "amount": total, "legs": out,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// checkSplit validates the legs and returns the amount moved.
+func (s *WalletService) checkSplit(debits, credits []SplitLeg) (decimal.Decimal, error) {
+	if len(debits) == 0 || len(credits) == 0 {
+		return decimal.Zero, fmt.Errorf("%w: need at least one debit and one credit", ErrInvalidSplit)
+	}
+	seen := map[uint64]bool{}
+	sums := [2]decimal.Decimal{}
+	for side, legs := range [][]SplitLeg{debits, credits} {
+		for _, l := range legs {
+			if l.WalletID == 0 || seen[l.WalletID] {
+				return decimal.Zero, fmt.Errorf("%w: wallet %d is missing or listed twice", ErrInvalidSplit, l.WalletID)
+			}
+			seen[l.WalletID] = true
+			if !l.Amount.IsPositive() {
+				return decimal.Zero, ErrInvalidAmount
+			}
+			sums[side] = sums[side].Add(l.Amount)
+		}
+	}
+	if !sums[0].Equal(sums[1]) {
+		return decimal.Zero, fmt.Errorf("%w: debits total %s but credits total %s", ErrInvalidSplit, sums[0], sums[1])
+	}
+	if err := s.checkAmount(sums[0]); err != nil {
+		return decimal.Zero, err
+	}
+	return sums[0], nil
+}
+
+// counterparty returns the single wallet on the other side, if there is one.
+func counterparty(other []SplitLeg) *uint64 {
+	if len(other) != 1 {
+		return nil
+	}
+	id := other[0].WalletID
+	return &id
+}
+
+// splitPostings rebuilds the result of an already executed split.
+func (s *WalletService) splitPostings(ctx context.Context, tx *gorm.DB, debits, credits []SplitLeg, key string) ([]SplitPosting, error) {
+	var out []SplitPosting
+	for _, side := range []struct {
+		legs []SplitLeg
+		typ  string
+	}{{debits, TxSplitOut}, {credits, TxSplitIn}} {
+		for _, l := range side.legs {
+			ok, row, err := s.repo.TxExists(ctx, tx, l.WalletID, key, side.typ)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("%w: idempotency key %q was used for a different split", ErrInvalidSplit, key)
+			}
+			out = append(out, SplitPosting{WalletID: l.WalletID, Type: side.typ, Amount: row.Amount, Balance: row.BalanceAfter})
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplit(t *testing.T) {
+	svc, ctx := newTestService(t)
+	for _, id := range []uint64{1, 2, 3, 4} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, d("100"), "d1")
+	require.NoError(t, err)
+
+	// buyer pays seller, platform and tax in one go
+	credits := []SplitLeg{{WalletID: 2, Amount: d("80")}, {WalletID: 3, Amount: d("15")}, {WalletID: 4, Amount: d("5")}}
+	out, err := svc.Split(ctx, []SplitLeg{{WalletID: 1, Amount: d("100")}}, credits, "order-1")
+	require.NoError(t, err)
+	require.Len(t, out, 4)
+	assert.Equal(t, "0", out[0].Balance.String())
+	assert.Equal(t, "80", out[1].Balance.String())
+
+	// replay
+	again, err := svc.Split(ctx, []SplitLeg{{WalletID: 1, Amount: d("100")}}, credits, "order-1")
+	require.NoError(t, err)
+	require.Len(t, again, 4)
+	for i := range out {
+		assert.Equal(t, out[i].WalletID, again[i].WalletID)
+		assert.True(t, out[i].Balance.Equal(again[i].Balance))
+	}
+
+	// amounts must balance exactly
+	_, err = svc.Split(ctx, []SplitLeg{{WalletID: 2, Amount: d("10")}}, []SplitLeg{{WalletID: 1, Amount: d("9.99")}}, "bad")
+	assert.ErrorIs(t, err, ErrInvalidSplit)
+
+	// several payers, one payee; one payer short means nothing moves
+	_, err = svc.Split(ctx, []SplitLeg{{WalletID: 2, Amount: d("10")}, {WalletID: 3, Amount: d("20")}},
+		[]SplitLeg{{WalletID: 1, Amount: d("30")}}, "pool-1")
+	assert.ErrorIs(t, err, repo.ErrInsufficientFunds)
+	w, err := svc.GetWallet(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "80", w.Balance.String())
+
+	_, err = svc.Split(ctx, []SplitLeg{{WalletID: 2, Amount: d("10")}, {WalletID: 3, Amount: d("5")}},
+		[]SplitLeg{{WalletID: 1, Amount: d("15")}}, "pool-2")
+	require.NoError(t, err)
+
+	var events []model.OutboxEvent
+	require.NoError(t, svc.Repo().DB(ctx).Where("event_type = ?", "Split").Find(&events).Error)
+	assert.Len(t, events, 2)
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+)
+
+// ErrInvalidPeriod means the statement period is empty or inverted.
+var ErrInvalidPeriod = errors.New("statement period must have from before to")
+
+// StatementService builds wallet statements from transaction history.
+type StatementService struct {
+	wallets *WalletService
+}
+
+// NewStatementService returns StatementService.
+func NewStatementService(w *WalletService) *StatementService {
+	return &StatementService{wallets: w}
+}
+
+// Generate builds the statement of walletID for [from, to).
+func (s *StatementService) Generate(ctx context.Context, walletID uint64, from, to time.Time) (*model.Statement, error) {
+	if !from.Before(to) {
+		return nil, ErrInvalidPeriod
+	}
+	st := &model.Statement{
+		WalletID:     walletID,
+		From:         from,
+		To:           to,
+		TotalsByType: map[string]decimal.Decimal{},
+		Lines:        []model.StatementLine{},
+		GeneratedAt:  time.Now().UTC(),
+	}
+
+	// opening balance is the balance after the last transaction before the period
+	prev, err := s.wallets.GetHistory(ctx, walletID, HistoryQuery{Limit: 1, Desc: true, Until: &from})
+	if err != nil {
+		return nil, err
+	}
+	if len(prev.Items) > 0 {
+		st.OpeningBalance = prev.Items[0].BalanceAfter
+	}
+	st.ClosingBalance = st.OpeningBalance
+
+	q := HistoryQuery{Limit: MaxHistoryLimit, Since: &from, Until: &to}
+	for {
+		page, err := s.wallets.GetHistory(ctx, walletID, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range page.Items {
+			amt := t.Amount
+			if t.BalanceAfter.LessThan(t.BalanceBefore) {
+				amt = amt.Neg()
+				st.TotalDebits = st.TotalDebits.Add(t.Amount)
+			} else {
+				st.TotalCredits = st.TotalCredits.Add(t.Amount)
+			}
+			st.TotalsByType[t.Type] = st.TotalsByType[t.Type].Add(t.Amount)
+			st.Lines = append(st.Lines, model.StatementLine{
+				TransactionID:   t.ID,
+				Time:            t.CreatedAt,
+				Type:            t.Type,
+				Amount:          amt,
+				Balance:         t.BalanceAfter,
+				RelatedWalletID: t.RelatedWalletID,
+			})
+			st.ClosingBalance = t.BalanceAfter
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	return st, nil
+}
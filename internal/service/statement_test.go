@@ -0,0 +1,44 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatementService_Generate(t *testing.T) {
+	svc, ctx := newTestService(t)
+	assert.NoError(t, svc.Repo().DB(ctx).Create(&model.Wallet{ID: 1, Balance: decimal.Zero}).Error)
+	assert.NoError(t, svc.Repo().DB(ctx).Create(&model.Wallet{ID: 2, Balance: decimal.Zero}).Error)
+
+	_, err := svc.Deposit(ctx, 1, decimal.NewFromInt(100), "d1")
+	assert.NoError(t, err)
+	// push the first deposit before the period
+	assert.NoError(t, svc.Repo().DB(ctx).Model(&model.Transaction{}).
+		Where("idempotency_key = ?", "d1").Update("created_at", time.Now().Add(-48*time.Hour)).Error)
+
+	from := time.Now().Add(-time.Hour)
+	_, err = svc.Deposit(ctx, 1, decimal.NewFromInt(50), "d2")
+	assert.NoError(t, err)
+	_, _, err = svc.Transfer(ctx, 1, 2, decimal.NewFromInt(30), "t1")
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, 1, decimal.NewFromInt(20), "w1")
+	assert.NoError(t, err)
+
+	st, err := NewStatementService(svc).Generate(ctx, 1, from, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, "100", st.OpeningBalance.String())
+	assert.Equal(t, "100", st.ClosingBalance.String())
+	assert.Len(t, st.Lines, 3)
+	assert.Equal(t, "150", st.Lines[0].Balance.String())
+	assert.Equal(t, "-30", st.Lines[1].Amount.String())
+	assert.Equal(t, "50", st.TotalCredits.String())
+	assert.Equal(t, "50", st.TotalDebits.String())
+	assert.Equal(t, "30", st.TotalsByType["TRANSFER_OUT"].String())
+
+	_, err = NewStatementService(svc).Generate(ctx, 1, from, from)
+	assert.ErrorIs(t, err, ErrInvalidPeriod)
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"time"
+	"net/http"
+	"strconv"
 
+	"github.com/richardliu001/wallet-service/internal/cache"
+	"github.com/richardliu001/wallet-service/internal/config"
 	"github.com/richardliu001/wallet-service/internal/model"
 	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/richardliu001/wallet-service/internal/settlement"
 	"github.com/shopspring/decimal"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 	"gorm.io/gorm"
 )
 
@@ -17,23 +22,64 @@ import (
 type WalletService struct {
 	repo repo.RepositoryInterface
 	log  *zap.SugaredLogger
+	cfg  func() *config.Config
+
+	local  *cache.LRU[uint64, model.Balance] // in-process balance tier
+	flight singleflight.Group                // coalesces balance loads per wallet
+	settle settlement.Provider               // pays external withdrawals out
+	hooks  *http.Client                      // delivers webhooks to subscribers
+}
+
+// Option configures optional WalletService behaviour.
+type Option func(*WalletService)
+
+// WithRuntime makes the service read limits and toggles from rt on every call,
+// so reloaded values apply without a restart.
+func WithRuntime(rt *config.Runtime) Option {
+	return func(s *WalletService) { s.cfg = rt.Current }
 }
 
 // NewWalletService returns WalletService.
-func NewWalletService(r repo.RepositoryInterface, logger *zap.SugaredLogger) *WalletService {
-	return &WalletService{repo: r, log: logger}
+func NewWalletService(r repo.RepositoryInterface, logger *zap.SugaredLogger, opts ...Option) *WalletService {
+	defaults := config.Defaults()
+	s := &WalletService{repo: r, log: logger, cfg: func() *config.Config { return &defaults }, hooks: webhookClient()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	cc := s.cfg().Cache
+	s.local = cache.NewLRU[uint64, model.Balance](cc.LocalSize, cc.LocalTTL)
+	return s
 }
 
-// ErrInvalidAmount means non-positive amount passed.
-var ErrInvalidAmount = errors.New("amount must be positive")
+var (
+	// ErrInvalidAmount means non-positive amount passed.
+	ErrInvalidAmount = errors.New("amount must be positive")
+	// ErrAmountTooLarge means the amount exceeds limits.max_amount.
+	ErrAmountTooLarge = errors.New("amount exceeds the per-transaction maximum")
+)
 
-// Deposit adds money; auto-creates wallet if absent.
-func (s *WalletService) Deposit(ctx context.Context, id uint64, amt decimal.Decimal, key string) (decimal.Decimal, error) {
+// checkAmount validates amt against the currently configured limits.
+func (s *WalletService) checkAmount(amt decimal.Decimal) error {
 	if amt.LessThanOrEqual(decimal.Zero) {
-		return decimal.Zero, ErrInvalidAmount
+		return ErrInvalidAmount
+	}
+	if max := s.cfg().Limits.MaxAmount; max.IsPositive() && amt.GreaterThan(max) {
+		return ErrAmountTooLarge
+	}
+	return nil
+}
+
+// Deposit adds money; creates the wallet only if auto-create is enabled.
+func (s *WalletService) Deposit(ctx context.Context, id uint64, amt decimal.Decimal, key string) (decimal.Decimal, error) {
+	if err := s.checkAmount(amt); err != nil {
+		return decimal.Zero, err
+	}
+	ctx, err := s.route(ctx, id)
+	if err != nil {
+		return decimal.Zero, err
 	}
 	var finalBal decimal.Decimal
-	err := s.repo.DB(ctx).Transaction(func(tx *gorm.DB) error {
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
 		existed, txRow, err := s.repo.TxExists(ctx, tx, id, key, "DEPOSIT")
 		if err != nil {
 			return err
@@ -43,26 +89,27 @@ func (s *WalletService) Deposit(ctx context.Context, id uint64, amt decimal.Deci
 			return nil
 		}
 
-		w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+		w, err := s.lockOrCreate(ctx, tx, id)
 		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				w = &model.Wallet{ID: id, Balance: decimal.Zero}
-				if err := s.repo.CreateWallet(ctx, tx, w); err != nil {
-					return err
-				}
-			} else {
-				return err
-			}
+			return err
+		}
+		if err := checkCredit(w); err != nil {
+			return err
 		}
 
 		newBal := w.Balance.Add(amt)
 		if err := s.repo.UpdateWallet(ctx, tx, id, newBal, w.Version); err != nil {
 			return err
 		}
+		before := utilization(w.Balance, w.CreditLimit)
 		t := &model.Transaction{
 			WalletID: id, Type: "DEPOSIT", Amount: amt,
 			BalanceBefore: w.Balance, BalanceAfter: newBal, IdempotencyKey: &key,
 		}
+		w.Balance, w.Version = newBal, w.Version+1
+		if err := s.checkUtilization(ctx, tx, w, before); err != nil {
+			return err
+		}
 		if err := s.repo.CreateTransaction(ctx, tx, t); err != nil {
 			return err
 		}
@@ -73,9 +120,7 @@ func (s *WalletService) Deposit(ctx context.Context, id uint64, amt decimal.Deci
 		if err := s.repo.CreateOutboxEvent(ctx, tx, evt); err != nil {
 			return err
 		}
-		if err := s.repo.CacheBalance(ctx, id, newBal); err != nil {
-			s.log.Warn(err)
-		}
+		s.cacheAfterCommit(ctx, model.NewBalance(w))
 		finalBal = newBal
 		return nil
 	})
@@ -85,67 +130,134 @@ func (s *WalletService) Deposit(ctx context.Context, id uint64, amt decimal.Deci
 	return finalBal, nil
 }
 
-// Withdraw subtracts money.
+// Withdraw subtracts money plus any withdrawal fee and returns the new
+// balance; see WithdrawWithFee.
 func (s *WalletService) Withdraw(ctx context.Context, id uint64, amt decimal.Decimal, key string) (decimal.Decimal, error) {
-	if amt.LessThanOrEqual(decimal.Zero) {
-		return decimal.Zero, ErrInvalidAmount
+	bal, _, err := s.WithdrawWithFee(ctx, id, amt, key)
+	return bal, err
+}
+
+// WithdrawWithFee subtracts money plus any withdrawal fee, which is credited
+// to the house wallet in the same DB transaction, or by a saga when the house
+// wallet is on another shard. It returns the new balance and the fee. Payouts
+// that an external provider has to make go through RequestWithdrawal instead.
+func (s *WalletService) WithdrawWithFee(ctx context.Context, id uint64, amt decimal.Decimal, key string) (decimal.Decimal, decimal.Decimal, error) {
+	if err := s.checkAmount(amt); err != nil {
+		return decimal.Zero, decimal.Zero, err
 	}
-	var finalBal decimal.Decimal
-	err := s.repo.DB(ctx).Transaction(func(tx *gorm.DB) error {
-		existed, _, err := s.repo.TxExists(ctx, tx, id, key, "WITHDRAW")
+	shard, err := s.repo.ShardOf(ctx, id)
+	if err != nil {
+		return decimal.Zero, decimal.Zero, err
+	}
+	ctx = repo.OnShard(ctx, shard)
+	var finalBal, fee decimal.Decimal
+	var saga *model.TransferSaga
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		existed, txRow, err := s.repo.TxExists(ctx, tx, id, key, "WITHDRAW")
 		if err != nil {
 			return err
 		}
 		if existed {
+			finalBal = txRow.BalanceAfter
+			if ok, feeRow, err := s.repo.TxExists(ctx, tx, id, key, TxFee); err != nil {
+				return err
+			} else if ok {
+				finalBal, fee = feeRow.BalanceAfter, feeRow.Amount
+			}
 			return nil
 		}
-		w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+		currency, err := s.walletCurrency(ctx, tx, id)
 		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return repo.ErrInsufficientFunds
-			}
 			return err
 		}
-		if w.Balance.LessThan(amt) {
-			return repo.ErrInsufficientFunds
+		var house uint64
+		fee, house = s.feeFor(LimitKindWithdraw, currency, id, amt)
+		houseShard := shard
+		if house != 0 {
+			if houseShard, err = s.repo.ShardOf(ctx, house); err != nil {
+				return err
+			}
 		}
-		newBal := w.Balance.Sub(amt)
-		if err := s.repo.UpdateWallet(ctx, tx, id, newBal, w.Version); err != nil {
+		ws, err := s.lockWallets(ctx, tx, s.withdrawLock(house, shard, houseShard), id, house)
+		if err != nil {
 			return err
 		}
-		t := &model.Transaction{
-			WalletID: id, Type: "WITHDRAW", Amount: amt,
-			BalanceBefore: w.Balance, BalanceAfter: newBal, IdempotencyKey: &key,
-		}
-		if err := s.repo.CreateTransaction(ctx, tx, t); err != nil {
+		w := ws[id]
+		if err := checkDebit(w); err != nil {
 			return err
 		}
-		payload, _ := json.Marshal(map[string]interface{}{"wallet_id": id, "amount": amt, "balance": newBal})
-		evt := &model.OutboxEvent{
-			Aggregate: "Wallet", AggregateID: id, EventType: "Withdraw", Payload: string(payload),
+		if house != 0 {
+			if err := checkHouse(ws[house], w.Currency); err != nil {
+				return err
+			}
 		}
-		if err := s.repo.CreateOutboxEvent(ctx, tx, evt); err != nil {
+		if err := s.checkLimits(ctx, tx, w, LimitKindWithdraw, amt); err != nil {
 			return err
 		}
-		if err := s.repo.CacheBalance(ctx, id, newBal); err != nil {
-			s.log.Warn(err)
+		if w.Available().LessThan(amt.Add(fee)) {
+			return repo.ErrInsufficientFunds
 		}
-		finalBal = newBal
-		return nil
+		p := newPostings(ws)
+		p.debit(id, "WITHDRAW", amt, nil, key)
+		if house != 0 {
+			chargeFee(p, id, house, fee, key)
+		}
+		if houseShard != shard {
+			if saga, err = s.feeAcross(ctx, tx, p, id, house, w.Currency, amt, fee, key); err != nil {
+				return err
+			}
+		}
+		if err := s.flush(ctx, tx, p); err != nil {
+			return err
+		}
+		finalBal = p.balance(id)
+		return s.emit(ctx, tx, id, "Withdraw", map[string]interface{}{
+			"wallet_id": id, "amount": amt, "fee": fee, "balance": finalBal,
+		})
 	})
-	return finalBal, err
+	if err != nil {
+		return decimal.Zero, decimal.Zero, err
+	}
+	if saga != nil {
+		// the withdrawal stands either way; a failed fee credit is retried by ResumeSagas
+		if _, err := s.advanceSaga(ctx, shard, saga.ID); err != nil {
+			s.log.Warnf("withdrawal fee of wallet %d, saga %d: %v", id, saga.ID, err)
+		}
+	}
+	return finalBal, fee, nil
 }
 
-// Transfer moves money between wallets.
+// Transfer moves money between wallets and returns both new balances; see
+// TransferWithFee.
 func (s *WalletService) Transfer(ctx context.Context, fromID, toID uint64, amt decimal.Decimal, key string) (decimal.Decimal, decimal.Decimal, error) {
-	if amt.LessThanOrEqual(decimal.Zero) {
-		return decimal.Zero, decimal.Zero, ErrInvalidAmount
+	fromBal, toBal, _, err := s.TransferWithFee(ctx, fromID, toID, amt, key)
+	return fromBal, toBal, err
+}
+
+// TransferWithFee moves money between wallets of the same currency; the
+// sender also pays any transfer fee. It returns both new balances and the fee.
+// When the recipient or the fee house is on another shard than the sender,
+// the debit commits first and a saga applies the credits, refunding the sender
+// if the recipient refuses (ErrTransferReversed).
+func (s *WalletService) TransferWithFee(ctx context.Context, fromID, toID uint64, amt decimal.Decimal, key string) (decimal.Decimal, decimal.Decimal, decimal.Decimal, error) {
+	if err := s.checkAmount(amt); err != nil {
+		return decimal.Zero, decimal.Zero, decimal.Zero, err
 	}
 	if fromID == toID {
-		return decimal.Zero, decimal.Zero, errors.New("cannot transfer to self")
+		return decimal.Zero, decimal.Zero, decimal.Zero, errors.New("cannot transfer to self")
+	}
+	fromShard, err := s.repo.ShardOf(ctx, fromID)
+	if err != nil {
+		return decimal.Zero, decimal.Zero, decimal.Zero, err
 	}
-	var fromBal, toBal decimal.Decimal
-	err := s.repo.DB(ctx).Transaction(func(tx *gorm.DB) error {
+	toShard, err := s.repo.ShardOf(ctx, toID)
+	if err != nil {
+		return decimal.Zero, decimal.Zero, decimal.Zero, err
+	}
+	ctx = repo.OnShard(ctx, fromShard)
+	var fromBal, toBal, fee decimal.Decimal
+	var saga *model.TransferSaga
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
 		existed, txOut, err := s.repo.TxExists(ctx, tx, fromID, key, "TRANSFER_OUT")
 		if err != nil {
 			return err
@@ -157,110 +269,175 @@ func (s *WalletService) Transfer(ctx context.Context, fromID, toID uint64, amt d
 				Where("wallet_id=? AND idempotency_key=? AND type=?", toID, key, "TRANSFER_IN").
 				First(&txIn).Error
 			toBal = txIn.BalanceAfter
-			return nil
-		}
-		// lock wallets in deterministic order
-		firstID, secondID := fromID, toID
-		if secondID < firstID {
-			firstID, secondID = secondID, firstID
-		}
-		w1, err := s.repo.GetWalletForUpdate(ctx, tx, firstID)
-		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				w1 = &model.Wallet{ID: firstID, Balance: decimal.Zero}
-				if err := s.repo.CreateWallet(ctx, tx, w1); err != nil {
-					return err
-				}
-			} else {
+			if ok, feeRow, err := s.repo.TxExists(ctx, tx, fromID, key, TxFee); err != nil {
 				return err
+			} else if ok {
+				fromBal, fee = feeRow.BalanceAfter, feeRow.Amount
 			}
+			saga, err = s.sagaByKey(ctx, tx, fromID, key)
+			return err
 		}
-		w2, err := s.repo.GetWalletForUpdate(ctx, tx, secondID)
+		currency, err := s.walletCurrency(ctx, tx, fromID)
 		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				w2 = &model.Wallet{ID: secondID, Balance: decimal.Zero}
-				if err := s.repo.CreateWallet(ctx, tx, w2); err != nil {
-					return err
-				}
-			} else {
+			return err
+		}
+		var house uint64
+		fee, house = s.feeFor(LimitKindTransfer, currency, fromID, amt)
+		houseShard := fromShard
+		if house != 0 {
+			if houseShard, err = s.repo.ShardOf(ctx, house); err != nil {
 				return err
 			}
 		}
-		var wFrom, wTo *model.Wallet
-		if firstID == fromID {
-			wFrom, wTo = w1, w2
-		} else {
-			wFrom, wTo = w2, w1
-		}
-		if wFrom.Balance.LessThan(amt) {
-			return repo.ErrInsufficientFunds
-		}
-		newFrom := wFrom.Balance.Sub(amt)
-		newTo := wTo.Balance.Add(amt)
-		if err := s.repo.UpdateWallet(ctx, tx, fromID, newFrom, wFrom.Version); err != nil {
+		if toShard != fromShard || houseShard != fromShard {
+			saga, fromBal, err = s.transferAcross(ctx, tx, fromID, toID, house, toShard, houseShard, amt, fee, currency, key)
 			return err
 		}
-		if err := s.repo.UpdateWallet(ctx, tx, toID, newTo, wTo.Version); err != nil {
+		ws, err := s.lockWallets(ctx, tx, s.transferLock(house), fromID, toID, house)
+		if err != nil {
 			return err
 		}
-		txOut = &model.Transaction{
-			WalletID: fromID, Type: "TRANSFER_OUT", Amount: amt,
-			BalanceBefore: wFrom.Balance, BalanceAfter: newFrom,
-			RelatedWalletID: &toID, IdempotencyKey: &key,
-		}
-		txIn := &model.Transaction{
-			WalletID: toID, Type: "TRANSFER_IN", Amount: amt,
-			BalanceBefore: wTo.Balance, BalanceAfter: newTo,
-			RelatedWalletID: &fromID, IdempotencyKey: &key,
-		}
-		if err := s.repo.CreateTransaction(ctx, tx, txOut); err != nil {
+		p := newPostings(ws)
+		if err := s.transferLocked(ctx, tx, p, fromID, toID, amt, fee, house, key); err != nil {
 			return err
 		}
-		if err := s.repo.CreateTransaction(ctx, tx, txIn); err != nil {
+		if err := s.flush(ctx, tx, p); err != nil {
 			return err
 		}
-		payload, _ := json.Marshal(map[string]interface{}{"from": fromID, "to": toID, "amount": amt})
-		evt := &model.OutboxEvent{
-			Aggregate: "Wallet", AggregateID: fromID, EventType: "Transfer", Payload: string(payload),
-		}
-		if err := s.repo.CreateOutboxEvent(ctx, tx, evt); err != nil {
-			return err
+		fromBal, toBal = p.balance(fromID), p.balance(toID)
+		return s.emit(ctx, tx, fromID, "Transfer", map[string]interface{}{
+			"from": fromID, "to": toID, "amount": amt, "fee": fee,
+		})
+	})
+	if err != nil {
+		return decimal.Zero, decimal.Zero, decimal.Zero, err
+	}
+	if saga != nil {
+		if toBal, err = s.finishTransfer(ctx, fromShard, saga); err != nil {
+			return decimal.Zero, decimal.Zero, decimal.Zero, err
 		}
-		if err := s.repo.CacheBalance(ctx, fromID, newFrom); err != nil {
-			s.log.Warn(err)
+	}
+	return fromBal, toBal, fee, nil
+}
+
+// transferLock locks transfer parties, creating them if auto-create is on,
+// except for fee house wallets, which must exist.
+func (s *WalletService) transferLock(houses ...uint64) lockFunc {
+	return func(ctx context.Context, tx *gorm.DB, id uint64) (*model.Wallet, error) {
+		for _, h := range houses {
+			if id == h {
+				return s.lockHouse(ctx, tx, id)
+			}
 		}
-		if err := s.repo.CacheBalance(ctx, toID, newTo); err != nil {
-			s.log.Warn(err)
+		return s.lockOrCreate(ctx, tx, id)
+	}
+}
+
+// transferLocked checks and posts a transfer (and its fee, if house is set)
+// between wallets already locked in p. Checks use p's running balances, so
+// several transfers can be posted before flushing.
+func (s *WalletService) transferLocked(ctx context.Context, tx *gorm.DB, p *postings, fromID, toID uint64, amt, fee decimal.Decimal, house uint64, key string) error {
+	if fromID == toID {
+		return errors.New("cannot transfer to self")
+	}
+	wFrom, wTo := p.wallets[fromID], p.wallets[toID]
+	if err := checkDebit(wFrom); err != nil {
+		return err
+	}
+	if err := checkCredit(wTo); err != nil {
+		return err
+	}
+	if wFrom.Currency != wTo.Currency {
+		return ErrCurrencyMismatch
+	}
+	if house != 0 {
+		if err := checkHouse(p.wallets[house], wFrom.Currency); err != nil {
+			return err
 		}
-		fromBal, toBal = newFrom, newTo
-		return nil
-	})
-	return fromBal, toBal, err
+	}
+	if err := s.checkLimits(ctx, tx, wFrom, LimitKindTransfer, amt); err != nil {
+		return err
+	}
+	if p.available(fromID).LessThan(amt.Add(fee)) {
+		return repo.ErrInsufficientFunds
+	}
+	p.debit(fromID, "TRANSFER_OUT", amt, &toID, key)
+	p.credit(toID, "TRANSFER_IN", amt, &fromID, key)
+	if house != 0 {
+		chargeFee(p, fromID, house, fee, key)
+	}
+	return nil
 }
 
-// GetBalance returns current wallet balance.
-func (s *WalletService) GetBalance(ctx context.Context, walletID uint64) (decimal.Decimal, error) {
-	bal, err := s.repo.GetCachedBalance(ctx, walletID)
+// GetBalance returns the wallet's balance breakdown. In read_write cache mode
+// it is served from the in-process tier or Redis when possible, and misses
+// from a read replica; concurrent misses on the same wallet share one read.
+func (s *WalletService) GetBalance(ctx context.Context, walletID uint64) (*model.Balance, error) {
+	cc := s.cfg().Cache
+	if !cc.Reads() {
+		return s.GetBalanceConsistent(ctx, walletID)
+	}
+	s.local.Resize(cc.LocalSize, cc.LocalTTL)
+	if b, ok := s.local.Get(walletID); ok {
+		balanceReads.Add("local", 1)
+		return &b, nil
+	}
+	b, err := s.repo.GetCachedBalance(ctx, walletID)
 	if err == nil {
-		return bal, nil
+		balanceReads.Add("redis", 1)
+		s.storeLocal(*b)
+		return b, nil
 	}
-	var w model.Wallet
-	if err := s.repo.DB(ctx).Where("id=?", walletID).First(&w).Error; err != nil {
-		return decimal.Zero, err
+	if errors.Is(err, cache.ErrCircuitOpen) {
+		balanceReads.Add("redis_open", 1)
+	}
+	v, err, shared := s.flight.Do(strconv.FormatUint(walletID, 10), func() (interface{}, error) {
+		// detached so one caller giving up doesn't fail the others
+		return s.loadBalance(context.WithoutCancel(ctx), walletID, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		balanceReads.Add("coalesced", 1)
 	}
-	_ = s.repo.CacheBalance(ctx, walletID, w.Balance)
-	return w.Balance, nil
+	out := *v.(*model.Balance)
+	return &out, nil
+}
+
+// GetBalanceConsistent returns the wallet's balance breakdown read from the
+// primary, bypassing the cache and replicas, and refreshes the cached copy.
+func (s *WalletService) GetBalanceConsistent(ctx context.Context, walletID uint64) (*model.Balance, error) {
+	return s.loadBalance(ctx, walletID, false)
 }
 
-// GetHistory fetches recent transactions.
-func (s *WalletService) GetHistory(ctx context.Context, walletID uint64, limit int, since time.Time) ([]model.Transaction, error) {
-	var txs []model.Transaction
-	err := s.repo.DB(ctx).
-		Where("wallet_id=? AND created_at>=?", walletID, since).
-		Order("created_at asc").
-		Limit(limit).
-		Find(&txs).Error
-	return txs, err
+// loadBalance reads the balance from the database: from a replica when
+// fromReplica is set and one is healthy, else from the primary. Replica reads
+// may lag, so only primary reads are cached.
+func (s *WalletService) loadBalance(ctx context.Context, walletID uint64, fromReplica bool) (*model.Balance, error) {
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	db, replica := s.repo.DB(ctx), false
+	if fromReplica {
+		db, replica = s.repo.ReadDB(ctx)
+	}
+	var w model.Wallet
+	if err := db.Where("id = ?", walletID).First(&w).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWalletNotFound
+		}
+		return nil, err
+	}
+	b := model.NewBalance(&w)
+	if replica {
+		balanceReads.Add("replica", 1)
+		return &b, nil
+	}
+	balanceReads.Add("db", 1)
+	s.cacheBalance(ctx, b)
+	return &b, nil
 }
 
 // Repo exposes underlying repository (unit tests helper).
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"github.com/go-redis/redismock/v8"
 	"testing"
 	"time"
@@ -18,9 +19,13 @@ import (
 
 func newTestService(t *testing.T) (*WalletService, context.Context) {
 	// SQLite in-memory DB
-	db, err := gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
 	assert.NoError(t, err)
-	assert.NoError(t, db.AutoMigrate(&model.Wallet{}, &model.Transaction{}, &model.OutboxEvent{}))
+	assert.NoError(t, db.AutoMigrate(&model.Wallet{}, &model.Transaction{}, &model.OutboxEvent{}, &model.LimitProfile{},
+		&model.TransferSchedule{}, &model.TransferScheduleRun{}, &model.Batch{}, &model.BatchLeg{}, &model.Escrow{}, &model.EscrowEvent{},
+		&model.InterestAccrual{}, &model.InterestPosting{}, &model.BalanceSnapshot{}, &model.TransactionArchive{}, &model.TransactionArchiveSegment{},
+		&model.WalletShard{}, &model.TransferSaga{}, &model.Withdrawal{}, &model.ProviderDeposit{}, &model.ProviderWebhook{},
+		&model.WebhookSubscription{}, &model.WebhookDelivery{}, &model.WebhookAttempt{}))
 
 	// Redis mock
 	rdb, mock := redismock.NewClientMock()
@@ -72,11 +77,61 @@ func TestWalletService_FullFlow(t *testing.T) {
 	// balance endpoint logic
 	b1, _ := svc.GetBalance(ctx, 1)
 	b2, _ := svc.GetBalance(ctx, 2)
-	assert.Equal(t, "70", b1.StringFixed(0))
-	assert.Equal(t, "30", b2.StringFixed(0))
+	assert.Equal(t, "70", b1.Ledger.StringFixed(0))
+	assert.Equal(t, "30", b2.Ledger.StringFixed(0))
 
 	// history
-	hist, err := svc.GetHistory(ctx, 1, 10, time.Now().Add(-time.Hour))
+	since := time.Now().Add(-time.Hour)
+	hist, err := svc.GetHistory(ctx, 1, HistoryQuery{Limit: 10, Since: &since})
 	assert.NoError(t, err)
-	assert.Len(t, hist, 2) // deposit + transfer_out
+	assert.Len(t, hist.Items, 2) // deposit + transfer_out
+}
+
+func TestWalletService_HistoryPagination(t *testing.T) {
+	svc, ctx := newTestService(t)
+	assert.NoError(t, svc.Repo().DB(ctx).Create(&model.Wallet{ID: 1, Balance: decimal.Zero}).Error)
+	assert.NoError(t, svc.Repo().DB(ctx).Create(&model.Wallet{ID: 2, Balance: decimal.Zero}).Error)
+
+	for i := 1; i <= 5; i++ {
+		_, err := svc.Deposit(ctx, 1, decimal.NewFromInt(int64(i*10)), fmt.Sprintf("dep%d", i))
+		assert.NoError(t, err)
+	}
+	_, _, err := svc.Transfer(ctx, 1, 2, decimal.NewFromInt(5), "tx1")
+	assert.NoError(t, err)
+
+	// page through everything newest first
+	var ids []uint64
+	q := HistoryQuery{Limit: 2, Desc: true}
+	for {
+		page, err := svc.GetHistory(ctx, 1, q)
+		assert.NoError(t, err)
+		for _, tx := range page.Items {
+			ids = append(ids, tx.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	assert.Len(t, ids, 6)
+	for i := 1; i < len(ids); i++ {
+		assert.Greater(t, ids[i-1], ids[i])
+	}
+
+	// filters
+	minAmt := decimal.NewFromInt(30)
+	page, err := svc.GetHistory(ctx, 1, HistoryQuery{Types: []string{"DEPOSIT"}, MinAmount: &minAmt})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 3)
+
+	cp := uint64(2)
+	page, err = svc.GetHistory(ctx, 1, HistoryQuery{Counterparty: &cp})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 1)
+	assert.Equal(t, "TRANSFER_OUT", page.Items[0].Type)
+
+	_, err = svc.GetHistory(ctx, 1, HistoryQuery{Cursor: "???"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+	_, err = svc.GetHistory(ctx, 1, HistoryQuery{Limit: MaxHistoryLimit + 1})
+	assert.ErrorIs(t, err, ErrInvalidLimit)
 }
@@ -0,0 +1,443 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrSubscriptionNotFound means no webhook subscription has that ID.
+	ErrSubscriptionNotFound = errors.New("webhook subscription not found")
+	// ErrInvalidSubscription means the webhook subscription is malformed.
+	ErrInvalidSubscription = errors.New("invalid webhook subscription")
+	// ErrDeliveryNotFound means the subscription has no delivery with that ID.
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	// ErrBlockedAddress means a webhook URL resolved to an address webhooks
+	// aren't sent to: loopback, private, link-local or unspecified.
+	ErrBlockedAddress = errors.New("webhook address not allowed")
+)
+
+// WithWebhookClient makes the service send webhooks with c instead of a
+// client that only reaches public addresses; tests use it for local servers.
+func WithWebhookClient(c *http.Client) Option {
+	return func(s *WalletService) { s.hooks = c }
+}
+
+// webhookClient returns the client webhooks are sent with by default. It only
+// dials public addresses, checked after DNS resolution so that a subscriber's
+// name can't point it at internal services, and doesn't follow redirects,
+// which count as failed deliveries.
+func webhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicOnly}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would dial subscribers on our behalf, unchecked
+	t.Proxy = nil
+	t.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport:     t,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// publicOnly is the dialer Control of webhookClient, refusing connections to
+// addresses that aren't public.
+func publicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, ip)
+	}
+	return nil
+}
+
+// Headers of the webhooks sent to subscribers.
+const (
+	WebhookSignatureHeader = "X-Wallet-Signature"
+	WebhookEventHeader     = "X-Wallet-Event"
+	WebhookDeliveryHeader  = "X-Wallet-Delivery"
+)
+
+// SignWebhook returns the signature header value of a webhook body sent at
+// unix time ts: "t=<ts>,v1=<hex HMAC-SHA256 of "<ts>.<body>" keyed by
+// secret>". Subscribers recompute it to check the sender, and reject old
+// timestamps to stop replays.
+func SignWebhook(secret string, ts int64, body []byte) string {
+	t := strconv.FormatInt(ts, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookEnvelope is the body of a webhook. ID names the event, the same in
+// every delivery of it, so subscribers can drop repeats.
+type webhookEnvelope struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Aggregate   string          `json:"aggregate"`
+	AggregateID uint64          `json:"aggregate_id"`
+	OccurredAt  time.Time       `json:"occurred_at"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// hooksDB is where subscriptions and deliveries are kept: shard 0, whatever
+// shard ctx is marked with.
+func (s *WalletService) hooksDB(ctx context.Context) *gorm.DB {
+	return s.repo.DB(repo.OnShard(ctx, 0))
+}
+
+// CreateWebhookSubscription registers sub, which starts ACTIVE. Its URL must
+// be absolute http(s) and its secret 16 to 128 characters.
+func (s *WalletService) CreateWebhookSubscription(ctx context.Context, sub *model.WebhookSubscription) error {
+	sub.URL = strings.TrimSpace(sub.URL)
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(sub.URL) > 512 {
+		return fmt.Errorf("%w: url must be an absolute http(s) URL of at most 512 characters", ErrInvalidSubscription)
+	}
+	if len(sub.Secret) < 16 || len(sub.Secret) > 128 {
+		return fmt.Errorf("%w: secret must be 16 to 128 characters", ErrInvalidSubscription)
+	}
+	types := make([]string, 0, len(sub.EventTypes))
+	seen := map[string]bool{}
+	for _, t := range sub.EventTypes {
+		t = strings.TrimSpace(t)
+		if t == "" || len(t) > 64 {
+			return fmt.Errorf("%w: event types must be 1 to 64 characters", ErrInvalidSubscription)
+		}
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	sub.ID, sub.EventTypes, sub.Status, sub.FailingSince = 0, types, model.SubscriptionActive, nil
+	return s.hooksDB(ctx).Create(sub).Error
+}
+
+// ListWebhookSubscriptions lists all webhook subscriptions.
+func (s *WalletService) ListWebhookSubscriptions(ctx context.Context) ([]model.WebhookSubscription, error) {
+	var out []model.WebhookSubscription
+	err := s.hooksDB(ctx).Order("id").Find(&out).Error
+	return out, err
+}
+
+// GetWebhookSubscription returns one webhook subscription.
+func (s *WalletService) GetWebhookSubscription(ctx context.Context, id uint64) (*model.WebhookSubscription, error) {
+	var sub model.WebhookSubscription
+	err := s.hooksDB(ctx).First(&sub, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// EnableWebhookSubscription makes a disabled subscription ACTIVE again; its
+// pending deliveries resume.
+func (s *WalletService) EnableWebhookSubscription(ctx context.Context, id uint64) (*model.WebhookSubscription, error) {
+	res := s.hooksDB(ctx).Model(&model.WebhookSubscription{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status": model.SubscriptionActive, "failing_since": nil, "updated_at": time.Now(),
+	})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrSubscriptionNotFound
+	}
+	return s.GetWebhookSubscription(ctx, id)
+}
+
+// DeleteWebhookSubscription removes a subscription with its deliveries and
+// their log.
+func (s *WalletService) DeleteWebhookSubscription(ctx context.Context, id uint64) error {
+	return s.hooksDB(ctx).Transaction(func(tx *gorm.DB) error {
+		deliveries := tx.Model(&model.WebhookDelivery{}).Select("id").Where("subscription_id = ?", id)
+		if err := tx.Where("delivery_id IN (?)", deliveries).Delete(&model.WebhookAttempt{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("subscription_id = ?", id).Delete(&model.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&model.WebhookSubscription{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrSubscriptionNotFound
+		}
+		return nil
+	})
+}
+
+// ListWebhookDeliveries lists up to limit of a subscription's deliveries,
+// newest first, optionally only those with status.
+func (s *WalletService) ListWebhookDeliveries(ctx context.Context, subID uint64, status string, limit int) ([]model.WebhookDelivery, error) {
+	if _, err := s.GetWebhookSubscription(ctx, subID); err != nil {
+		return nil, err
+	}
+	q := s.hooksDB(ctx).Where("subscription_id = ?", subID)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	var out []model.WebhookDelivery
+	err := q.Order("id desc").Limit(limit).Find(&out).Error
+	return out, err
+}
+
+// GetWebhookDelivery returns one of a subscription's deliveries with the log
+// of its attempts.
+func (s *WalletService) GetWebhookDelivery(ctx context.Context, subID, id uint64) (*model.WebhookDelivery, error) {
+	var d model.WebhookDelivery
+	err := s.hooksDB(ctx).Preload("Log", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Where("id = ? AND subscription_id = ?", id, subID).First(&d).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// EnqueueWebhooks queues a delivery of each of the events, taken from the
+// outbox of shard, to every ACTIVE subscription matching it. Events queued
+// before are skipped, so the outbox poller can call it again for events it
+// failed to mark processed.
+func (s *WalletService) EnqueueWebhooks(ctx context.Context, shard int, events []model.OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	db := s.hooksDB(ctx)
+	var subs []model.WebhookSubscription
+	if err := db.Where("status = ?", model.SubscriptionActive).Find(&subs).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	var out []model.WebhookDelivery
+	for i := range events {
+		evt := &events[i]
+		for j := range subs {
+			if !subs[j].Matches(evt) {
+				continue
+			}
+			out = append(out, model.WebhookDelivery{
+				SubscriptionID: subs[j].ID, Shard: shard, EventID: evt.ID, EventType: evt.EventType,
+				Aggregate: evt.Aggregate, AggregateID: evt.AggregateID, Payload: evt.Payload,
+				OccurredAt: evt.CreatedAt, Status: model.DeliveryPending, NextAttemptAt: now,
+			})
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(out, 100).Error
+}
+
+// DeliverWebhooks sends up to limit due deliveries, at most
+// webhooks.per_subscription to each subscription, and returns them as they
+// ended up. Each is POSTed once, signed with its subscription's secret; any
+// answer but 2xx is a failure, retried with backoff until webhooks.max_attempts
+// is reached. A subscription whose deliveries have only failed for
+// webhooks.disable_after is disabled. A subscription's deliveries are sent one
+// at a time, in order, and subscriptions in parallel, so a slow subscriber
+// only holds up its own.
+func (s *WalletService) DeliverWebhooks(ctx context.Context, now time.Time, limit int) ([]model.WebhookDelivery, error) {
+	wc := s.cfg().Webhooks
+	due, subs, err := s.claimDeliveries(ctx, now, limit, wc.PerSubscription, wc.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	queues := map[uint64][]int{}
+	for i, d := range due {
+		queues[d.SubscriptionID] = append(queues[d.SubscriptionID], i)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for subID, queue := range queues {
+		wg.Add(1)
+		go func(sub *model.WebhookSubscription, queue []int) {
+			defer wg.Done()
+			for _, i := range queue {
+				if err := s.deliverWebhook(ctx, &due[i], sub, now); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("delivery %d: %w", due[i].ID, err))
+					mu.Unlock()
+				}
+			}
+		}(subs[subID], queue)
+	}
+	wg.Wait()
+	return due, errors.Join(errs...)
+}
+
+// claimDeliveries claims up to limit due deliveries, at most per of each
+// subscription, with the subscriptions they go to. Each is leased for as long
+// as sending it and those of its subscription before it may take, so
+// concurrent workers skip it meanwhile.
+func (s *WalletService) claimDeliveries(ctx context.Context, now time.Time, limit, per int, timeout time.Duration) ([]model.WebhookDelivery, map[uint64]*model.WebhookSubscription, error) {
+	var due []model.WebhookDelivery
+	subs := map[uint64]*model.WebhookSubscription{}
+	err := s.hooksDB(ctx).Transaction(func(tx *gorm.DB) error {
+		active := tx.Model(&model.WebhookSubscription{}).Select("id").Where("status = ?", model.SubscriptionActive)
+		ranked := tx.Model(&model.WebhookDelivery{}).
+			Select("id, ROW_NUMBER() OVER (PARTITION BY subscription_id ORDER BY next_attempt_at, id) AS n").
+			Where("status = ? AND next_attempt_at <= ? AND (lease_until IS NULL OR lease_until < ?) AND subscription_id IN (?)",
+				model.DeliveryPending, now, now, active)
+		first := tx.Table("(?) AS ranked", ranked).Select("id").Where("n <= ?", per)
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("id IN (?)", first).Order("next_attempt_at, id").Limit(limit).Find(&due).Error; err != nil {
+			return err
+		}
+		if len(due) == 0 {
+			return nil
+		}
+		// the n-th delivery of a subscription is leased for n timeouts
+		byRank := map[int][]uint64{}
+		seen := map[uint64]int{}
+		subIDs := make([]uint64, 0, len(due))
+		for _, d := range due {
+			if _, ok := seen[d.SubscriptionID]; !ok {
+				subIDs = append(subIDs, d.SubscriptionID)
+			}
+			seen[d.SubscriptionID]++
+			byRank[seen[d.SubscriptionID]] = append(byRank[seen[d.SubscriptionID]], d.ID)
+		}
+		var found []model.WebhookSubscription
+		if err := tx.Where("id IN ?", subIDs).Find(&found).Error; err != nil {
+			return err
+		}
+		for i := range found {
+			subs[found[i].ID] = &found[i]
+		}
+		for rank, ids := range byRank {
+			lease := now.Add(time.Duration(rank) * timeout)
+			if err := tx.Model(&model.WebhookDelivery{}).Where("id IN ?", ids).Update("lease_until", lease).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return due, subs, err
+}
+
+// deliverWebhook makes one attempt at d and records it; d is updated to
+// match. Errors are about recording, not about the subscriber.
+func (s *WalletService) deliverWebhook(ctx context.Context, d *model.WebhookDelivery, sub *model.WebhookSubscription, now time.Time) error {
+	wc := s.cfg().Webhooks
+	body, err := json.Marshal(webhookEnvelope{
+		ID: fmt.Sprintf("%d-%d", d.Shard, d.EventID), Type: d.EventType, Aggregate: d.Aggregate,
+		AggregateID: d.AggregateID, OccurredAt: d.OccurredAt, Data: json.RawMessage(d.Payload),
+	})
+	if err != nil {
+		return err
+	}
+	attempt := model.WebhookAttempt{DeliveryID: d.ID}
+	start := time.Now()
+	cause := s.postWebhook(ctx, sub, d, body, wc.Timeout, &attempt)
+	attempt.DurationMS = time.Since(start).Milliseconds()
+
+	d.Attempts++
+	fields := map[string]interface{}{"attempts": d.Attempts, "lease_until": nil, "updated_at": time.Now()}
+	switch {
+	case cause == nil:
+		d.Status, d.DeliveredAt, d.LastError = model.DeliveryDelivered, &now, ""
+		fields["status"], fields["delivered_at"], fields["last_error"] = d.Status, now, ""
+	case d.Attempts >= wc.MaxAttempts:
+		attempt.Error = truncate(cause.Error(), 255)
+		d.Status, d.LastError = model.DeliveryFailed, attempt.Error
+		fields["status"], fields["last_error"] = d.Status, d.LastError
+	default:
+		attempt.Error = truncate(cause.Error(), 255)
+		delay := wc.RetryDelay
+		for i := 1; i < d.Attempts && delay < wc.MaxRetryDelay; i++ {
+			delay *= 2
+		}
+		d.LastError, d.NextAttemptAt = attempt.Error, now.Add(min(delay, wc.MaxRetryDelay))
+		fields["last_error"], fields["next_attempt_at"] = d.LastError, d.NextAttemptAt
+	}
+	var disabled bool
+	err = s.hooksDB(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&attempt).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&model.WebhookDelivery{}).Where("id = ? AND status = ?", d.ID, model.DeliveryPending).
+			Updates(fields).Error; err != nil {
+			return err
+		}
+		subs := tx.Model(&model.WebhookSubscription{}).Where("id = ?", d.SubscriptionID)
+		if cause == nil {
+			return subs.Update("failing_since", nil).Error
+		}
+		if err := subs.Update("failing_since", gorm.Expr("COALESCE(failing_since, ?)", now)).Error; err != nil {
+			return err
+		}
+		res := tx.Model(&model.WebhookSubscription{}).
+			Where("id = ? AND status = ? AND failing_since <= ?", d.SubscriptionID, model.SubscriptionActive, now.Add(-wc.DisableAfter)).
+			Updates(map[string]interface{}{"status": model.SubscriptionDisabled, "updated_at": time.Now()})
+		disabled = res.RowsAffected > 0
+		return res.Error
+	})
+	if disabled {
+		s.log.Warnf("webhook subscription %d disabled: deliveries failing for %s, last: %v", d.SubscriptionID, wc.DisableAfter, cause)
+	}
+	return err
+}
+
+// postWebhook sends body to sub and fills in what came back.
+func (s *WalletService) postWebhook(ctx context.Context, sub *model.WebhookSubscription, d *model.WebhookDelivery, body []byte, timeout time.Duration, attempt *model.WebhookAttempt) error {
+	if sub == nil {
+		return ErrSubscriptionNotFound
+	}
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(cctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, d.EventType)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatUint(d.ID, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(sub.Secret, time.Now().Unix(), body))
+	resp, err := s.hooks.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %d", resp.StatusCode)
+	}
+	return nil
+}
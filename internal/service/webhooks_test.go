@@ -0,0 +1,320 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const hookSecret = "0123456789abcdef"
+
+// newWebhookService returns a service with wallets 1 and 2 and a function
+// queueing the outbox events written so far, as the poller does.
+func newWebhookService(t *testing.T) (*WalletService, context.Context, func()) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	cfg.Cache.Mode = config.CacheOff
+	cfg.Webhooks.MaxAttempts = 3
+	cfg.Webhooks.DisableAfter = time.Hour
+	svc.cfg = func() *config.Config { return &cfg }
+	// the test servers listen on loopback, which the default client refuses
+	WithWebhookClient(&http.Client{})(svc)
+	for _, id := range []uint64{1, 2} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	flush := func() {
+		t.Helper()
+		events, err := svc.Repo().PollOutbox(ctx, 100)
+		require.NoError(t, err)
+		require.NoError(t, svc.EnqueueWebhooks(ctx, 0, events))
+		for _, evt := range events {
+			require.NoError(t, svc.Repo().MarkOutboxProcessed(ctx, evt.ID))
+		}
+	}
+	flush()
+	return svc, ctx, flush
+}
+
+// hookServer answers with the status codes in codes, then 200, and keeps
+// what it was sent.
+type hookServer struct {
+	mu     sync.Mutex
+	codes  []int
+	bodies []string
+	sigs   []string
+}
+
+func (h *hookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bodies = append(h.bodies, string(body))
+	h.sigs = append(h.sigs, r.Header.Get(WebhookSignatureHeader))
+	code := http.StatusOK
+	if len(h.codes) > 0 {
+		code, h.codes = h.codes[0], h.codes[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func TestCreateWebhookSubscription(t *testing.T) {
+	svc, ctx, flush := newWebhookService(t)
+	for _, bad := range []model.WebhookSubscription{
+		{URL: "ftp://example.com", Secret: hookSecret},
+		{URL: "/hooks", Secret: hookSecret},
+		{URL: "https://example.com", Secret: "short"},
+		{URL: "https://example.com", Secret: hookSecret, EventTypes: []string{" "}},
+	} {
+		assert.ErrorIs(t, svc.CreateWebhookSubscription(ctx, &bad), ErrInvalidSubscription)
+	}
+
+	one := uint64(1)
+	all := &model.WebhookSubscription{URL: "https://example.com/all", Secret: hookSecret}
+	deposits := &model.WebhookSubscription{URL: "https://example.com/dep", Secret: hookSecret,
+		EventTypes: []string{"Deposit", "Deposit"}, WalletID: &one}
+	require.NoError(t, svc.CreateWebhookSubscription(ctx, all))
+	require.NoError(t, svc.CreateWebhookSubscription(ctx, deposits))
+	assert.Equal(t, []string{"Deposit"}, deposits.EventTypes)
+	assert.Equal(t, model.SubscriptionActive, deposits.Status)
+
+	_, err := svc.Deposit(ctx, 1, d("10"), "a")
+	require.NoError(t, err)
+	_, err = svc.Deposit(ctx, 2, d("10"), "b")
+	require.NoError(t, err)
+	_, err = svc.Withdraw(ctx, 1, d("1"), "c")
+	require.NoError(t, err)
+	flush()
+
+	got, err := svc.ListWebhookDeliveries(ctx, all.ID, "", 10)
+	require.NoError(t, err)
+	assert.Len(t, got, 3)
+	got, err = svc.ListWebhookDeliveries(ctx, deposits.ID, model.DeliveryPending, 10)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, uint64(1), got[0].AggregateID)
+	assert.Equal(t, "Deposit", got[0].EventType)
+
+	// queueing the same events again adds nothing
+	var events []model.OutboxEvent
+	require.NoError(t, svc.Repo().DB(ctx).Where("id IN (?)",
+		svc.Repo().DB(ctx).Model(&model.WebhookDelivery{}).Select("event_id")).Find(&events).Error)
+	require.Len(t, events, 3)
+	require.NoError(t, svc.EnqueueWebhooks(ctx, 0, events))
+	var n int64
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.WebhookDelivery{}).Count(&n).Error)
+	assert.Equal(t, int64(4), n)
+
+	require.NoError(t, svc.DeleteWebhookSubscription(ctx, all.ID))
+	_, err = svc.ListWebhookDeliveries(ctx, all.ID, "", 10)
+	assert.ErrorIs(t, err, ErrSubscriptionNotFound)
+	require.NoError(t, svc.Repo().DB(ctx).Model(&model.WebhookDelivery{}).Count(&n).Error)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	svc, ctx, flush := newWebhookService(t)
+	hook := &hookServer{codes: []int{http.StatusInternalServerError}}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+	sub := &model.WebhookSubscription{URL: srv.URL, Secret: hookSecret}
+	require.NoError(t, svc.CreateWebhookSubscription(ctx, sub))
+	_, err := svc.Deposit(ctx, 1, d("10"), "a")
+	require.NoError(t, err)
+	flush()
+	now := time.Now()
+
+	// a failure is retried after retry_delay
+	done, err := svc.DeliverWebhooks(ctx, now, 10)
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	assert.Equal(t, model.DeliveryPending, done[0].Status)
+	assert.Equal(t, "endpoint answered 500", done[0].LastError)
+	assert.WithinDuration(t, now.Add(10*time.Second), done[0].NextAttemptAt, time.Millisecond)
+	done, err = svc.DeliverWebhooks(ctx, now.Add(5*time.Second), 10)
+	require.NoError(t, err)
+	assert.Empty(t, done)
+	done, err = svc.DeliverWebhooks(ctx, now.Add(10*time.Second), 10)
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	assert.Equal(t, model.DeliveryDelivered, done[0].Status)
+
+	// the body is the event, signed with the subscription's secret
+	require.Len(t, hook.bodies, 2)
+	assert.Equal(t, hook.bodies[0], hook.bodies[1])
+	var env webhookEnvelope
+	require.NoError(t, json.Unmarshal([]byte(hook.bodies[1]), &env))
+	assert.Equal(t, "Deposit", env.Type)
+	assert.Equal(t, uint64(1), env.AggregateID)
+	assert.Contains(t, string(env.Data), `"amount":"10"`)
+	ts, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(hook.sigs[1], ",")[0], "t="), 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, SignWebhook(hookSecret, ts, []byte(hook.bodies[1])), hook.sigs[1])
+
+	got, err := svc.GetWebhookDelivery(ctx, sub.ID, done[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, got.Attempts)
+	require.Len(t, got.Log, 2)
+	assert.Equal(t, []int{500, 200}, []int{got.Log[0].StatusCode, got.Log[1].StatusCode})
+	sub, err = svc.GetWebhookSubscription(ctx, sub.ID)
+	require.NoError(t, err)
+	assert.Nil(t, sub.FailingSince)
+}
+
+func TestDeliverWebhooks_Failing(t *testing.T) {
+	svc, ctx, flush := newWebhookService(t)
+	hook := &hookServer{codes: []int{503, 503, 503, 503}}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+	sub := &model.WebhookSubscription{URL: srv.URL, Secret: hookSecret}
+	require.NoError(t, svc.CreateWebhookSubscription(ctx, sub))
+	_, err := svc.Deposit(ctx, 1, d("10"), "a")
+	require.NoError(t, err)
+	flush()
+	now := time.Now()
+
+	// retried 10s, then 20s later, and given up after max_attempts
+	at := now
+	for i, status := range []string{model.DeliveryPending, model.DeliveryPending, model.DeliveryFailed} {
+		done, err := svc.DeliverWebhooks(ctx, at, 10)
+		require.NoError(t, err)
+		require.Len(t, done, 1, "attempt %d", i+1)
+		assert.Equal(t, status, done[0].Status)
+		at = done[0].NextAttemptAt
+	}
+	assert.WithinDuration(t, now.Add(30*time.Second), at, time.Millisecond)
+
+	// a subscription failing for disable_after is disabled, and its
+	// deliveries wait
+	_, err = svc.Deposit(ctx, 1, d("10"), "b")
+	require.NoError(t, err)
+	flush()
+	_, err = svc.DeliverWebhooks(ctx, now.Add(time.Hour), 10)
+	require.NoError(t, err)
+	sub, err = svc.GetWebhookSubscription(ctx, sub.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.SubscriptionDisabled, sub.Status)
+	done, err := svc.DeliverWebhooks(ctx, now.Add(2*time.Hour), 10)
+	require.NoError(t, err)
+	assert.Empty(t, done)
+
+	// new events aren't queued for it until it is enabled again
+	_, err = svc.Deposit(ctx, 1, d("10"), "c")
+	require.NoError(t, err)
+	flush()
+	pending, err := svc.ListWebhookDeliveries(ctx, sub.ID, model.DeliveryPending, 10)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+	sub, err = svc.EnableWebhookSubscription(ctx, sub.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.SubscriptionActive, sub.Status)
+	done, err = svc.DeliverWebhooks(ctx, now.Add(2*time.Hour), 10)
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	assert.Equal(t, model.DeliveryDelivered, done[0].Status)
+}
+
+func TestDeliverWebhooks_PerSubscription(t *testing.T) {
+	svc, ctx, flush := newWebhookService(t)
+	svc.cfg().Webhooks.PerSubscription = 2
+	// the slow subscriber answers only once the fast one has had both of
+	// its deliveries
+	var fast hookServer
+	fastDone := make(chan struct{})
+	fastSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fast.ServeHTTP(w, r)
+		fast.mu.Lock()
+		defer fast.mu.Unlock()
+		if len(fast.bodies) == 2 {
+			close(fastDone)
+		}
+	}))
+	defer fastSrv.Close()
+	slowSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-fastDone:
+			w.WriteHeader(http.StatusOK)
+		case <-time.After(2 * time.Second):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	}))
+	defer slowSrv.Close()
+	slow := &model.WebhookSubscription{URL: slowSrv.URL, Secret: hookSecret}
+	require.NoError(t, svc.CreateWebhookSubscription(ctx, slow))
+	require.NoError(t, svc.CreateWebhookSubscription(ctx, &model.WebhookSubscription{URL: fastSrv.URL, Secret: hookSecret}))
+	for _, ref := range []string{"a", "b", "c"} {
+		_, err := svc.Deposit(ctx, 1, d("10"), ref)
+		require.NoError(t, err)
+	}
+	flush()
+	now := time.Now()
+
+	done, err := svc.DeliverWebhooks(ctx, now, 10)
+	require.NoError(t, err)
+	require.Len(t, done, 4)
+	for _, d := range done {
+		assert.Equal(t, model.DeliveryDelivered, d.Status, "delivery %d", d.ID)
+	}
+	pending, err := svc.ListWebhookDeliveries(ctx, slow.ID, model.DeliveryPending, 10)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	done, err = svc.DeliverWebhooks(ctx, now, 10)
+	require.NoError(t, err)
+	assert.Len(t, done, 2)
+}
+
+func TestWebhookClient(t *testing.T) {
+	for addr, blocked := range map[string]bool{
+		"127.0.0.1:443": true, "[::1]:443": true, "[::ffff:127.0.0.1]:443": true, "0.0.0.0:80": true,
+		"10.1.2.3:443": true, "172.16.0.1:443": true, "192.168.1.1:443": true, "[fd00::1]:443": true,
+		"169.254.169.254:80": true, "[fe80::1]:443": true,
+		"93.184.216.34:443": false, "[2606:4700::1111]:443": false,
+	} {
+		err := publicOnly("tcp", addr, nil)
+		if blocked {
+			assert.ErrorIs(t, err, ErrBlockedAddress, addr)
+		} else {
+			assert.NoError(t, err, addr)
+		}
+	}
+
+	// the default client won't reach a local server
+	svc, ctx, flush := newWebhookService(t)
+	svc.hooks = webhookClient()
+	hook := &hookServer{}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+	require.NoError(t, svc.CreateWebhookSubscription(ctx, &model.WebhookSubscription{URL: srv.URL, Secret: hookSecret}))
+	_, err := svc.Deposit(ctx, 1, d("10"), "a")
+	require.NoError(t, err)
+	flush()
+	done, err := svc.DeliverWebhooks(ctx, time.Now(), 10)
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	assert.Contains(t, done[0].LastError, ErrBlockedAddress.Error())
+	assert.Empty(t, hook.bodies)
+
+	// nor follow redirects
+	redirect := httptest.NewServer(http.RedirectHandler(srv.URL, http.StatusFound))
+	defer redirect.Close()
+	c := webhookClient()
+	c.Transport = http.DefaultTransport
+	resp, err := c.Post(redirect.URL, "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Empty(t, hook.bodies)
+}
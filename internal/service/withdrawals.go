@@ -0,0 +1,397 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/richardliu001/wallet-service/internal/settlement"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrWithdrawalNotFound means the wallet has no withdrawal with that ID.
+	ErrWithdrawalNotFound = errors.New("withdrawal not found")
+	// ErrInvalidWithdrawal means the withdrawal request is malformed.
+	ErrInvalidWithdrawal = errors.New("invalid withdrawal")
+	// ErrSettlementDisabled means no settlement provider is configured.
+	ErrSettlementDisabled = errors.New("external withdrawals are not enabled")
+)
+
+// WithSettlement makes the service pay external withdrawals out through p;
+// only the process running RunWithdrawals needs it.
+func WithSettlement(p settlement.Provider) Option {
+	return func(s *WalletService) { s.settle = p }
+}
+
+// withdrawalKey is the idempotency key of the legs a settled withdrawal posts.
+func withdrawalKey(id uint64) string { return fmt.Sprintf("withdrawal:%d", id) }
+
+// withdrawalRef is the reference the provider knows a withdrawal by.
+func withdrawalRef(shard int, id uint64) string { return fmt.Sprintf("wd-%d-%d", shard, id) }
+
+// RequestWithdrawal holds amt plus the withdrawal fee on the wallet and
+// records a PENDING withdrawal to destination, which RunWithdrawals pays out.
+// Limits are checked now, and the withdrawal counts against them until it
+// settles. Reusing key returns the stored withdrawal.
+func (s *WalletService) RequestWithdrawal(ctx context.Context, walletID uint64, amt decimal.Decimal, destination, key string) (*model.Withdrawal, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%w: idempotency key required", ErrInvalidWithdrawal)
+	}
+	destination = strings.TrimSpace(destination)
+	if destination == "" || len(destination) > 255 {
+		return nil, fmt.Errorf("%w: destination must be 1 to 255 characters", ErrInvalidWithdrawal)
+	}
+	if err := s.checkAmount(amt); err != nil {
+		return nil, err
+	}
+	provider := s.cfg().Settlement.Provider
+	if provider == "" {
+		return nil, ErrSettlementDisabled
+	}
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	if wd, err := s.withdrawalByKey(ctx, walletID, key); err != nil || wd != nil {
+		return wd, err
+	}
+	wd := &model.Withdrawal{
+		IdempotencyKey: key, WalletID: walletID, Amount: amt, Destination: destination,
+		Provider: provider, Status: model.WithdrawalPending, NextAttemptAt: time.Now(),
+	}
+	err = s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		w, err := s.repo.GetWalletForUpdate(ctx, tx, walletID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrWalletNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkDebit(w); err != nil {
+			return err
+		}
+		fee, house := s.feeFor(LimitKindWithdraw, w.Currency, walletID, amt)
+		if house != 0 {
+			// the fee is credited on settlement, so the house must be fit now
+			shard, err := s.repo.ShardOf(ctx, house)
+			if err != nil {
+				return err
+			}
+			hw, err := s.peekWallet(ctx, house, shard, true)
+			if err != nil {
+				return err
+			}
+			if err := checkHouse(hw, w.Currency); err != nil {
+				return err
+			}
+			wd.HouseWalletID = &house
+		}
+		if err := s.checkLimits(ctx, tx, w, LimitKindWithdraw, amt); err != nil {
+			return err
+		}
+		if w.Available().LessThan(amt.Add(fee)) {
+			return repo.ErrInsufficientFunds
+		}
+		wd.Currency, wd.Fee = w.Currency, fee
+		if err := tx.Create(wd).Error; err != nil {
+			return err
+		}
+		if err := s.hold(ctx, tx, w, amt.Add(fee), decimal.Zero); err != nil {
+			return err
+		}
+		return s.emit(ctx, tx, walletID, "WithdrawalRequested", wd)
+	})
+	if err != nil {
+		// lost a race with a concurrent request with the same key
+		if existing, _ := s.withdrawalByKey(ctx, walletID, key); existing != nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return wd, nil
+}
+
+// hold adds held to the funds held on a wallet locked in tx, and pendingIn to
+// those announced to it; negative amounts release them.
+func (s *WalletService) hold(ctx context.Context, tx *gorm.DB, w *model.Wallet, held, pendingIn decimal.Decimal) error {
+	held, pendingIn = w.Held.Add(held), w.PendingIn.Add(pendingIn)
+	if err := s.repo.UpdateHolds(ctx, tx, w.ID, held, pendingIn, w.Version); err != nil {
+		return err
+	}
+	w.Held, w.PendingIn, w.Version = held, pendingIn, w.Version+1
+	s.cacheAfterCommit(ctx, model.NewBalance(w))
+	return nil
+}
+
+func (s *WalletService) withdrawalByKey(ctx context.Context, walletID uint64, key string) (*model.Withdrawal, error) {
+	var wd model.Withdrawal
+	err := s.repo.DB(ctx).Where("wallet_id = ? AND idempotency_key = ?", walletID, key).First(&wd).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wd, nil
+}
+
+// ListWithdrawals lists the wallet's external withdrawals, newest first.
+func (s *WalletService) ListWithdrawals(ctx context.Context, walletID uint64) ([]model.Withdrawal, error) {
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	var out []model.Withdrawal
+	err = s.repo.DB(ctx).Where("wallet_id = ?", walletID).Order("id desc").Find(&out).Error
+	return out, err
+}
+
+// GetWithdrawal returns one of the wallet's external withdrawals.
+func (s *WalletService) GetWithdrawal(ctx context.Context, walletID, id uint64) (*model.Withdrawal, error) {
+	ctx, err := s.route(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	var wd model.Withdrawal
+	err = s.repo.DB(ctx).Where("id = ? AND wallet_id = ?", id, walletID).First(&wd).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrWithdrawalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wd, nil
+}
+
+// RunWithdrawals advances up to limit due withdrawals per shard and returns
+// those it settled. New withdrawals are submitted to the provider, accepted
+// ones polled, and those the provider reports final are settled. A call that
+// fails or times out leaves the outcome unknown, so the next attempt asks the
+// provider for the payout's status before submitting it again. Each
+// withdrawal is leased for lease, so concurrent executors don't work on it at
+// once; withdrawals requested through another provider are left alone.
+func (s *WalletService) RunWithdrawals(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]model.Withdrawal, error) {
+	if s.settle == nil {
+		return nil, nil
+	}
+	var out []model.Withdrawal
+	var errs []error
+	for _, shard := range s.repo.Shards() {
+		due, err := s.claimWithdrawals(repo.OnShard(ctx, shard), now, limit, lease)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", shard, err))
+			continue
+		}
+		for _, wd := range due {
+			done, err := s.executeWithdrawal(ctx, shard, wd, now)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("withdrawal %d on shard %d: %w", wd.ID, shard, err))
+				continue
+			}
+			if done != nil {
+				out = append(out, *done)
+			}
+		}
+	}
+	return out, errors.Join(errs...)
+}
+
+func (s *WalletService) claimWithdrawals(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]model.Withdrawal, error) {
+	var out []model.Withdrawal
+	err := s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ? AND provider = ? AND next_attempt_at <= ? AND (lease_until IS NULL OR lease_until < ?)",
+				[]string{model.WithdrawalPending, model.WithdrawalSubmitted}, s.settle.Name(), now, now).
+			Order("next_attempt_at").Limit(limit).Find(&out).Error; err != nil {
+			return err
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		ids := make([]uint64, len(out))
+		for i, wd := range out {
+			ids[i] = wd.ID
+		}
+		return tx.Model(&model.Withdrawal{}).Where("id IN ?", ids).Update("lease_until", now.Add(lease)).Error
+	})
+	return out, err
+}
+
+// executeWithdrawal makes one provider call for a claimed withdrawal, or two
+// when a lost submission has to be resent, and records the outcome. It
+// returns the withdrawal if it settled.
+func (s *WalletService) executeWithdrawal(ctx context.Context, shard int, wd model.Withdrawal, now time.Time) (*model.Withdrawal, error) {
+	st := s.cfg().Settlement
+	ref := withdrawalRef(shard, wd.ID)
+	cctx, cancel := context.WithTimeout(ctx, st.Timeout)
+	defer cancel()
+	var res settlement.Result
+	var err error
+	if wd.Status == model.WithdrawalSubmitted || wd.Attempts > 0 {
+		res, err = s.settle.Status(cctx, ref)
+	}
+	if wd.Status == model.WithdrawalPending && (wd.Attempts == 0 || errors.Is(err, settlement.ErrNotFound)) {
+		res, err = s.settle.Submit(cctx, settlement.Request{
+			Reference: ref, WalletID: wd.WalletID, Currency: wd.Currency, Amount: wd.Amount, Destination: wd.Destination,
+		})
+	}
+	if err == nil {
+		switch res.State {
+		case settlement.StateCompleted, settlement.StateFailed:
+			done, err := s.settleWithdrawal(ctx, shard, wd.ID, res, now)
+			if err == nil {
+				return done, nil
+			}
+			// the provider's answer stands; settling is retried like a failed call
+			return nil, s.retryWithdrawal(ctx, shard, wd, now, err)
+		case settlement.StatePending:
+			return nil, s.updateWithdrawal(ctx, shard, wd, map[string]interface{}{
+				"status": model.WithdrawalSubmitted, "provider_ref": truncate(res.ProviderRef, 128),
+				"attempts": 0, "last_error": "", "next_attempt_at": now.Add(st.PollInterval), "lease_until": nil,
+			})
+		}
+		err = fmt.Errorf("provider reported unknown state %q", res.State)
+	}
+	return nil, s.retryWithdrawal(ctx, shard, wd, now, err)
+}
+
+// retryWithdrawal records a failed attempt and backs off, doubling the delay
+// with every consecutive failure.
+func (s *WalletService) retryWithdrawal(ctx context.Context, shard int, wd model.Withdrawal, now time.Time, cause error) error {
+	st := s.cfg().Settlement
+	delay := st.RetryDelay
+	for i := 0; i < wd.Attempts && delay < st.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if err := s.updateWithdrawal(ctx, shard, wd, map[string]interface{}{
+		"attempts": wd.Attempts + 1, "last_error": truncate(cause.Error(), 255),
+		"next_attempt_at": now.Add(min(delay, st.MaxRetryDelay)), "lease_until": nil,
+	}); err != nil {
+		return err
+	}
+	return cause
+}
+
+// updateWithdrawal changes a withdrawal the executor claimed, unless it was
+// settled meanwhile.
+func (s *WalletService) updateWithdrawal(ctx context.Context, shard int, wd model.Withdrawal, fields map[string]interface{}) error {
+	fields["updated_at"] = time.Now()
+	return s.repo.DB(repo.OnShard(ctx, shard)).Model(&model.Withdrawal{}).
+		Where("id = ? AND status = ?", wd.ID, wd.Status).Updates(fields).Error
+}
+
+// settleWithdrawal applies the provider's final answer: on COMPLETED the held
+// amount and fee are debited, on FAILED the hold is released. A withdrawal
+// already settled is returned as it is.
+func (s *WalletService) settleWithdrawal(ctx context.Context, shard int, id uint64, res settlement.Result, now time.Time) (*model.Withdrawal, error) {
+	ctx = repo.OnShard(ctx, shard)
+	var wd model.Withdrawal
+	var saga *model.TransferSaga
+	err := s.transaction(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&wd, id).Error; err != nil {
+			return err
+		}
+		if wd.Status == model.WithdrawalCompleted || wd.Status == model.WithdrawalFailed {
+			return nil
+		}
+		var house uint64
+		if wd.HouseWalletID != nil && wd.Fee.IsPositive() {
+			house = *wd.HouseWalletID
+		}
+		houseShard := shard
+		if house != 0 {
+			var err error
+			if houseShard, err = s.repo.ShardOf(ctx, house); err != nil {
+				return err
+			}
+		}
+		// the payout has happened or not whatever the wallet's status now
+		ws, err := s.lockWallets(ctx, tx, s.withdrawLock(house, shard, houseShard), wd.WalletID, house)
+		if err != nil {
+			return err
+		}
+		if err := s.hold(ctx, tx, ws[wd.WalletID], wd.Amount.Add(wd.Fee).Neg(), decimal.Zero); err != nil {
+			return err
+		}
+		event := "WithdrawalFailed"
+		wd.Status, wd.Reason = model.WithdrawalFailed, truncate(res.Reason, 255)
+		if res.State == settlement.StateCompleted {
+			event = "WithdrawalCompleted"
+			wd.Status, wd.Reason = model.WithdrawalCompleted, ""
+			key := withdrawalKey(wd.ID)
+			p := newPostings(ws)
+			p.debit(wd.WalletID, "WITHDRAW", wd.Amount, nil, key)
+			if house != 0 {
+				chargeFee(p, wd.WalletID, house, wd.Fee, key)
+				if houseShard != shard {
+					if saga, err = s.feeAcross(ctx, tx, p, wd.WalletID, house, wd.Currency, wd.Amount, wd.Fee, key); err != nil {
+						return err
+					}
+				}
+			}
+			if err := s.flush(ctx, tx, p); err != nil {
+				return err
+			}
+		}
+		if res.ProviderRef != "" {
+			wd.ProviderRef = truncate(res.ProviderRef, 128)
+		}
+		wd.Attempts, wd.LastError, wd.LeaseUntil, wd.SettledAt = 0, "", nil, &now
+		if err := tx.Model(&model.Withdrawal{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"status": wd.Status, "reason": wd.Reason, "provider_ref": wd.ProviderRef, "attempts": 0,
+			"last_error": "", "lease_until": nil, "settled_at": now, "updated_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return s.emit(ctx, tx, wd.WalletID, event, &wd)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if saga != nil {
+		// the withdrawal stands either way; a failed fee credit is retried by ResumeSagas
+		if _, err := s.advanceSaga(ctx, shard, saga.ID); err != nil {
+			s.log.Warnf("withdrawal fee of wallet %d, saga %d: %v", wd.WalletID, saga.ID, err)
+		}
+	}
+	return &wd, nil
+}
+
+// withdrawLock locks the wallet paying a withdrawal and the fee house. A house
+// on another shard than the wallet is only read; feeAcross credits it.
+func (s *WalletService) withdrawLock(house uint64, shard, houseShard int) lockFunc {
+	return func(ctx context.Context, tx *gorm.DB, id uint64) (*model.Wallet, error) {
+		if id == house && houseShard != shard {
+			return s.peekWallet(ctx, id, houseShard, true)
+		}
+		if id == house {
+			return s.lockHouse(ctx, tx, id)
+		}
+		w, err := s.repo.GetWalletForUpdate(ctx, tx, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWalletNotFound
+		}
+		return w, err
+	}
+}
+
+// feeAcross takes the fee credit to a house on another shard out of p and
+// records a saga, owing nothing to a recipient, that posts it there.
+func (s *WalletService) feeAcross(ctx context.Context, tx *gorm.DB, p *postings, payer, house uint64, currency string, amt, fee decimal.Decimal, key string) (*model.TransferSaga, error) {
+	p.drop(house)
+	sg := &model.TransferSaga{
+		FromWalletID: payer, HouseWalletID: &house, Currency: currency,
+		Amount: amt, Fee: fee, State: model.SagaCredited,
+	}
+	if err := s.createSaga(ctx, tx, sg, key); err != nil {
+		return nil, err
+	}
+	return sg, nil
+}
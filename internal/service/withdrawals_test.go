@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
+	"github.com/richardliu001/wallet-service/internal/settlement"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSettlementService returns a service paying withdrawals out through a
+// fake provider, with a flat withdrawal fee of 1 going to wallet 9 and 100 on
+// wallet 1.
+func newSettlementService(t *testing.T) (*WalletService, context.Context, *settlement.Fake) {
+	svc, ctx := newTestService(t)
+	cfg := config.Defaults()
+	cfg.Cache.Mode = config.CacheOff
+	cfg.Settlement.Provider = "fake"
+	cfg.Fees = config.FeesConfig{HouseWalletID: 9, Schedules: []config.FeeSchedule{
+		{Operation: "withdraw", Type: config.FeeFlat, Flat: d("1")},
+	}}
+	svc.cfg = func() *config.Config { return &cfg }
+	fake := settlement.NewFake()
+	svc.settle = fake
+	for _, id := range []uint64{1, 9} {
+		_, err := svc.CreateWallet(ctx, id, "")
+		require.NoError(t, err)
+	}
+	_, err := svc.Deposit(ctx, 1, d("100"), "dep")
+	require.NoError(t, err)
+	return svc, ctx, fake
+}
+
+func TestRequestWithdrawal(t *testing.T) {
+	svc, ctx, _ := newSettlementService(t)
+	wd, err := svc.RequestWithdrawal(ctx, 1, d("50"), " iban:DE89 ", "w1")
+	require.NoError(t, err)
+	assert.Equal(t, model.WithdrawalPending, wd.Status)
+	assert.Equal(t, "1", wd.Fee.String())
+	assert.Equal(t, "iban:DE89", wd.Destination)
+
+	b, err := svc.GetBalanceConsistent(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"100", "51", "49"}, []string{b.Ledger.String(), b.Held.String(), b.Available.String()})
+
+	// replays return the same withdrawal, holding nothing more
+	again, err := svc.RequestWithdrawal(ctx, 1, d("50"), "iban:DE89", "w1")
+	require.NoError(t, err)
+	assert.Equal(t, wd.ID, again.ID)
+	_, err = svc.RequestWithdrawal(ctx, 1, d("49"), "iban:DE89", "w2")
+	assert.ErrorIs(t, err, repo.ErrInsufficientFunds)
+
+	// held funds can't be spent or moved away
+	_, err = svc.Withdraw(ctx, 1, d("49"), "cash")
+	assert.ErrorIs(t, err, repo.ErrInsufficientFunds)
+	_, err = svc.Close(ctx, 1, "")
+	assert.ErrorIs(t, err, ErrBalanceNotZero)
+
+	// pending withdrawals count against the limits
+	capped := &model.LimitProfile{Name: "capped", DailyWithdraw: d("60")}
+	require.NoError(t, svc.SaveLimitProfile(ctx, capped))
+	require.NoError(t, svc.AssignLimitProfile(ctx, 1, &capped.ID))
+	_, err = svc.RequestWithdrawal(ctx, 1, d("20"), "iban:DE89", "w3")
+	var limitErr *LimitExceededError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "50", limitErr.Used.String())
+
+	_, err = svc.RequestWithdrawal(ctx, 1, d("1"), "", "w4")
+	assert.ErrorIs(t, err, ErrInvalidWithdrawal)
+	cfg := *svc.cfg()
+	cfg.Settlement.Provider = ""
+	svc.cfg = func() *config.Config { return &cfg }
+	_, err = svc.RequestWithdrawal(ctx, 1, d("1"), "iban:DE89", "w5")
+	assert.ErrorIs(t, err, ErrSettlementDisabled)
+}
+
+func TestRunWithdrawals(t *testing.T) {
+	svc, ctx, fake := newSettlementService(t)
+	fake.SettleAfter = 2
+	fake.Reject["iban:BAD"] = "account closed"
+	ok, err := svc.RequestWithdrawal(ctx, 1, d("30"), "iban:DE89", "ok")
+	require.NoError(t, err)
+	bad, err := svc.RequestWithdrawal(ctx, 1, d("20"), "iban:BAD", "bad")
+	require.NoError(t, err)
+	run := func(at time.Time) []model.Withdrawal {
+		t.Helper()
+		done, err := svc.RunWithdrawals(ctx, at, 10, time.Minute)
+		require.NoError(t, err)
+		return done
+	}
+	get := func(id uint64) *model.Withdrawal {
+		t.Helper()
+		wd, err := svc.GetWithdrawal(ctx, 1, id)
+		require.NoError(t, err)
+		return wd
+	}
+	now := time.Now()
+
+	// the refused one fails on submission and its hold is released
+	done := run(now)
+	require.Len(t, done, 1)
+	assert.Equal(t, model.WithdrawalFailed, done[0].Status)
+	assert.Equal(t, "account closed", done[0].Reason)
+	assert.Equal(t, model.WithdrawalSubmitted, get(ok.ID).Status)
+	b, err := svc.GetBalanceConsistent(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"100", "31"}, []string{b.Ledger.String(), b.Held.String()})
+
+	// accepted payouts are polled every poll_interval until they settle
+	assert.Empty(t, run(now.Add(time.Second)))
+	assert.Empty(t, run(now.Add(31*time.Second)))
+	done = run(now.Add(62 * time.Second))
+	require.Len(t, done, 1)
+	assert.Equal(t, model.WithdrawalCompleted, done[0].Status)
+	assert.Equal(t, "fake-1", done[0].ProviderRef)
+	b, err = svc.GetBalanceConsistent(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"69", "0"}, []string{b.Ledger.String(), b.Held.String()})
+	house, err := svc.GetBalanceConsistent(ctx, 9)
+	require.NoError(t, err)
+	assert.Equal(t, "1", house.Ledger.String())
+	page, err := svc.GetHistory(ctx, 1, HistoryQuery{Types: []string{"WITHDRAW"}})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 1)
+	assert.Equal(t, "30", page.Items[0].Amount.String())
+
+	// settled ones are not picked up again
+	assert.Empty(t, run(now.Add(time.Hour)))
+	assert.Equal(t, model.WithdrawalFailed, get(bad.ID).Status)
+	var evt model.OutboxEvent
+	require.NoError(t, svc.Repo().DB(ctx).Where("event_type = ?", "WithdrawalCompleted").First(&evt).Error)
+}
+
+func TestRunWithdrawals_ProviderTrouble(t *testing.T) {
+	svc, ctx, fake := newSettlementService(t)
+	wd, err := svc.RequestWithdrawal(ctx, 1, d("10"), "iban:DE89", "w1")
+	require.NoError(t, err)
+	ref := withdrawalRef(0, wd.ID)
+	now := time.Now()
+
+	// an outage backs off 10s, 20s, 40s...
+	fake.Down = errors.New("connection refused")
+	at := now
+	for i, delay := range []time.Duration{10, 20, 40} {
+		_, err := svc.RunWithdrawals(ctx, at, 10, time.Minute)
+		assert.ErrorContains(t, err, "connection refused")
+		got, err := svc.GetWithdrawal(ctx, 1, wd.ID)
+		require.NoError(t, err)
+		assert.Equal(t, i+1, got.Attempts)
+		assert.WithinDuration(t, at.Add(delay*time.Second), got.NextAttemptAt, time.Millisecond)
+		at = got.NextAttemptAt
+	}
+	fake.Down = nil
+
+	// a submission whose reply is lost is found by its status, not sent twice
+	fake.LoseReplies = 1
+	_, err = svc.RunWithdrawals(ctx, at, 10, time.Minute)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	sent, _ := fake.Sent(ref)
+	assert.Equal(t, 1, sent)
+	got, err := svc.GetWithdrawal(ctx, 1, wd.ID)
+	require.NoError(t, err)
+	_, err = svc.RunWithdrawals(ctx, got.NextAttemptAt, 10, time.Minute)
+	require.NoError(t, err)
+	sent, req := fake.Sent(ref)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, "10", req.Amount.String())
+	got, err = svc.GetWithdrawal(ctx, 1, wd.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.WithdrawalCompleted, got.Status)
+	assert.Zero(t, got.Attempts)
+
+	// a payout failing after it was accepted releases the funds
+	wd2, err := svc.RequestWithdrawal(ctx, 1, d("5"), "iban:DE89", "w2")
+	require.NoError(t, err)
+	fake.SettleAfter = 5
+	_, err = svc.RunWithdrawals(ctx, now.Add(time.Hour), 10, time.Minute)
+	require.NoError(t, err)
+	fake.Fail(withdrawalRef(0, wd2.ID), "returned by bank")
+	done, err := svc.RunWithdrawals(ctx, now.Add(2*time.Hour), 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	assert.Equal(t, model.WithdrawalFailed, done[0].Status)
+	b, err := svc.GetBalanceConsistent(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"89", "0"}, []string{b.Ledger.String(), b.Held.String()})
+}
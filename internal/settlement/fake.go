@@ -0,0 +1,194 @@
+package settlement
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Fake is an in-memory Provider for tests and local runs. Payouts settle on
+// the SettleAfter-th status check after their submission, or fail right away
+// when their destination is in Reject. Setting Down makes every call fail,
+// and LoseReplies drops the replies of that many submissions after accepting
+// them, as a timeout would.
+type Fake struct {
+	mu          sync.Mutex
+	payouts     map[string]*fakePayout
+	SettleAfter int
+	Reject      map[string]string
+	Down        error
+	LoseReplies int
+}
+
+type fakePayout struct {
+	req    Request
+	res    Result
+	checks int
+	sent   int
+}
+
+// NewFake returns a Fake that settles payouts on the first status check.
+func NewFake() *Fake {
+	return &Fake{payouts: map[string]*fakePayout{}, SettleAfter: 1, Reject: map[string]string{}}
+}
+
+func (f *Fake) Name() string { return "fake" }
+
+func (f *Fake) Submit(ctx context.Context, req Request) (Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Down != nil {
+		return Result{}, f.Down
+	}
+	p, ok := f.payouts[req.Reference]
+	if !ok {
+		p = &fakePayout{req: req, res: Result{ProviderRef: fmt.Sprintf("fake-%d", len(f.payouts)+1), State: StatePending}}
+		if reason, bad := f.Reject[req.Destination]; bad {
+			p.res.State, p.res.Reason = StateFailed, reason
+		}
+		f.payouts[req.Reference] = p
+	}
+	p.sent++
+	if f.LoseReplies > 0 {
+		f.LoseReplies--
+		return Result{}, context.DeadlineExceeded
+	}
+	return p.res, nil
+}
+
+func (f *Fake) Status(ctx context.Context, reference string) (Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Down != nil {
+		return Result{}, f.Down
+	}
+	p, ok := f.payouts[reference]
+	if !ok {
+		return Result{}, ErrNotFound
+	}
+	if p.res.State == StatePending {
+		if p.checks++; p.checks >= f.SettleAfter {
+			p.res.State = StateCompleted
+		}
+	}
+	return p.res, nil
+}
+
+// Sent returns how many times the payout with reference was submitted, and
+// the request; 0 when it never was.
+func (f *Fake) Sent(reference string) (int, Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.payouts[reference]; ok {
+		return p.sent, p.req
+	}
+	return 0, Request{}
+}
+
+// Fail makes a pending payout fail with reason on its next status check.
+func (f *Fake) Fail(reference, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.payouts[reference]; ok && p.res.State == StatePending {
+		p.res.State, p.res.Reason = StateFailed, reason
+	}
+}
+
+// FakeSignatureHeader carries a fake webhook's signature,
+// t=<unix>,v1=<hex HMAC-SHA256 of "<t>.<body>">.
+const FakeSignatureHeader = "X-Fake-Signature"
+
+// FakeSignatureTolerance is how far a fake webhook's signed time may be from
+// now; older ones are replays.
+const FakeSignatureTolerance = 5 * time.Minute
+
+// FakeWebhooks is the webhook adapter of a made-up provider, for tests and
+// local runs. Payloads look like
+//
+//	{"id": "pay_1", "wallet_id": 1, "currency": "USD", "amount": "10", "status": "settled"}
+//
+// with status one of pending, settled and reversed.
+type FakeWebhooks struct {
+	Secret string
+}
+
+// Sign returns the signature header value for body sent at ts.
+func (f FakeWebhooks) Sign(ts time.Time, body []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	return "t=" + t + ",v1=" + f.mac(t, body)
+}
+
+func (f FakeWebhooks) mac(t string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(f.Secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of body and that it was signed within
+// FakeSignatureTolerance of now.
+func (f FakeWebhooks) Verify(header http.Header, body []byte) error {
+	var t, v1 string
+	for _, part := range strings.Split(header.Get(FakeSignatureHeader), ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			t = v
+		case "v1":
+			v1 = v
+		}
+	}
+	ts, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || f.Secret == "" {
+		return ErrBadSignature
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > FakeSignatureTolerance || age < -FakeSignatureTolerance {
+		return ErrBadSignature
+	}
+	got, err := hex.DecodeString(v1)
+	if err != nil {
+		return ErrBadSignature
+	}
+	want, _ := hex.DecodeString(f.mac(t, body))
+	if !hmac.Equal(got, want) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Parse reads a fake provider's payload.
+func (f FakeWebhooks) Parse(body []byte) (Notification, error) {
+	var p struct {
+		ID       string          `json:"id"`
+		WalletID uint64          `json:"wallet_id"`
+		Currency string          `json:"currency"`
+		Amount   decimal.Decimal `json:"amount"`
+		Status   string          `json:"status"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return Notification{}, fmt.Errorf("%w: %v", ErrBadPayload, err)
+	}
+	n := Notification{
+		Reference: p.ID, WalletID: p.WalletID, Currency: strings.ToUpper(p.Currency),
+		Amount: p.Amount, State: strings.ToUpper(p.Status),
+	}
+	switch {
+	case n.Reference == "" || n.WalletID == 0:
+		return Notification{}, fmt.Errorf("%w: id and wallet_id are required", ErrBadPayload)
+	case !n.Amount.IsPositive():
+		return Notification{}, fmt.Errorf("%w: amount must be positive", ErrBadPayload)
+	case n.State != DepositPending && n.State != DepositSettled && n.State != DepositReversed:
+		return Notification{}, fmt.Errorf("%w: unknown status %q", ErrBadPayload, p.Status)
+	}
+	return n, nil
+}
@@ -0,0 +1,60 @@
+// Package settlement connects the wallet to external payment rails, such as
+// banks or chains: providers pay withdrawals out, and adapters read the
+// webhooks through which payment providers report incoming deposits.
+package settlement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// Payout states reported by a provider. PENDING payouts are still on their
+// way; COMPLETED and FAILED are final.
+const (
+	StatePending   = "PENDING"
+	StateCompleted = "COMPLETED"
+	StateFailed    = "FAILED"
+)
+
+// ErrNotFound is returned by Status for a reference the provider never
+// accepted, e.g. because the Submit carrying it was lost.
+var ErrNotFound = errors.New("payout not found")
+
+// Request asks for one payout. Reference is ours and unique per withdrawal;
+// providers must treat a repeated Submit with the same Reference as the same
+// payout, so that a submission whose outcome is unknown can be sent again.
+type Request struct {
+	Reference   string
+	WalletID    uint64
+	Currency    string
+	Amount      decimal.Decimal
+	Destination string
+}
+
+// Result is a provider's view of a payout. ProviderRef is the provider's own
+// ID for it and Reason says why it failed.
+type Result struct {
+	ProviderRef string
+	State       string
+	Reason      string
+}
+
+// Provider is an external payout rail. Errors, timeouts included, leave the
+// payout's outcome unknown; a definite refusal is a FAILED Result.
+type Provider interface {
+	Name() string
+	Submit(ctx context.Context, req Request) (Result, error)
+	Status(ctx context.Context, reference string) (Result, error)
+}
+
+// New returns the provider configured by name.
+func New(name string) (Provider, error) {
+	switch name {
+	case "fake":
+		return NewFake(), nil
+	}
+	return nil, fmt.Errorf("unknown settlement provider %q", name)
+}
@@ -0,0 +1,53 @@
+package settlement
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shopspring/decimal"
+)
+
+// Deposit states reported by provider webhooks. A deposit normally goes from
+// PENDING to SETTLED; REVERSED means it was charged back or never arrived.
+const (
+	DepositPending  = "PENDING"
+	DepositSettled  = "SETTLED"
+	DepositReversed = "REVERSED"
+)
+
+var (
+	// ErrBadSignature means a webhook failed signature verification.
+	ErrBadSignature = errors.New("invalid webhook signature")
+	// ErrBadPayload means a signed webhook could not be understood.
+	ErrBadPayload = errors.New("invalid webhook payload")
+)
+
+// Notification is what a provider reports about one incoming payment.
+// Reference is the provider's ID for the payment, the same in every
+// notification about it.
+type Notification struct {
+	Reference string
+	WalletID  uint64
+	Currency  string
+	Amount    decimal.Decimal
+	State     string
+}
+
+// Adapter understands one provider's deposit webhooks.
+type Adapter interface {
+	// Verify checks that the request was signed by the provider.
+	Verify(header http.Header, body []byte) error
+	// Parse reads a verified payload; errors wrap ErrBadPayload.
+	Parse(body []byte) (Notification, error)
+}
+
+// NewAdapter returns the webhook adapter of the given kind, checking
+// signatures with secret.
+func NewAdapter(kind, secret string) (Adapter, error) {
+	switch kind {
+	case "fake":
+		return FakeWebhooks{Secret: secret}, nil
+	}
+	return nil, fmt.Errorf("unknown webhook adapter %q", kind)
+}
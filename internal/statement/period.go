@@ -0,0 +1,37 @@
+package statement
+
+import (
+	"errors"
+	"time"
+)
+
+// ParsePeriod resolves a statement period either from a calendar month
+// ("2006-01") or from explicit from/to bounds (RFC3339 or "2006-01-02", UTC).
+func ParsePeriod(month, from, to string) (time.Time, time.Time, error) {
+	if month != "" {
+		start, err := time.Parse("2006-01", month)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid month, want YYYY-MM")
+		}
+		return start, start.AddDate(0, 1, 0), nil
+	}
+	if from == "" || to == "" {
+		return time.Time{}, time.Time{}, errors.New("either month or both from and to are required")
+	}
+	f, err := parseTime(from)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("invalid from")
+	}
+	t, err := parseTime(to)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("invalid to")
+	}
+	return f, t, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
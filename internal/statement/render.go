@@ -0,0 +1,148 @@
+// Package statement renders wallet statements as CSV, JSON or PDF.
+package statement
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+)
+
+// Format is an output format for statements.
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatCSV  Format = "csv"
+	FormatPDF  Format = "pdf"
+)
+
+// ParseFormat validates a format name.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatJSON, FormatCSV, FormatPDF:
+		return f, nil
+	}
+	return "", fmt.Errorf("unsupported statement format %q", s)
+}
+
+// ContentType returns the MIME type of the format.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatCSV:
+		return "text/csv"
+	case FormatPDF:
+		return "application/pdf"
+	}
+	return "application/json"
+}
+
+// Filename returns a conventional file name for a statement in this format.
+func (f Format) Filename(st *model.Statement) string {
+	return fmt.Sprintf("statement_%d_%s_%s.%s", st.WalletID,
+		st.From.Format("20060102"), st.To.Format("20060102"), f)
+}
+
+// Render writes st to w in the given format.
+func Render(w io.Writer, st *model.Statement, f Format) error {
+	switch f {
+	case FormatCSV:
+		return WriteCSV(w, st)
+	case FormatPDF:
+		return WritePDF(w, st)
+	}
+	return WriteJSON(w, st)
+}
+
+// WriteJSON writes the statement as indented JSON.
+func WriteJSON(w io.Writer, st *model.Statement) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(st)
+}
+
+// WriteCSV writes one row per transaction framed by opening, totals and closing rows.
+func WriteCSV(w io.Writer, st *model.Statement) error {
+	cw := csv.NewWriter(w)
+	rows := [][]string{
+		{"wallet_id", strconv.FormatUint(st.WalletID, 10)},
+		{"period_from", st.From.Format(time.RFC3339)},
+		{"period_to", st.To.Format(time.RFC3339)},
+		{"opening_balance", st.OpeningBalance.String()},
+		{},
+		{"time", "transaction_id", "type", "amount", "related_wallet_id", "balance"},
+	}
+	for _, l := range st.Lines {
+		rows = append(rows, []string{
+			l.Time.UTC().Format(time.RFC3339),
+			strconv.FormatUint(l.TransactionID, 10),
+			l.Type,
+			l.Amount.String(),
+			related(l.RelatedWalletID),
+			l.Balance.String(),
+		})
+	}
+	rows = append(rows, []string{})
+	for _, t := range sortedTypes(st) {
+		rows = append(rows, []string{"total_" + t, st.TotalsByType[t].String()})
+	}
+	rows = append(rows,
+		[]string{"total_credits", st.TotalCredits.String()},
+		[]string{"total_debits", st.TotalDebits.String()},
+		[]string{"closing_balance", st.ClosingBalance.String()},
+	)
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// WritePDF writes a plain, monospaced PDF rendering of the statement.
+func WritePDF(w io.Writer, st *model.Statement) error {
+	lines := []string{
+		fmt.Sprintf("Wallet statement - wallet %d", st.WalletID),
+		fmt.Sprintf("Period: %s to %s", st.From.UTC().Format(time.RFC3339), st.To.UTC().Format(time.RFC3339)),
+		fmt.Sprintf("Generated: %s", st.GeneratedAt.UTC().Format(time.RFC3339)),
+		"",
+		fmt.Sprintf("Opening balance: %s", st.OpeningBalance.String()),
+		"",
+		fmt.Sprintf("%-20s %-10s %-14s %18s %10s %18s", "Time", "Tx", "Type", "Amount", "Related", "Balance"),
+	}
+	for _, l := range st.Lines {
+		lines = append(lines, fmt.Sprintf("%-20s %-10d %-14s %18s %10s %18s",
+			l.Time.UTC().Format("2006-01-02 15:04:05"), l.TransactionID, l.Type,
+			l.Amount.StringFixed(8), related(l.RelatedWalletID), l.Balance.StringFixed(8)))
+	}
+	lines = append(lines, "")
+	for _, t := range sortedTypes(st) {
+		lines = append(lines, fmt.Sprintf("Total %-14s %18s", t, st.TotalsByType[t].StringFixed(8)))
+	}
+	lines = append(lines,
+		fmt.Sprintf("Total credits        %18s", st.TotalCredits.StringFixed(8)),
+		fmt.Sprintf("Total debits         %18s", st.TotalDebits.StringFixed(8)),
+		"",
+		fmt.Sprintf("Closing balance: %s", st.ClosingBalance.String()),
+	)
+	return writeTextPDF(w, lines)
+}
+
+func related(id *uint64) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatUint(*id, 10)
+}
+
+func sortedTypes(st *model.Statement) []string {
+	types := make([]string, 0, len(st.TotalsByType))
+	for t := range st.TotalsByType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,63 @@
+package statement
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func sampleStatement(lines int) *model.Statement {
+	st := &model.Statement{
+		WalletID:       7,
+		From:           time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC),
+		To:             time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		OpeningBalance: decimal.NewFromInt(10),
+		TotalsByType:   map[string]decimal.Decimal{},
+	}
+	bal := st.OpeningBalance
+	for i := 0; i < lines; i++ {
+		bal = bal.Add(decimal.NewFromInt(1))
+		st.Lines = append(st.Lines, model.StatementLine{
+			TransactionID: uint64(i + 1), Time: st.From.Add(time.Duration(i) * time.Hour),
+			Type: "DEPOSIT", Amount: decimal.NewFromInt(1), Balance: bal,
+		})
+		st.TotalsByType["DEPOSIT"] = st.TotalsByType["DEPOSIT"].Add(decimal.NewFromInt(1))
+	}
+	st.TotalCredits = decimal.NewFromInt(int64(lines))
+	st.ClosingBalance = bal
+	return st
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteCSV(&buf, sampleStatement(2)))
+	out := buf.String()
+	assert.Contains(t, out, "opening_balance,10\n")
+	assert.Contains(t, out, "2026-09-01T01:00:00Z,2,DEPOSIT,1,,12\n")
+	assert.Contains(t, out, "closing_balance,12\n")
+}
+
+func TestWritePDF_Paginates(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WritePDF(&buf, sampleStatement(100)))
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "%PDF-1.4"))
+	assert.Contains(t, out, "/Count 2")
+	assert.Contains(t, out, "(Page 2 of 2)")
+	assert.True(t, strings.HasSuffix(out, "%%EOF\n"))
+}
+
+func TestParsePeriod(t *testing.T) {
+	from, to, err := ParsePeriod("2026-02", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), to)
+	assert.Equal(t, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), from)
+
+	_, _, err = ParsePeriod("", "2026-01-01", "")
+	assert.Error(t, err)
+}
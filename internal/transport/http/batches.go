@@ -0,0 +1,82 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/service"
+	"github.com/shopspring/decimal"
+)
+
+func registerBatchHandlers(v1 *gin.RouterGroup, svc *service.WalletService) {
+	v1.POST("/batches", submitBatchHandler(svc))
+	v1.GET("/batches/:id", getBatchHandler(svc))
+}
+
+type batchLegReq struct {
+	FromID string `json:"from_id"`
+	ToID   string `json:"to_id" binding:"required"`
+	Amount string `json:"amount" binding:"required"`
+}
+
+// batchReq is a batch of transfers. Legs without from_id use the batch's from_id.
+type batchReq struct {
+	IdempotencyKey string        `json:"idempotency_key" binding:"required"`
+	Mode           string        `json:"mode" binding:"required"`
+	FromID         string        `json:"from_id"`
+	Legs           []batchLegReq `json:"legs" binding:"required,dive"`
+}
+
+func submitBatchHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req batchReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		legs := make([]model.BatchLeg, len(req.Legs))
+		for i, l := range req.Legs {
+			from := l.FromID
+			if from == "" {
+				from = req.FromID
+			}
+			fromID, err := strconv.ParseUint(from, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from_id in leg " + strconv.Itoa(i+1)})
+				return
+			}
+			toID, err := strconv.ParseUint(l.ToID, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to_id in leg " + strconv.Itoa(i+1)})
+				return
+			}
+			amt, err := decimal.NewFromString(l.Amount)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount in leg " + strconv.Itoa(i+1)})
+				return
+			}
+			legs[i] = model.BatchLeg{FromWalletID: fromID, ToWalletID: toID, Amount: amt}
+		}
+		b, err := svc.SubmitBatch(c, req.IdempotencyKey, strings.ToUpper(req.Mode), legs)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, b)
+	}
+}
+
+func getBatchHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		b, err := svc.GetBatch(c, id)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, b)
+	}
+}
@@ -0,0 +1,105 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/service"
+	"github.com/shopspring/decimal"
+)
+
+func registerEscrowHandlers(v1 *gin.RouterGroup, svc *service.WalletService) {
+	v1.POST("/escrows", createEscrowHandler(svc))
+	v1.GET("/escrows/:id", getEscrowHandler(svc))
+	v1.POST("/escrows/:id/release", settleEscrowHandler(svc.ReleaseEscrow))
+	v1.POST("/escrows/:id/refund", settleEscrowHandler(svc.RefundEscrow))
+}
+
+type createEscrowReq struct {
+	PayerID        string     `json:"payer_id" binding:"required"`
+	PayeeID        string     `json:"payee_id" binding:"required"`
+	Amount         string     `json:"amount" binding:"required"`
+	IdempotencyKey string     `json:"idempotency_key" binding:"required"`
+	Condition      string     `json:"condition"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+}
+
+func createEscrowHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req createEscrowReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		payerID, err := strconv.ParseUint(req.PayerID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payer_id"})
+			return
+		}
+		payeeID, err := strconv.ParseUint(req.PayeeID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payee_id"})
+			return
+		}
+		amt, err := decimal.NewFromString(req.Amount)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
+			return
+		}
+		e, err := svc.CreateEscrow(c, req.IdempotencyKey, payerID, payeeID, amt, req.Condition, req.ExpiresAt)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, e)
+	}
+}
+
+func getEscrowHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		e, err := svc.GetEscrow(c, id)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, e)
+	}
+}
+
+// settleEscrowReq releases or refunds amount, or everything still held if omitted.
+type settleEscrowReq struct {
+	Amount         *string `json:"amount"`
+	IdempotencyKey string  `json:"idempotency_key" binding:"required"`
+	Note           string  `json:"note"`
+}
+
+func settleEscrowHandler(settle func(ctx context.Context, id uint64, amt *decimal.Decimal, key, note string) (*model.Escrow, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req settleEscrowReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var amt *decimal.Decimal
+		if req.Amount != nil {
+			a, err := decimal.NewFromString(*req.Amount)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
+				return
+			}
+			amt = &a
+		}
+		e, err := settle(c, id, amt, req.IdempotencyKey, req.Note)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, e)
+	}
+}
@@ -1,23 +1,54 @@
 package http
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/repo"
 	"github.com/richardliu001/wallet-service/internal/service"
+	"github.com/richardliu001/wallet-service/internal/settlement"
+	"github.com/richardliu001/wallet-service/internal/statement"
 	"github.com/shopspring/decimal"
 )
 
 func RegisterHandlers(r *gin.Engine, svc *service.WalletService) {
+	stmts := service.NewStatementService(svc)
 	v1 := r.Group("/v1")
 	{
+		v1.POST("/wallets", createWalletHandler(svc))
+		v1.GET("/wallets/:id", getWalletHandler(svc))
+		v1.POST("/wallets/:id/freeze", walletStatusHandler(svc.Freeze))
+		v1.POST("/wallets/:id/unfreeze", walletStatusHandler(svc.Unfreeze))
+		v1.POST("/wallets/:id/close", walletStatusHandler(svc.Close))
+		v1.POST("/wallets/:id/status", setStatusHandler(svc))
 		v1.POST("/wallets/:id/deposit", depositHandler(svc))
 		v1.POST("/wallets/:id/withdraw", withdrawHandler(svc))
 		v1.POST("/wallets/:id/transfer", transferHandler(svc))
 		v1.GET("/wallets/:id/balance", balanceHandler(svc))
+		v1.PUT("/wallets/:id/credit-limit", creditLimitHandler(svc))
+		v1.PUT("/wallets/:id/rate-plan", ratePlanHandler(svc))
+		v1.GET("/wallets/:id/interest", interestHandler(svc))
 		v1.GET("/wallets/:id/history", historyHandler(svc))
+		v1.GET("/wallets/:id/statements", statementHandler(stmts))
+		v1.GET("/wallets/:id/limits", limitUsageHandler(svc))
+		v1.PUT("/wallets/:id/limit-profile", assignLimitProfileHandler(svc))
+		v1.GET("/limit-profiles", listLimitProfilesHandler(svc))
+		v1.POST("/limit-profiles", saveLimitProfileHandler(svc))
+		v1.PUT("/limit-profiles/:pid", saveLimitProfileHandler(svc))
+		v1.GET("/fees/quote", feeQuoteHandler(svc))
+		registerScheduleHandlers(v1, svc)
+		registerBatchHandlers(v1, svc)
+		v1.POST("/splits", splitHandler(svc))
+		registerEscrowHandlers(v1, svc)
+		registerWithdrawalHandlers(v1, svc)
+		registerPayinHandlers(v1, svc)
+		registerWebhookHandlers(v1, svc)
 	}
 }
 
@@ -41,7 +72,7 @@ func depositHandler(svc *service.WalletService) gin.HandlerFunc {
 		}
 		bal, err := svc.Deposit(c, id, amt, req.IdempotencyKey)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"balance": bal})
@@ -66,12 +97,12 @@ func withdrawHandler(svc *service.WalletService) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
 			return
 		}
-		bal, err := svc.Withdraw(c, id, amt, req.IdempotencyKey)
+		bal, fee, err := svc.WithdrawWithFee(c, id, amt, req.IdempotencyKey)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"balance": bal})
+		c.JSON(http.StatusOK, gin.H{"balance": bal, "fee": fee})
 	}
 }
 
@@ -99,41 +130,433 @@ func transferHandler(svc *service.WalletService) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
 			return
 		}
-		fromBal, toBal, err := svc.Transfer(c, fromID, toID, amt, req.IdempotencyKey)
+		fromBal, toBal, fee, err := svc.TransferWithFee(c, fromID, toID, amt, req.IdempotencyKey)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"from_balance": fromBal, "to_balance": toBal})
+		c.JSON(http.StatusOK, gin.H{"from_balance": fromBal, "to_balance": toBal, "fee": fee})
 	}
 }
 
+// feeQuoteHandler previews a fee: ?operation=withdraw|transfer&amount=..
+// plus wallet_id (or currency when there is no wallet yet).
+func feeQuoteHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		amt, err := decimal.NewFromString(c.Query("amount"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
+			return
+		}
+		var walletID uint64
+		if v := c.Query("wallet_id"); v != "" {
+			if walletID, err = strconv.ParseUint(v, 10, 64); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wallet_id"})
+				return
+			}
+		}
+		q, err := svc.QuoteFee(c, c.Query("operation"), walletID, strings.ToUpper(c.Query("currency")), amt)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, q)
+	}
+}
+
+// balanceHandler returns the current balance breakdown, or just the ledger
+// balance at a point in time with ?as_of=<RFC3339>. ?consistency=strong reads
+// the breakdown from the database instead of the cache.
 func balanceHandler(svc *service.WalletService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-		bal, err := svc.GetBalance(c, id)
+		if v := c.Query("as_of"); v != "" {
+			at, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid as_of"})
+				return
+			}
+			bal, err := svc.GetBalanceAt(c, id, at)
+			if err != nil {
+				writeError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"wallet_id": id, "balance": bal, "as_of": at})
+			return
+		}
+		get := svc.GetBalance
+		if c.Query("consistency") == "strong" {
+			get = svc.GetBalanceConsistent
+		}
+		b, err := get(c, id)
 		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, b)
+	}
+}
+
+type ratePlanReq struct {
+	RatePlan string `json:"rate_plan"`
+}
+
+// ratePlanHandler puts a wallet on a rate plan; an empty rate_plan removes it.
+func ratePlanHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ratePlanReq
+		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"balance": bal})
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		w, err := svc.SetRatePlan(c, id, req.RatePlan)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, w)
+	}
+}
+
+func interestHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		sum, err := svc.InterestSummary(c, id, 12)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, sum)
+	}
+}
+
+type creditLimitReq struct {
+	CreditLimit string `json:"credit_limit" binding:"required"`
+	Reason      string `json:"reason"`
+}
+
+func creditLimitHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req creditLimitReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		limit, err := decimal.NewFromString(req.CreditLimit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid credit_limit"})
+			return
+		}
+		cl, err := svc.SetCreditLimit(c, id, limit, req.Reason)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, cl)
 	}
 }
 func historyHandler(svc *service.WalletService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
-		sinceStr := c.DefaultQuery("since", time.Now().Add(-24*time.Hour).Format(time.RFC3339))
-		since, err := time.Parse(time.RFC3339, sinceStr)
+		q, err := parseHistoryQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		page, err := svc.GetHistory(c, id, q)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, page)
+	}
+}
+
+// parseHistoryQuery reads paging and filter parameters; malformed values are rejected.
+// As before paging, history is oldest first and covers the last 24 hours
+// unless order and since say otherwise.
+func parseHistoryQuery(c *gin.Context) (service.HistoryQuery, error) {
+	since := time.Now().Add(-24 * time.Hour)
+	q := service.HistoryQuery{Cursor: c.Query("cursor"), Since: &since}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > service.MaxHistoryLimit {
+			return q, service.ErrInvalidLimit
+		}
+		q.Limit = limit
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, errors.New("invalid order")
+	}
+	for _, t := range c.QueryArray("type") {
+		for _, part := range strings.Split(t, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				q.Types = append(q.Types, strings.ToUpper(part))
+			}
+		}
+	}
+	if v := c.Query("min_amount"); v != "" {
+		d, err := decimal.NewFromString(v)
+		if err != nil {
+			return q, errors.New("invalid min_amount")
+		}
+		q.MinAmount = &d
+	}
+	if v := c.Query("max_amount"); v != "" {
+		d, err := decimal.NewFromString(v)
+		if err != nil {
+			return q, errors.New("invalid max_amount")
+		}
+		q.MaxAmount = &d
+	}
+	if v := c.Query("counterparty"); v != "" {
+		cp, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return q, errors.New("invalid counterparty")
+		}
+		q.Counterparty = &cp
+	}
+	if v := c.Query("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, errors.New("invalid since")
+		}
+		q.Since = &t
+	}
+	if v := c.Query("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, errors.New("invalid until")
+		}
+		q.Until = &t
+	}
+	return q, nil
+}
+
+func statementHandler(stmts *service.StatementService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		format, err := statement.ParseFormat(c.DefaultQuery("format", "json"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		from, to, err := statement.ParsePeriod(c.Query("month"), c.Query("from"), c.Query("to"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		txs, err := svc.GetHistory(c, id, limit, since)
+		st, err := stmts.Generate(c, id, from, to)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, txs)
+		c.Header("Content-Type", format.ContentType())
+		if format != statement.FormatJSON {
+			c.Header("Content-Disposition", `attachment; filename="`+format.Filename(st)+`"`)
+		}
+		c.Status(http.StatusOK)
+		if err := statement.Render(c.Writer, st, format); err != nil {
+			_ = c.Error(err)
+		}
+	}
+}
+
+// writeError maps service errors to HTTP status codes.
+func writeError(c *gin.Context, err error) {
+	var limitErr *service.LimitExceededError
+	if errors.As(err, &limitErr) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "details": limitErr})
+		return
+	}
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, service.ErrWalletNotFound), errors.Is(err, service.ErrLimitProfileNotFound),
+		errors.Is(err, service.ErrScheduleNotFound), errors.Is(err, service.ErrBatchNotFound),
+		errors.Is(err, service.ErrEscrowNotFound), errors.Is(err, service.ErrWithdrawalNotFound),
+		errors.Is(err, service.ErrUnknownDepositProvider), errors.Is(err, service.ErrSubscriptionNotFound),
+		errors.Is(err, service.ErrDeliveryNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, settlement.ErrBadSignature):
+		status = http.StatusUnauthorized
+	case errors.Is(err, service.ErrWalletExists):
+		status = http.StatusConflict
+	case errors.Is(err, service.ErrWalletFrozen), errors.Is(err, service.ErrWalletClosed),
+		errors.Is(err, service.ErrDebitBlocked), errors.Is(err, service.ErrCreditBlocked):
+		status = http.StatusForbidden
+	case errors.Is(err, service.ErrBalanceNotZero), errors.Is(err, service.ErrInvalidStatus),
+		errors.Is(err, service.ErrEscrowClosed), errors.Is(err, service.ErrCreditInUse),
+		errors.Is(err, service.ErrDepositMismatch):
+		status = http.StatusConflict
+	case errors.Is(err, service.ErrCurrencyMismatch), errors.Is(err, service.ErrCrossShard):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, service.ErrTransferReversed):
+		status = http.StatusConflict
+	case errors.Is(err, service.ErrTransferPending):
+		status = http.StatusAccepted
+	case errors.Is(err, service.ErrSettlementDisabled):
+		status = http.StatusNotImplemented
+	case errors.Is(err, service.ErrWalletMoved), errors.Is(err, repo.ErrWalletMoving):
+		status = http.StatusServiceUnavailable
+		c.Header("Retry-After", "1")
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+type createWalletReq struct {
+	ID       string `json:"id"`
+	Currency string `json:"currency"`
+}
+
+func createWalletHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req createWalletReq
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		var id uint64
+		if req.ID != "" {
+			var err error
+			if id, err = strconv.ParseUint(req.ID, 10, 64); err != nil || id == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+				return
+			}
+		}
+		w, err := svc.CreateWallet(c, id, strings.ToUpper(req.Currency))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, w)
+	}
+}
+
+func getWalletHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		w, err := svc.GetWallet(c, id)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, w)
+	}
+}
+
+type statusReq struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+func walletStatusHandler(change func(ctx context.Context, id uint64, reason string) (*model.Wallet, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req statusReq
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		w, err := change(c, id, req.Reason)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, w)
+	}
+}
+
+func setStatusHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req statusReq
+		if err := c.ShouldBindJSON(&req); err != nil || req.Status == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status is required"})
+			return
+		}
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		w, err := svc.SetStatus(c, id, strings.ToUpper(req.Status), req.Reason)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, w)
+	}
+}
+
+func limitUsageHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		profile, usage, err := svc.LimitUsage(c, id)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"profile": profile, "usage": usage})
+	}
+}
+
+type assignLimitProfileReq struct {
+	ProfileID *uint64 `json:"profile_id"`
+}
+
+func assignLimitProfileHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req assignLimitProfileReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err := svc.AssignLimitProfile(c, id, req.ProfileID); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"wallet_id": id, "profile_id": req.ProfileID})
+	}
+}
+
+func listLimitProfilesHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ps, err := svc.ListLimitProfiles(c)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, ps)
+	}
+}
+
+func saveLimitProfileHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var p model.LimitProfile
+		if err := c.ShouldBindJSON(&p); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		p.ID = 0
+		status := http.StatusCreated
+		if pid := c.Param("pid"); pid != "" {
+			id, err := strconv.ParseUint(pid, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid profile id"})
+				return
+			}
+			p.ID, status = id, http.StatusOK
+		}
+		if err := svc.SaveLimitProfile(c, &p); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(status, p)
 	}
 }
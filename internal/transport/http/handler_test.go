@@ -0,0 +1,32 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHistoryQuery_Defaults(t *testing.T) {
+	parse := func(query string) (bool, *time.Time) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/v1/wallets/1/history?"+query, nil)
+		q, err := parseHistoryQuery(c)
+		require.NoError(t, err)
+		return q.Desc, q.Since
+	}
+
+	// oldest first over the last day, as before paging
+	desc, since := parse("")
+	assert.False(t, desc)
+	require.NotNil(t, since)
+	assert.WithinDuration(t, time.Now().Add(-24*time.Hour), *since, time.Minute)
+
+	desc, since = parse("order=desc&since=2024-01-01T00:00:00Z")
+	assert.True(t, desc)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), since.UTC())
+}
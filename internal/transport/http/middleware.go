@@ -1,14 +1,16 @@
 package http
 
 import (
-	"net"
+	"math"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/ratelimit"
 	"go.uber.org/zap"
-	"golang.org/x/time/rate"
 )
 
 // LoggingMiddleware prints request/response metrics.
@@ -21,24 +23,90 @@ func LoggingMiddleware(log *zap.SugaredLogger) gin.HandlerFunc {
 	}
 }
 
-// RateLimitMiddleware simple token bucket per IP.
-func RateLimitMiddleware(rps, burst int) gin.HandlerFunc {
-	var mu sync.Mutex
-	buckets := make(map[string]*rate.Limiter)
-	newLimiter := func() *rate.Limiter { return rate.NewLimiter(rate.Limit(rps), burst) }
+// RateLimitMiddleware enforces per-client and per-wallet quotas for each route
+// class (reads vs money movement) and reports them via RateLimit-* headers.
+// cfg is consulted on every request so reloaded limits apply immediately.
+func RateLimitMiddleware(l ratelimit.Limiter, cfg func() config.RateLimitConfig, log *zap.SugaredLogger) gin.HandlerFunc {
+	type check struct {
+		key   string
+		quota ratelimit.Quota
+	}
 	return func(c *gin.Context) {
-		ip, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
-		mu.Lock()
-		lim, ok := buckets[ip]
-		if !ok {
-			lim = newLimiter()
-			buckets[ip] = lim
+		cfg := cfg()
+		class, rc := "money", cfg.Money
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			class, rc = "read", cfg.Read
+		}
+
+		clientQuota := toQuota(rc.Client)
+		if !clientQuota.Enabled() {
+			clientQuota = ratelimit.Quota{Rate: cfg.RPS, Period: time.Second, Burst: cfg.Burst}
 		}
-		mu.Unlock()
-		if !lim.Allow() {
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
-			return
+		checks := []check{{key: class + ":client:" + clientID(c, cfg), quota: clientQuota}}
+		if id := c.Param("id"); id != "" && strings.HasPrefix(c.FullPath(), "/v1/wallets/") {
+			if q := toQuota(rc.Wallet); q.Enabled() {
+				checks = append(checks, check{key: class + ":wallet:" + id, quota: q})
+			}
+		}
+
+		var tightest *ratelimit.Result
+		for _, ch := range checks {
+			if !ch.quota.Enabled() {
+				continue
+			}
+			res, err := l.Allow(c.Request.Context(), ch.key, ch.quota)
+			if err != nil {
+				// fail open: a broken limiter must not take the API down
+				log.Warnf("rate limit %s: %v", ch.key, err)
+				continue
+			}
+			if !res.Allowed {
+				setRateLimitHeaders(c, res)
+				c.Header("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+				return
+			}
+			if tightest == nil || res.Remaining < tightest.Remaining {
+				r := res
+				tightest = &r
+			}
+		}
+		if tightest != nil {
+			setRateLimitHeaders(c, *tightest)
 		}
 		c.Next()
 	}
 }
+
+func toQuota(q config.QuotaConfig) ratelimit.Quota {
+	period := q.Period
+	if period == 0 {
+		period = time.Second
+	}
+	return ratelimit.Quota{Rate: q.Limit, Period: period, Burst: q.Burst}
+}
+
+// clientID identifies the API client by header when a trusted proxy set it,
+// and by the address the request came from otherwise, since anybody can send
+// the header or X-Forwarded-For.
+func clientID(c *gin.Context, cfg config.RateLimitConfig) string {
+	if !cfg.Trusts(c.RemoteIP()) {
+		return c.RemoteIP()
+	}
+	if cfg.ClientHeader != "" {
+		if v := c.GetHeader(cfg.ClientHeader); v != "" {
+			return v
+		}
+	}
+	return c.ClientIP()
+}
+
+func setRateLimitHeaders(c *gin.Context, res ratelimit.Result) {
+	c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.ResetAfter)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,41 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRateLimitMiddleware_ClientHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.RateLimitConfig{RPS: 1, Burst: 1, ClientHeader: "X-Client-ID", TrustedProxies: []string{"10.0.0.0/24"}}
+	r := gin.New()
+	r.Use(RateLimitMiddleware(ratelimit.NewLocalLimiter(time.Minute), func() config.RateLimitConfig { return cfg }, zap.NewNop().Sugar()))
+	r.GET("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
+	get := func(from, client string) int {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.RemoteAddr = from + ":4321"
+		req.Header.Set("X-Client-ID", client)
+		req.Header.Set("X-Forwarded-For", client)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// a caller can't reset its quota by sending another header value
+	assert.Equal(t, http.StatusOK, get("192.0.2.1", "a"))
+	assert.Equal(t, http.StatusTooManyRequests, get("192.0.2.1", "b"))
+	assert.Equal(t, http.StatusTooManyRequests, get("192.0.2.1", "192.0.2.2"))
+
+	// behind a trusted proxy, the header tells its clients apart
+	assert.Equal(t, http.StatusOK, get("10.0.0.5", "a"))
+	assert.Equal(t, http.StatusOK, get("10.0.0.5", "b"))
+	assert.Equal(t, http.StatusTooManyRequests, get("10.0.0.6", "b"))
+}
@@ -0,0 +1,49 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/service"
+)
+
+// maxWebhookBody caps the deposit webhook payloads read.
+const maxWebhookBody = 64 << 10
+
+func registerPayinHandlers(v1 *gin.RouterGroup, svc *service.WalletService) {
+	v1.POST("/webhooks/deposits/:provider", depositWebhookHandler(svc))
+	v1.GET("/wallets/:id/provider-deposits", listProviderDepositsHandler(svc))
+}
+
+// depositWebhookHandler answers 200 to every webhook that was taken into
+// account, duplicates and stale ones included, so that providers stop
+// sending them; anything else is worth sending again.
+func depositWebhookHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBody))
+		if err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		res, err := svc.ReceiveDepositWebhook(c, c.Param("provider"), c.Request.Header, body)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+func listProviderDepositsHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		out, err := svc.ListProviderDeposits(c, id)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
@@ -1,21 +1,29 @@
 package http
 
 import (
+	"expvar"
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/richardliu001/wallet-service/internal/config"
+	"github.com/richardliu001/wallet-service/internal/ratelimit"
 	"github.com/richardliu001/wallet-service/internal/service"
 	"go.uber.org/zap"
 )
 
-type rateCfg struct {
-	RPS   int
-	Burst int
-}
-
-func NewRouter(svc *service.WalletService, rl config.RateLimitConfig, log *zap.SugaredLogger) *gin.Engine {
+func NewRouter(svc *service.WalletService, limiter ratelimit.Limiter, rt *config.Runtime, log *zap.SugaredLogger) *gin.Engine {
 	r := gin.New()
 	r.Use(LoggingMiddleware(log))
-	r.Use(RateLimitMiddleware(rl.RPS, rl.Burst))
+	r.Use(RateLimitMiddleware(limiter, func() config.RateLimitConfig { return rt.Current().RateLimit }, log))
 	RegisterHandlers(r, svc)
 	return r
 }
+
+// NewAdminHandler serves the operational endpoints, which must not be exposed
+// publicly: /debug/vars has the cache tier, circuit breaker and replica lag
+// counters, among the runtime's defaults such as the command line.
+func NewAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
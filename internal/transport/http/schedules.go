@@ -0,0 +1,147 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/service"
+	"github.com/shopspring/decimal"
+)
+
+func registerScheduleHandlers(v1 *gin.RouterGroup, svc *service.WalletService) {
+	v1.POST("/wallets/:id/schedules", createScheduleHandler(svc))
+	v1.GET("/wallets/:id/schedules", listSchedulesHandler(svc))
+	v1.GET("/wallets/:id/schedules/:sid", getScheduleHandler(svc))
+	v1.PATCH("/wallets/:id/schedules/:sid", updateScheduleHandler(svc))
+	v1.DELETE("/wallets/:id/schedules/:sid", cancelScheduleHandler(svc))
+	v1.GET("/wallets/:id/schedules/:sid/runs", scheduleRunsHandler(svc))
+}
+
+type createScheduleReq struct {
+	ToID       string     `json:"to_id" binding:"required"`
+	Amount     string     `json:"amount" binding:"required"`
+	Recurrence string     `json:"recurrence" binding:"required"`
+	StartAt    time.Time  `json:"start_at"`
+	EndAt      *time.Time `json:"end_at"`
+}
+
+func createScheduleHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req createScheduleReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		toID, err := strconv.ParseUint(req.ToID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to_id"})
+			return
+		}
+		amt, err := decimal.NewFromString(req.Amount)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
+			return
+		}
+		sc := &model.TransferSchedule{
+			WalletID: id, ToWalletID: toID, Amount: amt,
+			Recurrence: strings.ToUpper(req.Recurrence), StartAt: req.StartAt, EndAt: req.EndAt,
+		}
+		if err := svc.CreateSchedule(c, sc); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, sc)
+	}
+}
+
+func listSchedulesHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		out, err := svc.ListSchedules(c, id)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func getScheduleHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		sc, err := svc.GetSchedule(c, id, sid)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, sc)
+	}
+}
+
+type updateScheduleReq struct {
+	Amount *string    `json:"amount"`
+	EndAt  *time.Time `json:"end_at"`
+	Status *string    `json:"status"`
+}
+
+func updateScheduleHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req updateScheduleReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		p := service.SchedulePatch{EndAt: req.EndAt}
+		if req.Amount != nil {
+			amt, err := decimal.NewFromString(*req.Amount)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
+				return
+			}
+			p.Amount = &amt
+		}
+		if req.Status != nil {
+			st := strings.ToUpper(*req.Status)
+			p.Status = &st
+		}
+		sc, err := svc.UpdateSchedule(c, id, sid, p)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, sc)
+	}
+}
+
+func cancelScheduleHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		if err := svc.CancelSchedule(c, id, sid); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func scheduleRunsHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		runs, err := svc.ScheduleRuns(c, id, sid)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, runs)
+	}
+}
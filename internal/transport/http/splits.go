@@ -0,0 +1,63 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/service"
+	"github.com/shopspring/decimal"
+)
+
+type splitLegReq struct {
+	WalletID string `json:"wallet_id" binding:"required"`
+	Amount   string `json:"amount" binding:"required"`
+}
+
+type splitReq struct {
+	IdempotencyKey string        `json:"idempotency_key" binding:"required"`
+	Debits         []splitLegReq `json:"debits" binding:"required,dive"`
+	Credits        []splitLegReq `json:"credits" binding:"required,dive"`
+}
+
+func parseSplitLegs(in []splitLegReq) ([]service.SplitLeg, bool) {
+	out := make([]service.SplitLeg, len(in))
+	for i, l := range in {
+		id, err := strconv.ParseUint(l.WalletID, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		amt, err := decimal.NewFromString(l.Amount)
+		if err != nil {
+			return nil, false
+		}
+		out[i] = service.SplitLeg{WalletID: id, Amount: amt}
+	}
+	return out, true
+}
+
+func splitHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req splitReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		debits, ok := parseSplitLegs(req.Debits)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid debit leg"})
+			return
+		}
+		credits, ok := parseSplitLegs(req.Credits)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid credit leg"})
+			return
+		}
+		postings, err := svc.Split(c, debits, credits, req.IdempotencyKey)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"legs": postings})
+	}
+}
@@ -0,0 +1,132 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/model"
+	"github.com/richardliu001/wallet-service/internal/service"
+)
+
+func registerWebhookHandlers(v1 *gin.RouterGroup, svc *service.WalletService) {
+	v1.POST("/webhooks/subscriptions", createSubscriptionHandler(svc))
+	v1.GET("/webhooks/subscriptions", listSubscriptionsHandler(svc))
+	v1.GET("/webhooks/subscriptions/:sid", getSubscriptionHandler(svc))
+	v1.DELETE("/webhooks/subscriptions/:sid", deleteSubscriptionHandler(svc))
+	v1.POST("/webhooks/subscriptions/:sid/enable", enableSubscriptionHandler(svc))
+	v1.GET("/webhooks/subscriptions/:sid/deliveries", listDeliveriesHandler(svc))
+	v1.GET("/webhooks/subscriptions/:sid/deliveries/:did", getDeliveryHandler(svc))
+}
+
+type createSubscriptionReq struct {
+	URL        string   `json:"url" binding:"required"`
+	EventTypes []string `json:"event_types"`
+	WalletID   string   `json:"wallet_id"`
+	Secret     string   `json:"secret" binding:"required"`
+}
+
+func createSubscriptionHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req createSubscriptionReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sub := &model.WebhookSubscription{URL: req.URL, EventTypes: req.EventTypes, Secret: req.Secret}
+		if req.WalletID != "" {
+			id, err := strconv.ParseUint(req.WalletID, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wallet_id"})
+				return
+			}
+			sub.WalletID = &id
+		}
+		if err := svc.CreateWebhookSubscription(c, sub); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, sub)
+	}
+}
+
+func listSubscriptionsHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		out, err := svc.ListWebhookSubscriptions(c)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func getSubscriptionHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		sub, err := svc.GetWebhookSubscription(c, sid)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, sub)
+	}
+}
+
+func deleteSubscriptionHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		if err := svc.DeleteWebhookSubscription(c, sid); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func enableSubscriptionHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		sub, err := svc.EnableWebhookSubscription(c, sid)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, sub)
+	}
+}
+
+// listDeliveriesHandler takes an optional status and a limit, 50 by default.
+func listDeliveriesHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		limit := 50
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > service.MaxHistoryLimit {
+				writeError(c, service.ErrInvalidLimit)
+				return
+			}
+			limit = n
+		}
+		out, err := svc.ListWebhookDeliveries(c, sid, c.Query("status"), limit)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func getDeliveryHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		did, _ := strconv.ParseUint(c.Param("did"), 10, 64)
+		d, err := svc.GetWebhookDelivery(c, sid, did)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, d)
+	}
+}
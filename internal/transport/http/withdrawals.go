@@ -0,0 +1,71 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/richardliu001/wallet-service/internal/service"
+	"github.com/shopspring/decimal"
+)
+
+func registerWithdrawalHandlers(v1 *gin.RouterGroup, svc *service.WalletService) {
+	v1.POST("/wallets/:id/withdrawals", requestWithdrawalHandler(svc))
+	v1.GET("/wallets/:id/withdrawals", listWithdrawalsHandler(svc))
+	v1.GET("/wallets/:id/withdrawals/:wid", getWithdrawalHandler(svc))
+}
+
+type requestWithdrawalReq struct {
+	Amount         string `json:"amount" binding:"required"`
+	Destination    string `json:"destination" binding:"required"`
+	IdempotencyKey string `json:"idempotency_key" binding:"required"`
+}
+
+// requestWithdrawalHandler answers 202: the payout happens in the background
+// and its progress is read back with GET.
+func requestWithdrawalHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req requestWithdrawalReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		amt, err := decimal.NewFromString(req.Amount)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
+			return
+		}
+		wd, err := svc.RequestWithdrawal(c, id, amt, req.Destination, req.IdempotencyKey)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, wd)
+	}
+}
+
+func listWithdrawalsHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		out, err := svc.ListWithdrawals(c, id)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func getWithdrawalHandler(svc *service.WalletService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		wid, _ := strconv.ParseUint(c.Param("wid"), 10, 64)
+		wd, err := svc.GetWithdrawal(c, id, wid)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, wd)
+	}
+}